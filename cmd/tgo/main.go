@@ -14,6 +14,12 @@ const (
 	tracelevelOptionDesc = "Functions are traced if the stack depth is within this `tracelevel`. The stack depth here is based on the point the tracing is enabled."
 	parselevelOptionDesc = "The trace log includes the function's args. The `parselevel` option determines how detailed these values should be."
 	verboseOptionDesc    = "Show the debug-level message"
+	remoteStubOptionDesc = "Control the tracee via the gdb remote stub at this `address` (e.g. gdbserver --multi). '|command' launches the stub with pipes. Linux only."
+	recordOptionDesc     = "Record the debug api requests to the tracee to this `file` so that the tracing can be reproduced offline. In the daemon mode, the session ID is appended to the file name."
+	replayOptionDesc     = "Serve back the debug api requests recorded in this `file` instead of controlling the tracee. The client must trace the same way as recorded."
+	allowRemoteDesc      = "Allow listening on the non-loopback address. Anyone who can connect to the server can trace the processes with its privilege."
+	daemonDesc           = "Keep running and serve multiple clients. Each client traces its own process in the separate session."
+	outputDirDesc        = "Write the tracing log of each session to the file in this `directory`. Used in the daemon mode. By default, the new private directory is created in the temp directory."
 )
 
 func serverCmd(args []string) error {
@@ -21,13 +27,22 @@ func serverCmd(args []string) error {
 	commandLine.Usage = func() {
 		fmt.Fprintf(commandLine.Output(), `Usage:
 
-  %s server [flags] [hostname:port]
+  %s server [flags] [hostname:port | unix:path]
+
+The secret the client must send on attach is read from the %s environment variable.
+It's required to listen on hostname:port.
 
 Flags:
-`, os.Args[0])
+`, os.Args[0], service.SecretEnvName)
 		commandLine.PrintDefaults()
 	}
 	verbose := commandLine.Bool("verbose", false, verboseOptionDesc)
+	remoteStub := commandLine.String("remote-stub", "", remoteStubOptionDesc)
+	record := commandLine.String("record", "", recordOptionDesc)
+	replay := commandLine.String("replay", "", replayOptionDesc)
+	allowRemote := commandLine.Bool("allow-remote", false, allowRemoteDesc)
+	daemon := commandLine.Bool("daemon", false, daemonDesc)
+	outputDir := commandLine.String("output-dir", "", outputDirDesc)
 
 	commandLine.Parse(args)
 	if commandLine.NArg() < 1 {
@@ -35,7 +50,16 @@ Flags:
 		os.Exit(1)
 	}
 	log.EnableDebugLog = *verbose
-
+	service.RemoteStubAddr = *remoteStub
+	service.RecordPath = *record
+	service.ReplayPath = *replay
+	service.AllowRemote = *allowRemote
+	service.Secret = os.Getenv(service.SecretEnvName)
+	os.Unsetenv(service.SecretEnvName) // not to leak the secret to the tracee launched by the remote stub
+
+	if *daemon {
+		return service.ServeDaemon(commandLine.Arg(0), *outputDir)
+	}
 	return service.Serve(commandLine.Arg(0))
 }
 
@@ -4,21 +4,43 @@ import (
 	"fmt"
 )
 
-// client is the client interface to control the tracee process.
-// It's still unstable and so do not export it.
-type client interface {
+// ClientInterface is the interface to control the tracee process.
+// Client implements it using the OS's debug api, but any implementation, such as the fake one in the debugapi/fake package, can be used.
+type ClientInterface interface {
 	// LaunchProcess launches the new prcoess.
 	LaunchProcess(name string, arg ...string) error
 	// AttachProcess attaches to the existing process.
 	AttachProcess(pid int) error
+	// DetachProcess detaches from the process. The process is killed if it's launched by LaunchProcess.
 	DetachProcess() error
+	// ReadMemory reads the process' memory at the specified address. The size of out is the size to read.
 	ReadMemory(addr uint64, out []byte) error
+	// WriteMemory writes the data to the process' memory at the specified address.
 	WriteMemory(addr uint64, data []byte) error
+	// ReadRegisters reads the registers of the thread.
 	ReadRegisters(threadID int) (Registers, error)
+	// WriteRegisters writes the registers of the thread.
 	WriteRegisters(threadID int, regs Registers) error
+	// ReadTLS reads the value in the thread local storage at the specified offset.
 	ReadTLS(threadID int, offset int32) (uint64, error)
+	// ContinueAndWait resumes the process and waits until an event happens.
 	ContinueAndWait() (Event, error)
+	// StepAndWait executes the one instruction of the thread and waits until an event happens.
+	// UnspecifiedThreadError is returned if other threads are stopped during the step.
 	StepAndWait(threadID int) (Event, error)
+	// SetWatchpoint sets the hardware watchpoint which traps the write access to [addr, addr+size).
+	SetWatchpoint(addr uint64, size int) error
+	// ClearWatchpoint clears the watchpoint at the specified address.
+	ClearWatchpoint(addr uint64) error
+	// HitWatchpoint returns the address of the watchpoint the thread hit, if any.
+	HitWatchpoint(threadID int) (uint64, bool, error)
+}
+
+// Interrupter is implemented by the clients which can stop the running process asynchronously.
+type Interrupter interface {
+	// Interrupt requests to stop the process. It can be called from any go routine, even while ContinueAndWait is waiting.
+	// ContinueAndWait returns the EventTypeInterrupted event after all the threads are stopped.
+	Interrupt() error
 }
 
 // EventType represents the type of the event.
@@ -33,6 +55,8 @@ const (
 	EventTypeExited
 	// EventTypeTerminated event happens when the process is terminated by a signal.
 	EventTypeTerminated
+	// EventTypeInterrupted event happens when all the threads are stopped due to the Interrupt call.
+	EventTypeInterrupted
 )
 
 // IsExitEvent returns true if the event indicates the process exits for some reason.
@@ -51,14 +75,32 @@ type Event struct {
 	//    EventTypeCoreDump    NA          NA
 	//    EventTypeExited      int         Exit status
 	//    EventTypeTerminated  int         Signal number
+	//    EventTypeInterrupted NA          NA
 	Data interface{}
 }
 
 // Registers represents the target's registers.
 type Registers struct {
-	Rip uint64
-	Rsp uint64
-	Rcx uint64
+	Rax, Rbx, Rcx, Rdx     uint64
+	Rsi, Rdi, Rbp, Rsp     uint64
+	R8, R9, R10, R11       uint64
+	R12, R13, R14, R15     uint64
+	Rip, Rflags            uint64
+	Cs, Ss, Ds, Es, Fs, Gs uint64
+	FsBase, GsBase         uint64
+	FP                     FPRegisters
+}
+
+// FPRegisters represents the target's x87, SSE and AVX registers.
+type FPRegisters struct {
+	Fcw, Fsw, Ftw, Fop uint16
+	Mxcsr              uint32
+	// St is ST0-ST7 in the 80-bit extended precision format.
+	St [8][10]byte
+	// Xmm is XMM0-XMM15, which are also the lower 128 bits of YMM0-YMM15.
+	Xmm [16][16]byte
+	// Ymmh is the upper 128 bits of YMM0-YMM15. Always zero if the target doesn't support AVX.
+	Ymmh [16][16]byte
 }
 
 // UnspecifiedThreadError indicates the stopped threads include unspecified ones.
@@ -1,7 +1,6 @@
 package debugapi
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -18,22 +17,16 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-// Assumes the packet size is not larger than this.
-const (
-	maxPacketSize = 4096
-	excBadAccess  = syscall.Signal(0x91) // EXC_BAD_ACCESS
-)
+const excBadAccess = syscall.Signal(0x91) // EXC_BAD_ACCESS
 
 // Client is the debug api client which depends on lldb's debugserver.
 // See the gdb's doc for the reference: https://sourceware.org/gdb/onlinedocs/gdb/Remote-Protocol.html
 // Some commands use the lldb extension: https://github.com/llvm-mirror/lldb/blob/master/docs/lldb-gdb-remote.txt
 type Client struct {
-	conn                 net.Conn
+	packetConn
 	pid                  int
 	killOnDetach         bool
-	noAckMode            bool
 	registerMetadataList []registerMetadata
-	buffer               []byte
 	// outputWriter is the writer to which the output of the debugee process will be written.
 	outputWriter io.Writer
 
@@ -44,7 +37,13 @@ type Client struct {
 
 // NewClient returns the new debug api client which depends on OS API.
 func NewClient() *Client {
-	return &Client{buffer: make([]byte, maxPacketSize), outputWriter: os.Stdout}
+	return &Client{packetConn: newPacketConn(nil), outputWriter: os.Stdout}
+}
+
+// newBackendClient returns the backend, such as the recording client, as it is. Unlike ptrace, the debugserver
+// doesn't require the requests to be issued from the same thread.
+func newBackendClient(raw ClientInterface) ClientInterface {
+	return raw
 }
 
 // LaunchProcess lets the debugserver launch the new prcoess.
@@ -167,11 +166,6 @@ func (c *Client) qThreadSuffixSupported() error {
 
 var errEndOfList = errors.New("the end of list")
 
-type registerMetadata struct {
-	name             string
-	id, offset, size int
-}
-
 func (c *Client) collectRegisterMetadata() ([]registerMetadata, error) {
 	var regs []registerMetadata
 	for i := 0; ; i++ {
@@ -352,10 +346,6 @@ func (c *Client) DetachProcess() error {
 	return c.receiveAndCheck()
 }
 
-func (c *Client) close() error {
-	return c.conn.Close()
-}
-
 func (c *Client) killProcess() error {
 	if err := c.send("k"); err != nil {
 		return err
@@ -377,7 +367,7 @@ func (c *Client) ReadRegisters(threadID int) (Registers, error) {
 		return Registers{}, err
 	}
 
-	return c.parseRegisterData(data)
+	return parseRegisterData(data, c.registerMetadataList)
 }
 
 func (c *Client) readRegisters(threadID int) (string, error) {
@@ -395,28 +385,6 @@ func (c *Client) readRegisters(threadID int) (string, error) {
 	return data, nil
 }
 
-func (c *Client) parseRegisterData(data string) (Registers, error) {
-	var regs Registers
-	for _, metadata := range c.registerMetadataList {
-		rawValue := data[metadata.offset*2 : (metadata.offset+metadata.size)*2]
-
-		var err error
-		switch metadata.name {
-		case "rip":
-			regs.Rip, err = hexToUint64(rawValue, true)
-		case "rsp":
-			regs.Rsp, err = hexToUint64(rawValue, true)
-		case "rcx":
-			regs.Rcx, err = hexToUint64(rawValue, true)
-		}
-		if err != nil {
-			return Registers{}, err
-		}
-	}
-
-	return regs, nil
-}
-
 // WriteRegisters updates the registers' value.
 func (c *Client) WriteRegisters(threadID int, regs Registers) error {
 	data, err := c.readRegisters(threadID)
@@ -425,25 +393,7 @@ func (c *Client) WriteRegisters(threadID int, regs Registers) error {
 	}
 
 	// The 'P' command is not used due to the bug explained here: https://github.com/llvm-mirror/lldb/commit/d8d7a40ca5377aa777e3840f3e9b6a63c6b09445
-
-	for _, metadata := range c.registerMetadataList {
-		prefix := data[0 : metadata.offset*2]
-		suffix := data[(metadata.offset+metadata.size)*2:]
-
-		var err error
-		switch metadata.name {
-		case "rip":
-			data = fmt.Sprintf("%s%s%s", prefix, uint64ToHex(regs.Rip, true), suffix)
-		case "rsp":
-			data = fmt.Sprintf("%s%s%s", prefix, uint64ToHex(regs.Rsp, true), suffix)
-		case "rcx":
-			data = fmt.Sprintf("%s%s%s", prefix, uint64ToHex(regs.Rcx, true), suffix)
-		}
-		if err != nil {
-			return err
-		}
-	}
-
+	data = updateRegisterData(data, c.registerMetadataList, regs)
 	command := fmt.Sprintf("G%s;thread:%x;", data, threadID)
 	if err := c.send(command); err != nil {
 		return err
@@ -570,6 +520,23 @@ func (c *Client) StepAndWait(threadID int) (Event, error) {
 	return event, err
 }
 
+var errWatchpointNotSupported = errors.New("hardware watchpoint is not supported on this platform")
+
+// SetWatchpoint is not supported on darwin.
+func (c *Client) SetWatchpoint(addr uint64, size int) error {
+	return errWatchpointNotSupported
+}
+
+// ClearWatchpoint is not supported on darwin.
+func (c *Client) ClearWatchpoint(addr uint64) error {
+	return errWatchpointNotSupported
+}
+
+// HitWatchpoint always returns false on darwin.
+func (c *Client) HitWatchpoint(threadID int) (uint64, bool, error) {
+	return 0, false, nil
+}
+
 func (c *Client) continueAndWait(signalNumber int) (Event, error) {
 	var command string
 	if signalNumber == 0 {
@@ -779,150 +746,6 @@ func (c *Client) handleXPacket(packet string) (Event, error) {
 	return Event{Type: EventTypeTerminated, Data: int(signalNumber)}, err
 }
 
-func (c *Client) send(command string) error {
-	packet := fmt.Sprintf("$%s#00", command)
-	if !c.noAckMode {
-		packet = fmt.Sprintf("$%s#%02x", command, calcChecksum([]byte(command)))
-	}
-
-	if n, err := c.conn.Write([]byte(packet)); err != nil {
-		return err
-	} else if n != len(packet) {
-		return fmt.Errorf("only part of the buffer is sent: %d / %d", n, len(packet))
-	}
-
-	if !c.noAckMode {
-		return c.receiveAck()
-	}
-	return nil
-}
-
-func (c *Client) receiveAndCheck() error {
-	if data, err := c.receive(); err != nil {
-		return err
-	} else if data != "OK" {
-		return fmt.Errorf("the error response is returned: %s", data)
-	}
-
-	return nil
-}
-
-func (c *Client) receive() (string, error) {
-	var rawPacket []byte
-	for {
-		n, err := c.conn.Read(c.buffer)
-		if err != nil {
-			return "", err
-		}
-
-		rawPacket = append(rawPacket, c.buffer[0:n]...)
-		if len(rawPacket) < 4 {
-			// there should be at least 4 bytes
-			continue
-		} else if rawPacket[len(rawPacket)-3] == '#' {
-			// received at least 1 packet.
-			// TODO: handle multiple packets case
-			break
-		}
-	}
-
-	packet := string(rawPacket)
-	data := string(rawPacket[1 : len(rawPacket)-3])
-	if !c.noAckMode {
-		if err := verifyPacket(packet); err != nil {
-			return "", err
-		}
-		return data, c.sendAck()
-	}
-
-	return data, nil
-}
-
-func (c *Client) receiveWithTimeout(timeout time.Duration) (string, error) {
-	c.conn.SetReadDeadline(time.Now().Add(timeout))
-	defer c.conn.SetReadDeadline(time.Time{})
-
-	return c.receive()
-}
-
-func (c *Client) sendAck() error {
-	_, err := c.conn.Write([]byte("+"))
-	return err
-}
-
-func (c *Client) receiveAck() error {
-	if _, err := c.conn.Read(c.buffer[0:1]); err != nil {
-		return err
-	} else if c.buffer[0] != '+' {
-		return errors.New("failed to receive ack")
-	}
-
-	return nil
-}
-
-func verifyPacket(packet string) error {
-	if packet[0:1] != "$" {
-		return fmt.Errorf("invalid head data: %v", packet[0])
-	}
-
-	if packet[len(packet)-3:len(packet)-2] != "#" {
-		return fmt.Errorf("invalid tail data: %v", packet[len(packet)-3])
-	}
-
-	body := packet[1 : len(packet)-3]
-	bodyChecksum := strconv.FormatUint(uint64(calcChecksum([]byte(body))), 16)
-	tailChecksum := packet[len(packet)-2:]
-	if tailChecksum != bodyChecksum {
-		return fmt.Errorf("invalid checksum: %s", tailChecksum)
-	}
-
-	return nil
-}
-
-func hexToUint64(hex string, littleEndian bool) (uint64, error) {
-	if littleEndian {
-		var reversedHex bytes.Buffer
-		for i := len(hex) - 2; i >= 0; i -= 2 {
-			reversedHex.WriteString(hex[i : i+2])
-		}
-		hex = reversedHex.String()
-	}
-	return strconv.ParseUint(hex, 16, 64)
-}
-
-func hexToByteArray(hex string) ([]byte, error) {
-	out := make([]byte, len(hex)/2)
-	for i := 0; i < len(hex); i += 2 {
-		value, err := strconv.ParseUint(hex[i:i+2], 16, 8)
-		if err != nil {
-			return nil, err
-		}
-
-		out[i/2] = uint8(value)
-	}
-	return out, nil
-}
-
-func uint64ToHex(input uint64, littleEndian bool) string {
-	hex := fmt.Sprintf("%016x", input)
-	if littleEndian {
-		var reversedHex bytes.Buffer
-		for i := len(hex) - 2; i >= 0; i -= 2 {
-			reversedHex.WriteString(hex[i : i+2])
-		}
-		hex = reversedHex.String()
-	}
-	return hex
-}
-
-func calcChecksum(buff []byte) uint8 {
-	var sum uint8
-	for _, b := range buff {
-		sum += b
-	}
-	return sum
-}
-
 var debugServerPathList = []string{
 	"/Library/Developer/CommandLineTools/Library/PrivateFrameworks/LLDB.framework/Versions/A/Resources/debugserver",
 	"/Applications/Xcode.app/Contents/SharedFrameworks/LLDB.framework/Resources/debugserver",
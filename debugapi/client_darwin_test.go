@@ -18,7 +18,7 @@ import (
 )
 
 func TestCheckInterface(t *testing.T) {
-	var _ client = NewClient()
+	var _ ClientInterface = NewClient()
 }
 
 func TestLaunchProcess(t *testing.T) {
@@ -685,128 +685,8 @@ func TestQfThreadInfo(t *testing.T) {
 	<-sendDone
 }
 
-func TestSendAndReceive(t *testing.T) {
-	connForReceive, connForSend := net.Pipe()
-	cmd := "command"
-
-	sendDone := make(chan bool)
-	go func(conn net.Conn, ch chan bool) {
-		defer close(ch)
-
-		client := newTestClient(conn, false)
-		if err := client.send(cmd); err != nil {
-			t.Fatalf("failed to send command: %v", err)
-		}
-	}(connForSend, sendDone)
-
-	client := newTestClient(connForReceive, false)
-	buff, err := client.receive()
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-	if cmd != buff {
-		t.Errorf("receieved unexpected data: %v", buff)
-	}
-
-	<-sendDone
-}
-
-func TestSendAndReceive_NoAckMode(t *testing.T) {
-	connForReceive, connForSend := net.Pipe()
-	cmd := "command"
-
-	sendDone := make(chan bool)
-	go func(conn net.Conn, ch chan bool) {
-		defer close(ch)
-
-		client := newTestClient(conn, true)
-		if err := client.send(cmd); err != nil {
-			t.Fatalf("failed to send command: %v", err)
-		}
-	}(connForSend, sendDone)
-
-	client := newTestClient(connForReceive, true)
-	buff, err := client.receive()
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-	if cmd != buff {
-		t.Errorf("receieved unexpected data: %v", buff)
-	}
-
-	<-sendDone
-}
-
-func TestVerifyPacket(t *testing.T) {
-	for i, test := range []struct {
-		packet      string
-		expectError bool
-	}{
-		{packet: "$command#df", expectError: false},
-		{packet: "#command#df", expectError: true},
-		{packet: "$command$df", expectError: true},
-		{packet: "$command#00", expectError: true},
-	} {
-		actual := verifyPacket(test.packet)
-		if test.expectError && actual == nil {
-			t.Errorf("[%d] error not returned", i)
-		} else if !test.expectError && actual != nil {
-			t.Errorf("[%d] error returned: %v", i, actual)
-		}
-	}
-}
-
-func TestHexToUint64(t *testing.T) {
-	for i, test := range []struct {
-		hex          string
-		littleEndian bool
-		expected     uint64
-	}{
-		{hex: "00000001", littleEndian: false, expected: 1},
-		{hex: "00000102", littleEndian: false, expected: 258},
-		{hex: "02010000", littleEndian: true, expected: 258},
-	} {
-		actual, _ := hexToUint64(test.hex, test.littleEndian)
-		if test.expected != actual {
-			t.Errorf("[%d] not expected value: %d", i, actual)
-		}
-	}
-}
-
-func TestUint64ToHex(t *testing.T) {
-	for i, test := range []struct {
-		input        uint64
-		littleEndian bool
-		expected     string
-	}{
-		{input: 1, littleEndian: false, expected: "0000000000000001"},
-		{input: 258, littleEndian: false, expected: "0000000000000102"},
-		{input: 258, littleEndian: true, expected: "0201000000000000"},
-	} {
-		actual := uint64ToHex(test.input, test.littleEndian)
-		if test.expected != actual {
-			t.Errorf("[%d] not expected value: %s", i, actual)
-		}
-	}
-}
-
-func TestChecksum(t *testing.T) {
-	for i, data := range []struct {
-		input    []byte
-		expected uint8
-	}{
-		{input: []byte{0x1, 0x2}, expected: 3},
-		{input: []byte{0x7f, 0x80}, expected: 255},
-		{input: []byte{0x80, 0x80}, expected: 0},
-		{input: []byte{0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64}, expected: 0xdf},
-	} {
-		sum := calcChecksum(data.input)
-		if sum != data.expected {
-			t.Errorf("[%d] wrong checksum: %x", i, sum)
-		}
-	}
-}
-
 func newTestClient(conn net.Conn, noAckMode bool) *Client {
-	return &Client{conn: conn, noAckMode: noAckMode, buffer: make([]byte, maxPacketSize)}
+	packetConn := newPacketConn(conn)
+	packetConn.noAckMode = noAckMode
+	return &Client{packetConn: packetConn}
 }
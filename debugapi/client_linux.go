@@ -9,7 +9,9 @@ import (
 	"os/exec"
 	"runtime"
 	"strconv"
+	"sync/atomic"
 	"syscall"
+	"unsafe"
 
 	"github.com/ks888/tgo/log"
 	"golang.org/x/sys/unix"
@@ -20,12 +22,30 @@ import (
 type Client struct {
 	reqCh  chan func()
 	doneCh chan struct{}
-	raw    *rawClient
+	raw    ClientInterface
 }
 
-// NewClient returns the new client proxy.
+// NewClient returns the new client proxy which uses ptrace.
 func NewClient() *Client {
-	clientProxy := &Client{reqCh: make(chan func()), doneCh: make(chan struct{}), raw: newRawClient()}
+	return newClientProxy(newRawClient())
+}
+
+// NewRemoteClient returns the new client proxy which talks to the remote stub, such as gdbserver, using the gdb's remote serial protocol.
+// It's useful when the tracer can't ptrace the process directly (e.g. the process is in the container).
+// The address is either `host:port` or `|command [args]`. In the latter case, the command is launched and its stdin and stdout
+// are used for the communication (e.g. `|gdbserver --multi -`).
+// The stub must support the extended mode (e.g. `gdbserver --multi`) to launch or attach to the process.
+func NewRemoteClient(address string) *Client {
+	return newClientProxy(newRemoteClient(address))
+}
+
+// newBackendClient returns the client which runs the backend, such as the recording client, in the ptrace thread.
+func newBackendClient(raw ClientInterface) ClientInterface {
+	return newClientProxy(raw)
+}
+
+func newClientProxy(raw ClientInterface) *Client {
+	clientProxy := &Client{reqCh: make(chan func()), doneCh: make(chan struct{}), raw: raw}
 	go func() {
 		runtime.LockOSThread()
 
@@ -38,6 +58,16 @@ func NewClient() *Client {
 	return clientProxy
 }
 
+// Interrupt stops the running process. Unlike the other methods, it's executed in the caller's go routine
+// because ContinueAndWait may be blocking the client's go routine.
+func (c *Client) Interrupt() error {
+	interrupter, ok := c.raw.(Interrupter)
+	if !ok {
+		return errors.New("interrupt is not supported")
+	}
+	return interrupter.Interrupt()
+}
+
 func (c *Client) LaunchProcess(name string, arg ...string) (err error) {
 	c.reqCh <- func() { err = c.raw.LaunchProcess(name, arg...) }
 	<-c.doneCh
@@ -98,6 +128,24 @@ func (c *Client) StepAndWait(threadID int) (ev Event, err error) {
 	return
 }
 
+func (c *Client) SetWatchpoint(addr uint64, size int) (err error) {
+	c.reqCh <- func() { err = c.raw.SetWatchpoint(addr, size) }
+	_ = <-c.doneCh
+	return
+}
+
+func (c *Client) ClearWatchpoint(addr uint64) (err error) {
+	c.reqCh <- func() { err = c.raw.ClearWatchpoint(addr) }
+	_ = <-c.doneCh
+	return
+}
+
+func (c *Client) HitWatchpoint(threadID int) (addr uint64, hit bool, err error) {
+	c.reqCh <- func() { addr, hit, err = c.raw.HitWatchpoint(threadID) }
+	_ = <-c.doneCh
+	return
+}
+
 // rawClient is the debug api client which depends on OS API.
 type rawClient struct {
 	tracingProcessID int
@@ -105,11 +153,41 @@ type rawClient struct {
 	trappedThreadIDs []int
 
 	killOnDetach bool
+
+	// interruptRequested is 1 if the Interrupt is called but the process is not stopped yet. Accessed atomically.
+	interruptRequested int32
+	// interruptDeferred is true if the interrupt signal is received while single-stepping or stopping the threads.
+	// In that case, the next ContinueAndWait returns the interrupted event without resuming the process.
+	interruptDeferred bool
+	// pendingSignals holds the signal which the thread received while stopping the threads. It's sent when the thread
+	// continues or is detached.
+	pendingSignals map[int]int
+	// watchpointTrappedThreadIDs holds the threads trapped by the watchpoint while stopping the threads.
+	// The next ContinueAndWait reports them without resuming the process, because the write can't be done again.
+	watchpointTrappedThreadIDs []int
+
+	// watchpoints holds the watchpoint assigned to each debug register (DR0-DR3). nil if unused.
+	watchpoints [numWatchpoints]*watchpoint
+	// syncedThreadIDs is the set of threads whose debug registers reflect the current watchpoints.
+	syncedThreadIDs map[int]bool
+
+	// xstateBuff is reused to read the XSAVE area, which is large. xstate is the area of xstateThreadID in the buffer.
+	// It's cached until the thread resumes because the registers are read and written repeatedly while the thread stops.
+	// xstateThreadID is 0 if nothing is cached.
+	xstateBuff     []byte
+	xstate         []byte
+	xstateIsXSave  bool
+	xstateThreadID int
+}
+
+type watchpoint struct {
+	addr uint64
+	size int
 }
 
 // newRawClient returns the new debug api client which depends on linux ptrace.
 func newRawClient() *rawClient {
-	return &rawClient{}
+	return &rawClient{syncedThreadIDs: make(map[int]bool), pendingSignals: make(map[int]int)}
 }
 
 // LaunchProcess launches the new prcoess with ptrace enabled.
@@ -194,24 +272,185 @@ func (c *rawClient) waitAndInitialize(threadID int) error {
 	return nil
 }
 
-// DetachProcess detaches from the process.
+// DetachProcess detaches from the process. The running threads are stopped first because only the stopped threads can be detached.
 func (c *rawClient) DetachProcess() error {
+	if err := c.stopAllThreads(); err != nil {
+		log.Debugf("failed to stop threads: %v", err)
+	}
+
 	// detach the processes even when we will kill them soon, because
 	// next wait call may receive the terminated event of these processes.
+	var detachErr error
 	for _, pid := range c.tracingThreadIDs {
-		if err := unix.PtraceDetach(pid); err != nil {
+		if err := ptraceDetach(pid, c.pendingSignals[pid]); err != nil {
 			// the process may have exited already
 			log.Debugf("failed to detach %d: %v", pid, err)
+			if err != unix.ESRCH && detachErr == nil {
+				detachErr = fmt.Errorf("failed to detach %d: %v", pid, err)
+			}
 		}
 	}
+	c.trappedThreadIDs = nil
+	c.pendingSignals = make(map[int]int)
+	c.watchpointTrappedThreadIDs = nil
+	c.interruptDeferred = false
+	c.xstateThreadID = 0
 
 	if c.killOnDetach {
 		return c.killProcess()
 	}
 
+	return detachErr
+}
+
+// ptraceDetach detaches the thread and then sends the signal to it, if not 0.
+func ptraceDetach(threadID, sig int) error {
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_DETACH, uintptr(threadID), 0, uintptr(sig), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Interrupt sends SIGSTOP to the thread leader. The signal is handled in the wait call and then all the threads are stopped.
+func (c *rawClient) Interrupt() error {
+	atomic.StoreInt32(&c.interruptRequested, 1)
+	return unix.Tgkill(c.tracingProcessID, c.tracingProcessID, unix.SIGSTOP)
+}
+
+// isInterruptSignal returns true if the status is the stop caused by the Interrupt call. The request is cleared in that case.
+func (c *rawClient) isInterruptSignal(status unix.WaitStatus) bool {
+	return status.Stopped() && status.StopSignal() == unix.SIGSTOP && atomic.CompareAndSwapInt32(&c.interruptRequested, 1, 0)
+}
+
+func (c *rawClient) interrupt() (Event, error) {
+	if err := c.stopAllThreads(); err != nil {
+		return Event{}, err
+	}
+	return Event{Type: EventTypeInterrupted}, nil
+}
+
+// stopAllThreads stops the running threads. If the thread is trapped at the breakpoint before stopped, its PC is
+// rewound to the breakpoint address so that the thread can run correctly after the breakpoint is cleared.
+func (c *rawClient) stopAllThreads() error {
+	stoppingThreadIDs := make(map[int]bool)
+	for _, threadID := range c.tracingThreadIDs {
+		if c.isTrapped(threadID) {
+			continue
+		}
+
+		if err := unix.Tgkill(c.tracingProcessID, threadID, unix.SIGSTOP); err != nil {
+			log.Debugf("failed to stop %d: %v", threadID, err) // the thread may have exited already
+			continue
+		}
+		stoppingThreadIDs[threadID] = true
+	}
+
+	// Wait any thread rather than the specific one, because the thread leader can't be waited until the other threads are waited.
+	for len(stoppingThreadIDs) > 0 {
+		var status unix.WaitStatus
+		threadID, err := unix.Wait4(-1, &status, unix.WNOTHREAD, nil)
+		if err == unix.ECHILD {
+			return nil // all exited
+		} else if err != nil {
+			return err
+		}
+
+		if !status.Stopped() {
+			delete(stoppingThreadIDs, threadID)
+			continue
+		}
+
+		switch {
+		case status.StopSignal() == unix.SIGSTOP:
+			if threadID == c.tracingProcessID && atomic.CompareAndSwapInt32(&c.interruptRequested, 1, 0) {
+				// the signal sent by Interrupt is merged into the signal sent above, because SIGSTOP is not queued.
+				c.interruptDeferred = true
+			}
+			c.trappedThreadIDs = append(c.trappedThreadIDs, threadID)
+			delete(stoppingThreadIDs, threadID)
+			continue
+		case status.StopSignal() == unix.SIGTRAP && status.TrapCause() == unix.PTRACE_EVENT_CLONE:
+			clonedThreadID, err := c.continueClone(threadID)
+			if err != nil {
+				return err
+			}
+			if err := unix.Tgkill(c.tracingProcessID, clonedThreadID, unix.SIGSTOP); err != nil {
+				return err
+			}
+			stoppingThreadIDs[clonedThreadID] = true
+		case status.StopSignal() == unix.SIGTRAP:
+			c.trappedThreadIDs = append(c.trappedThreadIDs, threadID)
+			hit, err := c.trappedAtWatchpoint(threadID)
+			if err == nil && !hit {
+				err = c.rewindBreakpoint(threadID)
+			}
+			c.trappedThreadIDs = c.trappedThreadIDs[:len(c.trappedThreadIDs)-1]
+			if err != nil {
+				return err
+			}
+			if hit {
+				c.watchpointTrappedThreadIDs = append(c.watchpointTrappedThreadIDs, threadID)
+			}
+		default:
+			c.pendingSignals[threadID] = int(status.StopSignal())
+		}
+
+		// the SIGSTOP signal is still pending.
+		c.xstateThreadID = 0
+		if err := unix.PtraceCont(threadID, 0); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func (c *rawClient) isTrapped(threadID int) bool {
+	for _, trappedThreadID := range c.trappedThreadIDs {
+		if trappedThreadID == threadID {
+			return true
+		}
+	}
+	return false
+}
+
+// trappedAtWatchpoint returns true if the debug status register says the thread is trapped by the watchpoint.
+// The status is not cleared so that HitWatchpoint reports the hit later.
+func (c *rawClient) trappedAtWatchpoint(threadID int) (bool, error) {
+	status, err := c.readDebugRegister(threadID, debugRegStatus)
+	if err != nil {
+		return false, err
+	}
+
+	for i, wp := range c.watchpoints {
+		if wp != nil && status&(1<<uint(i)) != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// rewindBreakpoint rewinds the PC if the thread executed the breakpoint instruction. The thread must not be
+// trapped by the watchpoint, because the previous instruction may happen to end with 0xcc.
+// Note that the int3 instruction in the original code is rewound as well, though it's rare in the go binary.
+func (c *rawClient) rewindBreakpoint(threadID int) error {
+	regs, err := c.ReadRegisters(threadID)
+	if err != nil {
+		return err
+	}
+
+	buff := make([]byte, 1)
+	if err := c.ReadMemory(regs.Rip-1, buff); err != nil {
+		return err
+	}
+	if buff[0] != 0xcc {
+		return nil
+	}
+
+	regs.Rip--
+	return c.WriteRegisters(threadID, regs)
+}
+
 func (c *rawClient) killProcess() error {
 	// it may be exited already
 	proc, _ := os.FindProcess(c.tracingProcessID)
@@ -264,9 +503,21 @@ func (c *rawClient) ReadRegisters(threadID int) (regs Registers, err error) {
 		return regs, err
 	}
 
-	regs.Rip = rawRegs.Rip
-	regs.Rsp = rawRegs.Rsp
-	regs.Rcx = rawRegs.Rcx
+	regs = Registers{
+		Rax: rawRegs.Rax, Rbx: rawRegs.Rbx, Rcx: rawRegs.Rcx, Rdx: rawRegs.Rdx,
+		Rsi: rawRegs.Rsi, Rdi: rawRegs.Rdi, Rbp: rawRegs.Rbp, Rsp: rawRegs.Rsp,
+		R8: rawRegs.R8, R9: rawRegs.R9, R10: rawRegs.R10, R11: rawRegs.R11,
+		R12: rawRegs.R12, R13: rawRegs.R13, R14: rawRegs.R14, R15: rawRegs.R15,
+		Rip: rawRegs.Rip, Rflags: rawRegs.Eflags,
+		Cs: rawRegs.Cs, Ss: rawRegs.Ss, Ds: rawRegs.Ds, Es: rawRegs.Es, Fs: rawRegs.Fs, Gs: rawRegs.Gs,
+		FsBase: rawRegs.Fs_base, GsBase: rawRegs.Gs_base,
+	}
+
+	xstate, _, err := c.readXState(threadID)
+	if err != nil {
+		return regs, err
+	}
+	regs.FP = parseXState(xstate)
 	return regs, nil
 }
 
@@ -277,10 +528,154 @@ func (c *rawClient) WriteRegisters(threadID int, regs Registers) error {
 		return err
 	}
 
-	rawRegs.Rip = regs.Rip
-	rawRegs.Rsp = regs.Rsp
-	rawRegs.Rcx = regs.Rcx
-	return unix.PtraceSetRegs(threadID, &rawRegs)
+	rawRegs.Rax, rawRegs.Rbx, rawRegs.Rcx, rawRegs.Rdx = regs.Rax, regs.Rbx, regs.Rcx, regs.Rdx
+	rawRegs.Rsi, rawRegs.Rdi, rawRegs.Rbp, rawRegs.Rsp = regs.Rsi, regs.Rdi, regs.Rbp, regs.Rsp
+	rawRegs.R8, rawRegs.R9, rawRegs.R10, rawRegs.R11 = regs.R8, regs.R9, regs.R10, regs.R11
+	rawRegs.R12, rawRegs.R13, rawRegs.R14, rawRegs.R15 = regs.R12, regs.R13, regs.R14, regs.R15
+	rawRegs.Rip, rawRegs.Eflags = regs.Rip, regs.Rflags
+	rawRegs.Cs, rawRegs.Ss, rawRegs.Ds, rawRegs.Es, rawRegs.Fs, rawRegs.Gs = regs.Cs, regs.Ss, regs.Ds, regs.Es, regs.Fs, regs.Gs
+	rawRegs.Fs_base, rawRegs.Gs_base = regs.FsBase, regs.GsBase
+	if err := unix.PtraceSetRegs(threadID, &rawRegs); err != nil {
+		return err
+	}
+
+	xstate, isXSave, err := c.readXState(threadID)
+	if err != nil {
+		return err
+	}
+	if parseXState(xstate) == regs.FP {
+		// avoid the extra system call because the registers are written frequently to change the pc.
+		return nil
+	}
+	updateXState(xstate, regs.FP)
+	return c.writeXState(threadID, xstate, isXSave)
+}
+
+const (
+	// maxXStateSize is large enough to hold the XSAVE area including the AMX state.
+	maxXStateSize = 16384
+	// fxsaveSize is the size of the legacy region (the data PTRACE_GETFPREGS returns).
+	fxsaveSize = 512
+
+	offsetFxsaveMxcsr = 24
+	offsetFxsaveSt    = 32
+	offsetFxsaveXmm   = 160
+	// offsetXFeatures is the offset of the supported features (XCR0) the kernel stores in the software reserved region.
+	offsetXFeatures = 464
+	offsetXStateBV  = 512
+	offsetYmmh      = 576
+
+	xfeatureX87 = 1 << 0
+	xfeatureSSE = 1 << 1
+	xfeatureAVX = 1 << 2
+)
+
+// readXState returns the XSAVE area of the thread. If the system doesn't support XSAVE, the FXSAVE area is returned instead.
+// The returned area is valid until the next call.
+func (c *rawClient) readXState(threadID int) ([]byte, bool, error) {
+	if c.xstateThreadID == threadID {
+		return c.xstate, c.xstateIsXSave, nil
+	}
+
+	c.xstateThreadID = 0
+	if c.xstateBuff == nil {
+		c.xstateBuff = make([]byte, maxXStateSize)
+	}
+	iov := unix.Iovec{Base: &c.xstateBuff[0]}
+	iov.SetLen(len(c.xstateBuff))
+	if err := ptraceRegSet(unix.PTRACE_GETREGSET, threadID, &iov); err == nil {
+		c.xstate, c.xstateIsXSave = c.xstateBuff[:iov.Len], true
+	} else {
+		fxsave := c.xstateBuff[:fxsaveSize]
+		if err := ptrace(unix.PTRACE_GETFPREGS, threadID, 0, uintptr(unsafe.Pointer(&fxsave[0]))); err != nil {
+			return nil, false, err
+		}
+		c.xstate, c.xstateIsXSave = fxsave, false
+	}
+	c.xstateThreadID = threadID
+	return c.xstate, c.xstateIsXSave, nil
+}
+
+func (c *rawClient) writeXState(threadID int, xstate []byte, isXSave bool) error {
+	var err error
+	if !isXSave {
+		err = ptrace(unix.PTRACE_SETFPREGS, threadID, 0, uintptr(unsafe.Pointer(&xstate[0])))
+	} else {
+		iov := unix.Iovec{Base: &xstate[0]}
+		iov.SetLen(len(xstate))
+		err = ptraceRegSet(unix.PTRACE_SETREGSET, threadID, &iov)
+	}
+	if err != nil {
+		c.xstateThreadID = 0 // the cached area is updated, but the thread's one is not.
+	}
+	return err
+}
+
+func ptraceRegSet(request, threadID int, iov *unix.Iovec) error {
+	return ptrace(request, threadID, unix.NT_X86_XSTATE, uintptr(unsafe.Pointer(iov)))
+}
+
+func ptrace(request, threadID int, addr, data uintptr) error {
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, uintptr(request), uintptr(threadID), addr, data, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// parseXState parses the XSAVE (or FXSAVE) area. See the Intel SDM Vol.1 Ch.13 for the layout.
+func parseXState(xstate []byte) (fp FPRegisters) {
+	fp.Fcw = binary.LittleEndian.Uint16(xstate[0:])
+	fp.Fsw = binary.LittleEndian.Uint16(xstate[2:])
+	fp.Ftw = binary.LittleEndian.Uint16(xstate[4:])
+	fp.Fop = binary.LittleEndian.Uint16(xstate[6:])
+	fp.Mxcsr = binary.LittleEndian.Uint32(xstate[offsetFxsaveMxcsr:])
+	for i := range fp.St {
+		copy(fp.St[i][:], xstate[offsetFxsaveSt+i*16:])
+	}
+	for i := range fp.Xmm {
+		copy(fp.Xmm[i][:], xstate[offsetFxsaveXmm+i*16:])
+	}
+
+	if len(xstate) < offsetYmmh+len(fp.Ymmh)*16 {
+		return
+	}
+	// the component in the init state may not be saved.
+	if binary.LittleEndian.Uint64(xstate[offsetXStateBV:])&xfeatureAVX != 0 {
+		for i := range fp.Ymmh {
+			copy(fp.Ymmh[i][:], xstate[offsetYmmh+i*16:])
+		}
+	}
+	return
+}
+
+// updateXState writes the registers to the XSAVE (or FXSAVE) area.
+func updateXState(xstate []byte, fp FPRegisters) {
+	binary.LittleEndian.PutUint16(xstate[0:], fp.Fcw)
+	binary.LittleEndian.PutUint16(xstate[2:], fp.Fsw)
+	binary.LittleEndian.PutUint16(xstate[4:], fp.Ftw)
+	binary.LittleEndian.PutUint16(xstate[6:], fp.Fop)
+	binary.LittleEndian.PutUint32(xstate[offsetFxsaveMxcsr:], fp.Mxcsr)
+	for i := range fp.St {
+		copy(xstate[offsetFxsaveSt+i*16:], fp.St[i][:])
+	}
+	for i := range fp.Xmm {
+		copy(xstate[offsetFxsaveXmm+i*16:], fp.Xmm[i][:])
+	}
+
+	if len(xstate) < offsetYmmh+len(fp.Ymmh)*16 {
+		return
+	}
+	features := uint64(xfeatureX87 | xfeatureSSE)
+	if binary.LittleEndian.Uint64(xstate[offsetXFeatures:])&xfeatureAVX != 0 {
+		features |= xfeatureAVX
+		for i := range fp.Ymmh {
+			copy(xstate[offsetYmmh+i*16:], fp.Ymmh[i][:])
+		}
+	}
+	// the component is ignored unless the corresponding bit is set.
+	xstateBV := binary.LittleEndian.Uint64(xstate[offsetXStateBV:])
+	binary.LittleEndian.PutUint64(xstate[offsetXStateBV:], xstateBV|features)
 }
 
 // ReadTLS reads the offset from the beginning of the TLS block.
@@ -298,20 +693,45 @@ func (c *rawClient) ReadTLS(threadID int, offset int32) (uint64, error) {
 }
 
 // ContinueAndWait resumes the list of processes and waits until an event happens.
+// If any thread is trapped by the watchpoint while the threads are stopped, it's reported without resuming the process.
 func (c *rawClient) ContinueAndWait() (Event, error) {
+	if !c.interruptDeferred && len(c.watchpointTrappedThreadIDs) > 0 {
+		var threadIDs []int
+		for _, threadID := range c.watchpointTrappedThreadIDs {
+			if c.isTrapped(threadID) {
+				threadIDs = append(threadIDs, threadID)
+			}
+		}
+		c.watchpointTrappedThreadIDs = nil
+		if len(threadIDs) > 0 {
+			return Event{Type: EventTypeTrapped, Data: threadIDs}, nil
+		}
+	}
 	return c.continueAndWait(0)
 }
 
 func (c *rawClient) continueAndWait(sig int) (Event, error) {
+	if c.interruptDeferred {
+		c.interruptDeferred = false
+		return c.interrupt()
+	}
+
+	c.xstateThreadID = 0
 	for _, threadID := range c.trappedThreadIDs {
-		if err := unix.PtraceCont(threadID, sig); err != nil {
+		threadSig := sig
+		if pendingSig, ok := c.pendingSignals[threadID]; ok {
+			threadSig = pendingSig
+			delete(c.pendingSignals, threadID)
+		}
+		if err := unix.PtraceCont(threadID, threadSig); err != nil {
 			return Event{}, err
 		}
 	}
 	c.trappedThreadIDs = nil
 
 	var status unix.WaitStatus
-	waitedThreadID, err := unix.Wait4(-1 /* any tracing thread */, &status, 0, nil)
+	// WNOTHREAD avoids waiting for the threads traced by the other clients in this process.
+	waitedThreadID, err := unix.Wait4(-1 /* any tracing thread */, &status, unix.WNOTHREAD, nil)
 	if err != nil {
 		return Event{}, err
 	}
@@ -322,6 +742,7 @@ func (c *rawClient) continueAndWait(sig int) (Event, error) {
 // StepAndWait executes the single instruction of the specified process and waits until an event happens.
 // Note that an event happens to any children of the current process is reported.
 func (c *rawClient) StepAndWait(threadID int) (Event, error) {
+	c.xstateThreadID = 0
 	if err := unix.PtraceSingleStep(threadID); err != nil {
 		return Event{}, err
 	}
@@ -338,12 +759,18 @@ func (c *rawClient) StepAndWait(threadID int) (Event, error) {
 		return Event{}, err
 	}
 
+	if c.isInterruptSignal(status) {
+		// the step is not done yet. Do it again and then handle the interrupt in the next ContinueAndWait.
+		c.interruptDeferred = true
+		return c.StepAndWait(threadID)
+	}
 	return c.handleWaitStatus(status, waitedThreadID)
 }
 
 func (c *rawClient) handleWaitStatus(status unix.WaitStatus, threadID int) (event Event, err error) {
 	if status.Stopped() {
 		c.trappedThreadIDs = append(c.trappedThreadIDs, threadID)
+		c.syncDebugRegisters(threadID)
 
 		if status.StopSignal() == unix.SIGTRAP {
 			if status.TrapCause() == unix.PTRACE_EVENT_CLONE {
@@ -355,6 +782,8 @@ func (c *rawClient) handleWaitStatus(status unix.WaitStatus, threadID int) (even
 			}
 
 			event = Event{Type: EventTypeTrapped, Data: []int{threadID}}
+		} else if c.isInterruptSignal(status) {
+			return c.interrupt()
 		} else {
 			return c.continueAndWait(int(status.StopSignal()))
 		}
@@ -379,6 +808,164 @@ func (c *rawClient) continueClone(parentThreadID int) (int, error) {
 	if _, err := unix.Wait4(int(clonedThreadID), nil, 0, nil); err != nil {
 		return 0, err
 	}
+	// The debug registers are not inherited by the new thread.
+	c.syncDebugRegisters(int(clonedThreadID))
+
 	err = unix.PtraceCont(int(clonedThreadID), 0)
 	return int(clonedThreadID), err
 }
+
+const (
+	numWatchpoints = 4 // DR0-DR3
+
+	// offsetDebugRegs is the offset of the u_debugreg field in the user struct (see sys/user.h).
+	offsetDebugRegs = 848
+	debugRegStatus  = 6
+	debugRegControl = 7
+)
+
+// SetWatchpoint sets the hardware watchpoint which traps the write access to the memory region [addr, addr+size).
+// The size must be 1, 2, 4 or 8 and the addr must be aligned to the size.
+// The running threads are stopped so that the watchpoint is applied to all the threads immediately.
+func (c *rawClient) SetWatchpoint(addr uint64, size int) error {
+	if size != 1 && size != 2 && size != 4 && size != 8 {
+		return fmt.Errorf("invalid watchpoint size: %d", size)
+	} else if addr%uint64(size) != 0 {
+		return fmt.Errorf("watchpoint address %#x is not aligned to %d", addr, size)
+	}
+
+	slot := -1
+	for i, wp := range c.watchpoints {
+		if wp != nil && wp.addr == addr {
+			return nil // set already
+		} else if wp == nil && slot == -1 {
+			slot = i
+		}
+	}
+	if slot == -1 {
+		return errors.New("no debug registers available")
+	}
+
+	c.watchpoints[slot] = &watchpoint{addr: addr, size: size}
+	return c.resyncDebugRegisters()
+}
+
+// ClearWatchpoint clears the hardware watchpoint at the specified address.
+func (c *rawClient) ClearWatchpoint(addr uint64) error {
+	for i, wp := range c.watchpoints {
+		if wp != nil && wp.addr == addr {
+			c.watchpoints[i] = nil
+			return c.resyncDebugRegisters()
+		}
+	}
+	return nil
+}
+
+// HitWatchpoint returns the address of the watchpoint if the specified thread is trapped by the watchpoint.
+// The status is cleared so that the same hit is not reported twice.
+func (c *rawClient) HitWatchpoint(threadID int) (uint64, bool, error) {
+	status, err := c.readDebugRegister(threadID, debugRegStatus)
+	if err != nil {
+		return 0, false, err
+	}
+
+	for i, wp := range c.watchpoints {
+		if status&(1<<uint(i)) == 0 || wp == nil {
+			continue
+		}
+
+		if err := c.writeDebugRegister(threadID, debugRegStatus, 0); err != nil {
+			return 0, false, err
+		}
+		return wp.addr, true, nil
+	}
+	return 0, false, nil
+}
+
+// resyncDebugRegisters writes the debug registers of all the threads. The running threads are stopped first, because
+// the debug registers of the running thread can't be written and the writes it makes until trapped would be missed.
+func (c *rawClient) resyncDebugRegisters() error {
+	if err := c.stopAllThreads(); err != nil {
+		return err
+	}
+
+	c.syncedThreadIDs = make(map[int]bool)
+	for _, threadID := range c.tracingThreadIDs {
+		if err := c.doSyncDebugRegisters(threadID); err != nil {
+			if c.isTrapped(threadID) {
+				return err
+			}
+			log.Debugf("failed to set debug registers of %d: %v", threadID, err) // the thread may have exited already
+			continue
+		}
+		c.syncedThreadIDs[threadID] = true
+	}
+	return nil
+}
+
+func (c *rawClient) syncDebugRegisters(threadID int) {
+	if c.syncedThreadIDs[threadID] {
+		return
+	}
+
+	if err := c.doSyncDebugRegisters(threadID); err != nil {
+		log.Debugf("failed to set debug registers of %d: %v", threadID, err)
+		return
+	}
+	c.syncedThreadIDs[threadID] = true
+}
+
+func (c *rawClient) doSyncDebugRegisters(threadID int) error {
+	// Disable all the watchpoints first. Otherwise, the kernel may reject the new address due to the old length setting.
+	if err := c.writeDebugRegister(threadID, debugRegControl, 0); err != nil {
+		return err
+	}
+
+	var control uint64
+	for i, wp := range c.watchpoints {
+		if wp == nil {
+			continue
+		}
+
+		if err := c.writeDebugRegister(threadID, i, wp.addr); err != nil {
+			return err
+		}
+		control |= watchpointControlBits(i, wp.size)
+	}
+	return c.writeDebugRegister(threadID, debugRegControl, control)
+}
+
+// watchpointControlBits returns the DR7 bits which enable the write watchpoint of the specified debug register.
+func watchpointControlBits(index, size int) uint64 {
+	const rwWrite = 0x1
+
+	var length uint64
+	switch size {
+	case 1:
+		length = 0x0
+	case 2:
+		length = 0x1
+	case 4:
+		length = 0x3
+	case 8:
+		length = 0x2
+	}
+
+	localEnable := uint64(1) << uint(index*2)
+	return localEnable | (rwWrite|length<<2)<<uint(16+index*4)
+}
+
+func (c *rawClient) readDebugRegister(threadID, index int) (uint64, error) {
+	buff := make([]byte, 8)
+	if _, err := unix.PtracePeekUser(threadID, uintptr(offsetDebugRegs+index*8), buff); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buff), nil
+}
+
+func (c *rawClient) writeDebugRegister(threadID, index int, value uint64) error {
+	buff := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buff, value)
+	_, err := unix.PtracePokeUser(threadID, uintptr(offsetDebugRegs+index*8), buff)
+	return err
+}
@@ -7,6 +7,7 @@ import (
 	"runtime"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/ks888/tgo/testutils"
 	"golang.org/x/sys/unix"
@@ -18,8 +19,11 @@ func TestMain(m *testing.M) {
 }
 
 func TestCheckInterface(t *testing.T) {
-	var _ client = newRawClient()
-	var _ client = NewClient()
+	var _ ClientInterface = newRawClient()
+	var _ ClientInterface = newRemoteClient("")
+	var _ ClientInterface = NewClient()
+	var _ ClientInterface = &recordingClient{}
+	var _ ClientInterface = &replayClient{}
 }
 
 func TestClientProxy(t *testing.T) {
@@ -181,6 +185,9 @@ func TestReadRegisters(t *testing.T) {
 	if regs.Rip == 0 {
 		t.Errorf("emptyr rip")
 	}
+	if regs.FP.Fcw != 0x37f {
+		t.Errorf("unexpected fcw: %#x", regs.FP.Fcw)
+	}
 }
 
 func TestWriteRegisters(t *testing.T) {
@@ -197,6 +204,45 @@ func TestWriteRegisters(t *testing.T) {
 	}
 }
 
+func TestWriteRegisters_Preserve(t *testing.T) {
+	client := newRawClient()
+	_ = client.LaunchProcess(testutils.ProgramInfloop)
+	defer client.DetachProcess()
+
+	pid := client.tracingThreadIDs[0]
+	regs, _ := client.ReadRegisters(pid)
+	regs.R12 = 0x1234
+	regs.FP.Xmm[1][0] = 0xab
+	if err := client.WriteRegisters(pid, regs); err != nil {
+		t.Fatalf("failed to write registers (pid: %d): %v", pid, err)
+	}
+
+	client.xstateThreadID = 0 // read the thread's registers rather than the cache
+	actual, _ := client.ReadRegisters(pid)
+	if actual != regs {
+		t.Errorf("registers changed: %#v", actual)
+	}
+}
+
+func TestReadRegisters_CacheXState(t *testing.T) {
+	client := newRawClient()
+	_ = client.LaunchProcess(testutils.ProgramInfloop)
+	defer client.DetachProcess()
+
+	pid := client.tracingThreadIDs[0]
+	_, _ = client.ReadRegisters(pid)
+	if client.xstateThreadID != pid {
+		t.Fatalf("not cached: %d", client.xstateThreadID)
+	}
+
+	if _, err := client.StepAndWait(pid); err != nil {
+		t.Fatalf("failed to step: %v", err)
+	}
+	if client.xstateThreadID != 0 {
+		t.Errorf("the cache is not invalidated after the thread resumed")
+	}
+}
+
 func TestReadTLS(t *testing.T) {
 	client := newRawClient()
 	err := client.LaunchProcess(testutils.ProgramInfloop)
@@ -339,6 +385,33 @@ func TestContinueAndWait_WaitAllChildrenExit(t *testing.T) {
 	}
 }
 
+func TestInterrupt(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	client := newRawClient()
+	_ = client.LaunchProcess(testutils.ProgramInfloop)
+	defer client.DetachProcess()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := client.Interrupt(); err != nil {
+			t.Errorf("failed to interrupt: %v", err)
+		}
+	}()
+
+	event, err := client.ContinueAndWait()
+	if err != nil {
+		t.Fatalf("failed to continue and wait: %v", err)
+	}
+	if event.Type != EventTypeInterrupted {
+		t.Fatalf("unexpected event: %#v", event)
+	}
+	if len(client.trappedThreadIDs) != len(client.tracingThreadIDs) {
+		t.Errorf("not all threads are stopped: %v, %v", client.trappedThreadIDs, client.tracingThreadIDs)
+	}
+}
+
 func TestStepAndWait(t *testing.T) {
 	client := newRawClient()
 	_ = client.LaunchProcess(testutils.ProgramInfloop)
@@ -357,3 +430,132 @@ func TestStepAndWait(t *testing.T) {
 		t.Fatalf("unexpected process is stopped: %d", stoppedPID)
 	}
 }
+
+func TestSetWatchpoint(t *testing.T) {
+	client := newRawClient()
+	_ = client.LaunchProcess(testutils.ProgramInfloop)
+	defer client.DetachProcess()
+
+	if err := client.SetWatchpoint(testutils.InfloopAddrFirstModuleData, 8); err != nil {
+		t.Fatalf("failed to set watchpoint: %v", err)
+	}
+
+	pid := client.tracingThreadIDs[0]
+	addr, err := client.readDebugRegister(pid, 0)
+	if err != nil {
+		t.Fatalf("failed to read debug register: %v", err)
+	}
+	if addr != testutils.InfloopAddrFirstModuleData {
+		t.Errorf("unexpected address: %#x", addr)
+	}
+
+	control, err := client.readDebugRegister(pid, debugRegControl)
+	if err != nil {
+		t.Fatalf("failed to read debug register: %v", err)
+	}
+	if control&0x1 == 0 {
+		t.Errorf("watchpoint is not enabled: %#x", control)
+	}
+}
+
+func TestSetWatchpoint_Unaligned(t *testing.T) {
+	client := newRawClient()
+	_ = client.LaunchProcess(testutils.ProgramInfloop)
+	defer client.DetachProcess()
+
+	if err := client.SetWatchpoint(testutils.InfloopAddrFirstModuleData+1, 8); err == nil {
+		t.Errorf("error is not returned")
+	}
+}
+
+func TestSetWatchpoint_RunningThreads(t *testing.T) {
+	client := newRawClient()
+	_ = client.LaunchProcess(testutils.ProgramWatch)
+	defer client.DetachProcess()
+
+	_ = client.WriteMemory(testutils.WatchAddrReady, []byte{0xcc})
+	event, err := client.ContinueAndWait()
+	if err != nil || event.Type != EventTypeTrapped {
+		t.Fatalf("failed to continue and wait: %v, %v", event, err)
+	}
+
+	// the other threads, including the writer's one, are running at this point.
+	if err := client.SetWatchpoint(testutils.WatchAddrCounter, 8); err != nil {
+		t.Fatalf("failed to set watchpoint: %v", err)
+	}
+	for _, threadID := range client.tracingThreadIDs {
+		addr, err := client.readDebugRegister(threadID, 0)
+		if err != nil || addr != testutils.WatchAddrCounter {
+			t.Errorf("unexpected address of %d: %#x, %v", threadID, addr, err)
+		}
+	}
+}
+
+func TestClearWatchpoint(t *testing.T) {
+	client := newRawClient()
+	_ = client.LaunchProcess(testutils.ProgramInfloop)
+	defer client.DetachProcess()
+
+	_ = client.SetWatchpoint(testutils.InfloopAddrFirstModuleData, 8)
+	if err := client.ClearWatchpoint(testutils.InfloopAddrFirstModuleData); err != nil {
+		t.Fatalf("failed to clear watchpoint: %v", err)
+	}
+
+	control, err := client.readDebugRegister(client.tracingThreadIDs[0], debugRegControl)
+	if err != nil {
+		t.Fatalf("failed to read debug register: %v", err)
+	}
+	if control&0x1 != 0 {
+		t.Errorf("watchpoint is still enabled: %#x", control)
+	}
+}
+
+func TestHitWatchpoint_NotHit(t *testing.T) {
+	client := newRawClient()
+	_ = client.LaunchProcess(testutils.ProgramInfloop)
+	defer client.DetachProcess()
+
+	_ = client.SetWatchpoint(testutils.InfloopAddrFirstModuleData, 8)
+	_, hit, err := client.HitWatchpoint(client.tracingThreadIDs[0])
+	if err != nil {
+		t.Fatalf("failed to check watchpoint: %v", err)
+	}
+	if hit {
+		t.Errorf("watchpoint is hit")
+	}
+}
+
+func TestContinueAndWait_TrappedByWatchpointWhileStopping(t *testing.T) {
+	client := newRawClient()
+	_ = client.LaunchProcess(testutils.ProgramInfloop)
+	defer client.DetachProcess()
+
+	threadID := client.tracingThreadIDs[0]
+	client.watchpointTrappedThreadIDs = []int{threadID}
+	event, err := client.ContinueAndWait()
+	if err != nil {
+		t.Fatalf("failed to continue: %v", err)
+	}
+	if event.Type != EventTypeTrapped || len(event.Data.([]int)) != 1 || event.Data.([]int)[0] != threadID {
+		t.Errorf("unexpected event: %v", event)
+	}
+	if !client.isTrapped(threadID) {
+		t.Errorf("the thread is resumed")
+	}
+}
+
+func TestWatchpointControlBits(t *testing.T) {
+	for i, testdata := range []struct {
+		index, size int
+		expected    uint64
+	}{
+		{index: 0, size: 1, expected: 0x10001},
+		{index: 1, size: 4, expected: 0xd00004},
+		{index: 3, size: 8, expected: 0x90000040},
+	} {
+		actual := watchpointControlBits(testdata.index, testdata.size)
+		if actual != testdata.expected {
+			t.Errorf("[%d] unexpected control bits: %#x", i, actual)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Package fake provides the in-memory fake of the debugapi client.
+// No process is involved, so the packages built on the tracee package can be tested without ptrace privileges.
+//
+// The memory image is loaded from the ELF file (or mapped directly) and the registers and events are scripted:
+//
+//	client := fake.NewClient()
+//	_ = client.LoadELF("/path/to/program")
+//	client.SetRegisters(1, debugapi.Registers{Rip: mainAddr + 1, Rsp: 0x7fff0000})
+//	client.AddStop(fake.Stop{Event: debugapi.Event{Type: debugapi.EventTypeTrapped, Data: []int{1}}})
+//	proc, _ := tracee.LaunchProcess("/path/to/program", nil, tracee.Attributes{DebugapiClient: client})
+package fake
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ks888/tgo/debugapi"
+)
+
+const pageSize = 4096
+
+// Stop is the scripted result of ContinueAndWait or StepAndWait.
+type Stop struct {
+	Event debugapi.Event
+	Err   error
+	// Registers are written to the threads before the event is returned.
+	Registers map[int]debugapi.Registers
+	// WatchpointHits is the address of the watchpoint each thread hit.
+	WatchpointHits map[int]uint64
+}
+
+// Client is the fake debugapi client. It's safe for concurrent use.
+type Client struct {
+	mtx         sync.Mutex
+	pages       map[uint64][]byte
+	registers   map[int]debugapi.Registers
+	tls         map[tlsKey]uint64
+	stops       []Stop
+	watchpoints map[uint64]int
+	hits        map[int]uint64
+
+	// Launched and Attached are true if LaunchProcess or AttachProcess is called. Detached is true if DetachProcess is called.
+	Launched, Attached, Detached bool
+}
+
+type tlsKey struct {
+	threadID int
+	offset   int32
+}
+
+// NewClient returns the new fake client with the empty memory.
+func NewClient() *Client {
+	return &Client{
+		pages:       make(map[uint64][]byte),
+		registers:   make(map[int]debugapi.Registers),
+		tls:         make(map[tlsKey]uint64),
+		watchpoints: make(map[uint64]int),
+		hits:        make(map[int]uint64),
+	}
+}
+
+// LoadELF maps the loadable segments of the ELF file to the memory.
+func (c *Client) LoadELF(path string) error {
+	elfFile, err := elf.Open(path)
+	if err != nil {
+		return err
+	}
+	defer elfFile.Close()
+
+	for _, prog := range elfFile.Progs {
+		if prog.Type != elf.PT_LOAD {
+			continue
+		}
+
+		data := make([]byte, prog.Memsz)
+		if _, err := prog.ReadAt(data[:prog.Filesz], 0); err != nil {
+			return fmt.Errorf("failed to read the segment at %#x: %v", prog.Vaddr, err)
+		}
+		c.MapMemory(prog.Vaddr, data)
+	}
+	return nil
+}
+
+// MapMemory maps the data to the memory at the specified address.
+func (c *Client) MapMemory(addr uint64, data []byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for i := range data {
+		pageAddr := (addr + uint64(i)) &^ (pageSize - 1)
+		page, ok := c.pages[pageAddr]
+		if !ok {
+			page = make([]byte, pageSize)
+			c.pages[pageAddr] = page
+		}
+		page[addr+uint64(i)-pageAddr] = data[i]
+	}
+}
+
+// SetRegisters sets the registers of the thread.
+func (c *Client) SetRegisters(threadID int, regs debugapi.Registers) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.registers[threadID] = regs
+}
+
+// SetTLS sets the value in the thread local storage at the specified offset.
+func (c *Client) SetTLS(threadID int, offset int32, value uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.tls[tlsKey{threadID, offset}] = value
+}
+
+// AddStop appends the stops returned by ContinueAndWait or StepAndWait in order.
+func (c *Client) AddStop(stops ...Stop) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.stops = append(c.stops, stops...)
+}
+
+// LaunchProcess does nothing other than marking the client launched.
+func (c *Client) LaunchProcess(name string, arg ...string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.Launched = true
+	return nil
+}
+
+// AttachProcess does nothing other than marking the client attached.
+func (c *Client) AttachProcess(pid int) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.Attached = true
+	return nil
+}
+
+// DetachProcess does nothing other than marking the client detached.
+func (c *Client) DetachProcess() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.Detached = true
+	return nil
+}
+
+// ReadMemory reads the mapped memory. It's an error to read the unmapped memory.
+func (c *Client) ReadMemory(addr uint64, out []byte) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for i := range out {
+		page, offset, err := c.findPage(addr + uint64(i))
+		if err != nil {
+			return err
+		}
+		out[i] = page[offset]
+	}
+	return nil
+}
+
+// WriteMemory writes the data to the mapped memory. It's an error to write to the unmapped memory.
+func (c *Client) WriteMemory(addr uint64, data []byte) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for i := range data {
+		page, offset, err := c.findPage(addr + uint64(i))
+		if err != nil {
+			return err
+		}
+		page[offset] = data[i]
+	}
+	return nil
+}
+
+func (c *Client) findPage(addr uint64) ([]byte, uint64, error) {
+	pageAddr := addr &^ (pageSize - 1)
+	page, ok := c.pages[pageAddr]
+	if !ok {
+		return nil, 0, fmt.Errorf("unmapped memory: %#x", addr)
+	}
+	return page, addr - pageAddr, nil
+}
+
+// ReadRegisters returns the registers of the thread. It's an error to read the registers of the unknown thread.
+func (c *Client) ReadRegisters(threadID int) (debugapi.Registers, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	regs, ok := c.registers[threadID]
+	if !ok {
+		return debugapi.Registers{}, fmt.Errorf("unknown thread: %d", threadID)
+	}
+	return regs, nil
+}
+
+// WriteRegisters writes the registers of the thread.
+func (c *Client) WriteRegisters(threadID int, regs debugapi.Registers) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.registers[threadID] = regs
+	return nil
+}
+
+// ReadTLS returns the value set by SetTLS.
+func (c *Client) ReadTLS(threadID int, offset int32) (uint64, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	value, ok := c.tls[tlsKey{threadID, offset}]
+	if !ok {
+		return 0, fmt.Errorf("unknown tls: thread %d, offset %d", threadID, offset)
+	}
+	return value, nil
+}
+
+// ContinueAndWait returns the next scripted stop.
+func (c *Client) ContinueAndWait() (debugapi.Event, error) {
+	return c.nextStop()
+}
+
+// StepAndWait returns the next scripted stop. Unlike the actual client, the registers are not changed unless scripted.
+func (c *Client) StepAndWait(threadID int) (debugapi.Event, error) {
+	return c.nextStop()
+}
+
+func (c *Client) nextStop() (debugapi.Event, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if len(c.stops) == 0 {
+		return debugapi.Event{}, errors.New("no more scripted stops")
+	}
+	stop := c.stops[0]
+	c.stops = c.stops[1:]
+
+	for threadID, regs := range stop.Registers {
+		c.registers[threadID] = regs
+	}
+	c.hits = make(map[int]uint64)
+	for threadID, addr := range stop.WatchpointHits {
+		c.hits[threadID] = addr
+	}
+	return stop.Event, stop.Err
+}
+
+// SetWatchpoint remembers the watchpoint. The hits are scripted by Stop.WatchpointHits.
+func (c *Client) SetWatchpoint(addr uint64, size int) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.watchpoints[addr] = size
+	return nil
+}
+
+// ClearWatchpoint forgets the watchpoint.
+func (c *Client) ClearWatchpoint(addr uint64) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	delete(c.watchpoints, addr)
+	return nil
+}
+
+// HitWatchpoint returns the hit scripted by the last stop, if any. Like the actual client, the same hit is not reported twice.
+func (c *Client) HitWatchpoint(threadID int) (uint64, bool, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	addr, ok := c.hits[threadID]
+	delete(c.hits, threadID)
+	return addr, ok, nil
+}
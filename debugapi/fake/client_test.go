@@ -0,0 +1,76 @@
+package fake
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ks888/tgo/debugapi"
+	"github.com/ks888/tgo/testutils"
+)
+
+func TestCheckInterface(t *testing.T) {
+	var _ debugapi.ClientInterface = NewClient()
+}
+
+func TestLoadELF(t *testing.T) {
+	client := NewClient()
+	if err := client.LoadELF(testutils.ProgramHelloworld); err != nil {
+		t.Fatalf("failed to load elf: %v", err)
+	}
+
+	buff := make([]byte, 1)
+	if err := client.ReadMemory(testutils.HelloworldAddrMain, buff); err != nil {
+		t.Fatalf("failed to read memory: %v", err)
+	}
+}
+
+func TestReadAndWriteMemory(t *testing.T) {
+	client := NewClient()
+	client.MapMemory(0xfff, []byte{0x1, 0x2})
+
+	if err := client.WriteMemory(0x1000, []byte{0x3}); err != nil {
+		t.Fatalf("failed to write memory: %v", err)
+	}
+	buff := make([]byte, 2)
+	if err := client.ReadMemory(0xfff, buff); err != nil {
+		t.Fatalf("failed to read memory: %v", err)
+	}
+	if !reflect.DeepEqual(buff, []byte{0x1, 0x3}) {
+		t.Errorf("unexpected content: %v", buff)
+	}
+}
+
+func TestReadMemory_Unmapped(t *testing.T) {
+	client := NewClient()
+	if err := client.ReadMemory(0x1000, make([]byte, 1)); err == nil {
+		t.Errorf("error not returned")
+	}
+}
+
+func TestContinueAndWait(t *testing.T) {
+	client := NewClient()
+	client.SetRegisters(1, debugapi.Registers{Rip: 0x1000})
+	trapped := debugapi.Event{Type: debugapi.EventTypeTrapped, Data: []int{1}}
+	client.AddStop(Stop{Event: trapped, Registers: map[int]debugapi.Registers{1: {Rip: 0x2001}}, WatchpointHits: map[int]uint64{1: 0x3000}})
+
+	event, err := client.ContinueAndWait()
+	if err != nil {
+		t.Fatalf("failed to continue: %v", err)
+	}
+	if !reflect.DeepEqual(event, trapped) {
+		t.Errorf("unexpected event: %#v", event)
+	}
+	if regs, _ := client.ReadRegisters(1); regs.Rip != 0x2001 {
+		t.Errorf("unexpected rip: %#x", regs.Rip)
+	}
+	if addr, hit, _ := client.HitWatchpoint(1); !hit || addr != 0x3000 {
+		t.Errorf("unexpected watchpoint hit: %#x, %v", addr, hit)
+	}
+	if _, hit, _ := client.HitWatchpoint(1); hit {
+		t.Errorf("same hit is reported twice")
+	}
+
+	if _, err := client.ContinueAndWait(); err == nil {
+		t.Errorf("error not returned")
+	}
+}
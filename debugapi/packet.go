@@ -0,0 +1,435 @@
+package debugapi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Assumes the packet size is not larger than this.
+const maxPacketSize = 4096
+
+// packetConn sends and receives the packets of the gdb's remote serial protocol.
+// See the gdb's doc for the reference: https://sourceware.org/gdb/onlinedocs/gdb/Remote-Protocol.html
+type packetConn struct {
+	conn      net.Conn
+	noAckMode bool
+	buffer    []byte
+	// pending is the data received but not processed yet. The stub may send multiple packets at once.
+	pending []byte
+}
+
+func newPacketConn(conn net.Conn) packetConn {
+	return packetConn{conn: conn, buffer: make([]byte, maxPacketSize)}
+}
+
+type registerMetadata struct {
+	name             string
+	id, offset, size int
+}
+
+func (c *packetConn) close() error {
+	return c.conn.Close()
+}
+
+func (c *packetConn) send(command string) error {
+	packet := fmt.Sprintf("$%s#00", command)
+	if !c.noAckMode {
+		packet = fmt.Sprintf("$%s#%02x", command, calcChecksum([]byte(command)))
+	}
+
+	if n, err := c.conn.Write([]byte(packet)); err != nil {
+		return err
+	} else if n != len(packet) {
+		return fmt.Errorf("only part of the buffer is sent: %d / %d", n, len(packet))
+	}
+
+	if !c.noAckMode {
+		return c.receiveAck()
+	}
+	return nil
+}
+
+func (c *packetConn) receiveAndCheck() error {
+	if data, err := c.receive(); err != nil {
+		return err
+	} else if data != "OK" {
+		return fmt.Errorf("the error response is returned: %s", data)
+	}
+
+	return nil
+}
+
+func (c *packetConn) receive() (string, error) {
+	var rawPacket []byte
+	for {
+		var ok bool
+		rawPacket, c.pending, ok = splitPacket(c.pending)
+		if ok {
+			break
+		}
+
+		n, err := c.conn.Read(c.buffer)
+		if err != nil {
+			return "", err
+		}
+		c.pending = append(c.pending, c.buffer[0:n]...)
+	}
+
+	packet := string(rawPacket)
+	data := string(rawPacket[1 : len(rawPacket)-3])
+	if !c.noAckMode {
+		if err := verifyPacket(packet); err != nil {
+			return "", err
+		}
+		return data, c.sendAck()
+	}
+
+	return data, nil
+}
+
+// splitPacket splits the first packet `$...#xx` from the data. The data before the packet, such as acks, is discarded.
+// ok is false if the data doesn't contain the whole packet yet.
+func splitPacket(data []byte) (packet, rest []byte, ok bool) {
+	start := bytes.IndexByte(data, '$')
+	if start == -1 {
+		return nil, nil, false
+	}
+	data = data[start:]
+
+	// '#' in the packet data is always escaped.
+	end := bytes.IndexByte(data, '#')
+	if end == -1 || end+3 > len(data) {
+		return nil, data, false
+	}
+	return data[:end+3], data[end+3:], true
+}
+
+func (c *packetConn) receiveWithTimeout(timeout time.Duration) (string, error) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	return c.receive()
+}
+
+func (c *packetConn) sendAck() error {
+	_, err := c.conn.Write([]byte("+"))
+	return err
+}
+
+func (c *packetConn) receiveAck() error {
+	if len(c.pending) > 0 {
+		ack := c.pending[0]
+		c.pending = c.pending[1:]
+		if ack != '+' {
+			return errors.New("failed to receive ack")
+		}
+		return nil
+	}
+
+	if _, err := c.conn.Read(c.buffer[0:1]); err != nil {
+		return err
+	} else if c.buffer[0] != '+' {
+		return errors.New("failed to receive ack")
+	}
+
+	return nil
+}
+
+func verifyPacket(packet string) error {
+	if packet[0:1] != "$" {
+		return fmt.Errorf("invalid head data: %v", packet[0])
+	}
+
+	if packet[len(packet)-3:len(packet)-2] != "#" {
+		return fmt.Errorf("invalid tail data: %v", packet[len(packet)-3])
+	}
+
+	body := packet[1 : len(packet)-3]
+	bodyChecksum := fmt.Sprintf("%02x", calcChecksum([]byte(body)))
+	tailChecksum := strings.ToLower(packet[len(packet)-2:])
+	if tailChecksum != bodyChecksum {
+		return fmt.Errorf("invalid checksum: %s", tailChecksum)
+	}
+
+	return nil
+}
+
+func hexToUint64(hex string, littleEndian bool) (uint64, error) {
+	if littleEndian {
+		var reversedHex bytes.Buffer
+		for i := len(hex) - 2; i >= 0; i -= 2 {
+			reversedHex.WriteString(hex[i : i+2])
+		}
+		hex = reversedHex.String()
+	}
+	return strconv.ParseUint(hex, 16, 64)
+}
+
+func hexToByteArray(hex string) ([]byte, error) {
+	out := make([]byte, len(hex)/2)
+	for i := 0; i < len(hex); i += 2 {
+		value, err := strconv.ParseUint(hex[i:i+2], 16, 8)
+		if err != nil {
+			return nil, err
+		}
+
+		out[i/2] = uint8(value)
+	}
+	return out, nil
+}
+
+func byteArrayToHex(data []byte) string {
+	var hex bytes.Buffer
+	for _, b := range data {
+		hex.WriteString(fmt.Sprintf("%02x", b))
+	}
+	return hex.String()
+}
+
+// decodeRunLength expands the run-length encoded data. `X*N` means the character X is repeated N-29 times more.
+func decodeRunLength(data string) string {
+	if !strings.Contains(data, "*") {
+		return data
+	}
+
+	var decoded bytes.Buffer
+	for i := 0; i < len(data); i++ {
+		if data[i] == '*' && i > 0 && i+1 < len(data) {
+			decoded.WriteString(strings.Repeat(data[i-1:i], int(data[i+1])-29))
+			i++
+			continue
+		}
+		decoded.WriteByte(data[i])
+	}
+	return decoded.String()
+}
+
+// unescapeBinary unescapes the binary data. The escaped byte is prefixed by '}' and XORed with 0x20.
+func unescapeBinary(data string) []byte {
+	var unescaped []byte
+	for i := 0; i < len(data); i++ {
+		if data[i] == '}' && i+1 < len(data) {
+			unescaped = append(unescaped, data[i+1]^0x20)
+			i++
+			continue
+		}
+		unescaped = append(unescaped, data[i])
+	}
+	return unescaped
+}
+
+func uint64ToHex(input uint64, littleEndian bool) string {
+	hex := fmt.Sprintf("%016x", input)
+	if littleEndian {
+		var reversedHex bytes.Buffer
+		for i := len(hex) - 2; i >= 0; i -= 2 {
+			reversedHex.WriteString(hex[i : i+2])
+		}
+		hex = reversedHex.String()
+	}
+	return hex
+}
+
+func calcChecksum(buff []byte) uint8 {
+	var sum uint8
+	for _, b := range buff {
+		sum += b
+	}
+	return sum
+}
+
+// parseRegisterData parses the data of the `g` packet's reply.
+func parseRegisterData(data string, metadataList []registerMetadata) (Registers, error) {
+	var regs Registers
+	for _, metadata := range metadataList {
+		if (metadata.offset+metadata.size)*2 > len(data) {
+			continue
+		}
+
+		value, err := hexToByteArray(data[metadata.offset*2 : (metadata.offset+metadata.size)*2])
+		if err != nil {
+			return Registers{}, err
+		}
+		setRegister(&regs, metadata.name, value)
+	}
+	return regs, nil
+}
+
+// updateRegisterData updates the data of the `g` packet's reply with regs. The registers regs doesn't hold remain unchanged.
+func updateRegisterData(data string, metadataList []registerMetadata, regs Registers) string {
+	for _, metadata := range metadataList {
+		if (metadata.offset+metadata.size)*2 > len(data) {
+			continue
+		}
+
+		value, ok := registerValue(&regs, metadata.name, metadata.size)
+		if !ok {
+			continue
+		}
+		data = data[0:metadata.offset*2] + byteArrayToHex(value) + data[(metadata.offset+metadata.size)*2:]
+	}
+	return data
+}
+
+// setRegister sets the value of the named register to regs. The value is in little endian. Unknown registers are ignored.
+// Both the gdb's names and the lldb's names are accepted.
+func setRegister(regs *Registers, name string, value []byte) {
+	padded := make([]byte, 8)
+	copy(padded, value)
+	scalar := binary.LittleEndian.Uint64(padded)
+
+	fp := &regs.FP
+	switch name {
+	case "fctrl":
+		fp.Fcw = uint16(scalar)
+	case "fstat":
+		fp.Fsw = uint16(scalar)
+	case "ftag":
+		fp.Ftw = uint16(scalar)
+	case "fop":
+		fp.Fop = uint16(scalar)
+	case "mxcsr":
+		fp.Mxcsr = uint32(scalar)
+	default:
+		if reg := integerRegister(regs, name); reg != nil {
+			*reg = scalar
+			return
+		}
+
+		low, high := vectorRegister(regs, name)
+		n := copy(low, value)
+		copy(high, value[n:])
+	}
+}
+
+// registerValue returns the little endian value of the named register. False is returned if the register is unknown.
+func registerValue(regs *Registers, name string, size int) ([]byte, bool) {
+	var scalar uint64
+	fp := &regs.FP
+	switch name {
+	case "fctrl":
+		scalar = uint64(fp.Fcw)
+	case "fstat":
+		scalar = uint64(fp.Fsw)
+	case "ftag":
+		scalar = uint64(fp.Ftw)
+	case "fop":
+		scalar = uint64(fp.Fop)
+	case "mxcsr":
+		scalar = uint64(fp.Mxcsr)
+	default:
+		if reg := integerRegister(regs, name); reg != nil {
+			scalar = *reg
+			break
+		}
+
+		low, high := vectorRegister(regs, name)
+		if low == nil {
+			return nil, false
+		}
+		value := make([]byte, size)
+		n := copy(value, low)
+		copy(value[n:], high)
+		return value, true
+	}
+
+	buff := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buff, scalar)
+	value := make([]byte, size)
+	copy(value, buff)
+	return value, true
+}
+
+func integerRegister(regs *Registers, name string) *uint64 {
+	switch name {
+	case "rax":
+		return &regs.Rax
+	case "rbx":
+		return &regs.Rbx
+	case "rcx":
+		return &regs.Rcx
+	case "rdx":
+		return &regs.Rdx
+	case "rsi":
+		return &regs.Rsi
+	case "rdi":
+		return &regs.Rdi
+	case "rbp":
+		return &regs.Rbp
+	case "rsp":
+		return &regs.Rsp
+	case "r8":
+		return &regs.R8
+	case "r9":
+		return &regs.R9
+	case "r10":
+		return &regs.R10
+	case "r11":
+		return &regs.R11
+	case "r12":
+		return &regs.R12
+	case "r13":
+		return &regs.R13
+	case "r14":
+		return &regs.R14
+	case "r15":
+		return &regs.R15
+	case "rip":
+		return &regs.Rip
+	case "eflags", "rflags":
+		return &regs.Rflags
+	case "cs":
+		return &regs.Cs
+	case "ss":
+		return &regs.Ss
+	case "ds":
+		return &regs.Ds
+	case "es":
+		return &regs.Es
+	case "fs":
+		return &regs.Fs
+	case "gs":
+		return &regs.Gs
+	case "fs_base":
+		return &regs.FsBase
+	case "gs_base":
+		return &regs.GsBase
+	}
+	return nil
+}
+
+// vectorRegister returns the byte representation of the named vector or x87 register. The high part is not nil
+// only if the register is split into 2 fields, like ymm0.
+func vectorRegister(regs *Registers, name string) (low, high []byte) {
+	fp := &regs.FP
+	if index, ok := registerIndex(name, "stmm", "", len(fp.St)); ok {
+		return fp.St[index][:], nil
+	} else if index, ok := registerIndex(name, "st", "", len(fp.St)); ok {
+		return fp.St[index][:], nil
+	} else if index, ok := registerIndex(name, "xmm", "", len(fp.Xmm)); ok {
+		return fp.Xmm[index][:], nil
+	} else if index, ok := registerIndex(name, "ymm", "h", len(fp.Ymmh)); ok {
+		return fp.Ymmh[index][:], nil
+	} else if index, ok := registerIndex(name, "ymm", "", len(fp.Ymmh)); ok {
+		return fp.Xmm[index][:], fp.Ymmh[index][:]
+	}
+	return nil, nil
+}
+
+// registerIndex returns the N of the register name like `<prefix>N<suffix>`.
+func registerIndex(name, prefix, suffix string, numRegisters int) (int, bool) {
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) || len(name) <= len(prefix)+len(suffix) {
+		return 0, false
+	}
+	index, err := strconv.Atoi(name[len(prefix) : len(name)-len(suffix)])
+	if err != nil || index < 0 || index >= numRegisters {
+		return 0, false
+	}
+	return index, true
+}
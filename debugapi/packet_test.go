@@ -0,0 +1,244 @@
+package debugapi
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSendAndReceive(t *testing.T) {
+	connForReceive, connForSend := net.Pipe()
+	cmd := "command"
+
+	sendDone := make(chan bool)
+	go func(conn net.Conn, ch chan bool) {
+		defer close(ch)
+
+		client := newTestPacketConn(conn, false)
+		if err := client.send(cmd); err != nil {
+			t.Errorf("failed to send command: %v", err)
+		}
+	}(connForSend, sendDone)
+
+	client := newTestPacketConn(connForReceive, false)
+	buff, err := client.receive()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cmd != buff {
+		t.Errorf("receieved unexpected data: %v", buff)
+	}
+
+	<-sendDone
+}
+
+func TestSendAndReceive_NoAckMode(t *testing.T) {
+	connForReceive, connForSend := net.Pipe()
+	cmd := "command"
+
+	sendDone := make(chan bool)
+	go func(conn net.Conn, ch chan bool) {
+		defer close(ch)
+
+		client := newTestPacketConn(conn, true)
+		if err := client.send(cmd); err != nil {
+			t.Errorf("failed to send command: %v", err)
+		}
+	}(connForSend, sendDone)
+
+	client := newTestPacketConn(connForReceive, true)
+	buff, err := client.receive()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cmd != buff {
+		t.Errorf("receieved unexpected data: %v", buff)
+	}
+
+	<-sendDone
+}
+
+func TestReceive_MultiplePackets(t *testing.T) {
+	connForReceive, connForSend := net.Pipe()
+	defer connForReceive.Close()
+
+	sendDone := make(chan bool)
+	go func() {
+		defer close(sendDone)
+
+		// the packets and the ack are sent at once.
+		if _, err := connForSend.Write([]byte("$OKg#01$command#df+")); err != nil {
+			t.Errorf("failed to write: %v", err)
+		}
+	}()
+
+	client := newTestPacketConn(connForReceive, true)
+	for _, expected := range []string{"OKg", "command"} {
+		data, err := client.receive()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if data != expected {
+			t.Errorf("receieved unexpected data: %v", data)
+		}
+	}
+	if err := client.receiveAck(); err != nil {
+		t.Errorf("failed to receive ack: %v", err)
+	}
+	<-sendDone
+}
+
+func TestVerifyPacket(t *testing.T) {
+	for i, test := range []struct {
+		packet      string
+		expectError bool
+	}{
+		{packet: "$command#df", expectError: false},
+		{packet: "#command#df", expectError: true},
+		{packet: "$command$df", expectError: true},
+		{packet: "$command#00", expectError: true},
+		{packet: "$OKg#01", expectError: false},
+		{packet: "$command#DF", expectError: false},
+	} {
+		actual := verifyPacket(test.packet)
+		if test.expectError && actual == nil {
+			t.Errorf("[%d] error not returned", i)
+		} else if !test.expectError && actual != nil {
+			t.Errorf("[%d] error returned: %v", i, actual)
+		}
+	}
+}
+
+func TestHexToUint64(t *testing.T) {
+	for i, test := range []struct {
+		hex          string
+		littleEndian bool
+		expected     uint64
+	}{
+		{hex: "00000001", littleEndian: false, expected: 1},
+		{hex: "00000102", littleEndian: false, expected: 258},
+		{hex: "02010000", littleEndian: true, expected: 258},
+	} {
+		actual, _ := hexToUint64(test.hex, test.littleEndian)
+		if test.expected != actual {
+			t.Errorf("[%d] not expected value: %d", i, actual)
+		}
+	}
+}
+
+func TestUint64ToHex(t *testing.T) {
+	for i, test := range []struct {
+		input        uint64
+		littleEndian bool
+		expected     string
+	}{
+		{input: 1, littleEndian: false, expected: "0000000000000001"},
+		{input: 258, littleEndian: false, expected: "0000000000000102"},
+		{input: 258, littleEndian: true, expected: "0201000000000000"},
+	} {
+		actual := uint64ToHex(test.input, test.littleEndian)
+		if test.expected != actual {
+			t.Errorf("[%d] not expected value: %s", i, actual)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	for i, data := range []struct {
+		input    []byte
+		expected uint8
+	}{
+		{input: []byte{0x1, 0x2}, expected: 3},
+		{input: []byte{0x7f, 0x80}, expected: 255},
+		{input: []byte{0x80, 0x80}, expected: 0},
+		{input: []byte{0x63, 0x6f, 0x6d, 0x6d, 0x61, 0x6e, 0x64}, expected: 0xdf},
+	} {
+		sum := calcChecksum(data.input)
+		if sum != data.expected {
+			t.Errorf("[%d] wrong checksum: %x", i, sum)
+		}
+	}
+}
+
+func TestDecodeRunLength(t *testing.T) {
+	for i, test := range []struct {
+		input    string
+		expected string
+	}{
+		{input: "0102", expected: "0102"},
+		{input: "0* ", expected: "0000"},
+		{input: "ab0*!cd", expected: "ab00000cd"},
+	} {
+		actual := decodeRunLength(test.input)
+		if test.expected != actual {
+			t.Errorf("[%d] not expected value: %s", i, actual)
+		}
+	}
+}
+
+func TestUnescapeBinary(t *testing.T) {
+	for i, test := range []struct {
+		input    string
+		expected string
+	}{
+		{input: "ab", expected: "ab"},
+		{input: "a}]b}\x03", expected: "a}b#"},
+		{input: "}\x04}\x0a", expected: "$*"},
+		{input: "a}", expected: "a}"},
+	} {
+		actual := unescapeBinary(test.input)
+		if string(actual) != test.expected {
+			t.Errorf("[%d] not expected value: %v", i, actual)
+		}
+	}
+}
+
+func TestParseThreadID(t *testing.T) {
+	for i, test := range []struct {
+		input    string
+		expected int
+	}{
+		{input: "1b3", expected: 0x1b3},
+		{input: "p1a.1b3", expected: 0x1b3},
+	} {
+		actual, err := parseThreadID(test.input)
+		if err != nil {
+			t.Fatalf("[%d] failed to parse: %v", i, err)
+		}
+		if test.expected != actual {
+			t.Errorf("[%d] not expected value: %d", i, actual)
+		}
+	}
+}
+
+func TestParseAndUpdateRegisterData(t *testing.T) {
+	metadataList := []registerMetadata{
+		{name: "rip", offset: 0, size: 8},
+		{name: "eflags", offset: 8, size: 4},
+		{name: "orig_rax", offset: 12, size: 8},
+		{name: "ymm0h", offset: 20, size: 16},
+		{name: "xmm0", offset: 36, size: 16},
+	}
+	data := "0100000000000000" + "02000000" + "0300000000000000" + strings.Repeat("04", 16) + strings.Repeat("05", 16)
+
+	regs, err := parseRegisterData(data, metadataList)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if regs.Rip != 1 || regs.Rflags != 2 || regs.FP.Ymmh[0][15] != 4 || regs.FP.Xmm[0][0] != 5 {
+		t.Errorf("unexpected registers: %#v", regs)
+	}
+
+	regs.Rip = 0x10
+	regs.FP.Xmm[0][0] = 0x6
+	expected := "1000000000000000" + "02000000" + "0300000000000000" + strings.Repeat("04", 16) + "06" + strings.Repeat("05", 15)
+	if actual := updateRegisterData(data, metadataList, regs); actual != expected {
+		t.Errorf("unexpected data: %s", actual)
+	}
+}
+
+func newTestPacketConn(conn net.Conn, noAckMode bool) *packetConn {
+	packetConn := newPacketConn(conn)
+	packetConn.noAckMode = noAckMode
+	return &packetConn
+}
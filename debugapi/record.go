@@ -0,0 +1,397 @@
+package debugapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// record is the result of one request, written to the log in the JSON lines format.
+type record struct {
+	Method   string
+	Addr     uint64 `json:",omitempty"`
+	Size     int    `json:",omitempty"`
+	ThreadID int    `json:",omitempty"`
+	Offset   int32  `json:",omitempty"`
+
+	// Data and Regs are the results of the read requests or the payloads of the write requests.
+	Data  []byte         `json:",omitempty"`
+	Regs  *Registers     `json:",omitempty"`
+	Value uint64         `json:",omitempty"`
+	Hit   bool           `json:",omitempty"`
+	Event *recordedEvent `json:",omitempty"`
+
+	Err                  string `json:",omitempty"`
+	UnspecifiedThreadIDs []int  `json:",omitempty"`
+}
+
+// recordedEvent is the Event with the concrete type of the data.
+type recordedEvent struct {
+	Type      EventType
+	ThreadIDs []int `json:",omitempty"`
+	Status    int   `json:",omitempty"`
+}
+
+func newRecordedEvent(ev Event) *recordedEvent {
+	recorded := &recordedEvent{Type: ev.Type}
+	switch data := ev.Data.(type) {
+	case []int:
+		recorded.ThreadIDs = data
+	case int:
+		recorded.Status = data
+	}
+	return recorded
+}
+
+func (e *recordedEvent) event() Event {
+	switch e.Type {
+	case EventTypeTrapped:
+		return Event{Type: e.Type, Data: e.ThreadIDs}
+	case EventTypeExited, EventTypeTerminated:
+		return Event{Type: e.Type, Data: e.Status}
+	}
+	return Event{Type: e.Type}
+}
+
+func (r *record) setErr(err error) {
+	if err == nil {
+		return
+	}
+	r.Err = err.Error()
+	if unspecifiedErr, ok := err.(UnspecifiedThreadError); ok {
+		r.UnspecifiedThreadIDs = unspecifiedErr.ThreadIDs
+	}
+}
+
+func (r *record) err() error {
+	if r.UnspecifiedThreadIDs != nil {
+		return UnspecifiedThreadError{ThreadIDs: r.UnspecifiedThreadIDs}
+	} else if r.Err != "" {
+		return errors.New(r.Err)
+	}
+	return nil
+}
+
+// NewRecordingClient returns the new client proxy which delegates the requests to the given client and
+// records their results to w. The log can be served back by the client NewReplayClient returns.
+// The given client should not be used directly after this call. If w is io.Closer, it's closed when the process is detached.
+func NewRecordingClient(c ClientInterface, w io.Writer) ClientInterface {
+	return newBackendClient(&recordingClient{raw: c, w: w, encoder: json.NewEncoder(w)})
+}
+
+// recordingClient is the backend which records the results of the requests.
+type recordingClient struct {
+	raw     ClientInterface
+	w       io.Writer
+	encoder *json.Encoder
+}
+
+func (c *recordingClient) record(r record, err error) error {
+	r.setErr(err)
+	if encodeErr := c.encoder.Encode(r); encodeErr != nil {
+		return fmt.Errorf("failed to record %s: %v", r.Method, encodeErr)
+	}
+	return err
+}
+
+// LaunchProcess closes the log if it fails, because the process is not detached in that case.
+func (c *recordingClient) LaunchProcess(name string, arg ...string) error {
+	err := c.record(record{Method: "LaunchProcess"}, c.raw.LaunchProcess(name, arg...))
+	if err != nil {
+		closeLog(c.w)
+	}
+	return err
+}
+
+// AttachProcess closes the log if it fails, because the process is not detached in that case.
+func (c *recordingClient) AttachProcess(pid int) error {
+	err := c.record(record{Method: "AttachProcess"}, c.raw.AttachProcess(pid))
+	if err != nil {
+		closeLog(c.w)
+	}
+	return err
+}
+
+func (c *recordingClient) DetachProcess() error {
+	err := c.record(record{Method: "DetachProcess"}, c.raw.DetachProcess())
+	if closeErr := closeLog(c.w); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// closeLog closes the log if it's io.Closer.
+func closeLog(stream interface{}) error {
+	if closer, ok := stream.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *recordingClient) ReadMemory(addr uint64, out []byte) error {
+	err := c.raw.ReadMemory(addr, out)
+	return c.record(record{Method: "ReadMemory", Addr: addr, Size: len(out), Data: out}, err)
+}
+
+func (c *recordingClient) WriteMemory(addr uint64, data []byte) error {
+	err := c.raw.WriteMemory(addr, data)
+	return c.record(record{Method: "WriteMemory", Addr: addr, Size: len(data), Data: data}, err)
+}
+
+func (c *recordingClient) ReadRegisters(threadID int) (Registers, error) {
+	regs, err := c.raw.ReadRegisters(threadID)
+	return regs, c.record(record{Method: "ReadRegisters", ThreadID: threadID, Regs: &regs}, err)
+}
+
+func (c *recordingClient) WriteRegisters(threadID int, regs Registers) error {
+	err := c.raw.WriteRegisters(threadID, regs)
+	return c.record(record{Method: "WriteRegisters", ThreadID: threadID, Regs: &regs}, err)
+}
+
+func (c *recordingClient) ReadTLS(threadID int, offset int32) (uint64, error) {
+	value, err := c.raw.ReadTLS(threadID, offset)
+	return value, c.record(record{Method: "ReadTLS", ThreadID: threadID, Offset: offset, Value: value}, err)
+}
+
+// Interrupt is not recorded because it's asynchronous. The interrupted event ContinueAndWait returns is recorded instead.
+func (c *recordingClient) Interrupt() error {
+	interrupter, ok := c.raw.(Interrupter)
+	if !ok {
+		return errors.New("interrupt is not supported")
+	}
+	return interrupter.Interrupt()
+}
+
+func (c *recordingClient) ContinueAndWait() (Event, error) {
+	ev, err := c.raw.ContinueAndWait()
+	return ev, c.record(record{Method: "ContinueAndWait", Event: newRecordedEvent(ev)}, err)
+}
+
+func (c *recordingClient) StepAndWait(threadID int) (Event, error) {
+	ev, err := c.raw.StepAndWait(threadID)
+	return ev, c.record(record{Method: "StepAndWait", ThreadID: threadID, Event: newRecordedEvent(ev)}, err)
+}
+
+func (c *recordingClient) SetWatchpoint(addr uint64, size int) error {
+	err := c.raw.SetWatchpoint(addr, size)
+	return c.record(record{Method: "SetWatchpoint", Addr: addr, Size: size}, err)
+}
+
+func (c *recordingClient) ClearWatchpoint(addr uint64) error {
+	err := c.raw.ClearWatchpoint(addr)
+	return c.record(record{Method: "ClearWatchpoint", Addr: addr}, err)
+}
+
+func (c *recordingClient) HitWatchpoint(threadID int) (uint64, bool, error) {
+	addr, hit, err := c.raw.HitWatchpoint(threadID)
+	return addr, hit, c.record(record{Method: "HitWatchpoint", ThreadID: threadID, Value: addr, Hit: hit}, err)
+}
+
+// ReplayMismatchError indicates the request differs from the recorded one.
+type ReplayMismatchError struct {
+	Expected, Actual string
+}
+
+// Error returns the description of the mismatch.
+func (e ReplayMismatchError) Error() string {
+	return fmt.Sprintf("replay mismatch: expected %s, but got %s", e.Expected, e.Actual)
+}
+
+// NewReplayClient returns the new client proxy which serves back the results recorded by the client NewRecordingClient returns.
+// No process is involved. The requests must be issued in the same order and with the same args as the recorded ones,
+// including the data and registers written. Otherwise, ReplayMismatchError is returned. If r is io.Closer, it's closed
+// when the process is detached.
+func NewReplayClient(r io.Reader) ClientInterface {
+	return newBackendClient(&replayClient{r: r, decoder: json.NewDecoder(r)})
+}
+
+// replayClient is the backend which serves back the recorded results.
+type replayClient struct {
+	r       io.Reader
+	decoder *json.Decoder
+}
+
+// next returns the next record if it matches the requested one.
+func (c *replayClient) next(requested record) (record, error) {
+	var recorded record
+	if err := c.decoder.Decode(&recorded); err == io.EOF {
+		return recorded, ReplayMismatchError{Expected: "end of log", Actual: describeRecord(requested)}
+	} else if err != nil {
+		return recorded, fmt.Errorf("failed to read the recorded log: %v", err)
+	}
+
+	if recorded.Method != requested.Method || recorded.Addr != requested.Addr || recorded.Size != requested.Size ||
+		recorded.ThreadID != requested.ThreadID || recorded.Offset != requested.Offset {
+		return recorded, ReplayMismatchError{Expected: describeRecord(recorded), Actual: describeRecord(requested)}
+	}
+
+	// the payloads are set only to the write requests.
+	if requested.Data != nil && !bytes.Equal(recorded.Data, requested.Data) {
+		return recorded, ReplayMismatchError{
+			Expected: fmt.Sprintf("%s writing %x", describeRecord(recorded), recorded.Data),
+			Actual:   fmt.Sprintf("%s writing %x", describeRecord(requested), requested.Data),
+		}
+	}
+	if requested.Regs != nil && (recorded.Regs == nil || *recorded.Regs != *requested.Regs) {
+		var recordedRegs Registers
+		if recorded.Regs != nil {
+			recordedRegs = *recorded.Regs
+		}
+		fields := differentFields(recordedRegs, *requested.Regs)
+		return recorded, ReplayMismatchError{
+			Expected: fmt.Sprintf("%s writing %s", describeRecord(recorded), describeFields(recordedRegs, fields)),
+			Actual:   fmt.Sprintf("%s writing %s", describeRecord(requested), describeFields(*requested.Regs, fields)),
+		}
+	}
+	return recorded, nil
+}
+
+func describeRecord(r record) string {
+	return fmt.Sprintf("%s(addr: %#x, size: %d, thread: %d, offset: %d)", r.Method, r.Addr, r.Size, r.ThreadID, r.Offset)
+}
+
+// differentFields returns the names of the registers whose values are different.
+func differentFields(a, b Registers) []string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	var fields []string
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			fields = append(fields, va.Type().Field(i).Name)
+		}
+	}
+	return fields
+}
+
+func describeFields(regs Registers, fields []string) string {
+	v := reflect.ValueOf(regs)
+	var descs []string
+	for _, field := range fields {
+		descs = append(descs, fmt.Sprintf("%s: %#x", field, v.FieldByName(field).Interface()))
+	}
+	return "{" + strings.Join(descs, ", ") + "}"
+}
+
+// LaunchProcess closes the log if it fails, because the process is not detached in that case.
+func (c *replayClient) LaunchProcess(name string, arg ...string) error {
+	r, err := c.next(record{Method: "LaunchProcess"})
+	if err == nil {
+		err = r.err()
+	}
+	if err != nil {
+		closeLog(c.r)
+	}
+	return err
+}
+
+// AttachProcess closes the log if it fails, because the process is not detached in that case.
+func (c *replayClient) AttachProcess(pid int) error {
+	r, err := c.next(record{Method: "AttachProcess"})
+	if err == nil {
+		err = r.err()
+	}
+	if err != nil {
+		closeLog(c.r)
+	}
+	return err
+}
+
+func (c *replayClient) DetachProcess() error {
+	defer closeLog(c.r)
+
+	r, err := c.next(record{Method: "DetachProcess"})
+	if err != nil {
+		return err
+	}
+	return r.err()
+}
+
+func (c *replayClient) ReadMemory(addr uint64, out []byte) error {
+	r, err := c.next(record{Method: "ReadMemory", Addr: addr, Size: len(out)})
+	if err != nil {
+		return err
+	}
+	copy(out, r.Data)
+	return r.err()
+}
+
+func (c *replayClient) WriteMemory(addr uint64, data []byte) error {
+	r, err := c.next(record{Method: "WriteMemory", Addr: addr, Size: len(data), Data: data})
+	if err != nil {
+		return err
+	}
+	return r.err()
+}
+
+func (c *replayClient) ReadRegisters(threadID int) (Registers, error) {
+	r, err := c.next(record{Method: "ReadRegisters", ThreadID: threadID})
+	if err != nil {
+		return Registers{}, err
+	}
+	if r.Regs == nil {
+		return Registers{}, r.err()
+	}
+	return *r.Regs, r.err()
+}
+
+func (c *replayClient) WriteRegisters(threadID int, regs Registers) error {
+	r, err := c.next(record{Method: "WriteRegisters", ThreadID: threadID, Regs: &regs})
+	if err != nil {
+		return err
+	}
+	return r.err()
+}
+
+func (c *replayClient) ReadTLS(threadID int, offset int32) (uint64, error) {
+	r, err := c.next(record{Method: "ReadTLS", ThreadID: threadID, Offset: offset})
+	if err != nil {
+		return 0, err
+	}
+	return r.Value, r.err()
+}
+
+func (c *replayClient) ContinueAndWait() (Event, error) {
+	return c.replayEvent(record{Method: "ContinueAndWait"})
+}
+
+func (c *replayClient) StepAndWait(threadID int) (Event, error) {
+	return c.replayEvent(record{Method: "StepAndWait", ThreadID: threadID})
+}
+
+func (c *replayClient) replayEvent(expected record) (Event, error) {
+	r, err := c.next(expected)
+	if err != nil {
+		return Event{}, err
+	}
+	if r.Event == nil {
+		return Event{}, r.err()
+	}
+	return r.Event.event(), r.err()
+}
+
+func (c *replayClient) SetWatchpoint(addr uint64, size int) error {
+	r, err := c.next(record{Method: "SetWatchpoint", Addr: addr, Size: size})
+	if err != nil {
+		return err
+	}
+	return r.err()
+}
+
+func (c *replayClient) ClearWatchpoint(addr uint64) error {
+	r, err := c.next(record{Method: "ClearWatchpoint", Addr: addr})
+	if err != nil {
+		return err
+	}
+	return r.err()
+}
+
+func (c *replayClient) HitWatchpoint(threadID int) (uint64, bool, error) {
+	r, err := c.next(record{Method: "HitWatchpoint", ThreadID: threadID})
+	if err != nil {
+		return 0, false, err
+	}
+	return r.Value, r.Hit, r.err()
+}
@@ -0,0 +1,124 @@
+package debugapi
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ks888/tgo/testutils"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	var log bytes.Buffer
+	recordingClient := NewRecordingClient(NewClient(), &log)
+	if err := recordingClient.LaunchProcess(testutils.ProgramInfloop); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+
+	_ = recordingClient.WriteMemory(testutils.InfloopAddrMain, []byte{0xcc})
+	recordedEvent, _ := recordingClient.ContinueAndWait()
+	threadID := recordedEvent.Data.([]int)[0]
+	recordedRegs, _ := recordingClient.ReadRegisters(threadID)
+	recordedMemory := make([]byte, 8)
+	_ = recordingClient.ReadMemory(recordedRegs.Rsp, recordedMemory)
+	_ = recordingClient.DetachProcess()
+
+	replayClient := NewReplayClient(&log)
+	if err := replayClient.LaunchProcess(testutils.ProgramInfloop); err != nil {
+		t.Fatalf("failed to replay launch process: %v", err)
+	}
+	_ = replayClient.WriteMemory(testutils.InfloopAddrMain, []byte{0xcc})
+	event, _ := replayClient.ContinueAndWait()
+	if !reflect.DeepEqual(event, recordedEvent) {
+		t.Errorf("wrong event: %#v", event)
+	}
+	regs, _ := replayClient.ReadRegisters(threadID)
+	if regs != recordedRegs {
+		t.Errorf("wrong registers: %#v", regs)
+	}
+	memory := make([]byte, 8)
+	_ = replayClient.ReadMemory(regs.Rsp, memory)
+	if !reflect.DeepEqual(memory, recordedMemory) {
+		t.Errorf("wrong memory: %v", memory)
+	}
+	if err := replayClient.DetachProcess(); err != nil {
+		t.Errorf("failed to replay detach process: %v", err)
+	}
+}
+
+func TestReplay_Mismatch(t *testing.T) {
+	log := bytes.NewBufferString(`{"Method":"ReadMemory","Addr":4096,"Size":1,"Data":"zA=="}` + "\n")
+	replayClient := NewReplayClient(log)
+
+	err := replayClient.ReadMemory(8192, make([]byte, 1))
+	if _, ok := err.(ReplayMismatchError); !ok {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestReplay_WrittenDataMismatch(t *testing.T) {
+	log := bytes.NewBufferString(`{"Method":"WriteMemory","Addr":4096,"Size":1,"Data":"zA=="}` + "\n")
+	replayClient := NewReplayClient(log)
+
+	err := replayClient.WriteMemory(4096, []byte{0x90})
+	if _, ok := err.(ReplayMismatchError); !ok || !strings.Contains(err.Error(), "writing cc") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestReplay_WrittenRegistersMismatch(t *testing.T) {
+	log := bytes.NewBufferString(`{"Method":"WriteRegisters","ThreadID":1,"Regs":{"Rip":4096}}` + "\n")
+	replayClient := NewReplayClient(log)
+
+	err := replayClient.WriteRegisters(1, Registers{Rip: 4097})
+	if _, ok := err.(ReplayMismatchError); !ok || !strings.Contains(err.Error(), "Rip: 0x1000") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestReplay_UnspecifiedThreadError(t *testing.T) {
+	log := bytes.NewBufferString(`{"Method":"StepAndWait","ThreadID":1,"Err":"unspecified threads: [2]","UnspecifiedThreadIDs":[2]}` + "\n")
+	replayClient := NewReplayClient(log)
+
+	_, err := replayClient.StepAndWait(1)
+	unspecifiedErr, ok := err.(UnspecifiedThreadError)
+	if !ok || !reflect.DeepEqual(unspecifiedErr.ThreadIDs, []int{2}) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestReplay_CloseLog(t *testing.T) {
+	log := &closeRecorder{}
+	log.WriteString(`{"Method":"AttachProcess"}` + "\n" + `{"Method":"DetachProcess"}` + "\n")
+	replayClient := NewReplayClient(log)
+
+	if err := replayClient.AttachProcess(1); err != nil {
+		t.Fatalf("failed to replay attach process: %v", err)
+	}
+	if log.closed {
+		t.Errorf("closed before detached")
+	}
+	if err := replayClient.DetachProcess(); err != nil {
+		t.Fatalf("failed to replay detach process: %v", err)
+	}
+	if !log.closed {
+		t.Errorf("not closed")
+	}
+
+	log = &closeRecorder{}
+	log.WriteString(`{"Method":"AttachProcess","Err":"no such process"}` + "\n")
+	if err := NewReplayClient(log).AttachProcess(1); err == nil || !log.closed {
+		t.Errorf("not closed after the failed attach: %v", err)
+	}
+}
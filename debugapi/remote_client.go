@@ -0,0 +1,723 @@
+package debugapi
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ks888/tgo/log"
+)
+
+// remoteClient is the debug api client which talks to the generic remote stub, such as gdbserver, using the gdb's remote serial protocol.
+// Unlike the client for lldb's debugserver, it doesn't depend on the lldb extensions.
+//
+// The stub is expected to run in the all-stop mode and, to launch or attach to the process, the extended mode (e.g. `gdbserver --multi`).
+type remoteClient struct {
+	packetConn
+	address              string
+	stubCmd              *exec.Cmd
+	pid                  int
+	killOnDetach         bool
+	registerMetadataList []registerMetadata
+	currentThreadID      int
+
+	watchpoints  map[uint64]int
+	watchHitAddr map[int]uint64
+
+	// interruptRequested is 1 if the Interrupt is called but the interrupted event is not returned yet. Accessed atomically.
+	interruptRequested int32
+}
+
+// newRemoteClient returns the new debug api client which talks to the remote stub at the specified address.
+// The address is either `host:port` or `|command [args]`. In the latter case, the command is launched and its stdin and stdout are used
+// for the communication (e.g. `|gdbserver --multi -`).
+func newRemoteClient(address string) *remoteClient {
+	return &remoteClient{
+		packetConn:   newPacketConn(nil),
+		address:      address,
+		watchpoints:  make(map[uint64]int),
+		watchHitAddr: make(map[int]uint64),
+	}
+}
+
+// LaunchProcess lets the remote stub launch the new process.
+func (c *remoteClient) LaunchProcess(name string, arg ...string) error {
+	if err := c.connect(); err != nil {
+		return err
+	}
+
+	command := "vRun;" + byteArrayToHex([]byte(name))
+	for _, a := range arg {
+		command += ";" + byteArrayToHex([]byte(a))
+	}
+	if err := c.send(command); err != nil {
+		return err
+	}
+
+	data, err := c.receive()
+	if err != nil {
+		return err
+	} else if data == "" {
+		return errors.New("vRun is not supported. Make sure the stub runs in the extended mode (e.g. gdbserver --multi)")
+	} else if !strings.HasPrefix(data, "T") && !strings.HasPrefix(data, "S") {
+		return fmt.Errorf("failed to launch the process: %s", data)
+	}
+
+	c.pid, err = c.qC()
+	if err != nil {
+		return err
+	}
+	c.killOnDetach = true
+	c.currentThreadID = c.pid
+	return nil
+}
+
+// AttachProcess lets the remote stub attach to the existing process.
+func (c *remoteClient) AttachProcess(pid int) error {
+	if err := c.connect(); err != nil {
+		return err
+	}
+
+	if err := c.send(fmt.Sprintf("vAttach;%x", pid)); err != nil {
+		return err
+	}
+
+	data, err := c.receive()
+	if err != nil {
+		return err
+	} else if data == "" {
+		return errors.New("vAttach is not supported. Make sure the stub runs in the extended mode (e.g. gdbserver --multi)")
+	} else if !strings.HasPrefix(data, "T") && !strings.HasPrefix(data, "S") {
+		return fmt.Errorf("failed to attach to the process: %s", data)
+	}
+
+	c.pid = pid
+	c.killOnDetach = false
+	c.currentThreadID = pid
+	return nil
+}
+
+func (c *remoteClient) connect() error {
+	var err error
+	if strings.HasPrefix(c.address, "|") {
+		c.conn, c.stubCmd, err = startStubWithPipe(strings.Fields(c.address[1:]))
+	} else {
+		c.conn, err = net.Dial("tcp", c.address)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to the remote stub (%s): %v", c.address, err)
+	}
+
+	return c.initialize()
+}
+
+func (c *remoteClient) initialize() error {
+	if err := c.setNoAckMode(); err != nil {
+		return err
+	}
+
+	if err := c.qSupported(); err != nil {
+		return err
+	}
+
+	var err error
+	c.registerMetadataList, err = c.collectRegisterMetadata()
+	return err
+}
+
+func (c *remoteClient) setNoAckMode() error {
+	if err := c.send("QStartNoAckMode"); err != nil {
+		return err
+	}
+
+	data, err := c.receive()
+	if err != nil {
+		return err
+	} else if data != "OK" {
+		// Some stubs don't support the no ack mode, which is fine.
+		log.Debugf("failed to set the no ack mode: %s", data)
+		return nil
+	}
+
+	c.noAckMode = true
+	return nil
+}
+
+func (c *remoteClient) qSupported() error {
+	var supportedFeatures = []string{"swbreak+", "hwbreak+", "xmlRegisters=i386"}
+	command := fmt.Sprintf("qSupported:%s", strings.Join(supportedFeatures, ";"))
+	if err := c.send(command); err != nil {
+		return err
+	}
+
+	data, err := c.receive()
+	if err != nil {
+		return err
+	} else if !strings.Contains(data, "qXfer:features:read+") {
+		return fmt.Errorf("the stub doesn't support the target description: %s", data)
+	}
+	return nil
+}
+
+func (c *remoteClient) qC() (int, error) {
+	if err := c.send("qC"); err != nil {
+		return 0, err
+	}
+
+	data, err := c.receive()
+	if err != nil {
+		return 0, err
+	} else if !strings.HasPrefix(data, "QC") {
+		return 0, fmt.Errorf("unexpected response: %s", data)
+	}
+	return parseThreadID(data[2:])
+}
+
+type targetFeature struct {
+	Includes  []targetInclude  `xml:"include"`
+	Features  []targetFeature  `xml:"feature"`
+	Registers []targetRegister `xml:"reg"`
+}
+
+type targetInclude struct {
+	Href string `xml:"href,attr"`
+}
+
+type targetRegister struct {
+	Name    string `xml:"name,attr"`
+	BitSize int    `xml:"bitsize,attr"`
+	RegNum  string `xml:"regnum,attr"`
+}
+
+// collectRegisterMetadata builds the register list using the target description.
+// The 'g' packet contains the registers in the order of the register number.
+func (c *remoteClient) collectRegisterMetadata() ([]registerMetadata, error) {
+	var rawRegs []targetRegister
+	if err := c.readTargetDescription("target.xml", &rawRegs); err != nil {
+		return nil, err
+	}
+
+	var regs []registerMetadata
+	nextID := 0
+	for _, rawReg := range rawRegs {
+		id := nextID
+		if rawReg.RegNum != "" {
+			num, err := strconv.Atoi(rawReg.RegNum)
+			if err != nil {
+				return nil, err
+			}
+			id = num
+		}
+		nextID = id + 1
+
+		regs = append(regs, registerMetadata{name: rawReg.Name, id: id, size: rawReg.BitSize / 8})
+	}
+	sort.Slice(regs, func(i, j int) bool { return regs[i].id < regs[j].id })
+
+	offset := 0
+	for i := range regs {
+		regs[i].offset = offset
+		offset += regs[i].size
+	}
+	return regs, nil
+}
+
+func (c *remoteClient) readTargetDescription(annex string, regs *[]targetRegister) error {
+	data, err := c.qXferFeaturesRead(annex)
+	if err != nil {
+		return err
+	}
+
+	var feature targetFeature
+	if err := xml.Unmarshal(data, &feature); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", annex, err)
+	}
+	return c.collectTargetRegisters(feature, regs)
+}
+
+func (c *remoteClient) collectTargetRegisters(feature targetFeature, regs *[]targetRegister) error {
+	for _, include := range feature.Includes {
+		if err := c.readTargetDescription(include.Href, regs); err != nil {
+			return err
+		}
+	}
+	for _, child := range feature.Features {
+		if err := c.collectTargetRegisters(child, regs); err != nil {
+			return err
+		}
+	}
+	*regs = append(*regs, feature.Registers...)
+	return nil
+}
+
+func (c *remoteClient) qXferFeaturesRead(annex string) ([]byte, error) {
+	var out []byte
+	for {
+		command := fmt.Sprintf("qXfer:features:read:%s:%x,%x", annex, len(out), maxPacketSize/2)
+		if err := c.send(command); err != nil {
+			return nil, err
+		}
+
+		data, err := c.receive()
+		if err != nil {
+			return nil, err
+		} else if data == "" || strings.HasPrefix(data, "E") {
+			return nil, fmt.Errorf("failed to read %s: %s", annex, data)
+		}
+
+		out = append(out, unescapeBinary(decodeRunLength(data[1:]))...)
+		if data[0] == 'l' {
+			return out, nil
+		}
+	}
+}
+
+// DetachProcess detaches from the process. The process is killed if it's launched by the stub.
+func (c *remoteClient) DetachProcess() error {
+	defer c.closeStub()
+
+	command := "D"
+	if c.killOnDetach {
+		command = fmt.Sprintf("vKill;%x", c.pid)
+	}
+	if err := c.send(command); err != nil {
+		return err
+	}
+	return c.receiveAndCheck()
+}
+
+func (c *remoteClient) closeStub() {
+	if c.conn != nil {
+		_ = c.close()
+	}
+	if c.stubCmd != nil {
+		_ = c.stubCmd.Wait()
+	}
+}
+
+// ReadMemory reads the specified memory region.
+func (c *remoteClient) ReadMemory(addr uint64, out []byte) error {
+	for len(out) > 0 {
+		size := len(out)
+		if size > maxPacketSize/2-8 {
+			size = maxPacketSize/2 - 8 // the hex encoding doubles the data size.
+		}
+
+		if err := c.send(fmt.Sprintf("m%x,%x", addr, size)); err != nil {
+			return err
+		}
+
+		data, err := c.receive()
+		if err != nil {
+			return err
+		} else if strings.HasPrefix(data, "E") {
+			return fmt.Errorf("error response: %s", data)
+		}
+
+		byteArray, err := hexToByteArray(decodeRunLength(data))
+		if err != nil {
+			return err
+		} else if len(byteArray) != size {
+			return fmt.Errorf("the number of data read is invalid: expect: %d, actual %d", size, len(byteArray))
+		}
+		copy(out, byteArray)
+
+		out = out[size:]
+		addr += uint64(size)
+	}
+	return nil
+}
+
+// WriteMemory writes the data to the specified memory region.
+func (c *remoteClient) WriteMemory(addr uint64, data []byte) error {
+	command := fmt.Sprintf("M%x,%x:%s", addr, len(data), byteArrayToHex(data))
+	if err := c.send(command); err != nil {
+		return err
+	}
+
+	return c.receiveAndCheck()
+}
+
+// ReadRegisters reads the target threadID's registers.
+func (c *remoteClient) ReadRegisters(threadID int) (Registers, error) {
+	data, err := c.readRegisters(threadID)
+	if err != nil {
+		return Registers{}, err
+	}
+
+	return parseRegisterData(data, c.registerMetadataList)
+}
+
+func (c *remoteClient) readRegisters(threadID int) (string, error) {
+	if err := c.selectThread(threadID); err != nil {
+		return "", err
+	}
+
+	if err := c.send("g"); err != nil {
+		return "", err
+	}
+
+	data, err := c.receive()
+	if err != nil {
+		return "", err
+	} else if strings.HasPrefix(data, "E") {
+		return "", fmt.Errorf("error response: %s", data)
+	}
+	return decodeRunLength(data), nil
+}
+
+// WriteRegisters updates the registers' value.
+func (c *remoteClient) WriteRegisters(threadID int, regs Registers) error {
+	data, err := c.readRegisters(threadID)
+	if err != nil {
+		return err
+	}
+
+	data = updateRegisterData(data, c.registerMetadataList, regs)
+	if err := c.send("G" + data); err != nil {
+		return err
+	}
+	return c.receiveAndCheck()
+}
+
+// selectThread sets the thread for the subsequent operations like reading registers.
+// The stub doesn't support the thread suffix (lldb extension) unlike debugserver.
+func (c *remoteClient) selectThread(threadID int) error {
+	if c.currentThreadID == threadID {
+		return nil
+	}
+
+	if err := c.send(fmt.Sprintf("Hg%x", threadID)); err != nil {
+		return err
+	}
+	if err := c.receiveAndCheck(); err != nil {
+		return err
+	}
+	c.currentThreadID = threadID
+	return nil
+}
+
+// ReadTLS reads the offset from the beginning of the TLS block. It requires the stub to offer the fs_base register.
+func (c *remoteClient) ReadTLS(threadID int, offset int32) (uint64, error) {
+	data, err := c.readRegisters(threadID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, metadata := range c.registerMetadataList {
+		if metadata.name != "fs_base" {
+			continue
+		}
+
+		fsBase, err := hexToUint64(data[metadata.offset*2:(metadata.offset+metadata.size)*2], true)
+		if err != nil {
+			return 0, err
+		}
+
+		buff := make([]byte, 8)
+		if err := c.ReadMemory(fsBase+uint64(offset), buff); err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint64(buff), nil
+	}
+	return 0, errors.New("the stub doesn't offer the fs_base register")
+}
+
+// Interrupt sends the interrupt request (`\x03`) to the stub, which stops the running process by SIGINT.
+// It's executed in the caller's go routine, while ContinueAndWait may be waiting the stop reply.
+// If the process is not running, the stub ignores the request and the next ContinueAndWait returns the interrupted event.
+func (c *remoteClient) Interrupt() error {
+	if c.conn == nil {
+		return errors.New("not connected")
+	}
+
+	atomic.StoreInt32(&c.interruptRequested, 1)
+	_, err := c.conn.Write([]byte{0x03})
+	return err
+}
+
+// ContinueAndWait resumes the process and waits until an event happens.
+func (c *remoteClient) ContinueAndWait() (Event, error) {
+	if atomic.CompareAndSwapInt32(&c.interruptRequested, 1, 0) {
+		return Event{Type: EventTypeInterrupted}, nil
+	}
+	return c.resumeAndWait("vCont;c", false)
+}
+
+// StepAndWait executes the one instruction of the specified thread and waits until an event happens.
+// If the unspecified thread is stopped, UnspecifiedThreadError is returned.
+func (c *remoteClient) StepAndWait(threadID int) (Event, error) {
+	event, err := c.resumeAndWait(fmt.Sprintf("vCont;s:%x", threadID), true)
+	if err != nil {
+		return Event{}, err
+	} else if event.Type != EventTypeTrapped {
+		return event, nil
+	} else if threadIDs := event.Data.([]int); len(threadIDs) != 1 || threadIDs[0] != threadID {
+		return Event{}, UnspecifiedThreadError{ThreadIDs: threadIDs}
+	}
+	return event, nil
+}
+
+func (c *remoteClient) resumeAndWait(resumeCommand string, step bool) (Event, error) {
+	command := resumeCommand
+	for {
+		if err := c.send(command); err != nil {
+			return Event{}, fmt.Errorf("send error: %v", err)
+		}
+
+		data, err := c.receiveStopReply()
+		if err != nil {
+			return Event{}, err
+		}
+
+		switch data[0] {
+		case 'T', 'S':
+			threadID, signalNumber, swBreak, err := c.handleTPacket(data)
+			if err != nil {
+				return Event{}, err
+			}
+			c.currentThreadID = threadID
+			if swBreak {
+				if err := c.advancePCPastBreakpoint(threadID); err != nil {
+					return Event{}, err
+				}
+			}
+
+			if syscall.Signal(signalNumber) == syscall.SIGTRAP {
+				return Event{Type: EventTypeTrapped, Data: []int{threadID}}, nil
+			} else if syscall.Signal(signalNumber) == syscall.SIGINT && atomic.LoadInt32(&c.interruptRequested) == 1 {
+				// the signal is not passed to the process.
+				if step {
+					// the step is not done yet. Do it again and then return the interrupted event in the next ContinueAndWait.
+					command = resumeCommand
+					continue
+				}
+				atomic.StoreInt32(&c.interruptRequested, 0)
+				return Event{Type: EventTypeInterrupted}, nil
+			}
+			// pass the signal to the thread and keep going.
+			command = fmt.Sprintf("vCont;C%02x:%x;c", signalNumber, threadID)
+		case 'W':
+			exitStatus, err := hexToUint64(strings.SplitN(data[1:], ";", 2)[0], false)
+			c.closeStub()
+			return Event{Type: EventTypeExited, Data: int(exitStatus)}, err
+		case 'X':
+			signalNumber, err := hexToUint64(strings.SplitN(data[1:], ";", 2)[0], false)
+			c.closeStub()
+			return Event{Type: EventTypeTerminated, Data: int(signalNumber)}, err
+		default:
+			return Event{}, fmt.Errorf("unknown packet type: %s", data)
+		}
+	}
+}
+
+// receiveStopReply receives the stop reply packet. The console output packets are written to stderr, because
+// stdout may be used for the trace logs.
+func (c *remoteClient) receiveStopReply() (string, error) {
+	for {
+		data, err := c.receive()
+		if err != nil {
+			return "", fmt.Errorf("receive error: %v", err)
+		}
+
+		if len(data) == 0 {
+			continue
+		} else if data[0] != 'O' || data == "OK" {
+			return data, nil
+		}
+
+		out, err := hexToByteArray(data[1:])
+		if err != nil {
+			return "", err
+		}
+		os.Stderr.Write(out)
+	}
+}
+
+// handleTPacket parses the stop reply. swBreak is true if the thread is stopped by the software breakpoint.
+func (c *remoteClient) handleTPacket(packet string) (threadID, signalNumber int, swBreak bool, err error) {
+	rawSignalNumber, err := hexToUint64(packet[1:3], false)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	threadID = c.currentThreadID
+
+	var watchHitAddr uint64
+	for _, kvInStr := range strings.Split(packet[3:], ";") {
+		kvArr := strings.SplitN(kvInStr, ":", 2)
+		if len(kvArr) != 2 {
+			continue
+		}
+
+		key, value := kvArr[0], kvArr[1]
+		switch key {
+		case "thread":
+			threadID, err = parseThreadID(value)
+			if err != nil {
+				return 0, 0, false, err
+			}
+		case "watch", "awatch":
+			watchHitAddr, err = hexToUint64(value, false)
+			if err != nil {
+				return 0, 0, false, err
+			}
+		case "swbreak":
+			swBreak = true
+		}
+	}
+
+	if watchHitAddr != 0 {
+		c.watchHitAddr[threadID] = watchHitAddr
+	}
+	return threadID, int(rawSignalNumber), swBreak, nil
+}
+
+// advancePCPastBreakpoint sets the pc of the thread to the address next to the breakpoint instruction.
+// The stub reports the pc at the breakpoint address if the swbreak feature is enabled, while the callers
+// expect the pc after the trap like ptrace.
+func (c *remoteClient) advancePCPastBreakpoint(threadID int) error {
+	data, err := c.readRegisters(threadID)
+	if err != nil {
+		return err
+	}
+
+	regs, err := parseRegisterData(data, c.registerMetadataList)
+	if err != nil {
+		return err
+	}
+	regs.Rip++
+
+	data = updateRegisterData(data, c.registerMetadataList, regs)
+	if err := c.send("G" + data); err != nil {
+		return err
+	}
+	return c.receiveAndCheck()
+}
+
+// SetWatchpoint sets the hardware watchpoint which traps the write access to the memory region [addr, addr+size).
+func (c *remoteClient) SetWatchpoint(addr uint64, size int) error {
+	if _, ok := c.watchpoints[addr]; ok {
+		return nil
+	}
+
+	if err := c.send(fmt.Sprintf("Z2,%x,%x", addr, size)); err != nil {
+		return err
+	}
+	if err := c.receiveAndCheck(); err != nil {
+		return err
+	}
+	c.watchpoints[addr] = size
+	return nil
+}
+
+// ClearWatchpoint clears the hardware watchpoint at the specified address.
+func (c *remoteClient) ClearWatchpoint(addr uint64) error {
+	size, ok := c.watchpoints[addr]
+	if !ok {
+		return nil
+	}
+
+	if err := c.send(fmt.Sprintf("z2,%x,%x", addr, size)); err != nil {
+		return err
+	}
+	if err := c.receiveAndCheck(); err != nil {
+		return err
+	}
+	delete(c.watchpoints, addr)
+	return nil
+}
+
+// HitWatchpoint returns the address of the watchpoint if the specified thread is trapped by the watchpoint.
+func (c *remoteClient) HitWatchpoint(threadID int) (uint64, bool, error) {
+	hitAddr, ok := c.watchHitAddr[threadID]
+	if !ok {
+		return 0, false, nil
+	}
+	delete(c.watchHitAddr, threadID)
+
+	for addr, size := range c.watchpoints {
+		if addr <= hitAddr && hitAddr < addr+uint64(size) {
+			return addr, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// parseThreadID parses the thread id, which may be in the form of `p<pid>.<tid>`.
+func parseThreadID(rawThreadID string) (int, error) {
+	if strings.HasPrefix(rawThreadID, "p") {
+		rawThreadID = rawThreadID[strings.Index(rawThreadID, ".")+1:]
+	}
+	threadID, err := hexToUint64(rawThreadID, false)
+	return int(threadID), err
+}
+
+// startStubWithPipe starts the stub and returns the connection using its stdin and stdout.
+func startStubWithPipe(args []string) (net.Conn, *exec.Cmd, error) {
+	if len(args) == 0 {
+		return nil, nil, errors.New("no command specified")
+	}
+
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = stdinReader
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	// the child has its own copies.
+	stdinReader.Close()
+	stdoutWriter.Close()
+
+	return &pipeConn{reader: stdoutReader, writer: stdinWriter}, cmd, nil
+}
+
+// pipeConn is the net.Conn implementation which uses the pipes.
+type pipeConn struct {
+	reader, writer *os.File
+}
+
+func (c *pipeConn) Read(b []byte) (int, error)  { return c.reader.Read(b) }
+func (c *pipeConn) Write(b []byte) (int, error) { return c.writer.Write(b) }
+
+func (c *pipeConn) Close() error {
+	c.writer.Close()
+	return c.reader.Close()
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return pipeAddr{} }
+func (c *pipeConn) RemoteAddr() net.Addr { return pipeAddr{} }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	if err := c.reader.SetDeadline(t); err != nil {
+		return err
+	}
+	return c.writer.SetDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return c.reader.SetReadDeadline(t) }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return c.writer.SetWriteDeadline(t) }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,223 @@
+package debugapi
+
+import (
+	"net"
+	"testing"
+)
+
+// stubExchange is the command the fake stub expects and its replies.
+type stubExchange struct {
+	command string
+	replies []string
+}
+
+// runFakeStub starts the fake stub which serves the exchanges in order. The returned channel is closed when done.
+func runFakeStub(t *testing.T, conn net.Conn, noAckMode bool, exchanges []stubExchange) chan bool {
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+
+		stub := newTestPacketConn(conn, noAckMode)
+		for _, exchange := range exchanges {
+			data, err := stub.receive()
+			if err != nil {
+				t.Errorf("failed to receive: %v", err)
+				return
+			} else if data != exchange.command {
+				t.Errorf("unexpected command: expect: %s, actual: %s", exchange.command, data)
+				return
+			}
+
+			for _, reply := range exchange.replies {
+				if err := stub.send(reply); err != nil {
+					t.Errorf("failed to send: %v", err)
+					return
+				}
+			}
+			if data == "QStartNoAckMode" {
+				stub.noAckMode = true
+			}
+		}
+	}()
+	return done
+}
+
+func newTestRemoteClient(conn net.Conn, noAckMode bool) *remoteClient {
+	client := newRemoteClient("")
+	client.conn = conn
+	client.noAckMode = noAckMode
+	client.registerMetadataList = []registerMetadata{
+		{name: "rax", id: 0, offset: 0, size: 8},
+		{name: "rip", id: 16, offset: 8, size: 8},
+		{name: "eflags", id: 17, offset: 16, size: 4},
+	}
+	return client
+}
+
+func TestRemoteClient_Initialize(t *testing.T) {
+	clientConn, stubConn := net.Pipe()
+	defer clientConn.Close()
+	done := runFakeStub(t, stubConn, false, []stubExchange{
+		{command: "QStartNoAckMode", replies: []string{"OK"}},
+		{command: "qSupported:swbreak+;hwbreak+;xmlRegisters=i386", replies: []string{"PacketSize=1000;qXfer:features:read+"}},
+		{command: "qXfer:features:read:target.xml:0,800", replies: []string{`l<target><include href="64bit-core.xml"/></target>`}},
+		{command: "qXfer:features:read:64bit-core.xml:0,800", replies: []string{
+			`m<feature><reg name="rax" bitsize="64"/><reg name="eflags" bitsize="32" regnum="17"/>`,
+		}},
+		{command: "qXfer:features:read:64bit-core.xml:54,800", replies: []string{`l<reg name="rip" bitsize="64" regnum="16"/></feature>`}},
+	})
+
+	client := newRemoteClient("")
+	client.conn = clientConn
+	if err := client.initialize(); err != nil {
+		t.Fatalf("failed to initialize: %v", err)
+	}
+	<-done
+
+	if !client.noAckMode {
+		t.Errorf("not in the no ack mode")
+	}
+	expected := []registerMetadata{
+		{name: "rax", id: 0, offset: 0, size: 8},
+		{name: "rip", id: 16, offset: 8, size: 8},
+		{name: "eflags", id: 17, offset: 16, size: 4},
+	}
+	if len(client.registerMetadataList) != len(expected) {
+		t.Fatalf("unexpected register list: %v", client.registerMetadataList)
+	}
+	for i, metadata := range client.registerMetadataList {
+		if metadata != expected[i] {
+			t.Errorf("[%d] unexpected register: %v", i, metadata)
+		}
+	}
+}
+
+func TestRemoteClient_ReadAndWriteRegisters(t *testing.T) {
+	clientConn, stubConn := net.Pipe()
+	defer clientConn.Close()
+	data := "0100000000000000" + "0200000000000000" + "46020000"
+	done := runFakeStub(t, stubConn, true, []stubExchange{
+		{command: "Hg12", replies: []string{"OK"}},
+		{command: "g", replies: []string{data}},
+		{command: "g", replies: []string{data}},
+		{command: "G" + "0100000000000000" + "1000000000000000" + "46020000", replies: []string{"OK"}},
+	})
+
+	client := newTestRemoteClient(clientConn, true)
+	regs, err := client.ReadRegisters(0x12)
+	if err != nil {
+		t.Fatalf("failed to read registers: %v", err)
+	}
+	if regs.Rax != 1 || regs.Rip != 2 || regs.Rflags != 0x246 {
+		t.Errorf("unexpected registers: %#v", regs)
+	}
+
+	regs.Rip = 0x10
+	if err := client.WriteRegisters(0x12, regs); err != nil {
+		t.Fatalf("failed to write registers: %v", err)
+	}
+	<-done
+}
+
+func TestRemoteClient_Watchpoint(t *testing.T) {
+	clientConn, stubConn := net.Pipe()
+	defer clientConn.Close()
+	done := runFakeStub(t, stubConn, true, []stubExchange{
+		{command: "Z2,1000,8", replies: []string{"OK"}},
+		// SIGCHLD is passed to the thread.
+		{command: "vCont;c", replies: []string{"T11thread:p10.12;"}},
+		{command: "vCont;C11:12;c", replies: []string{"O" + byteArrayToHex([]byte("hello\n")), "T05thread:p10.13;watch:1004;"}},
+		{command: "z2,1000,8", replies: []string{"OK"}},
+	})
+
+	client := newTestRemoteClient(clientConn, true)
+	if err := client.SetWatchpoint(0x1000, 8); err != nil {
+		t.Fatalf("failed to set watchpoint: %v", err)
+	}
+
+	event, err := client.ContinueAndWait()
+	if err != nil {
+		t.Fatalf("failed to continue: %v", err)
+	}
+	if event.Type != EventTypeTrapped || event.Data.([]int)[0] != 0x13 {
+		t.Errorf("unexpected event: %v", event)
+	}
+
+	if addr, ok, err := client.HitWatchpoint(0x13); err != nil || !ok || addr != 0x1000 {
+		t.Errorf("unexpected hit: %#x, %v, %v", addr, ok, err)
+	}
+	if _, ok, _ := client.HitWatchpoint(0x13); ok {
+		t.Errorf("hit twice")
+	}
+
+	if err := client.ClearWatchpoint(0x1000); err != nil {
+		t.Fatalf("failed to clear watchpoint: %v", err)
+	}
+	<-done
+}
+
+func TestRemoteClient_SoftwareBreakpoint(t *testing.T) {
+	clientConn, stubConn := net.Pipe()
+	defer clientConn.Close()
+	data := "0100000000000000" + "0010000000000000" + "46020000"
+	done := runFakeStub(t, stubConn, true, []stubExchange{
+		// the stub reports the pc at the breakpoint address.
+		{command: "vCont;c", replies: []string{"T05thread:p10.13;swbreak:;"}},
+		{command: "g", replies: []string{data}},
+		{command: "G" + "0100000000000000" + "0110000000000000" + "46020000", replies: []string{"OK"}},
+	})
+
+	client := newTestRemoteClient(clientConn, true)
+	event, err := client.ContinueAndWait()
+	if err != nil {
+		t.Fatalf("failed to continue: %v", err)
+	}
+	if event.Type != EventTypeTrapped || event.Data.([]int)[0] != 0x13 {
+		t.Errorf("unexpected event: %v", event)
+	}
+	<-done
+}
+
+func TestRemoteClient_Interrupt(t *testing.T) {
+	clientConn, stubConn := net.Pipe()
+	defer clientConn.Close()
+
+	resumed := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+
+		stub := newTestPacketConn(stubConn, true)
+		if data, err := stub.receive(); err != nil || data != "vCont;c" {
+			t.Errorf("unexpected command: %s, %v", data, err)
+			return
+		}
+		close(resumed)
+
+		buff := make([]byte, 1)
+		if _, err := stubConn.Read(buff); err != nil || buff[0] != 0x03 {
+			t.Errorf("unexpected interrupt request: %v, %v", buff, err)
+			return
+		}
+		if err := stub.send("T02thread:p10.12;"); err != nil {
+			t.Errorf("failed to send: %v", err)
+		}
+	}()
+
+	client := newTestRemoteClient(clientConn, true)
+	go func() {
+		<-resumed
+		if err := client.Interrupt(); err != nil {
+			t.Errorf("failed to interrupt: %v", err)
+		}
+	}()
+
+	event, err := client.ContinueAndWait()
+	if err != nil {
+		t.Fatalf("failed to continue: %v", err)
+	}
+	if event.Type != EventTypeInterrupted {
+		t.Errorf("unexpected event: %v", event)
+	}
+	<-done
+}
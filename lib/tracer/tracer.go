@@ -3,48 +3,326 @@
 package tracer
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"net"
+	"io/ioutil"
 	"net/rpc"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 	"unsafe" // For go:linkname
 
+	"github.com/ks888/tgo/log"
 	"github.com/ks888/tgo/service"
 )
 
-const expectedVersion = 1
+const expectedVersion = 19
+
+// flushTimeout is the max time to wait until the tracing log or events written so far are delivered.
+const flushTimeout = 10 * time.Second
 
 var (
-	client            *rpc.Client
-	serverCmd         *exec.Cmd
-	tracerProgramName           = "tgo"
-	traceLevel                  = 1
-	parseLevel                  = 1
-	verbose                     = false
-	writer            io.Writer = os.Stdout
-	errorWriter       io.Writer = os.Stderr
-	// Protects the server command and its rpc client
+	client                 *rpc.Client
+	serverCmd              *exec.Cmd
+	tracerProgramName                = "tgo"
+	traceLevel                       = 1
+	parseLevel                       = 1
+	verbose                          = false
+	outputFormat                     = OutputFormatText
+	printLocation                    = false
+	sampleRate                       = 0
+	maxCallsPerSecond                = 0
+	eventBudget                      = 0
+	foldRepeatedCalls                = false
+	collapseRecursionDepth           = 0
+	flightRecorderSize               = 0
+	flightRecorderSignal             = syscall.Signal(0)
+	printCallStack                   = false
+	callStackParseLevel              = 0
+	printReceiver                    = false
+	writer                 io.Writer = os.Stdout
+	errorWriter            io.Writer = os.Stderr
+	includeFuncs           []string
+	excludeFuncs           []string
+	localVariables         []string
+	interfaces             []string
+	// serverPath is the path of the server program set by SetServerPath.
+	serverPath string
+	// embeddedServer is true if this program itself runs as the server. See SetEmbeddedServer.
+	embeddedServer bool
+	// envOptionsLoaded is true once the options are read from the environment variables.
+	envOptionsLoaded bool
+	// endFuncs is the list of the end points added by StopAt.
+	endFuncs []string
+	// serverDir is the private directory which contains the server's unix domain socket.
+	serverDir string
+	// serverSecret is the shared secret sent to the server via the environment variable and then sent back in Attach.
+	serverSecret string
+	// eventsDone is not nil while the go routine receiving the events from the server is running.
+	// It's closed when the go routine exits.
+	eventsDone chan struct{}
+	// activeRegions is the number of the regions started by the start functions and not stopped yet.
+	activeRegions int
+	// Protects the server command, its rpc client and the variables above
 	serverMtx sync.Mutex
+	output    = &outputDemux{writers: make(map[string]*taggedWriter), flushed: make(chan struct{}, 1)}
+
+	eventHandler func(Event)
+	eventMtx     sync.Mutex // protects eventHandler
 )
 
 //go:linkname firstModuleData runtime.firstmoduledata
 var firstModuleData interface{}
 
+// ServerPathEnvName is the name of the environment variable which specifies the path of the server program.
+// SetServerPath takes precedence over it.
+const ServerPathEnvName = "TGO_SERVER"
+
+// The environment variables which set the options. They are read when tracing starts first time and override
+// the options set before then, so the options can be changed without recompiling. The invalid values are reported
+// to the error writer and ignored.
+const (
+	// TraceLevelEnvName is the name of the environment variable which sets the trace level. See SetTraceLevel.
+	TraceLevelEnvName = "TGO_TRACE_LEVEL"
+	// ParseLevelEnvName is the name of the environment variable which sets the parse level. See SetParseLevel.
+	ParseLevelEnvName = "TGO_PARSE_LEVEL"
+	// VerboseEnvName is the name of the environment variable which sets the verbose option, such as 'true' and '1'.
+	// See SetVerboseOption.
+	VerboseEnvName = "TGO_VERBOSE"
+	// OutputEnvName is the name of the environment variable which specifies the file to which the tracing log is
+	// written. The file is created or truncated. See SetWriter.
+	OutputEnvName = "TGO_OUTPUT"
+	// OutputFormatEnvName is the name of the environment variable which sets the output format. See SetOutputFormat.
+	OutputFormatEnvName = "TGO_OUTPUT_FORMAT"
+	// IncludeFuncsEnvName is the name of the environment variable which sets the comma-separated regular expressions
+	// of the functions to include. See SetIncludeFuncs.
+	IncludeFuncsEnvName = "TGO_INCLUDE_FUNCS"
+	// ExcludeFuncsEnvName is the name of the environment variable which sets the comma-separated regular expressions
+	// of the functions to exclude. See SetExcludeFuncs.
+	ExcludeFuncsEnvName = "TGO_EXCLUDE_FUNCS"
+	// PrintLocationEnvName is the name of the environment variable which sets the print location option.
+	// See SetPrintLocation.
+	PrintLocationEnvName = "TGO_PRINT_LOCATION"
+)
+
+// embeddedServerEnvName is the name of the environment variable set when this program is launched as the embedded server.
+const embeddedServerEnvName = "TGO_EMBEDDED_SERVER"
+
+func init() {
+	if os.Getenv(embeddedServerEnvName) == "" {
+		return
+	}
+
+	if err := serveEmbedded(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// serveEmbedded serves the tracer service instead of running the main function. The args are same as the server
+// command, but only the verbose option is supported.
+func serveEmbedded(args []string) error {
+	commandLine := flag.NewFlagSet("", flag.ContinueOnError)
+	verbose := commandLine.Bool("verbose", false, "Show the debug-level message")
+	if err := commandLine.Parse(args); err != nil {
+		return err
+	}
+	if commandLine.NArg() < 1 {
+		return errors.New("the address is not specified")
+	}
+
+	log.EnableDebugLog = *verbose
+	service.Secret = os.Getenv(service.SecretEnvName)
+	os.Unsetenv(service.SecretEnvName)
+	os.Unsetenv(embeddedServerEnvName)
+	return service.Serve(commandLine.Arg(0))
+}
+
+// The output formats of the tracing log.
+const (
+	OutputFormatText = "text"
+	OutputFormatJSON = "json"
+	// OutputFormatStats doesn't write each call, but aggregates the calls per function: the number of the calls,
+	// the durations, the number of the distinct callers and the panics. See PrintStats and WriteProfile.
+	OutputFormatStats = "stats"
+)
+
 // SetTraceLevel sets the trace level. Functions are traced if the stack depth is within this trace level. The stack depth here is based on the point tracing is enabled. The default is 1.
+// It takes effect even while tracing, from the next function call.
 func SetTraceLevel(option int) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
 	traceLevel = option
+	updateServer("Tracer.SetTraceLevel", option)
 }
 
 // SetParseLevel sets the parse level. The trace log includes the function's args. The parselevel option determines how detailed these values should be. The default is 1.
+// It takes effect even while tracing.
 func SetParseLevel(option int) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
 	parseLevel = option
+	updateServer("Tracer.SetParseLevel", option)
+}
+
+// SetIncludeFuncs limits the functions printed to the ones whose name matches one of the regular expressions.
+// The functions not printed are still counted in the trace level. It takes effect even while tracing.
+func SetIncludeFuncs(exprs ...string) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	includeFuncs = exprs
+	updateServer("Tracer.SetFuncFilters", service.FuncFiltersArgs{IncludeFuncs: includeFuncs, ExcludeFuncs: excludeFuncs})
+}
+
+// SetExcludeFuncs excludes the functions whose name matches one of the regular expressions from the tracing log.
+// It takes effect even while tracing.
+func SetExcludeFuncs(exprs ...string) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	excludeFuncs = exprs
+	updateServer("Tracer.SetFuncFilters", service.FuncFiltersArgs{IncludeFuncs: includeFuncs, ExcludeFuncs: excludeFuncs})
+}
+
+// SetOutputFormat sets the format of the tracing log, OutputFormatText, OutputFormatJSON or OutputFormatStats.
+// The default is OutputFormatText.
+// It takes effect even while tracing.
+func SetOutputFormat(option string) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	outputFormat = option
+	updateServer("Tracer.SetOutputFormat", option)
+}
+
+// SetPrintLocation sets the print location option. If true, the source locations of the function and its call site
+// are printed in the text format, such as 'at /path/to/main.go:10, called from /path/to/main.go:20'. They are always
+// included in the JSON format and the events. The default is false. It takes effect even while tracing.
+func SetPrintLocation(option bool) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	printLocation = option
+	updateServer("Tracer.SetPrintLocation", option)
+}
+
+// SetSampling sets the sampling options to reduce the overhead of tracing the frequently called functions.
+// If rate is larger than 1, only 1 in rate calls of each function is traced. If maxCalls is positive,
+// at most maxCalls calls of each function are traced per second. The functions called by the dropped call are
+// not traced either. The number of the dropped events is written when the tracer detaches. The default is no sampling.
+// It takes effect even while tracing.
+func SetSampling(rate, maxCalls int) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	sampleRate, maxCallsPerSecond = rate, maxCalls
+	updateServer("Tracer.SetSampling", service.SamplingArgs{SampleRate: sampleRate, MaxCallsPerSecond: maxCallsPerSecond})
+}
+
+// SetFolding sets the folding options of the text format to make the log of the recursive and looped calls compact.
+// If fold is true, the consecutive identical calls, which have the same function, args and results, are folded into
+// one line like 'main.fib(n = 1) (~r1 = 1) ×34'. If collapseDepth is positive, the recursive call beyond this recursion
+// depth is collapsed into one line with the number of the calls and the duration. The call is written after it returns.
+// The default is no folding. It takes effect even while tracing.
+func SetFolding(fold bool, collapseDepth int) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	foldRepeatedCalls, collapseRecursionDepth = fold, collapseDepth
+	updateServer("Tracer.SetFolding", service.FoldingArgs{FoldRepeatedCalls: fold, CollapseRecursionDepth: collapseDepth})
+}
+
+// SetCallStack sets the call stack options. If printStack is true, the call stack of the go routine is printed when it
+// starts tracing, so that it's clear how the go routine got there. The args of each function are printed if
+// parseLevel is positive. The default is false. It takes effect even while tracing.
+func SetCallStack(printStack bool, parseLevel int) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	printCallStack, callStackParseLevel = printStack, parseLevel
+	updateServer("Tracer.SetCallStack", service.CallStackArgs{PrintCallStack: printStack, CallStackParseLevel: parseLevel})
+}
+
+// SetLocalVariables sets the names of the local variables printed when the function returns. "*" selects all
+// the local variables. The default is none. The program must be built with the DWARF info. It takes effect even while tracing.
+func SetLocalVariables(names ...string) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	localVariables = names
+	updateServer("Tracer.SetLocalVariables", names)
+}
+
+// SetPrintReceiver sets the print receiver option. If true, the receiver of the method is printed separately from
+// the args, like '(*bytes.Buffer) Write(p = []{104}) (...) receiver: b = &{...}'. The default is false.
+// It takes effect even while tracing.
+func SetPrintReceiver(option bool) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	printReceiver = option
+	updateServer("Tracer.SetPrintReceiver", option)
+}
+
+// SetInterfaces sets the interfaces whose implementations are traced. If not empty, only the functions which implement
+// the method of one of the interfaces are printed. The interface is specified like "io.Writer", which selects all its
+// methods, or "io.Writer.Write". The implementations are found by scanning the itabs the linker generated, so the ones
+// used only through the itabs created at run time are not found. It takes effect even while tracing.
+func SetInterfaces(names ...string) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	interfaces = names
+	updateServer("Tracer.SetInterfaces", names)
+}
+
+// SetEventBudget sets the max number of the calls traced. Once the budget is exhausted, the later calls are dropped.
+// 0 means unlimited, which is the default. It takes effect when the tracer starts next time.
+func SetEventBudget(budget int) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	eventBudget = budget
+}
+
+// SetFlightRecorder enables the flight recorder mode if size is positive. In this mode, the tracing log is not written,
+// but the last `size` lines of each go routine are kept in memory. They are written when this process panics, exits
+// abnormally, receives dumpSignal (0 means none) or DumpFlightRecorder is called. The signal is detected only if
+// this process calls signal.Notify for the signal or is terminated by it. It's useful to trace the flaky tests
+// and see only the trace leading up to the failure. It takes effect when the tracer starts next time.
+func SetFlightRecorder(size int, dumpSignal syscall.Signal) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	flightRecorderSize, flightRecorderSignal = size, dumpSignal
+}
+
+// updateServer sends the updated option to the server if it's running. The server mutex must be held.
+func updateServer(serviceMethod string, args interface{}) {
+	if serverCmd == nil {
+		return // sent when initialized
+	}
+
+	reply := &struct{}{}
+	if err := client.Call(serviceMethod, args, reply); err != nil {
+		fmt.Fprintf(errorWriter, "failed to update the option (%s): %v\n", serviceMethod, err)
+	}
 }
 
 // SetVerboseOption sets the verbose option. It true, the debug-level messages are written as well as the normal tracing log. The default is false.
@@ -54,6 +332,11 @@ func SetVerboseOption(option bool) {
 
 // SetWriter sets the writer for the tracing log. The default is os.Stdout.
 func SetWriter(option io.Writer) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+	output.mtx.Lock()
+	defer output.mtx.Unlock()
+
 	writer = option
 }
 
@@ -62,17 +345,432 @@ func SetErrorWriter(option io.Writer) {
 	errorWriter = option
 }
 
+// SetServerPath sets the path of the server program, that is, the tgo binary. If empty, the path specified by the
+// TGO_SERVER environment variable is used, and then the tgo binary is searched in the PATH.
+// It takes effect when the server starts next time.
+func SetServerPath(path string) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	serverPath = path
+}
+
+// SetEmbeddedServer sets the embedded server option. If true, this program is launched again as the server instead of
+// the tgo binary, so the tgo binary is not necessary. In the launched program, the server starts when this package
+// is initialized and the main function is never called. Note that the init functions of the packages this package
+// doesn't depend on may be called before that. It takes effect when the server starts next time. The default is false.
+func SetEmbeddedServer(option bool) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	embeddedServer = option
+}
+
+// loadEnvOptions sets the options specified by the environment variables. It does nothing after the first call.
+// The server mutex must be held.
+func loadEnvOptions() {
+	if envOptionsLoaded {
+		return
+	}
+	envOptionsLoaded = true
+
+	loadIntEnvOption(TraceLevelEnvName, &traceLevel)
+	loadIntEnvOption(ParseLevelEnvName, &parseLevel)
+	loadBoolEnvOption(VerboseEnvName, &verbose)
+	loadBoolEnvOption(PrintLocationEnvName, &printLocation)
+	if value := os.Getenv(OutputFormatEnvName); value != "" {
+		if value != OutputFormatText && value != OutputFormatJSON && value != OutputFormatStats {
+			fmt.Fprintf(errorWriter, "invalid %s: unknown output format: %s\n", OutputFormatEnvName, value)
+		} else {
+			outputFormat = value
+		}
+	}
+	if value := os.Getenv(IncludeFuncsEnvName); value != "" {
+		includeFuncs = strings.Split(value, ",")
+	}
+	if value := os.Getenv(ExcludeFuncsEnvName); value != "" {
+		excludeFuncs = strings.Split(value, ",")
+	}
+	if path := os.Getenv(OutputEnvName); path != "" {
+		// the file is not closed because the log may be written until the program exits.
+		if f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			fmt.Fprintf(errorWriter, "invalid %s: %v\n", OutputEnvName, err)
+		} else {
+			output.mtx.Lock()
+			writer = f
+			output.mtx.Unlock()
+		}
+	}
+}
+
+func loadIntEnvOption(name string, option *int) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+
+	if v, err := strconv.Atoi(value); err != nil {
+		fmt.Fprintf(errorWriter, "invalid %s: %v\n", name, err)
+	} else {
+		*option = v
+	}
+}
+
+func loadBoolEnvOption(name string, option *bool) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+
+	if v, err := strconv.ParseBool(value); err != nil {
+		fmt.Fprintf(errorWriter, "invalid %s: %v\n", name, err)
+	} else {
+		*option = v
+	}
+}
+
+// Event is the function call or return of the traced go routine. See OnEvent.
+type Event struct {
+	// Type is EventTypeCall, EventTypeReturn, EventTypePanic, EventTypeRecover or EventTypeStack.
+	Type        string
+	GoRoutineID int64
+	// Depth is the stack depth based on the point tracing is enabled.
+	Depth                 int
+	Function              string
+	InputArgs, OutputArgs []string
+	// File and Line are the source location of the function. Empty if unknown.
+	File string
+	Line int
+	// CallerFile and CallerLine are the source location of the call site. Empty if unknown.
+	CallerFile string
+	CallerLine int
+	// UnwoundBy is "panic" or "runtime.Goexit" if the function is unwound without returning. The args are unknown in that case.
+	UnwoundBy string
+	// PanicValue is the value passed to panic(). Set only in the panic and recover events.
+	PanicValue string
+	// LocalVariables are the local variables selected by SetLocalVariables. Set only in the return event.
+	LocalVariables []string
+	// ReceiverType and Receiver are the type and value of the method's receiver, which are excluded from InputArgs.
+	// Set only if SetPrintReceiver is true.
+	ReceiverType, Receiver string
+}
+
+// The types of the event.
+const (
+	EventTypeCall   = "call"
+	EventTypeReturn = "return"
+	// EventTypePanic is the event the go routine starts unwinding the functions due to panic.
+	EventTypePanic = "panic"
+	// EventTypeRecover is the event the panic is recovered.
+	EventTypeRecover = "recover"
+	// EventTypeStack is the function in the call stack of the go routine which starts tracing.
+	// The events are sent from the outermost function.
+	EventTypeStack = "stack"
+)
+
+// OnEvent sets the handler called with each function call or return traced, in addition to the tracing log.
+// The events are sent from the server asynchronously and the handler is called in the dedicated go routine,
+// so the events right before the program exits may be lost. The nil handler stops calling the handler.
+func OnEvent(handler func(Event)) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+	eventMtx.Lock()
+	eventHandler = handler
+	eventMtx.Unlock()
+
+	if handler != nil && serverCmd != nil && eventsDone == nil {
+		startReceivingEvents()
+	}
+}
+
+// startReceivingEvents starts the go routine receiving the events. The server mutex must be held.
+func startReceivingEvents() {
+	eventsDone = make(chan struct{})
+	go receiveEvents(client, eventsDone)
+}
+
+func receiveEvents(client *rpc.Client, done chan struct{}) {
+	defer close(done)
+
+	for {
+		reply := &service.NextEventsReply{}
+		if err := client.Call("Tracer.NextEvents", struct{}{}, reply); err != nil {
+			if err != rpc.ErrShutdown {
+				fmt.Fprintf(errorWriter, "failed to receive the events: %v\n", err)
+			}
+			return
+		}
+		if reply.Dropped > 0 {
+			fmt.Fprintf(errorWriter, "%d events are dropped\n", reply.Dropped)
+		}
+
+		eventMtx.Lock()
+		handler := eventHandler
+		eventMtx.Unlock()
+		if handler != nil {
+			for _, event := range reply.Events {
+				handler(Event{
+					Type:           event.Type,
+					GoRoutineID:    event.GoRoutineID,
+					Depth:          event.Depth,
+					Function:       event.Function,
+					InputArgs:      event.InputArgs,
+					OutputArgs:     event.OutputArgs,
+					File:           event.File,
+					Line:           event.Line,
+					CallerFile:     event.CallerFile,
+					CallerLine:     event.CallerLine,
+					UnwoundBy:      event.UnwoundBy,
+					PanicValue:     event.PanicValue,
+					LocalVariables: event.LocalVariables,
+					ReceiverType:   event.ReceiverType,
+					Receiver:       event.Receiver,
+				})
+			}
+		}
+
+		if reply.Done {
+			return
+		}
+	}
+}
+
+// Option is the per-region option passed to StartWithOptions or Trace.
+// If not specified, the value set by the corresponding package-level setter at the time the region starts is used.
+type Option func(*options)
+
+type options struct {
+	traceLevel, parseLevel     int
+	includeFuncs, excludeFuncs []string
+	outputFormat               string
+	printLocation              bool
+	sampleRate                 int
+	maxCallsPerSecond          int
+	foldRepeatedCalls          bool
+	collapseRecursionDepth     int
+	printCallStack             bool
+	callStackParseLevel        int
+	localVariables             []string
+	printReceiver              bool
+	interfaces                 []string
+	writer                     io.Writer
+}
+
+// WithTraceLevel sets the trace level of the region. See SetTraceLevel.
+func WithTraceLevel(level int) Option {
+	return func(o *options) { o.traceLevel = level }
+}
+
+// WithParseLevel sets the parse level of the region. See SetParseLevel.
+func WithParseLevel(level int) Option {
+	return func(o *options) { o.parseLevel = level }
+}
+
+// WithWriter sets the writer for the tracing log of the region.
+func WithWriter(w io.Writer) Option {
+	return func(o *options) { o.writer = w }
+}
+
+// WithIncludeFuncs limits the traced functions printed to the ones whose name matches one of the regular expressions.
+// The functions not printed are still counted in the trace level.
+func WithIncludeFuncs(exprs ...string) Option {
+	return func(o *options) { o.includeFuncs = append(o.includeFuncs, exprs...) }
+}
+
+// WithOutputFormat sets the format of the tracing log of the region. See SetOutputFormat.
+func WithOutputFormat(format string) Option {
+	return func(o *options) { o.outputFormat = format }
+}
+
+// WithPrintLocation sets the print location option of the region. See SetPrintLocation.
+func WithPrintLocation(option bool) Option {
+	return func(o *options) { o.printLocation = option }
+}
+
+// WithSampling sets the sampling options of the region. See SetSampling.
+func WithSampling(sampleRate, maxCallsPerSecond int) Option {
+	return func(o *options) { o.sampleRate, o.maxCallsPerSecond = sampleRate, maxCallsPerSecond }
+}
+
+// WithFolding sets the folding options of the region. See SetFolding.
+func WithFolding(fold bool, collapseDepth int) Option {
+	return func(o *options) { o.foldRepeatedCalls, o.collapseRecursionDepth = fold, collapseDepth }
+}
+
+// WithCallStack sets the call stack options of the region. See SetCallStack.
+func WithCallStack(printStack bool, parseLevel int) Option {
+	return func(o *options) { o.printCallStack, o.callStackParseLevel = printStack, parseLevel }
+}
+
+// WithLocalVariables sets the names of the local variables of the region printed when the function returns.
+// See SetLocalVariables.
+func WithLocalVariables(names ...string) Option {
+	return func(o *options) { o.localVariables = names }
+}
+
+// WithPrintReceiver sets the print receiver option of the region. See SetPrintReceiver.
+func WithPrintReceiver(option bool) Option {
+	return func(o *options) { o.printReceiver = option }
+}
+
+// WithInterfaces sets the interfaces whose implementations are traced in the region. See SetInterfaces.
+func WithInterfaces(names ...string) Option {
+	return func(o *options) { o.interfaces = names }
+}
+
+// WithExcludeFuncs excludes the functions whose name matches one of the regular expressions from the tracing log.
+func WithExcludeFuncs(exprs ...string) Option {
+	return func(o *options) { o.excludeFuncs = append(o.excludeFuncs, exprs...) }
+}
+
+// Region is the traced region started by StartWithOptions.
+type Region struct {
+	// startTracePoint identifies the region.
+	startTracePoint uintptr
+}
+
 // Start enables tracing.
 func Start() error {
+	_, err := start(callerOfCaller)
+	return err
+}
+
+// StartWithOptions enables tracing with the options and returns the region. Call the region's Stop to end it.
+// The regions can be nested and stopped in any order, but they must be started and stopped in the same go routine.
+func StartWithOptions(opts ...Option) (*Region, error) {
+	return start(callerOfCaller, opts...)
+}
+
+// Trace traces the function call with the options. fn is traced as the function at the depth 1.
+func Trace(fn func(), opts ...Option) error {
+	region, err := start(caller, opts...)
+	if err != nil {
+		return err
+	}
+	defer region.Stop()
+
+	fn()
+	return nil
+}
+
+// The frames whose return address is the start trace point. See start.
+const (
+	caller         = 2
+	callerOfCaller = 3
+)
+
+// start enables tracing at the return address of the specified frame: its caller or its caller's caller.
+// It must be called directly from the exported functions to keep the depth of the call stack.
+func start(frame int, opts ...Option) (*Region, error) {
 	serverMtx.Lock()
 	defer serverMtx.Unlock()
+	loadEnvOptions()
 
 	pcs := make([]uintptr, 1)
-	_ = runtime.Callers(2, pcs)
+	_ = runtime.Callers(frame, pcs)
 	startTracePoint := pcs[0]
 
+	traceOptions := buildTraceOptions(regionTag(startTracePoint), opts)
 	if serverCmd == nil {
-		err := initialize(startTracePoint)
+		err := initialize(func(args *service.AttachArgs) {
+			args.InitialStartTracePoint = startTracePoint
+			args.InitialOptions = traceOptions
+		})
+		if err != nil {
+			_ = terminateServer()
+			return nil, fmt.Errorf("failed to start tracer: %v", err)
+		}
+		activeRegions++
+		return &Region{startTracePoint: startTracePoint}, nil
+	}
+
+	reply := &struct{}{} // sometimes the nil reply value causes panic even if the reply is not written.
+	if traceOptions == nil {
+		if err := client.Call("Tracer.AddStartTracePoint", startTracePoint, reply); err != nil {
+			return nil, err
+		}
+	} else {
+		args := service.StartTracePointArgs{Addr: startTracePoint, Options: *traceOptions}
+		if err := client.Call("Tracer.AddStartTracePointWithOptions", args, reply); err != nil {
+			output.unregister(traceOptions.OutputTag) // registered by buildTraceOptions
+			return nil, err
+		}
+	}
+	activeRegions++
+	return &Region{startTracePoint: startTracePoint}, nil
+}
+
+// regionTag returns the output tag of the region started at the start trace point.
+func regionTag(startTracePoint uintptr) string {
+	return strconv.FormatUint(uint64(startTracePoint), 16)
+}
+
+// buildTraceOptions returns the options sent to the server. The writer is registered with the tag.
+// It returns nil if no options are specified. In that case, the server's default options are used so that
+// the later changes by the setters take effect.
+func buildTraceOptions(tag string, opts []Option) *service.TraceOptions {
+	if len(opts) == 0 {
+		return nil
+	}
+
+	o := options{traceLevel: traceLevel, parseLevel: parseLevel, includeFuncs: includeFuncs, excludeFuncs: excludeFuncs, outputFormat: outputFormat, printLocation: printLocation,
+		sampleRate: sampleRate, maxCallsPerSecond: maxCallsPerSecond, foldRepeatedCalls: foldRepeatedCalls,
+		collapseRecursionDepth: collapseRecursionDepth, printCallStack: printCallStack, callStackParseLevel: callStackParseLevel,
+		localVariables: localVariables, printReceiver: printReceiver, interfaces: interfaces, writer: writer}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	output.register(tag, o.writer)
+	return &service.TraceOptions{
+		TraceLevel:             o.traceLevel,
+		ParseLevel:             o.parseLevel,
+		IncludeFuncs:           o.includeFuncs,
+		ExcludeFuncs:           o.excludeFuncs,
+		OutputFormat:           o.outputFormat,
+		OutputTag:              tag,
+		PrintLocation:          o.printLocation,
+		SampleRate:             o.sampleRate,
+		MaxCallsPerSecond:      o.maxCallsPerSecond,
+		FoldRepeatedCalls:      o.foldRepeatedCalls,
+		CollapseRecursionDepth: o.collapseRecursionDepth,
+		PrintCallStack:         o.printCallStack,
+		CallStackParseLevel:    o.callStackParseLevel,
+		LocalVariables:         o.localVariables,
+		PrintReceiver:          o.printReceiver,
+		Interfaces:             o.interfaces,
+	}
+}
+
+// TraceFunc enables tracing whenever the function which has the given fully-qualified name, such as 'main.handle' and
+// 'net/http.(*Server).ServeHTTP', is called, and disables it when the function returns. The functions it calls are traced.
+// It's useful to call it once at init. The function is looked up using the debugging info or the symbol table,
+// so the binary must not be stripped.
+//
+// The name can be followed by the condition, such as 'main.fib if n > 20' and 'main.handle if req.URL.Path == "/api/orders"'.
+// Then the tracing is enabled only when the condition over the function's args is true.
+// See the github.com/ks888/tgo/tracer.ParseCondition for the syntax.
+func TraceFunc(name string, opts ...Option) error {
+	return addStartTracePointByName(name, true, opts)
+}
+
+// StartAt enables tracing whenever the function which has the given fully-qualified name is called.
+// Unlike TraceFunc, the tracing continues until the go routine passes one of the end points, such as Stop and StopAt.
+// The name can be followed by the condition like TraceFunc.
+func StartAt(name string, opts ...Option) error {
+	return addStartTracePointByName(name, false, opts)
+}
+
+func addStartTracePointByName(name string, endAtReturn bool, opts []Option) error {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+	loadEnvOptions()
+
+	name, condition := splitCondition(name)
+	args := service.StartTracePointByNameArgs{Name: name, EndAtReturn: endAtReturn, Options: buildTraceOptions(name, opts), Condition: condition}
+	if serverCmd == nil {
+		err := initialize(func(attachArgs *service.AttachArgs) {
+			attachArgs.InitialStartTracePointByName = &args
+		})
 		if err != nil {
 			_ = terminateServer()
 			return fmt.Errorf("failed to start tracer: %v", err)
@@ -80,17 +778,51 @@ func Start() error {
 		return nil
 	}
 
-	reply := &struct{}{} // sometimes the nil reply value causes panic even if the reply is not written.
-	return client.Call("Tracer.AddStartTracePoint", startTracePoint, reply)
+	var reply uintptr
+	if err := client.Call("Tracer.AddStartTracePointByName", args, &reply); err != nil {
+		if args.Options != nil {
+			output.unregister(args.Options.OutputTag) // registered by buildTraceOptions
+		}
+		return err
+	}
+	return nil
+}
+
+// splitCondition splits the function name like 'main.fib if n > 20' into the name and the condition.
+func splitCondition(name string) (string, string) {
+	const separator = " if "
+	index := strings.Index(name, separator)
+	if index == -1 {
+		return strings.TrimSpace(name), ""
+	}
+	return strings.TrimSpace(name[:index]), strings.TrimSpace(name[index+len(separator):])
+}
+
+// StopAt disables tracing whenever the function which has the given fully-qualified name is called.
+func StopAt(name string) error {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	// the list is sent whenever the server starts, since the server can't apply the trace points until the tracee
+	// hits any trace point.
+	endFuncs = append(endFuncs, name)
+	if serverCmd == nil {
+		return nil
+	}
+
+	var reply uintptr
+	return client.Call("Tracer.AddEndTracePointByName", name, &reply)
 }
 
-func initialize(startTracePoint uintptr) error {
+// initialize starts the server and lets it attach to this process. setInitialTracePoint sets the initial start trace point to the args.
+func initialize(setInitialTracePoint func(*service.AttachArgs)) error {
 	addr, err := startServer()
 	if err != nil {
 		return err
 	}
 
 	client, err = connectServer(addr)
+	removeServerDir() // the socket is not necessary once connected.
 	if err != nil {
 		return err
 	}
@@ -108,76 +840,322 @@ func initialize(startTracePoint uintptr) error {
 		Pid:                    os.Getpid(),
 		TraceLevel:             traceLevel,
 		ParseLevel:             parseLevel,
-		InitialStartTracePoint: startTracePoint,
+		IncludeFuncs:           includeFuncs,
+		ExcludeFuncs:           excludeFuncs,
+		OutputFormat:           outputFormat,
+		PrintLocation:          printLocation,
+		SampleRate:             sampleRate,
+		MaxCallsPerSecond:      maxCallsPerSecond,
+		EventBudget:            eventBudget,
+		FoldRepeatedCalls:      foldRepeatedCalls,
+		CollapseRecursionDepth: collapseRecursionDepth,
+		FlightRecorderSize:     flightRecorderSize,
+		FlightRecorderSignal:   int(flightRecorderSignal),
+		PrintCallStack:         printCallStack,
+		CallStackParseLevel:    callStackParseLevel,
+		LocalVariables:         localVariables,
+		PrintReceiver:          printReceiver,
+		Interfaces:             interfaces,
+		StreamEvents:           eventHandler != nil,
+		Secret:                 serverSecret,
 		GoVersion:              runtime.Version(),
 		ProgramPath:            programPath,
 		FirstModuleDataAddr:    uintptr(unsafe.Pointer(&firstModuleData)),
 	}
+	setInitialTracePoint(attachArgs)
 	reply := &struct{}{}
 	if err := client.Call("Tracer.Attach", attachArgs, reply); err != nil {
 		return err
 	}
+	if attachArgs.StreamEvents {
+		startReceivingEvents()
+	}
+
+	for _, endFunc := range endFuncs {
+		var addr uintptr
+		if err := client.Call("Tracer.AddEndTracePointByName", endFunc, &addr); err != nil {
+			return err
+		}
+	}
 
 	stopFuncAddr := reflect.ValueOf(Stop).Pointer()
-	return client.Call("Tracer.AddEndTracePoint", stopFuncAddr, reply)
+	if err := client.Call("Tracer.AddEndTracePoint", stopFuncAddr, reply); err != nil {
+		return err
+	}
+
+	stopRegionFuncAddr := reflect.ValueOf(stopRegion).Pointer()
+	if err := client.Call("Tracer.AddRegionEndTracePoint", stopRegionFuncAddr, reply); err != nil {
+		return err
+	}
+
+	shutdownFuncAddr := reflect.ValueOf(Shutdown).Pointer()
+	return client.Call("Tracer.AddEndTracePoint", shutdownFuncAddr, reply)
 }
 
 func checkVersion() error {
 	var serverVersion int
-	if err := client.Call("Tracer.Version", struct{}{}, &serverVersion); err != nil {
-		return err
+	if err := client.Call("Tracer.APIVersion", struct{}{}, &serverVersion); err != nil {
+		// the server older than v3 doesn't have this method.
+		if err := client.Call("Tracer.Version", struct{}{}, &serverVersion); err != nil {
+			return err
+		}
 	}
 	if expectedVersion != serverVersion {
-		return fmt.Errorf("the expected API version (%d) is not same as the actual API version (%d)", expectedVersion, serverVersion)
+		programPath, err := os.Executable()
+		if err != nil {
+			programPath = os.Args[0]
+		}
+		return fmt.Errorf("the expected API version (%d) of %s is not same as the actual API version (%d) of the server %s", expectedVersion, programPath, serverVersion, serverCmd.Path)
 	}
 	return nil
 }
 
+// Close lets the tracer detach from this process and terminates it. It waits until the breakpoints are removed,
+// so the program can keep running safely after it returns. Tracing can be started again by the start functions.
+// In that case, the start points added before are cleared, while the options and the end points added by StopAt are kept.
+func Close() error {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	if serverCmd == nil {
+		return nil
+	}
+	return detachAndTerminateServer()
+}
+
 // Stop stops tracing.
 //
 //go:noinline
 func Stop() {
-	return
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	endRegion()
+}
+
+// Stop ends the region, even if the regions started in it are not stopped yet. It's safe to call it with the nil region,
+// which StartWithOptions returns on error.
+func (r *Region) Stop() {
+	if r == nil {
+		return
+	}
+	stopRegion(r.startTracePoint)
+}
+
+// stopRegion is the end point of the region started at the start trace point. The tracer reads the arg to find the region.
+//
+//go:noinline
+func stopRegion(startTracePoint uintptr) {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	endRegion()
+
+	tag := regionTag(startTracePoint)
+	if serverCmd != nil && output.registered(tag) {
+		// the last lines of the region may be still in the pipe.
+		if err := flushOutput(); err != nil {
+			fmt.Fprintf(errorWriter, "failed to flush the tracing log of the region: %v\n", err)
+		}
+	}
+	output.unregister(tag)
+}
+
+// Shutdown stops tracing like Stop and waits until the tracing log written so far is written to the writer.
+// If no other regions are active, it also lets the tracer detach from this process and terminates it like Close,
+// after the events are delivered to the OnEvent handler. It returns error if any of them failed.
+//
+//go:noinline
+func Shutdown() error {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	endRegion()
+	if serverCmd == nil {
+		return nil
+	}
+	if activeRegions > 0 {
+		return flushOutput()
+	}
+	return detachAndTerminateServer()
+}
+
+// PrintStats writes the stats of the functions traced in OutputFormatStats to the writer as the table, sorted by
+// the total duration. The stats are also written when the tracer detaches from this process.
+func PrintStats() error {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	if serverCmd == nil {
+		return nil
+	}
+	reply := &struct{}{}
+	if err := client.Call("Tracer.PrintStats", struct{}{}, reply); err != nil {
+		return err
+	}
+	return flushOutput()
+}
+
+// DumpFlightRecorder writes the tracing log the flight recorder keeps to the writer. See SetFlightRecorder.
+func DumpFlightRecorder() error {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	if serverCmd == nil {
+		return errors.New("tracer is not started")
+	}
+	reply := &struct{}{}
+	if err := client.Call("Tracer.DumpFlightRecorder", struct{}{}, reply); err != nil {
+		return err
+	}
+	return flushOutput()
+}
+
+// WriteProfile writes the call stacks traced in OutputFormatStats to w in the pprof format. All the calls are
+// recorded, so `go tool pprof` shows the exact call graph of the traced regions.
+func WriteProfile(w io.Writer) error {
+	serverMtx.Lock()
+	defer serverMtx.Unlock()
+
+	if serverCmd == nil {
+		return errors.New("tracer is not started")
+	}
+	var profile []byte
+	if err := client.Call("Tracer.Profile", struct{}{}, &profile); err != nil {
+		return err
+	}
+	_, err := w.Write(profile)
+	return err
+}
+
+// endRegion decrements the number of the active regions. The server mutex must be held.
+func endRegion() {
+	if activeRegions > 0 {
+		activeRegions--
+	}
+}
+
+// flushOutput waits until the tracing log the server has written so far is written to the writers.
+// The server mutex must be held.
+func flushOutput() error {
+	select {
+	case <-output.flushed: // clear the marker of the previous flush, which may be timed out.
+	default:
+	}
+
+	reply := &struct{}{}
+	if err := client.Call("Tracer.Flush", struct{}{}, reply); err != nil {
+		return err
+	}
+
+	select {
+	case <-output.flushed:
+		return nil
+	case <-time.After(flushTimeout):
+		return errors.New("timed out waiting for the tracing log to be written")
+	}
+}
+
+// detachAndTerminateServer lets the tracer detach from this process and then terminates it. The remaining tracing
+// log and events are delivered before it returns. The server mutex must be held.
+func detachAndTerminateServer() error {
+	reply := &struct{}{}
+	err := client.Call("Tracer.Detach", struct{}{}, reply)
+	if err == nil && eventsDone != nil {
+		// the server sends the remaining events once detached.
+		select {
+		case <-eventsDone:
+		case <-time.After(flushTimeout):
+			err = errors.New("timed out waiting for the events to be delivered")
+		}
+	}
+
+	if terminateErr := terminateServer(); err == nil {
+		err = terminateErr
+	}
+	return err
 }
 
+// startServer starts the server which listens on the unix domain socket in the private directory.
+// It returns the path of the socket.
 func startServer() (string, error) {
-	unusedPort, err := findUnusedPort()
+	dir, err := ioutil.TempDir("", "tgo")
+	if err != nil {
+		return "", fmt.Errorf("failed to create the directory for the socket: %v", err)
+	}
+	serverDir = dir
+	socketPath := filepath.Join(dir, "tgo.sock")
+
+	serverSecret, err = generateSecret()
 	if err != nil {
-		return "", fmt.Errorf("failed to find unused port: %v", err)
+		return "", fmt.Errorf("failed to generate the secret: %v", err)
 	}
-	addr := fmt.Sprintf(":%d", unusedPort)
 
-	args := []string{"server"}
+	programPath, err := serverProgramPath()
+	if err != nil {
+		return "", err
+	}
+	env := append(os.Environ(), service.SecretEnvName+"="+serverSecret)
+	var args []string
+	if embeddedServer {
+		env = append(env, embeddedServerEnvName+"=1")
+	} else {
+		args = append(args, "server")
+	}
 	if verbose {
 		args = append(args, "-verbose")
 	}
-	args = append(args, addr)
-	serverCmd = exec.Command(tracerProgramName, args...)
+	args = append(args, "unix:"+socketPath)
+
+	serverCmd = exec.Command(programPath, args...)
 	serverCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true} // Otherwise, tracer may receive the signal to this process.
-	serverCmd.Stdout = writer
+	serverCmd.Env = env
+	serverCmd.Stdout = output
 	serverCmd.Stderr = errorWriter
 	if err := serverCmd.Start(); err != nil {
+		if execErr, ok := err.(*exec.Error); ok && execErr.Err == exec.ErrNotFound {
+			return "", fmt.Errorf("failed to start server: %v (set the path by SetServerPath or %s, or use SetEmbeddedServer)", err, ServerPathEnvName)
+		}
 		return "", fmt.Errorf("failed to start server: %v", err)
 	}
-	return addr, nil
+	return socketPath, nil
 }
 
-func findUnusedPort() (int, error) {
-	listener, err := net.ListenTCP("tcp", &net.TCPAddr{})
-	if err != nil {
-		return 0, err
+// serverProgramPath returns the path of the server program. The server mutex must be held.
+func serverProgramPath() (string, error) {
+	if embeddedServer {
+		return os.Executable()
+	}
+	if serverPath != "" {
+		return serverPath, nil
+	}
+	if path := os.Getenv(ServerPathEnvName); path != "" {
+		return path, nil
 	}
-	defer listener.Close()
+	return tracerProgramName, nil
+}
+
+func removeServerDir() {
+	if serverDir != "" {
+		_ = os.RemoveAll(serverDir)
+		serverDir = ""
+	}
+}
 
-	return listener.Addr().(*net.TCPAddr).Port, nil
+func generateSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
 }
 
-func connectServer(addr string) (*rpc.Client, error) {
+func connectServer(socketPath string) (*rpc.Client, error) {
 	const numRetries = 5
 	interval := 100 * time.Millisecond
 	var err error
 	for i := 0; i < numRetries; i++ {
-		client, err = rpc.Dial("tcp", addr)
+		client, err = rpc.Dial("unix", socketPath)
 		if err == nil {
 			return client, nil
 		}
@@ -185,11 +1163,15 @@ func connectServer(addr string) (*rpc.Client, error) {
 		time.Sleep(interval)
 		interval *= 2
 	}
-	return nil, fmt.Errorf("can't connect to the server (addr: %s): %v", addr, err)
+	return nil, fmt.Errorf("can't connect to the server (addr: %s): %v", socketPath, err)
 }
 
+// terminateServer kills the server and waits until its output is written. The server mutex must be held.
 func terminateServer() error {
 	defer func() { serverCmd = nil }()
+	removeServerDir()
+	eventsDone = nil // the go routine exits when the client is closed.
+	activeRegions = 0
 
 	if client != nil {
 		if err := client.Close(); err != nil {
@@ -201,8 +1183,107 @@ func terminateServer() error {
 		if err := serverCmd.Process.Kill(); err != nil {
 			return err
 		}
-		_, err := serverCmd.Process.Wait()
-		return err
+		// Wait, not Process.Wait, to wait until the output copied from the server is written.
+		if err := serverCmd.Wait(); err != nil {
+			if _, killed := err.(*exec.ExitError); !killed {
+				return err
+			}
+		}
 	}
+	// the start points are cleared, so are their writers.
+	output.unregisterAll()
 	return nil
 }
+
+// outputDemux dispatches the tagged tracing log to the writer of each region.
+type outputDemux struct {
+	mtx     sync.Mutex
+	writers map[string]*taggedWriter
+	buff    []byte
+	// flushed is notified when the flush marker is written.
+	flushed chan struct{}
+}
+
+// taggedWriter is the writer registered with the tag. The same tag is registered again when the region
+// at the same start trace point starts in another go routine, so the writer is kept until all of them stop.
+type taggedWriter struct {
+	w    io.Writer
+	refs int
+}
+
+func (d *outputDemux) register(tag string, w io.Writer) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if tw, ok := d.writers[tag]; ok {
+		tw.w = w
+		tw.refs++
+		return
+	}
+	d.writers[tag] = &taggedWriter{w: w, refs: 1}
+}
+
+func (d *outputDemux) registered(tag string) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	_, ok := d.writers[tag]
+	return ok
+}
+
+// unregister removes the writer once it's unregistered as many times as registered. It's no-op if the tag is not registered.
+func (d *outputDemux) unregister(tag string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	tw, ok := d.writers[tag]
+	if !ok {
+		return
+	}
+	tw.refs--
+	if tw.refs <= 0 {
+		delete(d.writers, tag)
+	}
+}
+
+func (d *outputDemux) unregisterAll() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.writers = make(map[string]*taggedWriter)
+}
+
+func (d *outputDemux) Write(p []byte) (int, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.buff = append(d.buff, p...)
+	for {
+		end := bytes.IndexByte(d.buff, '\n')
+		if end == -1 {
+			break
+		}
+		line := d.buff[:end+1]
+		d.buff = d.buff[end+1:]
+
+		if bytes.Equal(line, service.FlushMarker) {
+			select {
+			case d.flushed <- struct{}{}:
+			default:
+			}
+			continue
+		}
+
+		w := writer
+		if tag, rest, ok := service.SplitOutputTag(line); ok {
+			if regionWriter, found := d.writers[tag]; found {
+				w = regionWriter.w
+			}
+			line = rest
+		}
+		if _, err := w.Write(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
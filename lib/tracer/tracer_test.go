@@ -1,6 +1,7 @@
 package tracer
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"os/exec"
@@ -9,6 +10,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/ks888/tgo/service"
 	"github.com/ks888/tgo/testutils"
 )
 
@@ -49,6 +51,220 @@ func TestRecursiveStartStop(t *testing.T) {
 	}
 }
 
+func TestTraceRegion(t *testing.T) {
+	cmd := exec.Command(testutils.ProgramTraceRegion)
+	out, _ := cmd.CombinedOutput()
+
+	outputs := strings.SplitN(string(out), "region:\n", 2)
+	if len(outputs) != 2 {
+		t.Fatalf("unexpected output: %s", string(out))
+	}
+	stdout, region := outputs[0], outputs[1]
+	if strings.Count(region, "main.inc") != 2 || strings.Count(region, "main.dec") != 0 {
+		t.Errorf("unexpected region output: %s", region)
+	}
+	// trace level 2 includes the calls in the anonymous function.
+	if strings.Count(stdout, "main.inc") != 2 || strings.Count(stdout, "main.dec") != 2 {
+		t.Errorf("unexpected output: %s", stdout)
+	}
+}
+
+func TestTraceNestedRegion(t *testing.T) {
+	cmd := exec.Command(testutils.ProgramTraceNestedRegion)
+	out, _ := cmd.CombinedOutput()
+
+	outputs := strings.SplitN(string(out), "inner:\n", 2)
+	if len(outputs) != 2 || !strings.Contains(outputs[0], "outer:\n") {
+		t.Fatalf("unexpected output: %s", string(out))
+	}
+	outer, inner := outputs[0], outputs[1]
+	if strings.Count(outer, "main.inc") != 0 || strings.Count(outer, "main.dec") != 0 {
+		t.Errorf("unexpected outer region output: %s", outer)
+	}
+	// the inner region is active until its Stop is called, even after the outer one is stopped.
+	if strings.Count(inner, "main.inc") != 2 || strings.Count(inner, "main.dec") != 2 {
+		t.Errorf("unexpected inner region output: %s", inner)
+	}
+}
+
+func TestTraceFunc(t *testing.T) {
+	cmd := exec.Command(testutils.ProgramTraceFunc)
+	out, _ := cmd.CombinedOutput()
+
+	// inner is traced only when called by outer.
+	if strings.Count(string(out), "main.inner") != 2 || strings.Count(string(out), "main.outer") != 0 {
+		t.Errorf("unexpected output: %s", string(out))
+	}
+}
+
+func TestOnEvent(t *testing.T) {
+	cmd := exec.Command(testutils.ProgramTraceEvent)
+	out, _ := cmd.CombinedOutput()
+
+	if !strings.Contains(string(out), "call main.inc\nreturn main.inc\n") || strings.Contains(string(out), "timeout") {
+		t.Errorf("unexpected output: %s", string(out))
+	}
+}
+
+func TestClose(t *testing.T) {
+	cmd := exec.Command(testutils.ProgramTraceClose)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to run: %v\n%s", err, string(out))
+	}
+
+	if strings.Count(string(out), "main.inc") != 2 || !strings.HasSuffix(string(out), "3\n") {
+		t.Errorf("unexpected output: %s", string(out))
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	cmd := exec.Command(testutils.ProgramTraceShutdown)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to run: %v\n%s", err, string(out))
+	}
+
+	if strings.Count(string(out), "main.inc") != 2 || !strings.HasSuffix(string(out), "3\n") {
+		t.Errorf("unexpected output: %s", string(out))
+	}
+}
+
+func TestEmbeddedServer(t *testing.T) {
+	cmd := exec.Command(testutils.ProgramTraceEmbedded)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to run: %v\n%s", err, string(out))
+	}
+
+	if strings.Count(string(out), "main.inc") != 2 {
+		t.Errorf("unexpected output: %s", string(out))
+	}
+}
+
+func TestServerProgramPath(t *testing.T) {
+	os.Setenv(ServerPathEnvName, "/path/to/env/tgo")
+	defer os.Unsetenv(ServerPathEnvName)
+	if path, _ := serverProgramPath(); path != "/path/to/env/tgo" {
+		t.Errorf("unexpected path: %s", path)
+	}
+
+	SetServerPath("/path/to/tgo")
+	defer SetServerPath("")
+	if path, _ := serverProgramPath(); path != "/path/to/tgo" {
+		t.Errorf("unexpected path: %s", path)
+	}
+
+	SetEmbeddedServer(true)
+	defer SetEmbeddedServer(false)
+	programPath, _ := os.Executable()
+	if path, _ := serverProgramPath(); path != programPath {
+		t.Errorf("unexpected path: %s", path)
+	}
+}
+
+func TestSplitCondition(t *testing.T) {
+	for i, testdata := range []struct {
+		input, name, condition string
+	}{
+		{input: "main.fib", name: "main.fib"},
+		{input: "main.fib if n > 20", name: "main.fib", condition: "n > 20"},
+		{input: `main.handle if req.URL.Path == "/api/orders"`, name: "main.handle", condition: `req.URL.Path == "/api/orders"`},
+	} {
+		name, condition := splitCondition(testdata.input)
+		if name != testdata.name || condition != testdata.condition {
+			t.Errorf("[%d] unexpected result: %s, %s", i, name, condition)
+		}
+	}
+}
+
+func TestLoadEnvOptions(t *testing.T) {
+	outputPath := filepath.Join(os.TempDir(), "tgo-test-output.log")
+	defer os.Remove(outputPath)
+	envs := map[string]string{
+		TraceLevelEnvName:   "3",
+		ParseLevelEnvName:   "invalid",
+		OutputEnvName:       outputPath,
+		OutputFormatEnvName: OutputFormatJSON,
+		IncludeFuncsEnvName: "^main\\.,^fmt\\.",
+	}
+	for name, value := range envs {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	origTraceLevel, origParseLevel, origOutputFormat, origWriter, origErrorWriter := traceLevel, parseLevel, outputFormat, writer, errorWriter
+	defer func() {
+		traceLevel, parseLevel, outputFormat, writer, errorWriter, includeFuncs = origTraceLevel, origParseLevel, origOutputFormat, origWriter, origErrorWriter, nil
+		envOptionsLoaded = false
+	}()
+	errBuff := &bytes.Buffer{}
+	errorWriter = errBuff
+
+	loadEnvOptions()
+	if traceLevel != 3 || parseLevel != origParseLevel || outputFormat != OutputFormatJSON || len(includeFuncs) != 2 || includeFuncs[1] != "^fmt\\." {
+		t.Errorf("unexpected options: %d, %d, %s, %v", traceLevel, parseLevel, outputFormat, includeFuncs)
+	}
+	if f, ok := writer.(*os.File); !ok || f.Name() != outputPath {
+		t.Errorf("unexpected writer: %#v", writer)
+	}
+	if !strings.Contains(errBuff.String(), ParseLevelEnvName) {
+		t.Errorf("unexpected error log: %s", errBuff.String())
+	}
+
+	// read only once
+	os.Setenv(TraceLevelEnvName, "4")
+	loadEnvOptions()
+	if traceLevel != 3 {
+		t.Errorf("unexpected trace level: %d", traceLevel)
+	}
+}
+
+func TestOutputDemux_Flush(t *testing.T) {
+	buff := &bytes.Buffer{}
+	origWriter := writer
+	writer = buff
+	defer func() { writer = origWriter }()
+
+	demux := &outputDemux{writers: make(map[string]*taggedWriter), flushed: make(chan struct{}, 1)}
+	fmt.Fprintf(demux, "line\n%s", service.FlushMarker)
+
+	select {
+	case <-demux.flushed:
+	default:
+		t.Errorf("not flushed")
+	}
+	if buff.String() != "line\n" {
+		t.Errorf("unexpected output: %q", buff.String())
+	}
+}
+
+func TestOutputDemux_Unregister(t *testing.T) {
+	buff := &bytes.Buffer{}
+	origWriter := writer
+	writer = buff
+	defer func() { writer = origWriter }()
+
+	regionBuff := &bytes.Buffer{}
+	demux := &outputDemux{writers: make(map[string]*taggedWriter), flushed: make(chan struct{}, 1)}
+	demux.register("tag", regionBuff)
+	demux.register("tag", regionBuff)
+
+	demux.unregister("tag")
+	fmt.Fprintf(demux, "\x00tag\x00line1\n")
+	demux.unregister("tag")
+	fmt.Fprintf(demux, "\x00tag\x00line2\n")
+
+	if regionBuff.String() != "line1\n" {
+		t.Errorf("unexpected region output: %q", regionBuff.String())
+	}
+	if buff.String() != "line2\n" {
+		t.Errorf("unexpected output: %q", buff.String())
+	}
+	if demux.registered("tag") {
+		t.Errorf("still registered")
+	}
+}
+
 func TestStart_NoTracerBinary(t *testing.T) {
 	origTracerName := tracerProgramName
 	tracerProgramName = "not-exist-tracer"
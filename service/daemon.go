@@ -0,0 +1,317 @@
+package service
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/ks888/tgo/log"
+)
+
+// Daemon manages the sessions of the server running in the daemon mode. Each client connection has its own session,
+// which starts when the client attaches to the tracee and ends when the tracer is detached or the connection is closed.
+// In addition, the client can manage multiple sessions over one connection using the methods which take the session ID,
+// such as 'Daemon.Attach' and 'Daemon.NextEvents'. Such a session ends when it's killed, the tracee exits or
+// the connection is closed.
+//
+// Each connection has its own Daemon. The client must authenticate the connection by 'Tracer.Attach', 'Daemon.Attach' or
+// 'Daemon.Authenticate' before calling the other methods, and can access only the sessions started over the connection.
+//
+// The simple name 'Daemon' is chosen because it becomes a part of the service methods
+// the rpc client uses.
+type Daemon struct {
+	table *sessionTable
+	// authenticated is true once the client sends the valid secret over the connection.
+	authenticated bool
+	mtx           sync.Mutex // protects authenticated
+}
+
+// sessionTable holds the sessions of all the connections.
+type sessionTable struct {
+	// The tracing log of each session is written to the file in this directory.
+	outputDir string
+	nextID    int
+	sessions  map[int]*session
+	mtx       sync.Mutex // protects nextID and sessions
+}
+
+func newSessionTable(outputDir string) *sessionTable {
+	return &sessionTable{outputDir: outputDir, sessions: make(map[int]*session)}
+}
+
+type session struct {
+	tracer *Tracer
+	// owner is the daemon of the connection which started the session.
+	owner      *Daemon
+	info       SessionInfo
+	outputFile io.Closer
+}
+
+// SessionInfo is the reply of the service method 'Daemon.ListSessions'
+type SessionInfo struct {
+	ID, Pid     int
+	ProgramPath string
+	// OutputPath is the path of the file to which the tracing log is written.
+	OutputPath string
+	// RecordPath is the path of the file to which the debug api requests are recorded. Empty if not recorded.
+	RecordPath string
+}
+
+// SessionStartTracePointByNameArgs is the input argument of the service method 'Daemon.AddStartTracePointByName'
+type SessionStartTracePointByNameArgs struct {
+	SessionID int
+	Args      StartTracePointByNameArgs
+}
+
+// SessionEndTracePointByNameArgs is the input argument of the service method 'Daemon.AddEndTracePointByName'
+type SessionEndTracePointByNameArgs struct {
+	SessionID int
+	Name      string
+}
+
+// Authenticate authenticates the connection. The args is the shared secret. See Secret.
+func (d *Daemon) Authenticate(args string, reply *struct{}) error {
+	if subtle.ConstantTimeCompare([]byte(args), []byte(Secret)) != 1 {
+		return errors.New("invalid secret")
+	}
+	d.setAuthenticated()
+	return nil
+}
+
+func (d *Daemon) setAuthenticated() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.authenticated = true
+}
+
+func (d *Daemon) checkAuthenticated() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if !d.authenticated {
+		return errors.New("not authenticated")
+	}
+	return nil
+}
+
+// ListSessions returns the active sessions started over the connection in the order of the session ID.
+func (d *Daemon) ListSessions(args struct{}, reply *[]SessionInfo) error {
+	if err := d.checkAuthenticated(); err != nil {
+		return err
+	}
+
+	d.table.mtx.Lock()
+	defer d.table.mtx.Unlock()
+
+	var infos []SessionInfo
+	for _, session := range d.table.sessions {
+		if session.owner == d {
+			infos = append(infos, session.info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	*reply = infos
+	return nil
+}
+
+// KillSession lets the session with the specified ID detach from its tracee. The tracee keeps running.
+func (d *Daemon) KillSession(args int, reply *struct{}) error {
+	tracer, err := d.tracer(args)
+	if err != nil {
+		return err
+	}
+	return tracer.Detach(struct{}{}, &struct{}{})
+}
+
+// Attach starts the new session which attaches to the specified process. Unlike 'Tracer.Attach', the client specifies
+// the session ID in the args of the other methods, so it can start multiple sessions over one connection. The reply is the session ID.
+// The args must have the valid secret like 'Tracer.Attach'.
+func (d *Daemon) Attach(args AttachArgs, reply *int) error {
+	tracer := &Tracer{daemon: d}
+	if err := tracer.Attach(args, &struct{}{}); err != nil {
+		return err
+	}
+	*reply = tracer.sessionID
+	return nil
+}
+
+// NextEvents is same as 'Tracer.NextEvents' except it returns the events of the specified session.
+func (d *Daemon) NextEvents(args int, reply *NextEventsReply) error {
+	tracer, err := d.tracer(args)
+	if err != nil {
+		return err
+	}
+	return tracer.NextEvents(struct{}{}, reply)
+}
+
+// AddStartTracePointByName is same as 'Tracer.AddStartTracePointByName' except it adds the trace point to the specified session.
+func (d *Daemon) AddStartTracePointByName(args SessionStartTracePointByNameArgs, reply *uintptr) error {
+	tracer, err := d.tracer(args.SessionID)
+	if err != nil {
+		return err
+	}
+	return tracer.AddStartTracePointByName(args.Args, reply)
+}
+
+// AddEndTracePointByName is same as 'Tracer.AddEndTracePointByName' except it adds the trace point to the specified session.
+func (d *Daemon) AddEndTracePointByName(args SessionEndTracePointByNameArgs, reply *uintptr) error {
+	tracer, err := d.tracer(args.SessionID)
+	if err != nil {
+		return err
+	}
+	return tracer.AddEndTracePointByName(args.Name, reply)
+}
+
+// PrintStats is same as 'Tracer.PrintStats' except it writes the stats of the specified session.
+func (d *Daemon) PrintStats(args int, reply *struct{}) error {
+	tracer, err := d.tracer(args)
+	if err != nil {
+		return err
+	}
+	return tracer.PrintStats(struct{}{}, reply)
+}
+
+// Profile is same as 'Tracer.Profile' except it returns the profile of the specified session.
+func (d *Daemon) Profile(args int, reply *[]byte) error {
+	tracer, err := d.tracer(args)
+	if err != nil {
+		return err
+	}
+	return tracer.Profile(struct{}{}, reply)
+}
+
+// DumpFlightRecorder is same as 'Tracer.DumpFlightRecorder' except it dumps the flight recorder of the specified session.
+func (d *Daemon) DumpFlightRecorder(args int, reply *struct{}) error {
+	tracer, err := d.tracer(args)
+	if err != nil {
+		return err
+	}
+	return tracer.DumpFlightRecorder(struct{}{}, reply)
+}
+
+// tracer returns the tracer of the session. The session started over the other connection is not returned.
+func (d *Daemon) tracer(id int) (*Tracer, error) {
+	if err := d.checkAuthenticated(); err != nil {
+		return nil, err
+	}
+
+	d.table.mtx.Lock()
+	defer d.table.mtx.Unlock()
+
+	session, ok := d.table.sessions[id]
+	if !ok || session.owner != d {
+		return nil, fmt.Errorf("no such session: %d", id)
+	}
+	return session.tracer, nil
+}
+
+// addSession creates the new session of the tracer and opens its output file. The tracer's mutex must be held.
+func (d *Daemon) addSession(t *Tracer, args AttachArgs) error {
+	d.table.mtx.Lock()
+	defer d.table.mtx.Unlock()
+
+	d.table.nextID++
+	id := d.table.nextID
+	outputPath := filepath.Join(d.table.outputDir, fmt.Sprintf("tgo-session-%d.log", id))
+	// O_EXCL not to follow the symbolic link someone may have placed at the path.
+	outputFile, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open the output file: %v", err)
+	}
+
+	t.sessionID = id
+	t.output = outputFile
+	d.table.sessions[id] = &session{
+		tracer:     t,
+		owner:      d,
+		info:       SessionInfo{ID: id, Pid: args.Pid, ProgramPath: args.ProgramPath, OutputPath: outputPath, RecordPath: t.recordPath()},
+		outputFile: outputFile,
+	}
+	return nil
+}
+
+// removeSession closes the output file of the session. It does nothing if the session is already removed.
+func (d *Daemon) removeSession(id int) {
+	d.table.mtx.Lock()
+	defer d.table.mtx.Unlock()
+
+	session, ok := d.table.sessions[id]
+	if !ok {
+		return
+	}
+	delete(d.table.sessions, id)
+	if err := session.outputFile.Close(); err != nil {
+		log.Printf("failed to close the output file: %v", err)
+	}
+}
+
+// ServeDaemon serves the tracer service to multiple clients until the listener fails. The address is same as Serve.
+// Each client has its own session and so can trace its own tracee. The tracing log of each session is written to
+// the file in the output directory. If the output directory is empty, the new directory only the owner can access
+// is created in the temp directory.
+func ServeDaemon(address, outputDir string) error {
+	listener, err := listen(address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	if outputDir == "" {
+		dir, err := ioutil.TempDir("", "tgo")
+		if err != nil {
+			return err
+		}
+		log.Printf("the tracing log is written to the files in %s", dir)
+		outputDir = dir
+	}
+
+	table := newSessionTable(outputDir)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			daemon := &Daemon{table: table}
+			tracer := &Tracer{daemon: daemon}
+			server := rpc.NewServer()
+			server.Register(tracer)
+			server.Register(daemon)
+
+			server.ServeConn(conn)
+			conn.Close() // connection may be closed already
+			if err := tracer.Detach(struct{}{}, &struct{}{}); err != nil {
+				log.Printf("failed to detach: %v", err)
+			}
+			// no other connection can access the sessions started by 'Daemon.Attach'.
+			daemon.killSessions()
+		}()
+	}
+}
+
+// killSessions lets all the sessions started over the connection detach from their tracees.
+func (d *Daemon) killSessions() {
+	d.table.mtx.Lock()
+	var tracers []*Tracer
+	for _, session := range d.table.sessions {
+		if session.owner == d {
+			tracers = append(tracers, session.tracer)
+		}
+	}
+	d.table.mtx.Unlock()
+
+	for _, tracer := range tracers {
+		if err := tracer.Detach(struct{}{}, &struct{}{}); err != nil {
+			log.Printf("failed to detach: %v", err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/ks888/tgo/tracer"
+)
+
+// maxQueuedEvents is the max number of the events the queue holds. The oldest events are dropped when the queue is full.
+const maxQueuedEvents = 65536
+
+// eventQueue holds the trace events until the client receives them.
+type eventQueue struct {
+	mtx  sync.Mutex
+	cond *sync.Cond
+	// The events are queued only after the client requests them, to avoid the unnecessary memory usage.
+	enabled bool
+	closed  bool
+	events  []tracer.Event
+	dropped int
+}
+
+func newEventQueue() *eventQueue {
+	q := &eventQueue{}
+	q.cond = sync.NewCond(&q.mtx)
+	return q
+}
+
+func (q *eventQueue) enable() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.enabled = true
+}
+
+// push queues the event. It never blocks because it's called in the controller's main loop.
+func (q *eventQueue) push(event tracer.Event) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if !q.enabled || q.closed {
+		return
+	}
+	if len(q.events) >= maxQueuedEvents {
+		q.events = q.events[1:]
+		q.dropped++
+	}
+	q.events = append(q.events, event)
+	q.cond.Broadcast()
+}
+
+// pop waits until any event is queued or the queue is closed, and then returns all the queued events and
+// the number of the events dropped since the last call.
+func (q *eventQueue) pop() (events []tracer.Event, dropped int, closed bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.enabled = true
+	for len(q.events) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+
+	events, dropped = q.events, q.dropped
+	q.events, q.dropped = nil, 0
+	return events, dropped, q.closed
+}
+
+// close wakes up the waiting client. The events already queued are still returned.
+func (q *eventQueue) close() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/ks888/tgo/tracer"
+)
+
+func TestEventQueue(t *testing.T) {
+	q := newEventQueue()
+	q.push(tracer.Event{Function: "main.notQueued"})
+	q.enable()
+	q.push(tracer.Event{Function: "main.f"})
+
+	events, dropped, closed := q.pop()
+	if len(events) != 1 || events[0].Function != "main.f" || dropped != 0 || closed {
+		t.Errorf("unexpected result: %v, %d, %v", events, dropped, closed)
+	}
+
+	q.close()
+	events, _, closed = q.pop()
+	if len(events) != 0 || !closed {
+		t.Errorf("unexpected result: %v, %v", events, closed)
+	}
+}
+
+func TestEventQueue_Full(t *testing.T) {
+	q := newEventQueue()
+	q.enable()
+	for i := 0; i < maxQueuedEvents+1; i++ {
+		q.push(tracer.Event{Depth: i})
+	}
+
+	events, dropped, _ := q.pop()
+	if len(events) != maxQueuedEvents || events[0].Depth != 1 || dropped != 1 {
+		t.Errorf("unexpected result: %d, %d, %d", len(events), events[0].Depth, dropped)
+	}
+}
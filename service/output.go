@@ -0,0 +1,61 @@
+package service
+
+import (
+	"bytes"
+	"io"
+)
+
+// outputTagDelimiter encloses the tag of the output line. The tracing log never contains this byte
+// because the non-printable characters in the args are escaped.
+const outputTagDelimiter = '\x00'
+
+// FlushMarker is the line the server writes on 'Tracer.Flush'. It's the empty line with the empty tag,
+// which the tagged writer never writes.
+var FlushMarker = []byte{outputTagDelimiter, outputTagDelimiter, '\n'}
+
+// taggedWriter prefixes each line with the tag so that the client can tell which region the line belongs to.
+type taggedWriter struct {
+	w           io.Writer
+	tag         []byte
+	atLineStart bool
+}
+
+// newTaggedWriter returns the writer which tags the lines. The tag must not contain the delimiter and new line.
+func newTaggedWriter(w io.Writer, tag string) *taggedWriter {
+	taggedPrefix := append([]byte{outputTagDelimiter}, tag...)
+	taggedPrefix = append(taggedPrefix, outputTagDelimiter)
+	return &taggedWriter{w: w, tag: taggedPrefix, atLineStart: true}
+}
+
+func (w *taggedWriter) Write(p []byte) (int, error) {
+	var buff []byte
+	for _, line := range bytes.SplitAfter(p, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		if w.atLineStart {
+			buff = append(buff, w.tag...)
+		}
+		buff = append(buff, line...)
+		w.atLineStart = line[len(line)-1] == '\n'
+	}
+
+	if _, err := w.w.Write(buff); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// SplitOutputTag splits the output line into the tag and the rest.
+// ok is false if the line is not tagged.
+func SplitOutputTag(line []byte) (tag string, rest []byte, ok bool) {
+	if len(line) == 0 || line[0] != outputTagDelimiter {
+		return "", line, false
+	}
+
+	end := bytes.IndexByte(line[1:], outputTagDelimiter)
+	if end == -1 {
+		return "", line, false
+	}
+	return string(line[1 : end+1]), line[end+2:], true
+}
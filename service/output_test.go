@@ -0,0 +1,34 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestTaggedWriter(t *testing.T) {
+	buff := &bytes.Buffer{}
+	w := newTaggedWriter(buff, "main.f")
+	fmt.Fprint(w, "line1\nli")
+	fmt.Fprint(w, "ne2\n")
+
+	for _, expected := range []string{"line1\n", "line2\n"} {
+		line, err := buff.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("failed to read line: %v", err)
+		}
+		tag, rest, ok := SplitOutputTag(line)
+		if !ok || tag != "main.f" || string(rest) != expected {
+			t.Errorf("unexpected split result: %s, %q, %v", tag, rest, ok)
+		}
+	}
+}
+
+func TestSplitOutputTag_NotTagged(t *testing.T) {
+	for _, line := range []string{"", "line\n", "\x00main.f"} {
+		_, rest, ok := SplitOutputTag([]byte(line))
+		if ok || string(rest) != line {
+			t.Errorf("unexpected split result of %q: %q, %v", line, rest, ok)
+		}
+	}
+}
@@ -1,16 +1,54 @@
 package service
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/rpc"
+	"os"
+	"regexp"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/ks888/tgo/log"
 	"github.com/ks888/tgo/tracer"
 )
 
-const serviceVersion = 1 // increment whenever any changes are aded to service methods.
+const serviceVersion = 19 // increment whenever any changes are aded to service methods.
+
+// v1ServiceVersion is the version the 'Tracer.Version' method returns. The v1 clients require the exact match,
+// so this value is kept while the v1 methods and their args are compatible. The newer clients use 'Tracer.APIVersion'.
+const v1ServiceVersion = 1
+
+// RemoteStubAddr is the address of the remote stub (e.g. gdbserver) via which the tracee process is controlled.
+// If empty, the tracer controls the tracee process directly.
+var RemoteStubAddr string
+
+// RecordPath is the path of the file to which the debug api requests to the tracee process are recorded.
+// The file can be replayed later using ReplayPath. In the daemon mode, the session ID is appended to the path,
+// like 'tgo.rec.1', so that the sessions don't overwrite each other's recording.
+var RecordPath string
+
+// ReplayPath is the path of the recorded file. If specified, the recorded debug api requests are served back instead of
+// controlling the tracee process. The client must attach and set the trace points in the same way as recorded.
+var ReplayPath string
+
+// SecretEnvName is the name of the environment variable via which the client passes the shared secret to the server.
+const SecretEnvName = "TGO_SERVER_SECRET"
+
+// Secret is the shared secret the client must send in 'Tracer.Attach'. In the daemon mode, it's also required to
+// authenticate the connection. See Daemon. If empty, any client can attach, so the server refuses to listen on the
+// TCP address. Only the unix domain socket, which the other users can't connect to, is allowed.
+var Secret string
+
+// AllowRemote allows the server to listen on the non-loopback TCP address. The server offers the access to the ptrace
+// capability, so it should be enabled only if the network is trusted.
+var AllowRemote bool
 
 // Tracer is the wrapper of the actual tracer in tgo/tracer package.
 //
@@ -18,24 +56,159 @@ const serviceVersion = 1 // increment whenever any changes are aded to service m
 // the rpc client uses.
 type Tracer struct {
 	controller *tracer.Controller
-	errCh      chan error
-	mtx        sync.Mutex // protects controller
+	// defaultOptions is the copy of the controller's default options, which is updated partially by the setter methods.
+	defaultOptions tracer.TraceOptions
+	// events holds the trace events until the client receives them via 'Tracer.NextEvents'.
+	events *eventQueue
+	errCh  chan error
+	mtx    sync.Mutex // protects controller, defaultOptions and events
+
+	// The tracing log is written to output. If nil, os.Stdout is used.
+	output io.Writer
+	// daemon is not nil if the server runs in the daemon mode. See ServeDaemon.
+	daemon    *Daemon
+	sessionID int
 }
 
 // AttachArgs is the input argument of the service method 'Tracer.Attach'
 type AttachArgs struct {
 	Pid                    int
 	TraceLevel, ParseLevel int
+	// The regular expressions of the function names to include in or exclude from the tracing log. Added in v3.
+	IncludeFuncs, ExcludeFuncs []string
+	// "text" (default), "json" (Added in v3) or "stats" (Added in v12).
+	OutputFormat string
 	// This parameter is required because the tracer may not have a chance to set the new trace points
 	// after the attached tracee starts running without trace points.
 	InitialStartTracePoint uintptr
 	Verbose                bool
 	GoVersion, ProgramPath string
 	FirstModuleDataAddr    uintptr
+	// If not nil, these options are used at the initial start trace point instead of TraceLevel and ParseLevel.
+	InitialOptions *TraceOptions
+	// If not nil, this trace point is added instead of InitialStartTracePoint and InitialOptions. Added in v4.
+	InitialStartTracePointByName *StartTracePointByNameArgs
+	// If true, the trace events are queued from the beginning. Otherwise, they are queued after the first
+	// 'Tracer.NextEvents' call. Added in v5.
+	StreamEvents bool
+	// Secret must be same as the server's one. Added in v6.
+	Secret string
+	// If true, the source locations are printed in the text format. Added in v10.
+	PrintLocation bool
+	// The sampling options of each function. See TraceOptions. Added in v13.
+	SampleRate, MaxCallsPerSecond int
+	// EventBudget is the max number of the calls traced. 0 means unlimited. Added in v13.
+	EventBudget int
+	// The folding options. See TraceOptions. Added in v14.
+	FoldRepeatedCalls      bool
+	CollapseRecursionDepth int
+	// If FlightRecorderSize is positive, the tracing log is not written, but the last FlightRecorderSize lines of
+	// each go routine are kept. They are written when the tracee panics, exits abnormally, receives
+	// FlightRecorderSignal (0 means none) or 'Tracer.DumpFlightRecorder' is called. Added in v16.
+	FlightRecorderSize, FlightRecorderSignal int
+	// The call stack options. See TraceOptions. Added in v17.
+	PrintCallStack      bool
+	CallStackParseLevel int
+	// The names of the local variables printed when the function returns. Added in v18.
+	LocalVariables []string
+	// The receiver and interface options. See TraceOptions. Added in v19.
+	PrintReceiver bool
+	Interfaces    []string
+}
+
+// TraceOptions is the set of the options applied to the go routines which start tracing at the start trace point.
+type TraceOptions struct {
+	TraceLevel, ParseLevel int
+	// The regular expressions of the function names to include in or exclude from the tracing log.
+	IncludeFuncs, ExcludeFuncs []string
+	// If not empty, each line of the tracing log is tagged with this tag. See SplitOutputTag.
+	// The tag must not contain the null character and new line.
+	OutputTag string
+	// "text" (default), "json" or "stats" (Added in v12).
+	OutputFormat string
+	// If true, the source locations of the function and its call site are printed in the text format. Added in v10.
+	PrintLocation bool
+	// If SampleRate is larger than 1, only 1 in SampleRate calls of each function is traced. Added in v13.
+	SampleRate int
+	// If positive, at most MaxCallsPerSecond calls of each function are traced per second. Added in v13.
+	MaxCallsPerSecond int
+	// If true, the consecutive identical calls are folded into one line in the text format. Added in v14.
+	FoldRepeatedCalls bool
+	// If positive, the recursive calls beyond this recursion depth are collapsed into one line in the text format.
+	// Added in v14.
+	CollapseRecursionDepth int
+	// If true, the call stack of the go routine is printed when it starts tracing. The args of each function are
+	// parsed at CallStackParseLevel (0 means not parsed). Added in v17.
+	PrintCallStack      bool
+	CallStackParseLevel int
+	// The names of the local variables printed when the function returns. "*" selects all the local variables.
+	// Added in v18.
+	LocalVariables []string
+	// If true, the receiver of the method is printed separately from the args. Added in v19.
+	PrintReceiver bool
+	// If not empty, only the implementations of the interface methods, like "io.Writer.Write", are printed. Added in v19.
+	Interfaces []string
+}
+
+// FuncFiltersArgs is the input argument of the service method 'Tracer.SetFuncFilters'
+type FuncFiltersArgs struct {
+	IncludeFuncs, ExcludeFuncs []string
+}
+
+// SamplingArgs is the input argument of the service method 'Tracer.SetSampling'
+type SamplingArgs struct {
+	SampleRate, MaxCallsPerSecond int
+}
+
+// FoldingArgs is the input argument of the service method 'Tracer.SetFolding'
+type FoldingArgs struct {
+	FoldRepeatedCalls      bool
+	CollapseRecursionDepth int
 }
 
-// Version returns the service version. The backward compatibility may be broken if the version is not same as the expected one.
+// CallStackArgs is the input argument of the service method 'Tracer.SetCallStack'
+type CallStackArgs struct {
+	PrintCallStack      bool
+	CallStackParseLevel int
+}
+
+// StartTracePointArgs is the input argument of the service method 'Tracer.AddStartTracePointWithOptions'
+type StartTracePointArgs struct {
+	Addr    uintptr
+	Options TraceOptions
+}
+
+// StartTracePointByNameArgs is the input argument of the service method 'Tracer.AddStartTracePointByName'
+type StartTracePointByNameArgs struct {
+	// Name is the fully-qualified function name, such as 'main.main' and 'net/http.(*Server).Serve'.
+	Name string
+	// If true, the tracing of the go routine ends when the function returns.
+	EndAtReturn bool
+	// If nil, the default options are used.
+	Options *TraceOptions
+	// Condition is the expression evaluated over the input args of the function, such as 'n > 20'.
+	// The go routine starts tracing only if it's true. See tracer.ParseCondition for the syntax. Added in v11.
+	Condition string
+}
+
+// NextEventsReply is the reply of the service method 'Tracer.NextEvents'
+type NextEventsReply struct {
+	// Events may include the panic and recover events and the return events of the unwound functions (Added in v15).
+	Events []tracer.Event
+	// Dropped is the number of the events dropped since the last call because the client didn't receive them in time.
+	Dropped int
+	// If true, the tracer is detached and no more events are sent.
+	Done bool
+}
+
+// Version returns the service version for the v1 clients. Use APIVersion instead.
 func (t *Tracer) Version(args struct{}, reply *int) error {
+	*reply = v1ServiceVersion
+	return nil
+}
+
+// APIVersion returns the service version. The backward compatibility may be broken if the version is not same as the expected one.
+func (t *Tracer) APIVersion(args struct{}, reply *int) error {
 	*reply = serviceVersion
 	return nil
 }
@@ -44,52 +217,259 @@ func (t *Tracer) Version(args struct{}, reply *int) error {
 func (t *Tracer) Attach(args AttachArgs, reply *struct{}) error {
 	t.mtx.Lock()
 	defer t.mtx.Unlock()
+	if subtle.ConstantTimeCompare([]byte(args.Secret), []byte(Secret)) != 1 {
+		return errors.New("invalid secret")
+	}
+	if t.daemon != nil {
+		t.daemon.setAuthenticated()
+	}
 	if t.controller != nil {
 		return errors.New("already attached")
 	}
 
-	t.controller = tracer.NewController()
+	if t.daemon != nil {
+		if err := t.daemon.addSession(t, args); err != nil {
+			return err
+		}
+	}
+	if err := t.attach(args); err != nil {
+		if t.daemon != nil {
+			t.closeSession(t.sessionID)
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *Tracer) attach(args AttachArgs) error {
+	// the options are built first not to leave the tracee attached and stopped if they are invalid.
+	defaultOptions, err := TraceOptions{
+		TraceLevel:             args.TraceLevel,
+		ParseLevel:             args.ParseLevel,
+		IncludeFuncs:           args.IncludeFuncs,
+		ExcludeFuncs:           args.ExcludeFuncs,
+		OutputFormat:           args.OutputFormat,
+		PrintLocation:          args.PrintLocation,
+		SampleRate:             args.SampleRate,
+		MaxCallsPerSecond:      args.MaxCallsPerSecond,
+		FoldRepeatedCalls:      args.FoldRepeatedCalls,
+		CollapseRecursionDepth: args.CollapseRecursionDepth,
+		PrintCallStack:         args.PrintCallStack,
+		CallStackParseLevel:    args.CallStackParseLevel,
+		LocalVariables:         args.LocalVariables,
+		PrintReceiver:          args.PrintReceiver,
+		Interfaces:             args.Interfaces,
+	}.controllerOptions(t.outputWriter())
+	if err != nil {
+		return err
+	}
+	var initialOptions *tracer.TraceOptions
+	if args.InitialStartTracePointByName == nil && args.InitialOptions != nil {
+		options, err := args.InitialOptions.controllerOptions(t.outputWriter())
+		if err != nil {
+			return err
+		}
+		initialOptions = &options
+	}
+
+	controller := tracer.NewController()
+	controller.SetOutputWriter(t.outputWriter())
+	events := newEventQueue()
+	if args.StreamEvents {
+		events.enable()
+	}
+	controller.SetEventHandler(events.push)
 	attrs := tracer.Attributes{
 		ProgramPath:         args.ProgramPath,
 		CompiledGoVersion:   args.GoVersion,
 		FirstModuleDataAddr: uint64(args.FirstModuleDataAddr),
+		RemoteStubAddr:      RemoteStubAddr,
+		RecordPath:          t.recordPath(),
+		ReplayPath:          ReplayPath,
+	}
+	if err := controller.AttachTracee(args.Pid, attrs); err != nil {
+		return err
 	}
-	if err := t.controller.AttachTracee(args.Pid, attrs); err != nil {
+
+	// buffered not to block the main loop's go routine if the client never detaches.
+	t.errCh = make(chan error, 1)
+	t.controller = controller
+	t.events = events
+	t.defaultOptions = defaultOptions
+	if err := t.setUpController(args, initialOptions); err != nil {
+		if detachErr := controller.Detach(); detachErr != nil {
+			log.Printf("failed to detach: %v", detachErr)
+		}
+		t.controller = nil
 		return err
 	}
-	t.controller.SetTraceLevel(args.TraceLevel)
-	t.controller.SetParseLevel(args.ParseLevel)
-	t.controller.AddStartTracePoint(uint64(args.InitialStartTracePoint))
 
+	errCh, sessionID := t.errCh, t.sessionID
 	go func() {
-		err := t.controller.MainLoop()
+		err := controller.MainLoop()
 		if err != nil && err != tracer.ErrInterrupted {
 			log.Debug(err)
 		}
-		t.errCh <- err
+		events.close()
+		errCh <- err
+
+		if t.daemon != nil {
+			t.endSession(controller, sessionID)
+		}
 	}()
 	return nil
 }
 
-// Detach lets the server detach from the attached process.
+// endSession ends the session after the main loop ends, because the tracee may exit without the detach.
+// It does nothing if the session is ended by the detach already.
+func (t *Tracer) endSession(controller *tracer.Controller, sessionID int) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.controller == controller {
+		t.controller = nil
+	}
+	t.closeSession(sessionID)
+}
+
+// closeSession removes the session and closes its output file. The tracer's mutex must be held.
+func (t *Tracer) closeSession(sessionID int) {
+	t.daemon.removeSession(sessionID)
+	if t.sessionID == sessionID {
+		t.output = nil
+	}
+}
+
+// setUpController sets the options and the initial start trace point to the attached controller.
+func (t *Tracer) setUpController(args AttachArgs, initialOptions *tracer.TraceOptions) error {
+	t.controller.SetEventBudget(args.EventBudget)
+	if args.FlightRecorderSize > 0 {
+		if err := t.controller.SetFlightRecorder(args.FlightRecorderSize, args.FlightRecorderSignal); err != nil {
+			return err
+		}
+	}
+	if err := t.controller.UpdateDefaultTraceOptions(t.defaultOptions); err != nil {
+		return err
+	}
+
+	if args.InitialStartTracePointByName != nil {
+		_, err := t.addStartTracePointByName(*args.InitialStartTracePointByName)
+		return err
+	} else if initialOptions != nil {
+		return t.controller.AddStartTracePointWithOptions(uint64(args.InitialStartTracePoint), *initialOptions)
+	}
+	return t.controller.AddStartTracePoint(uint64(args.InitialStartTracePoint))
+}
+
+// detachTimeout is the max time to wait until the tracer detaches from the process.
+const detachTimeout = 10 * time.Second
+
+// Detach lets the server detach from the attached process. The tracee is stopped and the breakpoints are removed
+// before it replies, so the tracee can keep running safely. It returns error if the detach failed or timed out.
 func (t *Tracer) Detach(args struct{}, reply *struct{}) error {
 	t.mtx.Lock()
+	defer t.mtx.Unlock()
 	if t.controller == nil {
-		t.mtx.Unlock()
 		return nil
 	}
 
-	// TODO: the tracer may be killed before detached (and before breakpoints cleared). Implement the cancellation mechanism which can wait until the process is detached.
 	t.controller.Interrupt()
-	go func() {
-		defer t.mtx.Unlock()
-		if err := <-t.errCh; err != nil && err != tracer.ErrInterrupted {
+	select {
+	case err := <-t.errCh:
+		t.controller = nil
+		if t.daemon != nil {
+			t.closeSession(t.sessionID)
+		}
+		if _, ok := err.(tracer.DetachError); ok {
+			return err
+		} else if err != nil && err != tracer.ErrInterrupted {
+			// the tracing had failed before the interrupt.
 			log.Printf("%v", err)
 		} else {
 			log.Printf("detached")
 		}
-		t.controller = nil
-	}()
+		return nil
+	case <-time.After(detachTimeout):
+		return errors.New("timed out waiting for the tracer to detach")
+	}
+}
+
+// Flush writes FlushMarker to the output. The tracing log the tracer has written so far precedes the marker,
+// so the client can wait until the log is delivered. It does nothing in the daemon mode, since the log is
+// written to the file directly. Added in v9.
+func (t *Tracer) Flush(args struct{}, reply *struct{}) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.daemon != nil {
+		return nil
+	}
+	_, err := t.outputWriter().Write(FlushMarker)
+	return err
+}
+
+// PrintStats writes the stats of the functions traced in the "stats" output format to the output as the table.
+// Added in v12.
+func (t *Tracer) PrintStats(args struct{}, reply *struct{}) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.controller == nil {
+		return nil
+	}
+	return t.controller.PrintStats(t.outputWriter())
+}
+
+// Profile returns the call stacks traced in the "stats" output format in the gzip-compressed pprof format.
+// Added in v12.
+func (t *Tracer) Profile(args struct{}, reply *[]byte) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.controller == nil {
+		return errors.New("not attached")
+	}
+	buff := &bytes.Buffer{}
+	if err := t.controller.WriteProfile(buff); err != nil {
+		return err
+	}
+	*reply = buff.Bytes()
+	return nil
+}
+
+// DumpFlightRecorder writes the tracing log the flight recorder keeps to the output. Added in v16.
+func (t *Tracer) DumpFlightRecorder(args struct{}, reply *struct{}) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.controller == nil {
+		return errors.New("not attached")
+	}
+	return t.controller.DumpFlightRecorder(t.outputWriter(), "requested")
+}
+
+// SessionID returns the ID of the session the connection is associated with. It's 0 if the server doesn't
+// run in the daemon mode or the client is not attached yet. Added in v7.
+func (t *Tracer) SessionID(args struct{}, reply *int) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	*reply = t.sessionID
+	return nil
+}
+
+// NextEvents waits until any trace event occurs and then returns the events occurred since the last call.
+// The client is expected to call it repeatedly in the dedicated go routine until the reply's Done is true.
+func (t *Tracer) NextEvents(args struct{}, reply *NextEventsReply) error {
+	t.mtx.Lock()
+	events := t.events
+	t.mtx.Unlock()
+
+	if events == nil {
+		reply.Done = true
+		return nil
+	}
+	reply.Events, reply.Dropped, reply.Done = events.pop()
 	return nil
 }
 
@@ -104,6 +484,269 @@ func (t *Tracer) AddStartTracePoint(args uintptr, reply *struct{}) error {
 	return t.controller.AddStartTracePoint(uint64(args))
 }
 
+// AddStartTracePointWithOptions adds a new start trace point with its own options.
+func (t *Tracer) AddStartTracePointWithOptions(args StartTracePointArgs, reply *struct{}) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.controller == nil {
+		return nil
+	}
+	options, err := args.Options.controllerOptions(t.outputWriter())
+	if err != nil {
+		return err
+	}
+	return t.controller.AddStartTracePointWithOptions(uint64(args.Addr), options)
+}
+
+// AddStartTracePointByName adds a new start trace point at the beginning of the function which has the given name.
+// The reply is the address of the function.
+func (t *Tracer) AddStartTracePointByName(args StartTracePointByNameArgs, reply *uintptr) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.controller == nil {
+		return nil
+	}
+	addr, err := t.addStartTracePointByName(args)
+	if reply != nil {
+		*reply = addr
+	}
+	return err
+}
+
+func (t *Tracer) addStartTracePointByName(args StartTracePointByNameArgs) (uintptr, error) {
+	addr, err := t.controller.FunctionAddress(args.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	var options *tracer.TraceOptions
+	if args.Options != nil {
+		controllerOptions, err := args.Options.controllerOptions(t.outputWriter())
+		if err != nil {
+			return 0, err
+		}
+		options = &controllerOptions
+	}
+
+	if args.Condition != "" {
+		condition, err := tracer.ParseCondition(args.Condition)
+		if err != nil {
+			return 0, fmt.Errorf("invalid condition: %v", err)
+		}
+		err = t.controller.AddConditionalStartTracePoint(addr, condition, options, args.EndAtReturn)
+		return uintptr(addr), err
+	}
+
+	if args.EndAtReturn {
+		err = t.controller.AddFunctionTracePoint(addr, options)
+	} else if options != nil {
+		err = t.controller.AddStartTracePointWithOptions(addr, *options)
+	} else {
+		err = t.controller.AddStartTracePoint(addr)
+	}
+	return uintptr(addr), err
+}
+
+// AddEndTracePointByName adds a new end trace point at the beginning of the function which has the given name.
+// The reply is the address of the function.
+func (t *Tracer) AddEndTracePointByName(args string, reply *uintptr) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.controller == nil {
+		return nil
+	}
+	addr, err := t.controller.FunctionAddress(args)
+	if err != nil {
+		return err
+	}
+	if reply != nil {
+		*reply = uintptr(addr)
+	}
+	return t.controller.AddEndTracePoint(addr)
+}
+
+// SetTraceLevel updates the default trace level, which is used at the start trace points without the options.
+func (t *Tracer) SetTraceLevel(args int, reply *struct{}) error {
+	return t.updateDefaultOptions(func(options *tracer.TraceOptions) error {
+		options.TraceLevel = args
+		return nil
+	})
+}
+
+// SetParseLevel updates the default parse level, which is used at the start trace points without the options.
+func (t *Tracer) SetParseLevel(args int, reply *struct{}) error {
+	return t.updateDefaultOptions(func(options *tracer.TraceOptions) error {
+		options.ParseLevel = args
+		return nil
+	})
+}
+
+// SetFuncFilters updates the default function filters, which are used at the start trace points without the options.
+func (t *Tracer) SetFuncFilters(args FuncFiltersArgs, reply *struct{}) error {
+	return t.updateDefaultOptions(func(options *tracer.TraceOptions) (err error) {
+		if options.IncludeFuncs, err = compileRegexps(args.IncludeFuncs); err != nil {
+			return err
+		}
+		options.ExcludeFuncs, err = compileRegexps(args.ExcludeFuncs)
+		return err
+	})
+}
+
+// SetOutputFormat updates the default output format, which is used at the start trace points without the options.
+func (t *Tracer) SetOutputFormat(args string, reply *struct{}) error {
+	return t.updateDefaultOptions(func(options *tracer.TraceOptions) (err error) {
+		options.Format, err = parseOutputFormat(args)
+		return err
+	})
+}
+
+// SetPrintLocation updates the default print location option, which is used at the start trace points without the options.
+// Added in v10.
+func (t *Tracer) SetPrintLocation(args bool, reply *struct{}) error {
+	return t.updateDefaultOptions(func(options *tracer.TraceOptions) error {
+		options.PrintLocation = args
+		return nil
+	})
+}
+
+// SetSampling updates the default sampling options, which are used at the start trace points without the options.
+// Added in v13.
+func (t *Tracer) SetSampling(args SamplingArgs, reply *struct{}) error {
+	return t.updateDefaultOptions(func(options *tracer.TraceOptions) error {
+		options.SampleRate = args.SampleRate
+		options.MaxCallsPerSecond = args.MaxCallsPerSecond
+		return nil
+	})
+}
+
+// SetFolding updates the default folding options, which are used at the start trace points without the options.
+// Added in v14.
+func (t *Tracer) SetFolding(args FoldingArgs, reply *struct{}) error {
+	return t.updateDefaultOptions(func(options *tracer.TraceOptions) error {
+		options.FoldRepeatedCalls = args.FoldRepeatedCalls
+		options.CollapseRecursionDepth = args.CollapseRecursionDepth
+		return nil
+	})
+}
+
+// SetCallStack updates the default call stack options, which are used at the start trace points without the options.
+// Added in v17.
+func (t *Tracer) SetCallStack(args CallStackArgs, reply *struct{}) error {
+	return t.updateDefaultOptions(func(options *tracer.TraceOptions) error {
+		options.PrintCallStack = args.PrintCallStack
+		options.CallStackParseLevel = args.CallStackParseLevel
+		return nil
+	})
+}
+
+// SetLocalVariables updates the names of the local variables printed when the function returns, which are used
+// at the start trace points without the options. Added in v18.
+func (t *Tracer) SetLocalVariables(names []string, reply *struct{}) error {
+	return t.updateDefaultOptions(func(options *tracer.TraceOptions) error {
+		options.LocalVariables = names
+		return nil
+	})
+}
+
+// SetPrintReceiver updates the default print receiver option, which is used at the start trace points without the options.
+// Added in v19.
+func (t *Tracer) SetPrintReceiver(args bool, reply *struct{}) error {
+	return t.updateDefaultOptions(func(options *tracer.TraceOptions) error {
+		options.PrintReceiver = args
+		return nil
+	})
+}
+
+// SetInterfaces updates the default interfaces whose implementations are printed, which are used at the start trace points
+// without the options. Added in v19.
+func (t *Tracer) SetInterfaces(args []string, reply *struct{}) error {
+	return t.updateDefaultOptions(func(options *tracer.TraceOptions) error {
+		options.Interfaces = args
+		return nil
+	})
+}
+
+func (t *Tracer) updateDefaultOptions(update func(*tracer.TraceOptions) error) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	options := t.defaultOptions
+	if err := update(&options); err != nil {
+		return err
+	}
+	t.defaultOptions = options
+
+	if t.controller == nil {
+		return nil
+	}
+	return t.controller.UpdateDefaultTraceOptions(options)
+}
+
+// recordPath returns the path to which the session's debug api requests are recorded.
+func (t *Tracer) recordPath() string {
+	if t.daemon == nil || RecordPath == "" {
+		return RecordPath
+	}
+	return fmt.Sprintf("%s.%d", RecordPath, t.sessionID)
+}
+
+func (t *Tracer) outputWriter() io.Writer {
+	if t.output == nil {
+		return os.Stdout
+	}
+	return t.output
+}
+
+// controllerOptions converts the options. The tagged log is written to w.
+func (o TraceOptions) controllerOptions(w io.Writer) (tracer.TraceOptions, error) {
+	options := tracer.TraceOptions{TraceLevel: o.TraceLevel, ParseLevel: o.ParseLevel, PrintLocation: o.PrintLocation,
+		SampleRate: o.SampleRate, MaxCallsPerSecond: o.MaxCallsPerSecond,
+		FoldRepeatedCalls: o.FoldRepeatedCalls, CollapseRecursionDepth: o.CollapseRecursionDepth,
+		PrintCallStack: o.PrintCallStack, CallStackParseLevel: o.CallStackParseLevel, LocalVariables: o.LocalVariables,
+		PrintReceiver: o.PrintReceiver, Interfaces: o.Interfaces}
+	var err error
+	if options.IncludeFuncs, err = compileRegexps(o.IncludeFuncs); err != nil {
+		return options, err
+	}
+	if options.ExcludeFuncs, err = compileRegexps(o.ExcludeFuncs); err != nil {
+		return options, err
+	}
+	if options.Format, err = parseOutputFormat(o.OutputFormat); err != nil {
+		return options, err
+	}
+	if o.OutputTag != "" {
+		options.OutputWriter = newTaggedWriter(w, o.OutputTag)
+	}
+	return options, nil
+}
+
+func parseOutputFormat(format string) (tracer.OutputFormat, error) {
+	switch format {
+	case "", "text":
+		return tracer.OutputFormatText, nil
+	case "json":
+		return tracer.OutputFormatJSON, nil
+	case "stats":
+		return tracer.OutputFormatStats, nil
+	}
+	return tracer.OutputFormatText, fmt.Errorf("unknown output format: %s", format)
+}
+
+func compileRegexps(exprs []string) ([]*regexp.Regexp, error) {
+	var regexps []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid function filter %q: %v", expr, err)
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
 // AddEndTracePoint adds a new end trace point.
 func (t *Tracer) AddEndTracePoint(args uintptr, reply *struct{}) error {
 	t.mtx.Lock()
@@ -115,12 +758,26 @@ func (t *Tracer) AddEndTracePoint(args uintptr, reply *struct{}) error {
 	return t.controller.AddEndTracePoint(uint64(args))
 }
 
-// Serve serves the tracer service.
+// AddRegionEndTracePoint adds a new end trace point which ends the region started at the start trace point
+// the function's first arg specifies.
+func (t *Tracer) AddRegionEndTracePoint(args uintptr, reply *struct{}) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.controller == nil {
+		return nil
+	}
+	return t.controller.AddRegionEndTracePoint(uint64(args))
+}
+
+// Serve serves the tracer service. The address is either 'unix:path' or 'hostname:port'. The unix domain socket
+// is accessible only by the owner. The hostname must be the loopback address unless AllowRemote is true, and
+// Secret must not be empty to listen on the hostname:port.
 func Serve(address string) error {
-	tracer := &Tracer{errCh: make(chan error)}
+	tracer := &Tracer{}
 	rpc.Register(tracer)
 
-	listener, err := net.Listen("tcp", address)
+	listener, err := listen(address)
 	if err != nil {
 		return err
 	}
@@ -128,7 +785,7 @@ func Serve(address string) error {
 	// The server is running only for 1 client. So close the listener socket immediately and
 	// do not create a new go routine for a new connection.
 	conn, err := listener.Accept()
-	listener.Close()
+	listener.Close() // the unix domain socket file is removed as well
 	if err != nil {
 		return err
 	}
@@ -137,3 +794,62 @@ func Serve(address string) error {
 	conn.Close() // connection may be closed already
 	return nil
 }
+
+func listen(address string) (net.Listener, error) {
+	network, addr, err := parseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "tcp" && Secret == "" {
+		return nil, fmt.Errorf("the secret is required to listen on the TCP address. Set the %s environment variable", SecretEnvName)
+	}
+
+	if network == "unix" {
+		// Create the socket file without the group and other permissions so that other users can't connect
+		// before chmod.
+		oldMask := syscall.Umask(0077)
+		defer syscall.Umask(oldMask)
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if err := os.Chmod(addr, 0600); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+const unixAddressPrefix = "unix:"
+
+// parseAddress returns the network and address to listen on.
+func parseAddress(address string) (network, addr string, err error) {
+	if strings.HasPrefix(address, unixAddressPrefix) {
+		return "unix", strings.TrimPrefix(address, unixAddressPrefix), nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", "", err
+	}
+	if host == "" {
+		// Do not listen on all the interfaces.
+		host = "127.0.0.1"
+	}
+	if !AllowRemote && !isLoopback(host) {
+		return "", "", fmt.Errorf("the non-loopback address is not allowed: %s", host)
+	}
+	return "tcp", net.JoinHostPort(host, port), nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
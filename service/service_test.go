@@ -1,9 +1,14 @@
 package service
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/rpc"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"testing"
 	"time"
@@ -34,12 +39,121 @@ func TestAttachAndDetach(t *testing.T) {
 	cmd.Process.Wait()
 }
 
+func TestAttach_InvalidSecret(t *testing.T) {
+	Secret = "secret"
+	defer func() { Secret = "" }()
+
+	tracer := &Tracer{}
+	if err := tracer.Attach(AttachArgs{Secret: "invalid"}, nil); err == nil {
+		t.Errorf("should return error")
+	}
+	if tracer.controller != nil {
+		t.Errorf("should not attach")
+	}
+}
+
+func TestAttach_InvalidOptions(t *testing.T) {
+	cmd := exec.Command(testutils.ProgramInfloop)
+	_ = cmd.Start()
+	defer func() { cmd.Process.Kill(); cmd.Process.Wait() }()
+
+	tracer := &Tracer{}
+	args := AttachArgs{
+		Pid:                    cmd.Process.Pid,
+		InitialStartTracePoint: uintptr(testutils.InfloopAddrMain),
+		ProgramPath:            testutils.ProgramInfloop,
+		GoVersion:              runtime.Version(),
+		IncludeFuncs:           []string{"("},
+	}
+	if err := tracer.Attach(args, nil); err == nil {
+		t.Errorf("should return error")
+	}
+	if tracer.controller != nil {
+		t.Errorf("should not attach")
+	}
+
+	// the tracee is not left attached.
+	args.IncludeFuncs = nil
+	if err := tracer.Attach(args, nil); err != nil {
+		t.Fatalf("failed to attach: %v", err)
+	}
+	if err := tracer.Detach(struct{}{}, nil); err != nil {
+		t.Errorf("failed to detach: %v", err)
+	}
+}
+
+func TestSetDefaultOptions(t *testing.T) {
+	tracer := &Tracer{}
+	if err := tracer.SetTraceLevel(2, nil); err != nil {
+		t.Errorf("failed to set trace level: %v", err)
+	}
+	if err := tracer.SetFuncFilters(FuncFiltersArgs{IncludeFuncs: []string{"^main\\."}}, nil); err != nil {
+		t.Errorf("failed to set func filters: %v", err)
+	}
+	if err := tracer.SetPrintLocation(true, nil); err != nil {
+		t.Errorf("failed to set print location: %v", err)
+	}
+	if err := tracer.SetSampling(SamplingArgs{SampleRate: 10, MaxCallsPerSecond: 100}, nil); err != nil {
+		t.Errorf("failed to set sampling: %v", err)
+	}
+	if err := tracer.SetFolding(FoldingArgs{FoldRepeatedCalls: true, CollapseRecursionDepth: 3}, nil); err != nil {
+		t.Errorf("failed to set folding: %v", err)
+	}
+	if err := tracer.SetCallStack(CallStackArgs{PrintCallStack: true, CallStackParseLevel: 1}, nil); err != nil {
+		t.Errorf("failed to set call stack: %v", err)
+	}
+	if err := tracer.SetLocalVariables([]string{"*"}, nil); err != nil {
+		t.Errorf("failed to set local variables: %v", err)
+	}
+	if err := tracer.SetPrintReceiver(true, nil); err != nil {
+		t.Errorf("failed to set print receiver: %v", err)
+	}
+	if err := tracer.SetInterfaces([]string{"io.Writer"}, nil); err != nil {
+		t.Errorf("failed to set interfaces: %v", err)
+	}
+	if tracer.defaultOptions.TraceLevel != 2 || len(tracer.defaultOptions.IncludeFuncs) != 1 || !tracer.defaultOptions.PrintLocation ||
+		tracer.defaultOptions.SampleRate != 10 || tracer.defaultOptions.MaxCallsPerSecond != 100 ||
+		!tracer.defaultOptions.FoldRepeatedCalls || tracer.defaultOptions.CollapseRecursionDepth != 3 ||
+		!tracer.defaultOptions.PrintCallStack || tracer.defaultOptions.CallStackParseLevel != 1 ||
+		len(tracer.defaultOptions.LocalVariables) != 1 || !tracer.defaultOptions.PrintReceiver || len(tracer.defaultOptions.Interfaces) != 1 {
+		t.Errorf("unexpected options: %#v", tracer.defaultOptions)
+	}
+
+	if err := tracer.SetOutputFormat("xml", nil); err == nil {
+		t.Errorf("should return error")
+	}
+	if err := tracer.SetFuncFilters(FuncFiltersArgs{ExcludeFuncs: []string{"("}}, nil); err == nil {
+		t.Errorf("should return error")
+	}
+	if tracer.defaultOptions.Format != 0 || len(tracer.defaultOptions.IncludeFuncs) != 1 {
+		t.Errorf("options should not be changed on error: %#v", tracer.defaultOptions)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	buff := &bytes.Buffer{}
+	tracer := &Tracer{output: buff}
+	if err := tracer.Flush(struct{}{}, nil); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	if !bytes.Equal(buff.Bytes(), FlushMarker) {
+		t.Errorf("unexpected output: %q", buff.Bytes())
+	}
+
+	tag, rest, ok := SplitOutputTag(FlushMarker)
+	if !ok || tag != "" || string(rest) != "\n" {
+		t.Errorf("unexpected split result: %s, %q, %v", tag, rest, ok)
+	}
+}
+
 func TestServe(t *testing.T) {
 	unusedPort, err := findUnusedPort()
 	if err != nil {
 		t.Fatalf("failed to find unused port: %v", err)
 	}
 	addr := fmt.Sprintf(":%d", unusedPort)
+	Secret = "secret"
+	defer func() { Secret = "" }()
 
 	errCh := make(chan error)
 	go func() {
@@ -58,6 +172,245 @@ func TestServe(t *testing.T) {
 	}
 }
 
+func TestServe_NoSecret(t *testing.T) {
+	unusedPort, err := findUnusedPort()
+	if err != nil {
+		t.Fatalf("failed to find unused port: %v", err)
+	}
+
+	if err := Serve(fmt.Sprintf(":%d", unusedPort)); err == nil {
+		t.Errorf("should return error")
+	}
+}
+
+func TestServe_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgo")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "tgo.sock")
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- Serve("unix:" + socketPath)
+	}()
+
+	conn, err := connectNetwork("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	if stat, err := os.Stat(socketPath); err != nil || stat.Mode().Perm() != 0600 {
+		t.Errorf("unexpected socket file: %v, %v", stat, err)
+	}
+	conn.Close()
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("failed to serve: %v", err)
+	}
+}
+
+func TestServeDaemon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgo")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "tgo.sock")
+	go ServeDaemon("unix:"+socketPath, dir)
+
+	var clients []*rpc.Client
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command(testutils.ProgramInfloop)
+		_ = cmd.Start()
+		defer func() { cmd.Process.Kill(); cmd.Process.Wait() }()
+
+		conn, err := connectNetwork("unix", socketPath)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		client := rpc.NewClient(conn)
+		defer client.Close()
+		args := AttachArgs{
+			Pid:                    cmd.Process.Pid,
+			InitialStartTracePoint: uintptr(testutils.InfloopAddrMain),
+			ProgramPath:            testutils.ProgramInfloop,
+			GoVersion:              runtime.Version(),
+		}
+		if err := client.Call("Tracer.Attach", args, &struct{}{}); err != nil {
+			t.Fatalf("failed to attach: %v", err)
+		}
+		clients = append(clients, client)
+	}
+
+	var sessionID int
+	if err := clients[0].Call("Tracer.SessionID", struct{}{}, &sessionID); err != nil || sessionID != 1 {
+		t.Errorf("unexpected session id: %d, %v", sessionID, err)
+	}
+	var sessions []SessionInfo
+	if err := clients[1].Call("Daemon.ListSessions", struct{}{}, &sessions); err != nil || len(sessions) != 1 {
+		t.Fatalf("unexpected sessions: %v, %v", sessions, err)
+	}
+	if sessions[0].ID != 2 || sessions[0].OutputPath != filepath.Join(dir, "tgo-session-2.log") {
+		t.Errorf("unexpected session: %#v", sessions[0])
+	}
+
+	// the session started over the other connection.
+	if err := clients[0].Call("Daemon.KillSession", 2, &struct{}{}); err == nil {
+		t.Errorf("the session of the other connection is killed")
+	}
+	if err := clients[1].Call("Daemon.KillSession", 2, &struct{}{}); err != nil {
+		t.Fatalf("failed to kill session: %v", err)
+	}
+	if err := clients[1].Call("Daemon.ListSessions", struct{}{}, &sessions); err != nil || len(sessions) != 0 {
+		t.Errorf("unexpected sessions: %v, %v", sessions, err)
+	}
+
+	// the session which is not associated with the connection.
+	cmd := exec.Command(testutils.ProgramInfloop)
+	_ = cmd.Start()
+	defer func() { cmd.Process.Kill(); cmd.Process.Wait() }()
+	args := AttachArgs{
+		Pid:                    cmd.Process.Pid,
+		InitialStartTracePoint: uintptr(testutils.InfloopAddrMain),
+		ProgramPath:            testutils.ProgramInfloop,
+		GoVersion:              runtime.Version(),
+	}
+	if err := clients[0].Call("Daemon.Attach", args, &sessionID); err != nil || sessionID != 3 {
+		t.Fatalf("failed to attach: %d, %v", sessionID, err)
+	}
+	if err := clients[0].Call("Daemon.PrintStats", sessionID, &struct{}{}); err != nil {
+		t.Errorf("failed to print stats: %v", err)
+	}
+	if err := clients[0].Call("Daemon.KillSession", sessionID, &struct{}{}); err != nil {
+		t.Fatalf("failed to kill session: %v", err)
+	}
+	if err := clients[0].Call("Daemon.PrintStats", sessionID, &struct{}{}); err == nil {
+		t.Errorf("the killed session is still available")
+	}
+}
+
+func TestServeDaemon_Authenticate(t *testing.T) {
+	defer func(orig string) { Secret = orig }(Secret)
+	Secret = "secret"
+
+	dir, err := ioutil.TempDir("", "tgo")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "tgo.sock")
+	go ServeDaemon("unix:"+socketPath, dir)
+
+	conn, err := connectNetwork("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	var sessions []SessionInfo
+	if err := client.Call("Daemon.ListSessions", struct{}{}, &sessions); err == nil {
+		t.Errorf("not authenticated, but listed")
+	}
+	if err := client.Call("Daemon.Authenticate", "invalid", &struct{}{}); err == nil {
+		t.Errorf("authenticated by the invalid secret")
+	}
+	if err := client.Call("Daemon.Authenticate", "secret", &struct{}{}); err != nil {
+		t.Fatalf("failed to authenticate: %v", err)
+	}
+	if err := client.Call("Daemon.ListSessions", struct{}{}, &sessions); err != nil {
+		t.Errorf("failed to list: %v", err)
+	}
+}
+
+func TestAddSession_ExistingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgo")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	outputPath := filepath.Join(dir, "tgo-session-1.log")
+	if err := ioutil.WriteFile(outputPath, []byte("existing"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	daemon := &Daemon{table: newSessionTable(dir)}
+	if err := daemon.addSession(&Tracer{daemon: daemon}, AttachArgs{}); err == nil {
+		t.Errorf("the existing file is opened")
+	}
+	if data, _ := ioutil.ReadFile(outputPath); string(data) != "existing" {
+		t.Errorf("the existing file is modified: %s", data)
+	}
+}
+
+func TestEndSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgo")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	daemon := &Daemon{table: newSessionTable(dir)}
+	tracer := &Tracer{daemon: daemon}
+	if err := daemon.addSession(tracer, AttachArgs{}); err != nil {
+		t.Fatalf("failed to add session: %v", err)
+	}
+
+	// the tracee exited without the detach.
+	tracer.endSession(nil, tracer.sessionID)
+	if tracer.output != nil {
+		t.Errorf("the closed output file is still used")
+	}
+	if len(daemon.table.sessions) != 0 {
+		t.Errorf("the session is not removed: %v", daemon.table.sessions)
+	}
+}
+
+func TestRecordPath(t *testing.T) {
+	defer func(orig string) { RecordPath = orig }(RecordPath)
+	RecordPath = "tgo.rec"
+
+	if path := (&Tracer{}).recordPath(); path != "tgo.rec" {
+		t.Errorf("unexpected path: %s", path)
+	}
+	if path := (&Tracer{daemon: &Daemon{}, sessionID: 2}).recordPath(); path != "tgo.rec.2" {
+		t.Errorf("unexpected path in the daemon mode: %s", path)
+	}
+
+	RecordPath = ""
+	if path := (&Tracer{daemon: &Daemon{}, sessionID: 2}).recordPath(); path != "" {
+		t.Errorf("unexpected path: %s", path)
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	for i, testdata := range []struct {
+		address, expectedNetwork, expectedAddr string
+		allowRemote, expectError               bool
+	}{
+		{address: "unix:/tmp/tgo.sock", expectedNetwork: "unix", expectedAddr: "/tmp/tgo.sock"},
+		{address: ":8080", expectedNetwork: "tcp", expectedAddr: "127.0.0.1:8080"},
+		{address: "localhost:8080", expectedNetwork: "tcp", expectedAddr: "localhost:8080"},
+		{address: "[::1]:8080", expectedNetwork: "tcp", expectedAddr: "[::1]:8080"},
+		{address: "0.0.0.0:8080", expectError: true},
+		{address: "0.0.0.0:8080", allowRemote: true, expectedNetwork: "tcp", expectedAddr: "0.0.0.0:8080"},
+	} {
+		AllowRemote = testdata.allowRemote
+		network, addr, err := parseAddress(testdata.address)
+		if testdata.expectError {
+			if err == nil {
+				t.Errorf("[%d] should return error", i)
+			}
+			continue
+		}
+		if err != nil || network != testdata.expectedNetwork || addr != testdata.expectedAddr {
+			t.Errorf("[%d] unexpected result: %s, %s, %v", i, network, addr, err)
+		}
+	}
+	AllowRemote = false
+}
+
 func findUnusedPort() (int, error) {
 	listener, err := net.ListenTCP("tcp", &net.TCPAddr{})
 	if err != nil {
@@ -69,11 +422,15 @@ func findUnusedPort() (int, error) {
 }
 
 func connect(addr string) (net.Conn, error) {
+	return connectNetwork("tcp", addr)
+}
+
+func connectNetwork(network, addr string) (net.Conn, error) {
 	const numRetries = 5
 	interval := 100 * time.Millisecond
 	var err error
 	for i := 0; i < numRetries; i++ {
-		conn, err := net.Dial("tcp", addr)
+		conn, err := net.Dial(network, addr)
 		if err == nil {
 			return conn, nil
 		}
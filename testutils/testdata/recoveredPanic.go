@@ -0,0 +1,31 @@
+package main
+
+import "fmt"
+
+func main() {
+	for i := 0; i < 2; i++ {
+		call(i)
+	}
+}
+
+func call(i int) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("recovered:", r)
+		}
+	}()
+	panicIfZero(i)
+}
+
+//go:noinline
+func panicIfZero(i int) {
+	inc(i)
+	if i == 0 {
+		panic("zero")
+	}
+}
+
+//go:noinline
+func inc(i int) int {
+	return i + 1
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ks888/tgo/lib/tracer"
+)
+
+//go:noinline
+func inc(i int) int {
+	return i + 1
+}
+
+func main() {
+	if err := tracer.Start(); err != nil {
+		panic(err)
+	}
+	_ = inc(1)
+	tracer.Stop()
+
+	if err := tracer.Close(); err != nil {
+		panic(err)
+	}
+	// the breakpoints must be removed.
+	fmt.Println(inc(2))
+}
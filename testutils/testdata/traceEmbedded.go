@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+
+	"github.com/ks888/tgo/lib/tracer"
+)
+
+//go:noinline
+func inc(i int) int {
+	return i + 1
+}
+
+func main() {
+	// the tgo binary must not be necessary.
+	os.Setenv("PATH", "")
+	tracer.SetEmbeddedServer(true)
+
+	if err := tracer.Start(); err != nil {
+		panic(err)
+	}
+	_ = inc(1)
+	if err := tracer.Shutdown(); err != nil {
+		panic(err)
+	}
+}
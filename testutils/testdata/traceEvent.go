@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/ks888/tgo/lib/tracer"
+)
+
+//go:noinline
+func inc(i int) int {
+	return i + 1
+}
+
+func main() {
+	done := make(chan bool)
+	tracer.OnEvent(func(event tracer.Event) {
+		fmt.Printf("%s %s\n", event.Type, event.Function)
+		if event.Type == tracer.EventTypeReturn && event.Function == "main.inc" {
+			close(done)
+		}
+	})
+	tracer.SetWriter(ioutil.Discard)
+
+	if err := tracer.Start(); err != nil {
+		panic(err)
+	}
+	_ = inc(1)
+	tracer.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		fmt.Println("timeout")
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ks888/tgo/lib/tracer"
+)
+
+func init() {
+	if err := tracer.TraceFunc("main.outer"); err != nil {
+		panic(err)
+	}
+}
+
+//go:noinline
+func inner(i int) int {
+	return i + 1
+}
+
+//go:noinline
+func outer(i int) int {
+	return inner(i)
+}
+
+func main() {
+	fmt.Println(outer(1), inner(2))
+}
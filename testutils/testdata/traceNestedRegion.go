@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ks888/tgo/lib/tracer"
+)
+
+//go:noinline
+func inc(i int) int {
+	return i + 1
+}
+
+//go:noinline
+func dec(i int) int {
+	return i - 1
+}
+
+func main() {
+	outerBuff, innerBuff := &bytes.Buffer{}, &bytes.Buffer{}
+	outer, err := tracer.StartWithOptions(tracer.WithWriter(outerBuff))
+	if err != nil {
+		panic(err)
+	}
+	inner, err := tracer.StartWithOptions(tracer.WithWriter(innerBuff))
+	if err != nil {
+		panic(err)
+	}
+	_ = inc(1)
+
+	// the inner region is still active.
+	outer.Stop()
+	_ = dec(1)
+
+	inner.Stop()
+	_ = inc(2)
+
+	tracer.Shutdown()
+	fmt.Print("outer:\n", outerBuff.String(), "inner:\n", innerBuff.String())
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ks888/tgo/lib/tracer"
+)
+
+//go:noinline
+func inc(i int) int {
+	return i + 1
+}
+
+//go:noinline
+func dec(i int) int {
+	return i - 1
+}
+
+func main() {
+	buff := &bytes.Buffer{}
+	region, err := tracer.StartWithOptions(tracer.WithWriter(buff), tracer.WithExcludeFuncs("^main.dec$"))
+	if err != nil {
+		panic(err)
+	}
+	_ = dec(inc(1))
+	region.Stop()
+
+	if err := tracer.Trace(func() { _ = inc(dec(1)) }, tracer.WithTraceLevel(2)); err != nil {
+		panic(err)
+	}
+
+	tracer.Stop()
+	fmt.Print("region:\n", buff.String())
+}
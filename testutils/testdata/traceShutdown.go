@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ks888/tgo/lib/tracer"
+)
+
+//go:noinline
+func inc(i int) int {
+	return i + 1
+}
+
+func main() {
+	buff := &bytes.Buffer{}
+	tracer.SetWriter(buff)
+
+	if err := tracer.Start(); err != nil {
+		panic(err)
+	}
+	_ = inc(1)
+	if err := tracer.Shutdown(); err != nil {
+		panic(err)
+	}
+	// the tracing log must be written already.
+	fmt.Print(buff.String())
+	fmt.Println(inc(2))
+}
@@ -0,0 +1,26 @@
+package main
+
+import "time"
+
+var counter int64
+
+//go:noinline
+func write() {
+	counter++
+}
+
+//go:noinline
+func ready() {}
+
+func main() {
+	go func() {
+		for {
+			write()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	// let the writer run on the other thread before the watch point is set.
+	time.Sleep(50 * time.Millisecond)
+	ready()
+	time.Sleep(100 * time.Millisecond)
+}
@@ -93,9 +93,32 @@ var (
 
 	ProgramRecursiveStartStop string
 
+	ProgramTraceRegion string
+
+	ProgramTraceNestedRegion string
+
+	ProgramTraceFunc string
+
+	ProgramTraceEvent string
+
+	ProgramTraceClose string
+
+	ProgramTraceShutdown string
+
+	ProgramTraceEmbedded string
+
 	ProgramSpecialFuncs             string
 	SpecialFuncsAddrMain            uint64
 	SpecialFuncsAddrFirstModuleData uint64
+
+	ProgramWatch             string
+	WatchAddrReady           uint64
+	WatchAddrCounter         uint64
+	WatchAddrFirstModuleData uint64
+
+	ProgramRecoveredPanic             string
+	RecoveredPanicAddrPanicIfZero     uint64
+	RecoveredPanicAddrFirstModuleData uint64
 )
 
 func init() {
@@ -129,9 +152,36 @@ func init() {
 	if err := buildProgramRecursiveStartStop(srcDirname); err != nil {
 		panic(err)
 	}
+	if err := buildProgramTraceRegion(srcDirname); err != nil {
+		panic(err)
+	}
+	if err := buildProgramTraceNestedRegion(srcDirname); err != nil {
+		panic(err)
+	}
+	if err := buildProgramTraceFunc(srcDirname); err != nil {
+		panic(err)
+	}
+	if err := buildProgramTraceEvent(srcDirname); err != nil {
+		panic(err)
+	}
+	if err := buildProgramTraceClose(srcDirname); err != nil {
+		panic(err)
+	}
+	if err := buildProgramTraceShutdown(srcDirname); err != nil {
+		panic(err)
+	}
+	if err := buildProgramTraceEmbedded(srcDirname); err != nil {
+		panic(err)
+	}
 	if err := buildProgramSpecialFuncs(srcDirname); err != nil {
 		panic(err)
 	}
+	if err := buildProgramWatch(srcDirname); err != nil {
+		panic(err)
+	}
+	if err := buildProgramRecoveredPanic(srcDirname); err != nil {
+		panic(err)
+	}
 
 	log.EnableDebugLog = true
 }
@@ -380,6 +430,48 @@ func buildProgramRecursiveStartStop(srcDirname string) error {
 	return buildProgram(ProgramRecursiveStartStop)
 }
 
+func buildProgramTraceRegion(srcDirname string) error {
+	ProgramTraceRegion = srcDirname + "/testdata/traceRegion"
+
+	return buildProgram(ProgramTraceRegion)
+}
+
+func buildProgramTraceNestedRegion(srcDirname string) error {
+	ProgramTraceNestedRegion = srcDirname + "/testdata/traceNestedRegion"
+
+	return buildProgram(ProgramTraceNestedRegion)
+}
+
+func buildProgramTraceFunc(srcDirname string) error {
+	ProgramTraceFunc = srcDirname + "/testdata/traceFunc"
+
+	return buildProgram(ProgramTraceFunc)
+}
+
+func buildProgramTraceEvent(srcDirname string) error {
+	ProgramTraceEvent = srcDirname + "/testdata/traceEvent"
+
+	return buildProgram(ProgramTraceEvent)
+}
+
+func buildProgramTraceClose(srcDirname string) error {
+	ProgramTraceClose = srcDirname + "/testdata/traceClose"
+
+	return buildProgram(ProgramTraceClose)
+}
+
+func buildProgramTraceShutdown(srcDirname string) error {
+	ProgramTraceShutdown = srcDirname + "/testdata/traceShutdown"
+
+	return buildProgram(ProgramTraceShutdown)
+}
+
+func buildProgramTraceEmbedded(srcDirname string) error {
+	ProgramTraceEmbedded = srcDirname + "/testdata/traceEmbedded"
+
+	return buildProgram(ProgramTraceEmbedded)
+}
+
 func buildProgramSpecialFuncs(srcDirname string) error {
 	ProgramSpecialFuncs = srcDirname + "/testdata/specialFuncs"
 
@@ -400,6 +492,48 @@ func buildProgramSpecialFuncs(srcDirname string) error {
 	return walkSymbols(ProgramSpecialFuncs, updateAddressIfMatched)
 }
 
+func buildProgramWatch(srcDirname string) error {
+	ProgramWatch = srcDirname + "/testdata/watch"
+
+	if err := buildProgram(ProgramWatch); err != nil {
+		return err
+	}
+
+	updateAddressIfMatched := func(name string, value uint64) error {
+		switch name {
+		case "main.ready":
+			WatchAddrReady = value
+		case "main.counter":
+			WatchAddrCounter = value
+		case "runtime.firstmoduledata":
+			WatchAddrFirstModuleData = value
+		}
+		return nil
+	}
+
+	return walkSymbols(ProgramWatch, updateAddressIfMatched)
+}
+
+func buildProgramRecoveredPanic(srcDirname string) error {
+	ProgramRecoveredPanic = srcDirname + "/testdata/recoveredPanic"
+
+	if err := buildProgram(ProgramRecoveredPanic); err != nil {
+		return err
+	}
+
+	updateAddressIfMatched := func(name string, value uint64) error {
+		switch name {
+		case "main.panicIfZero":
+			RecoveredPanicAddrPanicIfZero = value
+		case "runtime.firstmoduledata":
+			RecoveredPanicAddrFirstModuleData = value
+		}
+		return nil
+	}
+
+	return walkSymbols(ProgramRecoveredPanic, updateAddressIfMatched)
+}
+
 func buildProgram(programName string) error {
 	// Optimization is enabled, because the tool aims to work well even if the binary is optimized.
 	linkOptions := ""
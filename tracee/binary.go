@@ -25,6 +25,10 @@ const (
 type BinaryFile interface {
 	// FindFunction returns the function info to which the given pc specifies.
 	FindFunction(pc uint64) (*Function, error)
+	// FindFunctionByName returns the function info which has the given fully-qualified name, such as 'main.main' and 'fmt.(*pp).Flag'.
+	FindFunctionByName(name string) (*Function, error)
+	// FindLocation returns the source location to which the given pc specifies.
+	FindLocation(pc uint64) (Location, error)
 	// Close closes the binary file.
 	Close() error
 	// findDwarfTypeByAddr finds the dwarf.Type to which the given address specifies.
@@ -60,6 +64,19 @@ type Function struct {
 	EndAddr uint64
 	// Parameters may be empty due to the lack of information.
 	Parameters []Parameter
+	// LocalVariables are the local variables in the memory, including the ones in the lexical blocks.
+	// Their Offset is negative because they are placed below the parameter list.
+	LocalVariables []Parameter
+}
+
+// Location represents the position in the source code.
+type Location struct {
+	File string
+	Line int
+}
+
+func (l Location) String() string {
+	return fmt.Sprintf("%s:%d", l.File, l.Line)
 }
 
 // Parameter represents a parameter given to or the returned from the function.
@@ -174,6 +191,33 @@ func (b debuggableBinaryFile) FindFunction(pc uint64) (*Function, error) {
 	return reader.Seek(pc)
 }
 
+// FindFunctionByName looks up the function info described in the debug info section by its name.
+func (b debuggableBinaryFile) FindFunctionByName(name string) (*Function, error) {
+	reader := subprogramReader{raw: b.dwarf.Reader(), dwarfData: b.dwarf}
+	return reader.SeekName(name)
+}
+
+// FindLocation looks up the source location using the line table in the debug info section.
+func (b debuggableBinaryFile) FindLocation(pc uint64) (Location, error) {
+	compileUnit, err := b.dwarf.Reader().SeekPC(pc)
+	if err != nil {
+		return Location{}, err
+	}
+
+	lineReader, err := b.dwarf.LineReader(compileUnit)
+	if err != nil {
+		return Location{}, err
+	} else if lineReader == nil {
+		return Location{}, errors.New("no line table")
+	}
+
+	var entry dwarf.LineEntry
+	if err := lineReader.SeekPC(pc, &entry); err != nil {
+		return Location{}, err
+	}
+	return Location{File: entry.File.Name, Line: entry.Line}, nil
+}
+
 // Close releases the resources associated with the binary.
 func (b debuggableBinaryFile) Close() error {
 	return b.closer.Close()
@@ -224,7 +268,7 @@ func (r subprogramReader) Next(setParameters bool) (*Function, error) {
 		}
 
 		if setParameters {
-			function.Parameters, err = r.parameters()
+			function.Parameters, function.LocalVariables, err = r.parameters()
 		}
 		return function, err
 
@@ -256,7 +300,35 @@ func (r subprogramReader) Seek(pc uint64) (*Function, error) {
 			return nil, err
 		}
 
-		function.Parameters, err = r.parameters()
+		function.Parameters, function.LocalVariables, err = r.parameters()
+		return function, err
+	}
+}
+
+func (r subprogramReader) SeekName(name string) (*Function, error) {
+	for {
+		entry, err := r.raw.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			return nil, fmt.Errorf("function not found: %s", name)
+		}
+
+		if entry.Tag != dwarf.TagSubprogram {
+			continue
+		}
+		if r.isInline(entry) || r.name(entry) != name {
+			r.raw.SkipChildren()
+			continue
+		}
+
+		function, err := r.buildFunction(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		function.Parameters, function.LocalVariables, err = r.parameters()
 		return function, err
 	}
 }
@@ -283,14 +355,20 @@ func (r subprogramReader) isInline(subprogram *dwarf.Entry) bool {
 	return subprogram.AttrField(dwarf.AttrInline) != nil
 }
 
-func (r subprogramReader) buildFunction(subprogram *dwarf.Entry) (*Function, error) {
+// name returns the name of the subprogram. It's empty if not found.
+func (r subprogramReader) name(subprogram *dwarf.Entry) string {
 	var name string
-	err := walkUpOrigins(subprogram, r.dwarfData.Data, func(entry *dwarf.Entry) bool {
+	_ = walkUpOrigins(subprogram, r.dwarfData.Data, func(entry *dwarf.Entry) bool {
 		var err error
 		name, err = stringClassAttr(entry, dwarf.AttrName)
 		return err == nil
 	})
-	if err != nil {
+	return name
+}
+
+func (r subprogramReader) buildFunction(subprogram *dwarf.Entry) (*Function, error) {
+	name := r.name(subprogram)
+	if name == "" {
 		return nil, errors.New("name attr not found")
 	}
 
@@ -314,34 +392,45 @@ func (r subprogramReader) buildFunction(subprogram *dwarf.Entry) (*Function, err
 	return &Function{Name: name, StartAddr: lowPC, EndAddr: highPC}, nil
 }
 
-func (r subprogramReader) parameters() ([]Parameter, error) {
-	var params []Parameter
+// parameters returns the parameters and the local variables of the subprogram.
+func (r subprogramReader) parameters() ([]Parameter, []Parameter, error) {
+	var params, localVars []Parameter
+	// depth is the depth of the lexical blocks the reader is in.
+	depth := 0
 	for {
-		param, err := r.nextParameter()
-		if err != nil || param == nil {
+		entry, err := r.raw.Next()
+		if err != nil || entry == nil || (entry.Tag == 0 && depth == 0) {
 			// the parameters are sorted by the name.
 			sort.Slice(params, func(i, j int) bool { return params[i].Offset < params[j].Offset })
-			return params, err
-		}
-
-		params = append(params, *param)
-		r.raw.SkipChildren()
-	}
-}
-
-func (r subprogramReader) nextParameter() (*Parameter, error) {
-	for {
-		param, err := r.raw.Next()
-		if err != nil || param.Tag == 0 {
-			return nil, err
+			sort.Slice(localVars, func(i, j int) bool { return localVars[i].Offset < localVars[j].Offset })
+			return params, localVars, err
 		}
 
-		if param.Tag != dwarf.TagFormalParameter {
-			r.raw.SkipChildren()
+		switch entry.Tag {
+		case 0:
+			depth--
+			continue
+		case dwarf.TagFormalParameter:
+			param, err := r.buildParameter(entry)
+			if err != nil {
+				return params, localVars, err
+			}
+			params = append(params, *param)
+		case dwarf.TagVariable:
+			localVar, err := r.buildLocalVariable(entry)
+			if err != nil {
+				// the local variables are optional. Don't let them hide the parameters.
+				log.Debugf("failed to build the local variable at %#x: %v", entry.Offset, err)
+				break
+			}
+			localVars = append(localVars, *localVar)
+		case dwarf.TagLexDwarfBlock:
+			if entry.Children {
+				depth++
+			}
 			continue
 		}
-
-		return r.buildParameter(param)
+		r.raw.SkipChildren()
 	}
 }
 
@@ -377,6 +466,32 @@ func (r subprogramReader) buildParameter(param *dwarf.Entry) (*Parameter, error)
 	return &Parameter{Name: name, Typ: typ, Offset: offset, IsOutput: isOutput, Exist: exist}, err
 }
 
+func (r subprogramReader) buildLocalVariable(variable *dwarf.Entry) (*Parameter, error) {
+	var name string
+	var typeOffset dwarf.Offset
+	err := walkUpOrigins(variable, r.dwarfData.Data, func(entry *dwarf.Entry) bool {
+		var err error
+		name, err = stringClassAttr(entry, dwarf.AttrName)
+		if err != nil {
+			return false
+		}
+
+		typeOffset, err = referenceClassAttr(entry, dwarf.AttrType)
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	typ, err := r.dwarfData.Type(typeOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	offset, exist, err := r.findLocation(variable)
+	return &Parameter{Name: name, Typ: typ, Offset: offset, Exist: exist}, err
+}
+
 func (r subprogramReader) findLocation(param *dwarf.Entry) (offset int, exist bool, err error) {
 	offset, exist, err = r.findLocationByLocationDesc(param)
 	if err != nil && r.dwarfData.locationList != nil {
@@ -627,10 +742,12 @@ type symbol struct {
 // nonDebuggableBinaryFile represents the binary file WITHOUT DWARF sections.
 type nonDebuggableBinaryFile struct {
 	closer io.Closer
+	// funcSymbols is the map from the function name to its address. Empty if the symbol table is stripped.
+	funcSymbols map[string]uint64
 }
 
-func newNonDebuggableBinaryFile(closer io.Closer) (nonDebuggableBinaryFile, error) {
-	return nonDebuggableBinaryFile{closer: closer}, nil
+func newNonDebuggableBinaryFile(closer io.Closer, funcSymbols map[string]uint64) (nonDebuggableBinaryFile, error) {
+	return nonDebuggableBinaryFile{closer: closer, funcSymbols: funcSymbols}, nil
 }
 
 // FindFunction always returns error because it's difficult to get function info using non-DWARF binary.
@@ -638,6 +755,20 @@ func (b nonDebuggableBinaryFile) FindFunction(pc uint64) (*Function, error) {
 	return nil, errors.New("no DWARF info")
 }
 
+// FindFunctionByName looks up the function in the symbol table. The returned function has only the name and start address.
+func (b nonDebuggableBinaryFile) FindFunctionByName(name string) (*Function, error) {
+	addr, ok := b.funcSymbols[name]
+	if !ok {
+		return nil, fmt.Errorf("function not found: %s (no DWARF info and symbol)", name)
+	}
+	return &Function{Name: name, StartAddr: addr}, nil
+}
+
+// FindLocation always returns error. Use the pclntable instead.
+func (b nonDebuggableBinaryFile) FindLocation(pc uint64) (Location, error) {
+	return Location{}, errors.New("no DWARF info")
+}
+
 func (b nonDebuggableBinaryFile) Close() error {
 	return b.closer.Close()
 }
@@ -712,6 +843,29 @@ var moduleDataType = &dwarf.StructType{
 			},
 			ByteOffset: 24,
 		},
+		&dwarf.StructField{
+			Name: "filetab",
+			Type: &dwarf.StructType{
+				CommonType: dwarf.CommonType{ByteSize: 24},
+				StructName: "[]uint32",
+				Field: []*dwarf.StructField{
+					&dwarf.StructField{
+						Name: "array",
+						Type: &dwarf.PtrType{
+							CommonType: dwarf.CommonType{ByteSize: 8},
+							Type:       &dwarf.UintType{BasicType: dwarf.BasicType{CommonType: dwarf.CommonType{ByteSize: 4}}},
+						},
+						ByteOffset: 0,
+					},
+					&dwarf.StructField{
+						Name:       "len",
+						Type:       &dwarf.IntType{BasicType: dwarf.BasicType{CommonType: dwarf.CommonType{ByteSize: 8}}},
+						ByteOffset: 8,
+					},
+				},
+			},
+			ByteOffset: 48,
+		},
 		&dwarf.StructField{
 			Name:       "findfunctab",
 			Type:       &dwarf.UintType{BasicType: dwarf.BasicType{CommonType: dwarf.CommonType{ByteSize: 8}}},
@@ -737,6 +891,29 @@ var moduleDataType = &dwarf.StructType{
 			Type:       &dwarf.UintType{BasicType: dwarf.BasicType{CommonType: dwarf.CommonType{ByteSize: 8}}},
 			ByteOffset: 208,
 		},
+		&dwarf.StructField{
+			Name: "itablinks",
+			Type: &dwarf.StructType{
+				CommonType: dwarf.CommonType{ByteSize: 24},
+				StructName: "[]*runtime.itab",
+				Field: []*dwarf.StructField{
+					&dwarf.StructField{
+						Name: "array",
+						Type: &dwarf.PtrType{
+							CommonType: dwarf.CommonType{ByteSize: 8},
+							Type:       &dwarf.PtrType{CommonType: dwarf.CommonType{ByteSize: 8}},
+						},
+						ByteOffset: 0,
+					},
+					&dwarf.StructField{
+						Name:       "len",
+						Type:       &dwarf.IntType{BasicType: dwarf.BasicType{CommonType: dwarf.CommonType{ByteSize: 8}}},
+						ByteOffset: 8,
+					},
+				},
+			},
+			ByteOffset: 264,
+		},
 		&dwarf.StructField{
 			Name:       "next",
 			Type:       &dwarf.PtrType{CommonType: dwarf.CommonType{ByteSize: 8}},
@@ -7,6 +7,7 @@ import (
 	"debug/macho"
 	"encoding/binary"
 	"io"
+	"strings"
 )
 
 var locationListSectionNames = []string{
@@ -23,7 +24,7 @@ func openBinaryFile(pathToProgram string, goVersion GoVersion) (BinaryFile, erro
 
 	data, locList, err := findDWARF(machoFile)
 	if err != nil {
-		binaryFile, err := newNonDebuggableBinaryFile(closer)
+		binaryFile, err := newNonDebuggableBinaryFile(closer, findFuncSymbols(machoFile))
 		if err != nil {
 			closer.Close()
 		}
@@ -37,6 +38,23 @@ func openBinaryFile(pathToProgram string, goVersion GoVersion) (BinaryFile, erro
 	return binaryFile, err
 }
 
+func findFuncSymbols(machoFile *macho.File) map[string]uint64 {
+	funcSymbols := make(map[string]uint64)
+	textSection := machoFile.Section("__text")
+	if machoFile.Symtab == nil || textSection == nil {
+		return funcSymbols // the symbol table may be stripped.
+	}
+
+	for _, symbol := range machoFile.Symtab.Syms {
+		if symbol.Value < textSection.Addr || textSection.Addr+textSection.Size <= symbol.Value {
+			continue
+		}
+		// the external symbol has the '_' prefix.
+		funcSymbols[strings.TrimPrefix(symbol.Name, "_")] = symbol.Value
+	}
+	return funcSymbols
+}
+
 func findDWARF(machoFile *macho.File) (data *dwarf.Data, locList []byte, err error) {
 	var locListSection *macho.Section
 	for _, locListSectionName := range locationListSectionNames {
@@ -23,7 +23,7 @@ func openBinaryFile(pathToProgram string, goVersion GoVersion) (BinaryFile, erro
 
 	data, locList, err := findDWARF(elfFile)
 	if err != nil {
-		binaryFile, err := newNonDebuggableBinaryFile(closer)
+		binaryFile, err := newNonDebuggableBinaryFile(closer, findFuncSymbols(elfFile))
 		if err != nil {
 			closer.Close()
 		}
@@ -37,6 +37,17 @@ func openBinaryFile(pathToProgram string, goVersion GoVersion) (BinaryFile, erro
 	return binaryFile, err
 }
 
+func findFuncSymbols(elfFile *elf.File) map[string]uint64 {
+	funcSymbols := make(map[string]uint64)
+	symbols, _ := elfFile.Symbols() // the symbol table may be stripped.
+	for _, symbol := range symbols {
+		if elf.ST_TYPE(symbol.Info) == elf.STT_FUNC {
+			funcSymbols[symbol.Name] = symbol.Value
+		}
+	}
+	return funcSymbols
+}
+
 func findDWARF(elfFile *elf.File) (data *dwarf.Data, locList []byte, err error) {
 	var locListSection *elf.Section
 	for _, locListSectionName := range locationListSectionNames {
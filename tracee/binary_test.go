@@ -6,6 +6,7 @@ import (
 	"debug/macho"
 	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/ks888/tgo/testutils"
@@ -67,6 +68,49 @@ func TestFindFunction(t *testing.T) {
 	}
 }
 
+func TestFindFunctionByName(t *testing.T) {
+	binary, _ := OpenBinaryFile(testutils.ProgramHelloworld, GoVersion{})
+	function, err := binary.FindFunctionByName("main.oneParameter")
+	if err != nil {
+		t.Fatalf("failed to find function: %v", err)
+	}
+
+	if function.StartAddr != testutils.HelloworldAddrOneParameter {
+		t.Errorf("wrong start address: %#x", function.StartAddr)
+	}
+	if len(function.Parameters) != 2 {
+		t.Errorf("wrong parameters: %v", function.Parameters)
+	}
+}
+
+func TestFindFunctionByName_NotFound(t *testing.T) {
+	for _, program := range []string{testutils.ProgramHelloworld, testutils.ProgramHelloworldNoDwarf} {
+		binary, _ := OpenBinaryFile(program, GoVersion{})
+		if _, err := binary.FindFunctionByName("main.notExist"); err == nil {
+			t.Errorf("error not returned: %s", program)
+		}
+	}
+}
+
+func TestFindLocation(t *testing.T) {
+	binary, _ := OpenBinaryFile(testutils.ProgramHelloworld, GoVersion{})
+	location, err := binary.FindLocation(testutils.HelloworldAddrNoParameter)
+	if err != nil {
+		t.Fatalf("failed to find location: %v", err)
+	}
+
+	if !strings.HasSuffix(location.File, "helloworld.go") || location.Line != 9 {
+		t.Errorf("unexpected location: %s", location)
+	}
+}
+
+func TestFindLocation_NoDwarf(t *testing.T) {
+	binary, _ := OpenBinaryFile(testutils.ProgramHelloworldNoDwarf, GoVersion{})
+	if _, err := binary.FindLocation(testutils.HelloworldAddrNoParameter); err == nil {
+		t.Errorf("should return error")
+	}
+}
+
 func TestIsExported(t *testing.T) {
 	for i, testdata := range []struct {
 		name     string
@@ -208,6 +252,9 @@ func TestSeek_HasVariableBeforeParameter(t *testing.T) {
 	if function.Parameters[0].Name != "i" {
 		t.Errorf("invalid parameter name: %s", function.Parameters[0].Name)
 	}
+	if len(function.LocalVariables) != 1 || function.LocalVariables[0].Name != "a" || function.LocalVariables[0].IsOutput {
+		t.Errorf("invalid local variables: %v", function.LocalVariables)
+	}
 }
 
 func TestSeek_HasTwoParameters(t *testing.T) {
@@ -0,0 +1,182 @@
+package tracee
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The layouts of the runtime.itab, runtime.interfacetype, runtime._type and runtime.name types.
+// They are same in go 1.10 and 1.11.
+const (
+	itabInterOffset = 0
+	itabFunOffset   = 24
+	// mhdr follows the _type and pkgpath fields.
+	interfaceTypeMhdrOffset = 56
+	imethodSize             = 8
+	typeTflagOffset         = 20
+	typeStrOffset           = 40
+	// tflagExtraStar means the name in the str field has the extra '*' prefix.
+	tflagExtraStar = 1 << 1
+	// the name data is prefixed by 1 byte flags and 2 bytes big-endian length.
+	nameHeaderSize = 3
+)
+
+// FindInterfaceMethodImpls returns the start addresses of the functions which implement the method of the interface.
+// name is the interface name like "io.Writer", which selects all the methods, or the method name like "io.Writer.Write".
+// The package path is ignored because the runtime type name has only the package name.
+//
+// The implementations are found by scanning the itabs in the module data, so the ones whose itab is created at run time,
+// such as by the type assertion to the interface, are not found. If the receiver is not a pointer, the address may be
+// the wrapper function the compiler generated.
+func (p *Process) FindInterfaceMethodImpls(name string) ([]uint64, error) {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	var addrs []uint64
+	for _, md := range p.moduleDataList {
+		if _, ok := md.fields["itablinks"]; !ok {
+			return nil, errors.New("no itablinks field in the module data")
+		}
+
+		ptrToArrayType, ptrToArray := md.retrieveArrayInSlice(p.debugapiClient, "itablinks")
+		if ptrToArrayType == nil {
+			continue
+		}
+
+		numItabs := md.retrieveSliceLen(p.debugapiClient, "itablinks")
+		for i := 0; i < numItabs; i++ {
+			itabAddr, err := p.readUint64(ptrToArray + uint64(i)*8)
+			if err != nil {
+				return nil, err
+			}
+
+			implAddrs, err := p.findItabMethods(itabAddr, name)
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, implAddrs...)
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no implementation of %s found", name)
+	}
+	return addrs, nil
+}
+
+// findItabMethods returns the addresses of the methods in the itab if the itab's interface or its method has the name.
+func (p *Process) findItabMethods(itabAddr uint64, name string) ([]uint64, error) {
+	interfaceTypeAddr, err := p.readUint64(itabAddr + itabInterOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	interfaceName, err := p.resolveTypeName(interfaceTypeAddr)
+	if err != nil {
+		return nil, err
+	}
+	if name != interfaceName && !strings.HasPrefix(name, interfaceName+".") {
+		return nil, nil
+	}
+
+	mhdr, err := p.readUint64(interfaceTypeAddr + interfaceTypeMhdrOffset)
+	if err != nil {
+		return nil, err
+	}
+	numMethods, err := p.readUint64(interfaceTypeAddr + interfaceTypeMhdrOffset + 8)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []uint64
+	for i := uint64(0); i < numMethods; i++ {
+		if name != interfaceName {
+			methodName, err := p.resolveMethodName(interfaceTypeAddr, mhdr+i*imethodSize)
+			if err != nil {
+				return nil, err
+			}
+			if name != interfaceName+"."+methodName {
+				continue
+			}
+		}
+
+		// the fun array is in the same order as the methods of the interface.
+		addr, err := p.readUint64(itabAddr + itabFunOffset + i*8)
+		if err != nil {
+			return nil, err
+		}
+		if addr == 0 {
+			continue // the type doesn't implement the interface.
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func (p *Process) resolveTypeName(typeAddr uint64) (string, error) {
+	buff := make([]byte, 1)
+	if err := p.debugapiClient.ReadMemory(typeAddr+typeTflagOffset, buff); err != nil {
+		return "", err
+	}
+	tflag := buff[0]
+
+	buff = make([]byte, 4)
+	if err := p.debugapiClient.ReadMemory(typeAddr+typeStrOffset, buff); err != nil {
+		return "", err
+	}
+
+	name, err := p.resolveTypeNameoff(typeAddr, int32(binary.LittleEndian.Uint32(buff)))
+	if err != nil {
+		return "", err
+	}
+	if tflag&tflagExtraStar != 0 {
+		name = strings.TrimPrefix(name, "*")
+	}
+	return name, nil
+}
+
+func (p *Process) resolveMethodName(interfaceTypeAddr, imethodAddr uint64) (string, error) {
+	buff := make([]byte, 4)
+	if err := p.debugapiClient.ReadMemory(imethodAddr, buff); err != nil {
+		return "", err
+	}
+	return p.resolveTypeNameoff(interfaceTypeAddr, int32(binary.LittleEndian.Uint32(buff)))
+}
+
+// resolveTypeNameoff returns the name at the offset from the types section of the module which contains the type,
+// same as the runtime.resolveNameOff.
+func (p *Process) resolveTypeNameoff(typeAddr uint64, nameoff int32) (string, error) {
+	var md *moduleData
+	for _, candidate := range p.moduleDataList {
+		if candidate.types(p.debugapiClient) <= typeAddr && typeAddr < candidate.etypes(p.debugapiClient) {
+			md = candidate
+			break
+		}
+	}
+	if md == nil {
+		return "", fmt.Errorf("no moduledata found for type %#x", typeAddr)
+	}
+
+	nameAddr := md.types(p.debugapiClient) + uint64(nameoff)
+	header := make([]byte, nameHeaderSize)
+	if err := p.debugapiClient.ReadMemory(nameAddr, header); err != nil {
+		return "", err
+	}
+
+	data := make([]byte, int(header[1])<<8|int(header[2]))
+	if err := p.debugapiClient.ReadMemory(nameAddr+nameHeaderSize, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (p *Process) readUint64(addr uint64) (uint64, error) {
+	buff := make([]byte, 8)
+	if err := p.debugapiClient.ReadMemory(addr, buff); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buff), nil
+}
@@ -3,6 +3,7 @@ package tracee
 import (
 	"debug/dwarf"
 	"encoding/binary"
+	"errors"
 	"fmt"
 
 	"github.com/ks888/tgo/log"
@@ -64,6 +65,23 @@ func (md *moduleData) functab(reader memoryReader, index int) (entry, funcoff ui
 	return
 }
 
+// fileoff returns the offset of the file name in the pclntable. The file name is specified by the `index` of the filetab.
+func (md *moduleData) fileoff(reader memoryReader, index int) (uint32, error) {
+	if _, ok := md.fields["filetab"]; !ok {
+		return 0, errors.New("no filetab field in moduledata")
+	}
+	if index < 0 || index >= md.retrieveSliceLen(reader, "filetab") {
+		return 0, fmt.Errorf("invalid filetab index: %d", index)
+	}
+
+	_, ptrToArray := md.retrieveArrayInSlice(reader, "filetab")
+	buff := make([]byte, 4)
+	if err := reader.ReadMemory(ptrToArray+uint64(index)*4, buff); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(buff), nil
+}
+
 func (md *moduleData) ftabLen(reader memoryReader) int {
 	return md.retrieveSliceLen(reader, "ftab")
 }
@@ -3,6 +3,7 @@ package tracee
 import (
 	"debug/dwarf"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"sort"
 	"strings"
@@ -21,12 +22,14 @@ type breakpoint struct {
 
 // Process represents the tracee process launched by or attached to this tracer.
 type Process struct {
-	debugapiClient *debugapi.Client
+	debugapiClient debugapi.ClientInterface
 	breakpoints    map[uint64]breakpoint
 	Binary         BinaryFile
 	GoVersion      GoVersion
 	moduleDataList []*moduleData
 	valueParser    valueParser
+	// locations caches the source locations, since the same pc is looked up repeatedly.
+	locations map[uint64]Location
 }
 
 const countDisabled = -1
@@ -36,7 +39,10 @@ type StackFrame struct {
 	Function        *Function
 	InputArguments  []Argument
 	OutputArguments []Argument
-	ReturnAddress   uint64
+	// LocalVariables are the function's local variables. Their values are meaningful only when the function returns
+	// or is about to return, and may be stale if they were kept in the registers.
+	LocalVariables []Argument
+	ReturnAddress  uint64
 }
 
 // Attributes specifies the set of tracee's attributes.
@@ -44,11 +50,25 @@ type Attributes struct {
 	ProgramPath         string
 	CompiledGoVersion   string
 	FirstModuleDataAddr uint64
+	// RemoteStubAddr is the address of the remote stub, such as gdbserver, which controls the tracee process.
+	// If empty, the tracee process is controlled directly. Linux only.
+	RemoteStubAddr string
+	// RecordPath is the path of the file to which the results of the debug api requests are recorded.
+	RecordPath string
+	// ReplayPath is the path of the recorded file. If specified, the recorded results are served back instead of
+	// controlling the actual process.
+	ReplayPath string
+	// DebugapiClient is the client to control the tracee process. If nil, the client is chosen based on the other attributes.
+	// It's useful to use the fake client in tests.
+	DebugapiClient debugapi.ClientInterface
 }
 
 // LaunchProcess launches new tracee process.
 func LaunchProcess(name string, arg []string, attrs Attributes) (*Process, error) {
-	debugapiClient := debugapi.NewClient()
+	debugapiClient, err := newDebugapiClient(attrs)
+	if err != nil {
+		return nil, err
+	}
 	if err := debugapiClient.LaunchProcess(name, arg...); err != nil {
 		return nil, err
 	}
@@ -65,11 +85,13 @@ func LaunchProcess(name string, arg []string, attrs Attributes) (*Process, error
 
 // AttachProcess attaches to the existing tracee process.
 func AttachProcess(pid int, attrs Attributes) (*Process, error) {
-	debugapiClient := debugapi.NewClient()
-	err := debugapiClient.AttachProcess(pid)
+	debugapiClient, err := newDebugapiClient(attrs)
 	if err != nil {
 		return nil, err
 	}
+	if err := debugapiClient.AttachProcess(pid); err != nil {
+		return nil, err
+	}
 
 	proc, err := newProcess(debugapiClient, attrs)
 	if err != nil {
@@ -78,8 +100,8 @@ func AttachProcess(pid int, attrs Attributes) (*Process, error) {
 	return proc, err
 }
 
-func newProcess(debugapiClient *debugapi.Client, attrs Attributes) (*Process, error) {
-	proc := &Process{debugapiClient: debugapiClient, breakpoints: make(map[uint64]breakpoint)}
+func newProcess(debugapiClient debugapi.ClientInterface, attrs Attributes) (*Process, error) {
+	proc := &Process{debugapiClient: debugapiClient, breakpoints: make(map[uint64]breakpoint), locations: make(map[uint64]Location)}
 
 	proc.GoVersion = ParseGoVersion(attrs.CompiledGoVersion)
 	var err error
@@ -136,6 +158,16 @@ func (p *Process) close() error {
 	return p.Binary.Close()
 }
 
+// Interrupt stops the running process asynchronously. ContinueAndWait returns the interrupted event after all the threads are stopped.
+// It returns error if the debug api client doesn't support it.
+func (p *Process) Interrupt() error {
+	interrupter, ok := p.debugapiClient.(debugapi.Interrupter)
+	if !ok {
+		return errors.New("interrupt is not supported")
+	}
+	return interrupter.Interrupt()
+}
+
 // ContinueAndWait continues the execution and waits until an event happens.
 // Note that the id of the stopped thread may be different from the id of the continued thread.
 func (p *Process) ContinueAndWait() (debugapi.Event, error) {
@@ -237,6 +269,23 @@ func (p *Process) ExistBreakpoint(addr uint64) bool {
 	return ok
 }
 
+// SetWatchpoint sets the hardware watchpoint which traps the write access to the memory region [addr, addr+size).
+// The size must be 1, 2, 4 or 8 and the addr must be aligned to the size. At most 4 watchpoints can be set.
+// Unlike the breakpoint, the thread is trapped after the write instruction is executed.
+func (p *Process) SetWatchpoint(addr uint64, size int) error {
+	return p.debugapiClient.SetWatchpoint(addr, size)
+}
+
+// ClearWatchpoint clears the hardware watchpoint at the specified address.
+func (p *Process) ClearWatchpoint(addr uint64) error {
+	return p.debugapiClient.ClearWatchpoint(addr)
+}
+
+// HitWatchpoint returns the address of the watchpoint if the specified thread is trapped by the watchpoint.
+func (p *Process) HitWatchpoint(threadID int) (uint64, bool, error) {
+	return p.debugapiClient.HitWatchpoint(threadID)
+}
+
 // StackFrameAt returns the stack frame to which the given rbp specified.
 // To get the correct stack frame, it assumes:
 // * rsp points to the return address.
@@ -261,14 +310,86 @@ func (p *Process) StackFrameAt(rsp, rip uint64) (*StackFrame, error) {
 		return nil, err
 	}
 
+	// the local variables are placed relative to the CFA as well as the parameters.
+	localVars, _, err := p.currentArgs(function.LocalVariables, rsp+8)
+	if err != nil {
+		return nil, err
+	}
+
 	return &StackFrame{
 		Function:        function,
 		ReturnAddress:   retAddr,
 		InputArguments:  inputArgs,
 		OutputArguments: outputArgs,
+		LocalVariables:  localVars,
 	}, nil
 }
 
+// CallStack returns at most maxFrames stack frames from the current function to the outermost one.
+// Unlike StackFrameAt, rip may point to the middle of the function. The return address is found using the pc-sp table.
+// The stack frames of the callers are found using the pc-sp tables in the pclntable, same as the runtime's traceback.
+// The frames found before the error are returned if the stack can't be unwound to the outermost one.
+func (p *Process) CallStack(rsp, rip uint64, maxFrames int) ([]*StackFrame, error) {
+	spDelta, err := p.spDelta(rip)
+	if err != nil {
+		return nil, err
+	}
+	rsp += uint64(spDelta)
+
+	var frames []*StackFrame
+	for len(frames) < maxFrames {
+		frame, err := p.StackFrameAt(rsp, rip)
+		if err != nil {
+			if len(frames) == 0 {
+				return nil, err
+			}
+			break
+		}
+		frames = append(frames, frame)
+
+		callInstAddr := frame.ReturnAddress - 1
+		caller, err := p.FindFunction(callInstAddr)
+		if err != nil || caller.Name == "runtime.goexit" || caller.Name == "runtime.mstart" {
+			break // the outermost function, or the caller is unknown
+		}
+		spDelta, err := p.spDelta(callInstAddr)
+		if err != nil {
+			break
+		}
+		// the caller's sp at the call instruction is next to the return address.
+		rsp = rsp + 8 + uint64(spDelta)
+		rip = callInstAddr
+	}
+	return frames, nil
+}
+
+// spDelta returns the offset from the sp to the return address of the function at the pc, same as the runtime.funcspdelta.
+func (p *Process) spDelta(pc uint64) (int32, error) {
+	md := p.findModuleDataByPC(pc)
+	if md == nil {
+		return 0, fmt.Errorf("no moduledata found for pc %#x", pc)
+	}
+
+	funcTypeVal, _, err := p.findFuncType(md, pc)
+	if err != nil {
+		return 0, err
+	}
+
+	var entry uint64
+	var pcsp int32
+	for _, field := range _funcType.Field {
+		rawData := funcTypeVal[field.ByteOffset : field.ByteOffset+field.Type.Size()]
+		switch field.Name {
+		case "entry":
+			entry = binary.LittleEndian.Uint64(rawData)
+		case "pcsp":
+			pcsp = int32(binary.LittleEndian.Uint32(rawData))
+		}
+	}
+
+	return p.pcValue(md, pcsp, entry, pc)
+}
+
 // FindFunction finds the function to which pc specifies.
 func (p *Process) FindFunction(pc uint64) (*Function, error) {
 	function, err := p.Binary.FindFunction(pc)
@@ -281,6 +402,24 @@ func (p *Process) FindFunction(pc uint64) (*Function, error) {
 	return p.findFunctionByModuleData(pc)
 }
 
+// FindLocation finds the source location to which pc specifies. The line table in the debug info section is used
+// if available. Otherwise, the pc-file and pc-line tables in the pclntable are used.
+func (p *Process) FindLocation(pc uint64) (Location, error) {
+	if location, ok := p.locations[pc]; ok {
+		return location, nil
+	}
+
+	location, err := p.Binary.FindLocation(pc)
+	if err != nil {
+		location, err = p.findLocationByModuleData(pc)
+		if err != nil {
+			return Location{}, err
+		}
+	}
+	p.locations[pc] = location
+	return location, nil
+}
+
 func (p *Process) fillInOutputParameters(pc uint64, params []Parameter) {
 	if !p.canFillInOutputParameters(pc, params) {
 		return
@@ -471,6 +610,21 @@ var _funcType = &dwarf.StructType{
 			Type:       &dwarf.IntType{BasicType: dwarf.BasicType{CommonType: dwarf.CommonType{ByteSize: 4}}},
 			ByteOffset: 12,
 		},
+		&dwarf.StructField{
+			Name:       "pcsp",
+			Type:       &dwarf.IntType{BasicType: dwarf.BasicType{CommonType: dwarf.CommonType{ByteSize: 4}}},
+			ByteOffset: 20,
+		},
+		&dwarf.StructField{
+			Name:       "pcfile",
+			Type:       &dwarf.IntType{BasicType: dwarf.BasicType{CommonType: dwarf.CommonType{ByteSize: 4}}},
+			ByteOffset: 24,
+		},
+		&dwarf.StructField{
+			Name:       "pcln",
+			Type:       &dwarf.IntType{BasicType: dwarf.BasicType{CommonType: dwarf.CommonType{ByteSize: 4}}},
+			ByteOffset: 28,
+		},
 	},
 }
 
@@ -525,6 +679,107 @@ func (p *Process) findFunctionByModuleData(pc uint64) (*Function, error) {
 	return &Function{Name: funcName, StartAddr: entry, EndAddr: endAddr, Parameters: params}, nil
 }
 
+// findLocationByModuleData has the same logic as the runtime.funcline.
+func (p *Process) findLocationByModuleData(pc uint64) (Location, error) {
+	md := p.findModuleDataByPC(pc)
+	if md == nil {
+		return Location{}, fmt.Errorf("no moduledata found for pc %#x", pc)
+	}
+
+	funcTypeVal, _, err := p.findFuncType(md, pc)
+	if err != nil {
+		return Location{}, err
+	}
+
+	var entry uint64
+	var pcfile, pcln int32
+	for _, field := range _funcType.Field {
+		rawData := funcTypeVal[field.ByteOffset : field.ByteOffset+field.Type.Size()]
+		switch field.Name {
+		case "entry":
+			entry = binary.LittleEndian.Uint64(rawData)
+		case "pcfile":
+			pcfile = int32(binary.LittleEndian.Uint32(rawData))
+		case "pcln":
+			pcln = int32(binary.LittleEndian.Uint32(rawData))
+		}
+	}
+
+	fileIndex, err := p.pcValue(md, pcfile, entry, pc)
+	if err != nil {
+		return Location{}, err
+	}
+	line, err := p.pcValue(md, pcln, entry, pc)
+	if err != nil {
+		return Location{}, err
+	}
+
+	fileoff, err := md.fileoff(p.debugapiClient, int(fileIndex))
+	if err != nil {
+		return Location{}, err
+	}
+	file, err := p.resolveNameoff(md, int(fileoff))
+	if err != nil {
+		return Location{}, err
+	}
+	return Location{File: file, Line: int(line)}, nil
+}
+
+// pcValue decodes the pc-value table at the offset of the pclntable and returns the value at the pc.
+// The logic is same as the runtime.pcvalue. The table is the sequence of the (value delta, pc delta) pairs.
+// Each value delta is zig-zag encoded varint and each pc delta is varint.
+func (p *Process) pcValue(md *moduleData, tableOffset int32, entry, pc uint64) (int32, error) {
+	if tableOffset == 0 {
+		return 0, errors.New("no pc-value table")
+	}
+
+	reader := &memoryByteReader{reader: p.debugapiClient, addr: md.pclntable(p.debugapiClient, int(tableOffset))}
+	val := int32(-1)
+	currPC := entry
+	for first := true; ; first = false {
+		uvdelta, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return 0, err
+		}
+		if uvdelta == 0 && !first {
+			return 0, fmt.Errorf("pc %#x not found in the pc-value table", pc)
+		}
+		val += int32(-(uint32(uvdelta) & 1) ^ (uint32(uvdelta) >> 1))
+
+		pcdelta, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return 0, err
+		}
+		currPC += pcdelta // the pc quantum is 1 in amd64
+		if pc < currPC {
+			return val, nil
+		}
+	}
+}
+
+// memoryByteReader reads the tracee's memory byte by byte. The memory is actually read in the small chunk.
+type memoryByteReader struct {
+	reader memoryReader
+	addr   uint64
+	buff   []byte
+}
+
+func (r *memoryByteReader) ReadByte() (byte, error) {
+	if len(r.buff) == 0 {
+		const chunkSize = 64
+		buff := make([]byte, chunkSize)
+		if err := r.reader.ReadMemory(r.addr, buff); err != nil {
+			return 0, err
+		}
+		r.buff = buff
+		r.addr += chunkSize
+	}
+
+	b := r.buff[0]
+	r.buff = r.buff[1:]
+	return b, nil
+}
+
 func (p *Process) findModuleDataByPC(pc uint64) *moduleData {
 	for _, moduleData := range p.moduleDataList {
 		if moduleData.minpc(p.debugapiClient) <= pc && pc < moduleData.maxpc(p.debugapiClient) {
@@ -724,6 +979,29 @@ type GoRoutineInfo struct {
 	NextDeferFuncAddr uint64
 	Panicking         bool
 	PanicHandler      *PanicHandler
+	// Panic is the panic the go routine is handling. nil if not panicking.
+	Panic *Panic
+}
+
+// Panic describes the panic the go routine is handling.
+type Panic struct {
+	// Recovered is true if the panic is recovered and the go routine is going to return to the deferring function.
+	Recovered bool
+	// Goexit is true if the panic is the one runtime.Goexit uses to run the deferred functions (go1.14 or later).
+	Goexit bool
+	// parseValue lazily parses the value passed to panic(). nil if the type of the value is unknown.
+	parseValue func(int) value
+}
+
+// ParseValue parses the value passed to panic() and returns its string representation.
+func (p *Panic) ParseValue(depth int) string {
+	if p.parseValue == nil {
+		return "-"
+	}
+	if val := p.parseValue(depth); val != nil {
+		return val.String()
+	}
+	return "-"
 }
 
 // PanicHandler holds the function info which (will) handles panic.
@@ -767,12 +1045,19 @@ func (p *Process) CurrentGoRoutineInfo(threadID int) (GoRoutineInfo, error) {
 	}
 	usedStackSize := stackHi - regs.Rsp
 
-	_, panicRawVal, err := p.findFieldInStruct(gAddr, p.Binary.runtimeGType(), "_panic")
+	ptrToPanicType, panicRawVal, err := p.findFieldInStruct(gAddr, p.Binary.runtimeGType(), "_panic")
 	if err != nil {
 		return GoRoutineInfo{}, err
 	}
 	panicAddr := binary.LittleEndian.Uint64(panicRawVal)
 	panicking := panicAddr != 0
+	var panicInfo *Panic
+	if panicking {
+		panicInfo, err = p.findPanic(panicAddr, ptrToPanicType)
+		if err != nil {
+			return GoRoutineInfo{}, err
+		}
+	}
 
 	panicHandler, err := p.findPanicHandler(gAddr, panicAddr, stackHi)
 	if err != nil {
@@ -784,7 +1069,35 @@ func (p *Process) CurrentGoRoutineInfo(threadID int) (GoRoutineInfo, error) {
 		return GoRoutineInfo{}, err
 	}
 
-	return GoRoutineInfo{ID: id, UsedStackSize: usedStackSize, CurrentPC: regs.Rip, CurrentStackAddr: regs.Rsp, NextDeferFuncAddr: nextDeferFuncAddr, Panicking: panicking, PanicHandler: panicHandler}, nil
+	return GoRoutineInfo{ID: id, UsedStackSize: usedStackSize, CurrentPC: regs.Rip, CurrentStackAddr: regs.Rsp, NextDeferFuncAddr: nextDeferFuncAddr, Panicking: panicking, PanicHandler: panicHandler, Panic: panicInfo}, nil
+}
+
+func (p *Process) findPanic(panicAddr uint64, ptrToPanicType dwarf.Type) (*Panic, error) {
+	panicType := ptrToPanicType.(*dwarf.PtrType).Type
+	if panicType == nil {
+		return &Panic{}, nil // the type is unknown if DWARF is not available.
+	}
+
+	panicInfo := &Panic{}
+	_, rawVal, err := p.findFieldInStruct(panicAddr, panicType, "recovered")
+	if err != nil {
+		return nil, err
+	}
+	panicInfo.Recovered = rawVal[0] != 0
+
+	// the field is added in go1.14.
+	if _, rawVal, err := p.findFieldInStruct(panicAddr, panicType, "goexit"); err == nil {
+		panicInfo.Goexit = rawVal[0] != 0
+	}
+
+	argType, argRawVal, err := p.findFieldInStruct(panicAddr, panicType, "arg")
+	if err != nil {
+		return nil, err
+	}
+	panicInfo.parseValue = func(depth int) value {
+		return p.valueParser.parseValue(argType, argRawVal, depth)
+	}
+	return panicInfo, nil
 }
 
 func (p *Process) singleStepUnspecifiedThreads(threadID int, err debugapi.UnspecifiedThreadError) error {
@@ -937,3 +1250,11 @@ func (arg Argument) ParseValue(depth int) string {
 	}
 	return fmt.Sprintf("%s = %s", arg.Name, valStr)
 }
+
+// Value parses the arg value and returns it as the Go value. The signed integers are converted to int64, the unsigned
+// integers to uint64, the floats to float64 and the complexes to complex128. The slice and array are converted to
+// []interface{}, the struct to map[string]interface{} and the map to map[interface{}]interface{}, whose keys are converted by MapKey.
+// The pointer and interface are dereferenced. nil is returned if the value is nil or not parsed.
+func (arg Argument) Value(depth int) interface{} {
+	return nativeValue(arg.parseValue(depth))
+}
@@ -1,5 +1,38 @@
 package tracee
 
+import (
+	"os"
+
+	"github.com/ks888/tgo/debugapi"
+)
+
+func newDebugapiClient(attrs Attributes) (debugapi.ClientInterface, error) {
+	if attrs.DebugapiClient != nil {
+		return attrs.DebugapiClient, nil
+	}
+	if attrs.ReplayPath != "" {
+		f, err := os.Open(attrs.ReplayPath)
+		if err != nil {
+			return nil, err
+		}
+		return debugapi.NewReplayClient(f), nil
+	}
+
+	var client debugapi.ClientInterface = debugapi.NewClient()
+	if attrs.RemoteStubAddr != "" {
+		client = debugapi.NewRemoteClient(attrs.RemoteStubAddr)
+	}
+
+	if attrs.RecordPath != "" {
+		f, err := os.Create(attrs.RecordPath)
+		if err != nil {
+			return nil, err
+		}
+		client = debugapi.NewRecordingClient(client, f)
+	}
+	return client, nil
+}
+
 func (p *Process) offsetToG() int32 {
 	return -8
 }
@@ -4,8 +4,10 @@ import (
 	"debug/dwarf"
 	"os/exec"
 	"runtime"
+	"strings"
 	"testing"
 
+	"github.com/ks888/tgo/debugapi/fake"
 	"github.com/ks888/tgo/testutils"
 	"golang.org/x/arch/x86/x86asm"
 )
@@ -32,6 +34,32 @@ func TestLaunchProcess(t *testing.T) {
 	}
 }
 
+func TestLaunchProcess_FakeClient(t *testing.T) {
+	client := fake.NewClient()
+	if err := client.LoadELF(testutils.ProgramHelloworld); err != nil {
+		t.Fatalf("failed to load elf: %v", err)
+	}
+	attrs := helloworldAttr
+	attrs.DebugapiClient = client
+
+	proc, err := LaunchProcess(testutils.ProgramHelloworld, nil, attrs)
+	if err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	if !client.Launched {
+		t.Errorf("fake client is not used")
+	}
+
+	if err := proc.SetBreakpoint(testutils.HelloworldAddrMain); err != nil {
+		t.Fatalf("failed to set breakpoint: %v", err)
+	}
+	insts := make([]byte, 1)
+	_ = client.ReadMemory(testutils.HelloworldAddrMain, insts)
+	if insts[0] != 0xcc {
+		t.Errorf("breakpoint is not written: %#x", insts[0])
+	}
+}
+
 func TestAttachProcess(t *testing.T) {
 	cmd := exec.Command(testutils.ProgramInfloop)
 	_ = cmd.Start()
@@ -208,6 +236,72 @@ func TestStackFrameAt(t *testing.T) {
 	}
 }
 
+func TestFindInterfaceMethodImpls(t *testing.T) {
+	proc, err := LaunchProcess(testutils.ProgramHelloworld, nil, helloworldAttr)
+	if err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	defer proc.Detach()
+
+	addrs, err := proc.FindInterfaceMethodImpls("io.Writer.Write")
+	if err != nil {
+		t.Fatalf("failed to find impls: %v", err)
+	}
+	found := false
+	for _, addr := range addrs {
+		if function, err := proc.FindFunction(addr); err == nil && function.Name == "os.(*File).Write" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("os.(*File).Write not found: %v", addrs)
+	}
+
+	if _, err := proc.FindInterfaceMethodImpls("io.NoSuchInterface"); err == nil {
+		t.Errorf("should return error")
+	}
+}
+
+func TestCallStack(t *testing.T) {
+	proc, err := LaunchProcess(testutils.ProgramHelloworld, nil, helloworldAttr)
+	if err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	defer proc.Detach()
+
+	if err := proc.SetBreakpoint(testutils.HelloworldAddrOneParameterAndVariable); err != nil {
+		t.Fatalf("failed to set breakpoint: %v", err)
+	}
+
+	event, err := proc.ContinueAndWait()
+	if err != nil {
+		t.Fatalf("failed to continue and wait: %v", err)
+	}
+
+	tids := event.Data.([]int)
+	regs, err := proc.debugapiClient.ReadRegisters(tids[0])
+	if err != nil {
+		t.Fatalf("failed to read registers: %v", err)
+	}
+
+	frames, err := proc.CallStack(regs.Rsp, regs.Rip, 10)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	var names []string
+	for _, frame := range frames {
+		names = append(names, frame.Function.Name)
+	}
+	if len(names) != 3 || names[0] != "main.oneParameterAndOneVariable" || names[1] != "main.main" || names[2] != "runtime.main" {
+		t.Errorf("unexpected call stack: %v", names)
+	}
+
+	frames, err = proc.CallStack(regs.Rsp, regs.Rip, 1)
+	if err != nil || len(frames) != 1 {
+		t.Errorf("unexpected call stack: %v, %v", frames, err)
+	}
+}
+
 func TestStackFrameAt_NoDwarfCase(t *testing.T) {
 	proc, err := LaunchProcess(testutils.ProgramHelloworldNoDwarf, nil, helloworldAttr)
 	if err != nil {
@@ -251,6 +345,22 @@ func TestStackFrameAt_NoDwarfCase(t *testing.T) {
 	}
 }
 
+func TestFindLocation_NoDwarfCase(t *testing.T) {
+	proc, err := LaunchProcess(testutils.ProgramHelloworldNoDwarf, nil, helloworldAttr)
+	if err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	defer proc.Detach()
+
+	location, err := proc.FindLocation(testutils.HelloworldAddrNoParameter)
+	if err != nil {
+		t.Fatalf("failed to find location: %v", err)
+	}
+	if !strings.HasSuffix(location.File, "helloworld.go") || location.Line != 9 {
+		t.Errorf("unexpected location: %s", location)
+	}
+}
+
 func TestFindFunction_FillInOneUnknownParameterOffset(t *testing.T) {
 	for i, testdata := range []uint64{
 		testutils.HelloworldAddrOneParameter,
@@ -536,6 +646,17 @@ func TestCurrentGoRoutineInfo_Panicking(t *testing.T) {
 		if goRoutineInfo.PanicHandler.PCAtDefer == 0 {
 			t.Errorf("invalid panic handler")
 		}
+
+		if goRoutineInfo.Panic == nil || goRoutineInfo.Panic.Recovered || goRoutineInfo.Panic.Goexit {
+			t.Fatalf("invalid panic: %#v", goRoutineInfo.Panic)
+		}
+		expectedValue := "-"
+		if testProgram == testutils.ProgramPanic {
+			expectedValue = `string("2")`
+		}
+		if value := goRoutineInfo.Panic.ParseValue(1); value != expectedValue {
+			t.Errorf("unexpected panic value: %s", value)
+		}
 	}
 }
 
@@ -277,6 +277,88 @@ func (v voidValue) String() string {
 	return fmt.Sprintf("%v", v.val)
 }
 
+// nativeValue converts the value to the Go value. See Argument.Value for the conversion rules.
+func nativeValue(v value) interface{} {
+	switch v := v.(type) {
+	case int8Value:
+		return int64(v.val)
+	case int16Value:
+		return int64(v.val)
+	case int32Value:
+		return int64(v.val)
+	case int64Value:
+		return v.val
+	case uint8Value:
+		return uint64(v.val)
+	case uint16Value:
+		return uint64(v.val)
+	case uint32Value:
+		return uint64(v.val)
+	case uint64Value:
+		return v.val
+	case float32Value:
+		return float64(v.val)
+	case float64Value:
+		return v.val
+	case complex64Value:
+		return complex128(v.val)
+	case complex128Value:
+		return v.val
+	case boolValue:
+		return v.val
+	case stringValue:
+		return v.val
+	case ptrValue:
+		if v.pointedVal != nil {
+			return nativeValue(v.pointedVal)
+		} else if v.addr != 0 {
+			return v.addr
+		}
+	case funcValue:
+		return v.addr
+	case sliceValue:
+		return nativeValues(v.val)
+	case arrayValue:
+		return nativeValues(v.val)
+	case structValue:
+		if v.abbreviated {
+			return nil
+		}
+		fields := make(map[string]interface{}, len(v.fields))
+		for name, field := range v.fields {
+			fields[name] = nativeValue(field)
+		}
+		return fields
+	case interfaceValue:
+		return nativeValue(v.implVal)
+	case mapValue:
+		m := make(map[interface{}]interface{}, len(v.val))
+		for key, val := range v.val {
+			m[MapKey(nativeValue(key))] = nativeValue(val)
+		}
+		return m
+	}
+	return nil
+}
+
+// MapKey converts the Go value to the key of the map Argument.Value returns. The slice, array and struct are not
+// hashable, so they are converted to the string like fmt.Sprint. The other values are returned as they are.
+func MapKey(key interface{}) interface{} {
+	switch key.(type) {
+	case []interface{}, map[string]interface{}:
+		return fmt.Sprint(key)
+	}
+	return key
+}
+
+func nativeValues(vals []value) []interface{} {
+	var natives []interface{}
+	for _, val := range vals {
+		natives = append(natives, nativeValue(val))
+	}
+	return natives
+}
+
 type valueParser struct {
 	reader         memoryReader
 	mapRuntimeType func(addr uint64) (dwarf.Type, error)
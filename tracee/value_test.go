@@ -78,6 +78,32 @@ func TestParseValue(t *testing.T) {
 	}
 }
 
+func TestNativeValue(t *testing.T) {
+	for i, testdata := range []struct {
+		val      value
+		expected string
+	}{
+		{val: int8Value{val: -1}, expected: "int64 -1"},
+		{val: uint16Value{val: 2}, expected: "uint64 2"},
+		{val: float32Value{val: 0.5}, expected: "float64 0.5"},
+		{val: boolValue{val: true}, expected: "bool true"},
+		{val: stringValue{val: "a"}, expected: "string a"},
+		{val: ptrValue{addr: 0x10, pointedVal: int64Value{val: 1}}, expected: "int64 1"},
+		{val: ptrValue{}, expected: "<nil> <nil>"},
+		{val: sliceValue{val: []value{int32Value{val: 1}, stringValue{val: "b"}}}, expected: "[]interface {} [1 b]"},
+		{val: structValue{fields: map[string]value{"a": uint8Value{val: 1}}}, expected: "map[string]interface {} map[a:1]"},
+		{val: structValue{abbreviated: true}, expected: "<nil> <nil>"},
+		{val: interfaceValue{implVal: stringValue{val: "c"}}, expected: "string c"},
+		{val: mapValue{val: map[value]value{stringValue{val: "k"}: int16Value{val: 2}}}, expected: "map[interface {}]interface {} map[k:2]"},
+	} {
+		native := nativeValue(testdata.val)
+		actual := fmt.Sprintf("%T %v", native, native)
+		if actual != testdata.expected {
+			t.Errorf("[%d] wrong value: %s", i, actual)
+		}
+	}
+}
+
 func TestParseValue_NotFixedStringCase(t *testing.T) {
 	proc, err := LaunchProcess(testutils.ProgramTypePrint, nil, typePrintAttr)
 	if err != nil {
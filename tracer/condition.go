@@ -0,0 +1,747 @@
+package tracer
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/ks888/tgo/tracee"
+)
+
+// Condition is the boolean expression evaluated over the input args of the function. The go routine starts tracing at
+// the conditional start trace point only if the condition is true. See ParseCondition for the syntax.
+type Condition struct {
+	expr conditionNode
+	// parseLevel is the parse level required to evaluate the expression.
+	parseLevel int
+	raw        string
+}
+
+// ParseCondition parses the expression like Go's one, such as 'n > 20' and 'req.URL.Path == "/api/orders"'.
+// The expression consists of:
+//   - the arg names and the literals: integer, float, string ("..." or `...`), true, false and nil
+//   - the field access (a.b) and the indexing (a[0] and m["key"]). The pointers and interfaces are dereferenced implicitly.
+//   - the comparison operators (==, !=, <, <=, >, >=), the logical operators (&&, ||, !) and the parentheses
+//   - the functions: len(s), contains(s, substr), hasPrefix(s, prefix) and hasSuffix(s, suffix)
+func ParseCondition(expr string) (*Condition, error) {
+	tokens, err := tokenizeCondition(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &conditionParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected token at %d: %s", tok.pos, tok.text)
+	}
+
+	parseLevel := node.depth()
+	if parseLevel < 1 {
+		parseLevel = 1
+	}
+	return &Condition{expr: node, parseLevel: parseLevel, raw: expr}, nil
+}
+
+// ParseLevel returns the parse level of the args required to evaluate the condition.
+func (c *Condition) ParseLevel() int {
+	return c.parseLevel
+}
+
+func (c *Condition) String() string {
+	return c.raw
+}
+
+// Evaluate evaluates the condition. The args map the arg names to their values, such as the ones tracee.Argument.Value returns.
+func (c *Condition) Evaluate(args map[string]interface{}) (bool, error) {
+	val, err := c.expr.eval(args)
+	if err != nil {
+		return false, err
+	}
+
+	result, ok := val.(bool)
+	if !ok {
+		return false, fmt.Errorf("the condition is not boolean: %v", val)
+	}
+	return result, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenInt
+	tokenFloat
+	tokenString
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var conditionOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "-", "(", ")", "[", "]", ".", ","}
+
+func tokenizeCondition(expr string) ([]token, error) {
+	var tokens []token
+	for pos := 0; pos < len(expr); {
+		ch := rune(expr[pos])
+		switch {
+		case unicode.IsSpace(ch):
+			pos++
+
+		case ch == '_' || unicode.IsLetter(ch):
+			end := pos + 1
+			for end < len(expr) && (expr[end] == '_' || unicode.IsLetter(rune(expr[end])) || unicode.IsDigit(rune(expr[end]))) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: expr[pos:end], pos: pos})
+			pos = end
+
+		case unicode.IsDigit(ch):
+			end := pos + 1
+			kind := tokenInt
+			for end < len(expr) && (unicode.IsDigit(rune(expr[end])) || unicode.IsLetter(rune(expr[end])) || expr[end] == '.') {
+				if expr[end] == '.' {
+					kind = tokenFloat
+				}
+				end++
+			}
+			tokens = append(tokens, token{kind: kind, text: expr[pos:end], pos: pos})
+			pos = end
+
+		case ch == '"' || ch == '`':
+			end := pos + 1
+			for end < len(expr) && expr[end] != byte(ch) {
+				if ch == '"' && expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at %d", pos)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: expr[pos : end+1], pos: pos})
+			pos = end + 1
+
+		default:
+			found := false
+			for _, op := range conditionOperators {
+				if strings.HasPrefix(expr[pos:], op) {
+					tokens = append(tokens, token{kind: tokenOperator, text: op, pos: pos})
+					pos += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character at %d: %c", pos, ch)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, text: "EOF", pos: len(expr)}), nil
+}
+
+// conditionParser is the recursive descent parser. The precedence is same as Go's one.
+type conditionParser struct {
+	tokens []token
+	index  int
+}
+
+func (p *conditionParser) peek() token {
+	return p.tokens[p.index]
+}
+
+func (p *conditionParser) next() token {
+	tok := p.tokens[p.index]
+	if tok.kind != tokenEOF {
+		p.index++
+	}
+	return tok
+}
+
+func (p *conditionParser) consumeOperator(op string) bool {
+	if tok := p.peek(); tok.kind == tokenOperator && tok.text == op {
+		p.index++
+		return true
+	}
+	return false
+}
+
+func (p *conditionParser) expectOperator(op string) error {
+	if !p.consumeOperator(op) {
+		tok := p.peek()
+		return fmt.Errorf("expected %s at %d, but got %s", op, tok.pos, tok.text)
+	}
+	return nil
+}
+
+func (p *conditionParser) parseOr() (conditionNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.consumeOperator("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseAnd() (conditionNode, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for p.consumeOperator("&&") {
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseComparison() (conditionNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op.kind != tokenOperator || !isComparisonOperator(op.text) {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = comparisonNode{op: op.text, left: left, right: right}
+	}
+}
+
+func isComparisonOperator(op string) bool {
+	switch op {
+	case "==", "!=", "<=", ">=", "<", ">":
+		return true
+	}
+	return false
+}
+
+func (p *conditionParser) parseUnary() (conditionNode, error) {
+	if p.consumeOperator("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand: operand}, nil
+	}
+	if p.consumeOperator("-") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negateNode{operand: operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *conditionParser) parsePostfix() (conditionNode, error) {
+	node, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch {
+		case p.consumeOperator("."):
+			tok := p.next()
+			if tok.kind != tokenIdent {
+				return nil, fmt.Errorf("expected field name at %d, but got %s", tok.pos, tok.text)
+			}
+			node = selectorNode{operand: node, field: tok.text}
+		case p.consumeOperator("["):
+			index, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectOperator("]"); err != nil {
+				return nil, err
+			}
+			node = indexNode{operand: node, index: index}
+		default:
+			return node, nil
+		}
+	}
+}
+
+func (p *conditionParser) parsePrimary() (conditionNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenInt:
+		val, err := strconv.ParseInt(tok.text, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer at %d: %s", tok.pos, tok.text)
+		}
+		return literalNode{val: val}, nil
+	case tokenFloat:
+		val, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid float at %d: %s", tok.pos, tok.text)
+		}
+		return literalNode{val: val}, nil
+	case tokenString:
+		val, err := strconv.Unquote(tok.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string at %d: %s", tok.pos, tok.text)
+		}
+		return literalNode{val: val}, nil
+	case tokenIdent:
+		switch tok.text {
+		case "true":
+			return literalNode{val: true}, nil
+		case "false":
+			return literalNode{val: false}, nil
+		case "nil":
+			return literalNode{val: nil}, nil
+		}
+		if p.consumeOperator("(") {
+			return p.parseCall(tok)
+		}
+		return identNode{name: tok.text}, nil
+	case tokenOperator:
+		if tok.text == "(" {
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expectOperator(")")
+		}
+	}
+	return nil, fmt.Errorf("unexpected token at %d: %s", tok.pos, tok.text)
+}
+
+func (p *conditionParser) parseCall(name token) (conditionNode, error) {
+	fn, ok := conditionFuncs[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function at %d: %s", name.pos, name.text)
+	}
+
+	var args []conditionNode
+	if !p.consumeOperator(")") {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.consumeOperator(")") {
+				break
+			}
+			if err := p.expectOperator(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(args) != fn.numArgs {
+		return nil, fmt.Errorf("%s requires %d args, but got %d", name.text, fn.numArgs, len(args))
+	}
+	return callNode{name: name.text, fn: fn, args: args}, nil
+}
+
+// conditionNode is the node of the abstract syntax tree.
+type conditionNode interface {
+	eval(args map[string]interface{}) (interface{}, error)
+	// depth returns the max number of the field accesses and indexings applied to the arg.
+	depth() int
+}
+
+type literalNode struct {
+	val interface{}
+}
+
+func (n literalNode) eval(args map[string]interface{}) (interface{}, error) { return n.val, nil }
+
+func (n literalNode) depth() int { return 0 }
+
+type identNode struct {
+	name string
+}
+
+func (n identNode) eval(args map[string]interface{}) (interface{}, error) {
+	val, ok := args[n.name]
+	if !ok {
+		return nil, fmt.Errorf("unknown arg: %s", n.name)
+	}
+	return val, nil
+}
+
+func (n identNode) depth() int { return 0 }
+
+type selectorNode struct {
+	operand conditionNode
+	field   string
+}
+
+func (n selectorNode) eval(args map[string]interface{}) (interface{}, error) {
+	operand, err := n.operand.eval(args)
+	if err != nil {
+		return nil, err
+	}
+
+	strct, ok := operand.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("can't access the field %s of %v", n.field, operand)
+	}
+	val, ok := strct[n.field]
+	if !ok {
+		return nil, fmt.Errorf("no field %s", n.field)
+	}
+	return val, nil
+}
+
+func (n selectorNode) depth() int { return n.operand.depth() + 1 }
+
+type indexNode struct {
+	operand, index conditionNode
+}
+
+func (n indexNode) eval(args map[string]interface{}) (interface{}, error) {
+	operand, err := n.operand.eval(args)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(args)
+	if err != nil {
+		return nil, err
+	}
+
+	switch container := operand.(type) {
+	case []interface{}:
+		i, ok := index.(int64)
+		if !ok {
+			return nil, fmt.Errorf("non-integer index: %v", index)
+		}
+		if i < 0 || i >= int64(len(container)) {
+			return nil, fmt.Errorf("index out of range: %d", i)
+		}
+		return container[i], nil
+	case map[interface{}]interface{}:
+		// converted in the same way as the keys. Otherwise, the unhashable index panics.
+		key := tracee.MapKey(index)
+		if _, ok := key.(map[interface{}]interface{}); ok {
+			return nil, fmt.Errorf("unhashable index: %v", index)
+		}
+		return container[key], nil // the zero value is unknown. So nil if not found.
+	}
+	return nil, fmt.Errorf("can't index %v", operand)
+}
+
+func (n indexNode) depth() int {
+	if d := n.index.depth(); d > n.operand.depth()+1 {
+		return d
+	}
+	return n.operand.depth() + 1
+}
+
+type callNode struct {
+	name string
+	fn   conditionFunc
+	args []conditionNode
+}
+
+func (n callNode) eval(args map[string]interface{}) (interface{}, error) {
+	var vals []interface{}
+	for _, arg := range n.args {
+		val, err := arg.eval(args)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, val)
+	}
+	val, err := n.fn.call(vals)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", n.name, err)
+	}
+	return val, nil
+}
+
+func (n callNode) depth() int {
+	max := 0
+	for _, arg := range n.args {
+		if d := arg.depth(); d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+type notNode struct {
+	operand conditionNode
+}
+
+func (n notNode) eval(args map[string]interface{}) (interface{}, error) {
+	val, err := evalBool(n.operand, args)
+	if err != nil {
+		return nil, err
+	}
+	return !val, nil
+}
+
+func (n notNode) depth() int { return n.operand.depth() }
+
+type negateNode struct {
+	operand conditionNode
+}
+
+func (n negateNode) eval(args map[string]interface{}) (interface{}, error) {
+	val, err := n.operand.eval(args)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := val.(type) {
+	case int64:
+		return -v, nil
+	case float64:
+		return -v, nil
+	}
+	return nil, fmt.Errorf("can't negate %v", val)
+}
+
+func (n negateNode) depth() int { return n.operand.depth() }
+
+type logicalNode struct {
+	op          string
+	left, right conditionNode
+}
+
+func (n logicalNode) eval(args map[string]interface{}) (interface{}, error) {
+	left, err := evalBool(n.left, args)
+	if err != nil {
+		return nil, err
+	}
+	if (n.op == "&&" && !left) || (n.op == "||" && left) {
+		return left, nil
+	}
+	return evalBool(n.right, args)
+}
+
+func (n logicalNode) depth() int { return maxDepth(n.left, n.right) }
+
+type comparisonNode struct {
+	op          string
+	left, right conditionNode
+}
+
+func (n comparisonNode) eval(args map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(args)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.op == "==" || n.op == "!=" {
+		equal, err := equalValues(left, right)
+		if err != nil {
+			return nil, err
+		}
+		return equal == (n.op == "=="), nil
+	}
+
+	cmp, err := compareValues(left, right)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+func (n comparisonNode) depth() int { return maxDepth(n.left, n.right) }
+
+func maxDepth(left, right conditionNode) int {
+	if l, r := left.depth(), right.depth(); l > r {
+		return l
+	} else {
+		return r
+	}
+}
+
+func evalBool(node conditionNode, args map[string]interface{}) (bool, error) {
+	val, err := node.eval(args)
+	if err != nil {
+		return false, err
+	}
+	b, ok := val.(bool)
+	if !ok {
+		return false, fmt.Errorf("not boolean: %v", val)
+	}
+	return b, nil
+}
+
+func equalValues(left, right interface{}) (bool, error) {
+	if left == nil || right == nil {
+		return left == nil && right == nil, nil
+	}
+
+	if isNumber(left) && isNumber(right) {
+		cmp, err := compareValues(left, right)
+		return cmp == 0, err
+	}
+
+	switch l := left.(type) {
+	case string:
+		r, ok := right.(string)
+		return ok && l == r, nil
+	case bool:
+		r, ok := right.(bool)
+		return ok && l == r, nil
+	case complex128:
+		r, ok := right.(complex128)
+		return ok && l == r, nil
+	}
+	return false, fmt.Errorf("can't compare %v and %v", left, right)
+}
+
+// compareValues returns the negative value if left < right, 0 if left == right and the positive value if left > right.
+func compareValues(left, right interface{}) (int, error) {
+	if l, ok := left.(string); ok {
+		if r, ok := right.(string); ok {
+			return strings.Compare(l, r), nil
+		}
+	}
+
+	switch l := left.(type) {
+	case int64:
+		switch r := right.(type) {
+		case int64:
+			return compareInts(l, r), nil
+		case uint64:
+			if l < 0 {
+				return -1, nil
+			}
+			return compareUints(uint64(l), r), nil
+		}
+	case uint64:
+		switch r := right.(type) {
+		case uint64:
+			return compareUints(l, r), nil
+		case int64:
+			if r < 0 {
+				return 1, nil
+			}
+			return compareUints(l, uint64(r)), nil
+		}
+	}
+
+	if isNumber(left) && isNumber(right) {
+		l, r := toFloat(left), toFloat(right)
+		switch {
+		case l < r:
+			return -1, nil
+		case l > r:
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("can't compare %v and %v", left, right)
+}
+
+func compareInts(l, r int64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+func compareUints(l, r uint64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+func isNumber(val interface{}) bool {
+	switch val.(type) {
+	case int64, uint64, float64:
+		return true
+	}
+	return false
+}
+
+func toFloat(val interface{}) float64 {
+	switch v := val.(type) {
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
+}
+
+type conditionFunc struct {
+	numArgs int
+	call    func(args []interface{}) (interface{}, error)
+}
+
+var conditionFuncs = map[string]conditionFunc{
+	"len": {numArgs: 1, call: func(args []interface{}) (interface{}, error) {
+		switch v := args[0].(type) {
+		case string:
+			return int64(len(v)), nil
+		case []interface{}:
+			return int64(len(v)), nil
+		case map[interface{}]interface{}:
+			return int64(len(v)), nil
+		case nil:
+			return int64(0), nil
+		}
+		return nil, fmt.Errorf("invalid arg: %v", args[0])
+	}},
+	"contains":  stringFunc(strings.Contains),
+	"hasPrefix": stringFunc(strings.HasPrefix),
+	"hasSuffix": stringFunc(strings.HasSuffix),
+}
+
+func stringFunc(fn func(s, t string) bool) conditionFunc {
+	return conditionFunc{numArgs: 2, call: func(args []interface{}) (interface{}, error) {
+		s, ok1 := args[0].(string)
+		t, ok2 := args[1].(string)
+		if !ok1 || !ok2 {
+			return nil, errors.New("the args must be string")
+		}
+		return fn(s, t), nil
+	}}
+}
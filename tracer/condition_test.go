@@ -0,0 +1,131 @@
+package tracer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ks888/tgo/tracee"
+)
+
+func TestParseCondition(t *testing.T) {
+	args := map[string]interface{}{
+		"n":     int64(30),
+		"u":     uint64(5),
+		"f":     float64(1.5),
+		"ok":    true,
+		"s":     "hello",
+		"null":  nil,
+		"slice": []interface{}{int64(1), "two"},
+		"m":     map[interface{}]interface{}{"key": int64(1), int64(2): "two"},
+		"point": map[string]interface{}{"X": int64(1), "Y": int64(2)},
+		"pm":    map[interface{}]interface{}{tracee.MapKey(map[string]interface{}{"X": int64(1), "Y": int64(2)}): int64(1)},
+		"req": map[string]interface{}{
+			"Method": "GET",
+			"URL":    map[string]interface{}{"Path": "/api/orders"},
+		},
+	}
+
+	for i, testdata := range []struct {
+		expr     string
+		expected bool
+	}{
+		{expr: "n > 20", expected: true},
+		{expr: "n <= 20", expected: false},
+		{expr: "n == 30 && u < 10", expected: true},
+		{expr: "n != 30 || u >= 10", expected: false},
+		{expr: "-1 < u && u > n == false", expected: true},
+		{expr: "f > 1 && f < 2.0", expected: true},
+		{expr: "ok", expected: true},
+		{expr: "!ok || !(n > 0)", expected: false},
+		{expr: `s == "hello" && s < "world"`, expected: true},
+		{expr: "s == `hello`", expected: true},
+		{expr: "null == nil && s != nil", expected: true},
+		{expr: `slice[0] == 1 && slice[1] == "two"`, expected: true},
+		{expr: `m["key"] == 1 && m[2] == "two" && m["none"] == nil`, expected: true},
+		{expr: `pm[point] == 1 && pm[slice] == nil`, expected: true},
+		{expr: `req.URL.Path == "/api/orders"`, expected: true},
+		{expr: `req.Method == "GET" && hasPrefix(req.URL.Path, "/api/") && hasSuffix(req.URL.Path, "orders")`, expected: true},
+		{expr: `contains(s, "ell") && !contains(s, "x")`, expected: true},
+		{expr: `len(s) == 5 && len(slice) == 2 && len(m) == 2 && len(null) == 0`, expected: true},
+	} {
+		cond, err := ParseCondition(testdata.expr)
+		if err != nil {
+			t.Errorf("[%d] failed to parse %s: %v", i, testdata.expr, err)
+			continue
+		}
+		actual, err := cond.Evaluate(args)
+		if err != nil {
+			t.Errorf("[%d] failed to evaluate %s: %v", i, testdata.expr, err)
+			continue
+		}
+		if actual != testdata.expected {
+			t.Errorf("[%d] wrong result of %s: %v", i, testdata.expr, actual)
+		}
+	}
+}
+
+func TestParseCondition_InvalidExpr(t *testing.T) {
+	for i, expr := range []string{
+		"",
+		"n >",
+		"n > 1 )",
+		"(n > 1",
+		`s == "hello`,
+		"a.",
+		"a[1",
+		"n # 1",
+		"unknown(s)",
+		"contains(s)",
+		"1abc == 1",
+	} {
+		if _, err := ParseCondition(expr); err == nil {
+			t.Errorf("[%d] no error: %s", i, expr)
+		}
+	}
+}
+
+func TestCondition_EvaluateError(t *testing.T) {
+	args := map[string]interface{}{"n": int64(1), "s": "a", "slice": []interface{}{int64(1)}, "null": nil,
+		"m": map[interface{}]interface{}{"key": int64(1)}}
+
+	for i, testdata := range []struct {
+		expr, errMsg string
+	}{
+		{expr: "x == 1", errMsg: "unknown arg"},
+		{expr: "n", errMsg: "not boolean"},
+		{expr: "n && true", errMsg: "not boolean"},
+		{expr: "n == s", errMsg: "can't compare"},
+		{expr: "null.a == 1", errMsg: "can't access the field"},
+		{expr: "slice[1] == 1", errMsg: "index out of range"},
+		{expr: "n[0] == 1", errMsg: "can't index"},
+		{expr: "m[m] == 1", errMsg: "unhashable index"},
+		{expr: "contains(n, s)", errMsg: "must be string"},
+	} {
+		cond, err := ParseCondition(testdata.expr)
+		if err != nil {
+			t.Fatalf("[%d] failed to parse %s: %v", i, testdata.expr, err)
+		}
+		if _, err := cond.Evaluate(args); err == nil || !strings.Contains(err.Error(), testdata.errMsg) {
+			t.Errorf("[%d] unexpected error of %s: %v", i, testdata.expr, err)
+		}
+	}
+}
+
+func TestCondition_ParseLevel(t *testing.T) {
+	for i, testdata := range []struct {
+		expr     string
+		expected int
+	}{
+		{expr: "n > 20", expected: 1},
+		{expr: `req.URL.Path == "/"`, expected: 2},
+		{expr: `a.b == 1 || hasPrefix(x.y[0].z, "a")`, expected: 3},
+	} {
+		cond, err := ParseCondition(testdata.expr)
+		if err != nil {
+			t.Fatalf("[%d] failed to parse %s: %v", i, testdata.expr, err)
+		}
+		if cond.ParseLevel() != testdata.expected {
+			t.Errorf("[%d] wrong parse level: %d", i, cond.ParseLevel())
+		}
+	}
+}
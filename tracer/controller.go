@@ -1,13 +1,17 @@
 package tracer
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/ks888/tgo/debugapi"
+	"github.com/ks888/tgo/log"
 	"github.com/ks888/tgo/tracee"
 	"golang.org/x/arch/x86/x86asm"
 )
@@ -17,6 +21,16 @@ const chanBufferSize = 64
 // ErrInterrupted indicates the tracer is interrupted due to the Interrupt() call.
 var ErrInterrupted = errors.New("interrupted")
 
+// DetachError indicates the tracer is interrupted, but failed to detach from the tracee.
+type DetachError struct {
+	Err error
+}
+
+// Error returns the cause of the failure.
+func (e DetachError) Error() string {
+	return fmt.Sprintf("failed to detach: %v", e.Err)
+}
+
 type breakpointHint int
 
 const (
@@ -39,17 +53,190 @@ type Controller struct {
 
 	tracingPoints     tracingPoints
 	tracingGoRoutines tracingGoRoutines
-	traceLevel        int
-	parseLevel        int
+	watchPoints       []watchPoint
+	// defaultOptions is used by the go routines which start tracing at the start trace point without the options.
+	// Its OutputWriter is ignored and outputWriter is used instead.
+	defaultOptions TraceOptions
+	// startTraceOptions holds the options of the start trace point added with the options.
+	startTraceOptions map[uint64]TraceOptions
+	// goRoutineStartAddrs holds the stack of the start trace points the go routine passed.
+	// The options of the last one are used while the go routine is traced.
+	goRoutineStartAddrs map[int64][]uint64
+	// endAtReturnStartAddrs is the set of the start trace points at which the tracing ends when the function returns.
+	endAtReturnStartAddrs map[uint64]bool
+	// regionEndAddrs is the set of the end trace points which end the region specified by the first arg.
+	regionEndAddrs map[uint64]bool
+	// startConditions holds the conditions of the conditional start trace points.
+	startConditions map[uint64]*Condition
+	// returnTracePoints holds the stack of the return addresses at which the tracing of the go routine ends.
+	returnTracePoints map[int64][]returnTracePoint
 
 	// Use the buffered channels to handle the requests to the controller asyncronously.
 	// It's because the tracee process must be trapped to handle these requests, but the process may not
 	// be trapped when the requests are sent.
 	interruptCh            chan bool
-	pendingStartTracePoint chan uint64
-	pendingEndTracePoint   chan uint64
+	pendingStartTracePoint chan startTracePoint
+	pendingEndTracePoint   chan endTracePoint
+	pendingWatchPoint      chan watchPoint
+	pendingDefaultOptions  chan TraceOptions
 	// The traced data is written to this writer.
 	outputWriter io.Writer
+	// If not nil, the handler is called with the event whenever the traced data is written.
+	eventHandler func(Event)
+	// stats aggregates the calls traced in the stats format.
+	stats   *callStats
+	sampler *callSampler
+	// callFolders holds the folders of the go routines traced with the fold or collapse options.
+	callFolders map[int64]*callFolder
+	// panics holds the value of the panic each go routine is handling. The panic is reported only once.
+	panics map[int64]string
+	// flightRecorder is not nil if the tracing log is kept in memory instead of written. See SetFlightRecorder.
+	flightRecorder *flightRecorder
+	// dumpPoints holds the addresses of the functions at which the flight recorder is dumped or pruned.
+	dumpPoints map[uint64]string
+	// dumpSignal is the signal number at which the flight recorder is dumped. 0 if not specified.
+	dumpSignal int
+	// interfaceImpls holds the start addresses of the functions which implement the interface method, keyed by
+	// the name in the Interfaces option.
+	interfaceImpls map[string]map[uint64]bool
+}
+
+// TraceOptions is the set of the options applied to the go routines which start tracing at the start trace point.
+type TraceOptions struct {
+	TraceLevel, ParseLevel int
+	// If IncludeFuncs is not empty, only the functions whose name matches one of them are printed.
+	IncludeFuncs []*regexp.Regexp
+	// The functions whose name matches one of ExcludeFuncs are not printed.
+	ExcludeFuncs []*regexp.Regexp
+	// The traced data is written to OutputWriter. If nil, the controller's writer is used.
+	OutputWriter io.Writer
+	Format       OutputFormat
+	// If true, the source locations of the function and its call site are printed in the text format.
+	// They are always written in the JSON format.
+	PrintLocation bool
+	// If SampleRate is larger than 1, only 1 in SampleRate calls of each function is traced.
+	SampleRate int
+	// If MaxCallsPerSecond is positive, at most MaxCallsPerSecond calls of each function are traced per second.
+	// The functions called by the dropped call are not traced either and the call instructions in it are not trapped.
+	MaxCallsPerSecond int
+	// If true, the consecutive identical calls, which have the same function, args and results, are folded into one line
+	// like 'main.fib(n = 1) (~r1 = 1) ×34' in the text format. The call is written after it returns.
+	FoldRepeatedCalls bool
+	// If positive, the recursive call whose recursion depth is beyond CollapseRecursionDepth is collapsed into one line
+	// with the number of the calls and the duration in the text format. The call is written after it returns.
+	CollapseRecursionDepth int
+	// If true, the call stack of the go routine is printed when the go routine starts tracing, so that it's clear
+	// how the go routine got to the start trace point.
+	PrintCallStack bool
+	// CallStackParseLevel is the parse level of the args of the functions in the call stack. If 0, the args are not parsed.
+	CallStackParseLevel int
+	// The local variables whose names are in LocalVariables are printed when the function returns, like
+	// 'main.f(i = 1) (~r1 = 2) {sum = 3}' in the text format. "*" selects all the local variables.
+	// The DWARF info is required. The variable kept in the register may have the stale value.
+	LocalVariables []string
+	// If true, the receiver of the method is printed separately from the args, like
+	// '(*bytes.Buffer) Write(p = []{104}) (...) receiver: b = &{...}' in the text format.
+	// The receiver is parsed 1 level deeper than the args.
+	PrintReceiver bool
+	// If Interfaces is not empty, only the functions which implement the method of one of the interfaces are printed.
+	// The interface is specified like "io.Writer", which selects all its methods, or "io.Writer.Write".
+	// The implementations are found by scanning the itabs the linker generated, and the direct calls of them are printed too.
+	// The itab of the method with the value receiver holds its pointer receiver wrapper, so both are printed.
+	Interfaces []string
+}
+
+// OutputFormat is the format of the traced data.
+type OutputFormat int
+
+const (
+	// OutputFormatText is the human-readable format. Each line represents the function call or return and
+	// the number of the leading '|' is the stack depth.
+	OutputFormatText OutputFormat = iota
+	// OutputFormatJSON is the JSON lines format. Each line is the JSON object like:
+	//   {"event":"call","goroutine":1,"depth":1,"function":"main.f","inputArgs":["i = 1"],"outputArgs":null,
+	//    "file":"/path/to/main.go","line":10,"callerFile":"/path/to/main.go","callerLine":20}
+	OutputFormatJSON
+	// OutputFormatStats doesn't print each call, but aggregates the calls per function. The stats are printed as the table
+	// when the main loop ends or PrintStats is called. They can be exported in the pprof format using WriteProfile.
+	OutputFormatStats
+)
+
+// Event is the function call or return of the traced go routine. It's written as is in the JSON format.
+type Event struct {
+	// Type is EventTypeCall, EventTypeReturn, EventTypePanic, EventTypeRecover or EventTypeStack.
+	Type        string   `json:"event"`
+	GoRoutineID int64    `json:"goroutine"`
+	Depth       int      `json:"depth"`
+	Function    string   `json:"function"`
+	InputArgs   []string `json:"inputArgs"`
+	OutputArgs  []string `json:"outputArgs"`
+	// File and Line are the source location of the function. Empty if unknown.
+	// In the stack event, they are the location the function is executing.
+	File string `json:"file"`
+	Line int    `json:"line"`
+	// CallerFile and CallerLine are the source location of the call site. Empty if unknown.
+	CallerFile string `json:"callerFile"`
+	CallerLine int    `json:"callerLine"`
+	// UnwoundBy is UnwoundByPanic or UnwoundByGoexit if the function is unwound without returning.
+	// The args are unknown in that case.
+	UnwoundBy string `json:"unwoundBy,omitempty"`
+	// PanicValue is the value passed to panic(). Set only in the panic and recover events.
+	PanicValue string `json:"panicValue,omitempty"`
+	// LocalVariables are the local variables selected by the trace options. Set only in the return event.
+	LocalVariables []string `json:"localVariables,omitempty"`
+	// ReceiverType and Receiver are the type and value of the method's receiver, which are excluded from InputArgs.
+	// Set only if the PrintReceiver option is true.
+	ReceiverType string `json:"receiverType,omitempty"`
+	Receiver     string `json:"receiver,omitempty"`
+}
+
+// The types of the event.
+const (
+	EventTypeCall   = "call"
+	EventTypeReturn = "return"
+	// EventTypePanic is the event the go routine starts unwinding the functions due to panic.
+	EventTypePanic = "panic"
+	// EventTypeRecover is the event the panic is recovered.
+	EventTypeRecover = "recover"
+	// EventTypeStack is the function in the call stack of the go routine which starts tracing.
+	// The events are sent from the outermost function.
+	EventTypeStack = "stack"
+)
+
+// maxCallStackFrames is the max number of the functions printed as the call stack.
+const maxCallStackFrames = 64
+
+// The reasons the function is unwound.
+const (
+	UnwoundByPanic  = "panic"
+	UnwoundByGoexit = "runtime.Goexit"
+)
+
+type startTracePoint struct {
+	addr        uint64
+	options     *TraceOptions // nil if the default options are used.
+	endAtReturn bool
+	condition   *Condition // nil if the go routine always starts tracing.
+}
+
+type endTracePoint struct {
+	addr   uint64
+	region bool
+}
+
+// returnTracePoint is the end point of the tracing set when the go routine enters the function.
+type returnTracePoint struct {
+	addr uint64
+	// usedStackSize is the used stack size at the beginning of the function. It's larger than the size after the function returns.
+	usedStackSize uint64
+	// deferFuncAddr is the address of the deferred function which may recover the panic unwinding the function.
+	deferFuncAddr uint64
+}
+
+// watchPoint is the memory region whose write access is reported.
+type watchPoint struct {
+	addr uint64
+	size int
 }
 
 type goRoutineStatus struct {
@@ -70,6 +257,13 @@ type callingFunction struct {
 	returnAddress          uint64
 	usedStackSize          uint64
 	setCallInstBreakpoints bool
+	// dropped is true if the call is not traced due to the sampling or the event budget.
+	dropped bool
+	// The fields below are used only if the call is recorded to the stats.
+	recordStats   bool
+	calledAt      time.Time
+	caller        string
+	childDuration time.Duration
 }
 
 // NewController returns the new controller.
@@ -79,9 +273,23 @@ func NewController() *Controller {
 		statusStore:            make(map[int64]goRoutineStatus),
 		breakpointHints:        make(map[uint64]breakpointHint),
 		callInstAddrCache:      make(map[uint64][]uint64),
+		startTraceOptions:      make(map[uint64]TraceOptions),
+		goRoutineStartAddrs:    make(map[int64][]uint64),
+		endAtReturnStartAddrs:  make(map[uint64]bool),
+		regionEndAddrs:         make(map[uint64]bool),
+		startConditions:        make(map[uint64]*Condition),
+		returnTracePoints:      make(map[int64][]returnTracePoint),
 		interruptCh:            make(chan bool, chanBufferSize),
-		pendingStartTracePoint: make(chan uint64, chanBufferSize),
-		pendingEndTracePoint:   make(chan uint64, chanBufferSize),
+		pendingStartTracePoint: make(chan startTracePoint, chanBufferSize),
+		pendingEndTracePoint:   make(chan endTracePoint, chanBufferSize),
+		pendingWatchPoint:      make(chan watchPoint, chanBufferSize),
+		pendingDefaultOptions:  make(chan TraceOptions, chanBufferSize),
+		stats:                  newCallStats(),
+		sampler:                newCallSampler(),
+		callFolders:            make(map[int64]*callFolder),
+		panics:                 make(map[int64]string),
+		dumpPoints:             make(map[uint64]string),
+		interfaceImpls:         make(map[string]map[uint64]bool),
 	}
 }
 
@@ -104,10 +312,65 @@ func (c *Controller) AttachTracee(pid int, attrs Attributes) error {
 	return err
 }
 
+// Detach detaches from the tracee without running the main loop, such as when the setup after AttachTracee fails.
+// The tracee keeps running. To end the running main loop, use Interrupt instead.
+func (c *Controller) Detach() error {
+	return c.process.Detach()
+}
+
+// SetOutputWriter sets the writer to which the traced data is written. The default is os.Stdout.
+// It must be set before the main loop starts.
+func (c *Controller) SetOutputWriter(w io.Writer) {
+	c.outputWriter = w
+}
+
+// SetEventHandler sets the handler called with the function call or return event in addition to the output.
+// The handler is called in the main loop, so it must not block. It must be set before the main loop starts.
+func (c *Controller) SetEventHandler(handler func(Event)) {
+	c.eventHandler = handler
+}
+
 // AddStartTracePoint adds the starting point of the tracing. The go routines which passed one of the starting points before are traced.
+// The default options are used at this point, even if the options were specified before.
 func (c *Controller) AddStartTracePoint(startAddr uint64) error {
+	return c.addStartTracePoint(startTracePoint{addr: startAddr})
+}
+
+// AddStartTracePointWithOptions adds the starting point of the tracing like AddStartTracePoint, but the go routines
+// which start tracing at this point use the specified options instead of the controller's ones.
+// If the options are already specified for the point, they are replaced and the go routines already traced use the new ones.
+func (c *Controller) AddStartTracePointWithOptions(startAddr uint64, options TraceOptions) error {
+	return c.addStartTracePoint(startTracePoint{addr: startAddr, options: &options})
+}
+
+// AddFunctionTracePoint adds the starting point of the tracing at the beginning of the function like AddStartTracePoint,
+// but the tracing of the go routine ends when the function returns. The functions called by the function are traced.
+// If the options is nil, the default options are used.
+func (c *Controller) AddFunctionTracePoint(funcAddr uint64, options *TraceOptions) error {
+	return c.addStartTracePoint(startTracePoint{addr: funcAddr, options: options, endAtReturn: true})
+}
+
+// AddConditionalStartTracePoint adds the starting point of the tracing at the beginning of the function, but the go routine
+// starts tracing only if the condition is true. The condition is evaluated over the input args of the function.
+// If endAtReturn is true, the tracing ends when the function returns like AddFunctionTracePoint.
+// If the options is nil, the default options are used.
+func (c *Controller) AddConditionalStartTracePoint(funcAddr uint64, condition *Condition, options *TraceOptions, endAtReturn bool) error {
+	return c.addStartTracePoint(startTracePoint{addr: funcAddr, options: options, endAtReturn: endAtReturn, condition: condition})
+}
+
+// FunctionAddress returns the start address of the function which has the given fully-qualified name.
+// It only reads the binary file and so is safe to call while the main loop is running.
+func (c *Controller) FunctionAddress(name string) (uint64, error) {
+	function, err := c.process.Binary.FindFunctionByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return function.StartAddr, nil
+}
+
+func (c *Controller) addStartTracePoint(point startTracePoint) error {
 	select {
-	case c.pendingStartTracePoint <- startAddr:
+	case c.pendingStartTracePoint <- point:
 	default:
 		// maybe buffer full
 		return errors.New("failed to add start trace point")
@@ -116,9 +379,21 @@ func (c *Controller) AddStartTracePoint(startAddr uint64) error {
 }
 
 // AddEndTracePoint adds the ending point of the tracing. The go routines which passed one of the ending points are not traced anymore.
+// If the go routine passed the start trace points more than once, the tracing started last ends.
 func (c *Controller) AddEndTracePoint(endAddr uint64) error {
+	return c.addEndTracePoint(endTracePoint{addr: endAddr})
+}
+
+// AddRegionEndTracePoint adds the ending point of the tracing at the beginning of the function like AddEndTracePoint,
+// but the tracing to end is the one started at the start trace point the function's first arg specifies.
+// So the nested regions can be ended in any order. The first arg must be the integer type, such as uintptr.
+func (c *Controller) AddRegionEndTracePoint(funcAddr uint64) error {
+	return c.addEndTracePoint(endTracePoint{addr: funcAddr, region: true})
+}
+
+func (c *Controller) addEndTracePoint(point endTracePoint) error {
 	select {
-	case c.pendingEndTracePoint <- endAddr:
+	case c.pendingEndTracePoint <- point:
 	default:
 		// maybe buffer full
 		return errors.New("failed to add end trace point")
@@ -126,23 +401,142 @@ func (c *Controller) AddEndTracePoint(endAddr uint64) error {
 	return nil
 }
 
+// AddWatchPoint adds the memory region [addr, addr+size) to be watched. Whenever any go routine writes to the region,
+// the go routine id and the function which wrote it are printed. The size must be 1, 2, 4 or 8 and the addr must be aligned to the size.
+// It uses the hardware debug registers and so at most 4 watch points can be added.
+func (c *Controller) AddWatchPoint(addr uint64, size int) error {
+	select {
+	case c.pendingWatchPoint <- watchPoint{addr: addr, size: size}:
+	default:
+		// maybe buffer full
+		return errors.New("failed to add watch point")
+	}
+	return nil
+}
+
 // SetTraceLevel set the tracing level, which determines whether to print the traced info of the functions.
 // The traced info is printed if the function is (directly or indirectly) called by the trace point function AND
 // the stack depth is within the `level`.
 // The depth here is the relative value from the point the tracing starts.
 func (c *Controller) SetTraceLevel(level int) {
-	c.traceLevel = level
+	c.defaultOptions.TraceLevel = level
 }
 
 // SetParseLevel sets the parsing level, which determines how deeply the parser parses the value of args.
 func (c *Controller) SetParseLevel(level int) {
-	c.parseLevel = level
+	c.defaultOptions.ParseLevel = level
+}
+
+// SetEventBudget sets the max number of the calls traced. Once the budget is exhausted, the later calls are dropped
+// and the call instructions in them are not trapped. 0 means unlimited. It must be called before the main loop.
+func (c *Controller) SetEventBudget(budget int) {
+	c.sampler.budget = budget
+}
+
+// The functions at which the flight recorder is dumped.
+const (
+	dumpPointPanic      = "runtime.gopanic"
+	dumpPointFatalPanic = "runtime.fatalpanic"
+	// the function the os/signal package calls when the signal is delivered to the channel passed to signal.Notify.
+	dumpPointSignal = "os/signal.process"
+	// the function the go routine calls when it exits. The lines of the go routine are discarded here instead of dumped.
+	dumpPointGoRoutineExit = "runtime.goexit1"
+)
+
+// SetFlightRecorder enables the flight recorder mode. In this mode, the tracing log is not written, but the last
+// `size` lines of each go routine are kept in memory. They are written when the tracee panics, exits abnormally,
+// receives the `dumpSignal` (0 means none) or DumpFlightRecorder is called. The signal is detected only if the tracee
+// calls signal.Notify for the signal or is terminated by it. The lines are kept after the dump at the panic, because
+// the panic may be recovered. The lines of the go routine are discarded when it exits. It must be called after the tracee
+// is launched or attached and before the main loop.
+func (c *Controller) SetFlightRecorder(size int, dumpSignal int) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid flight recorder size: %d", size)
+	}
+
+	dumpPoints := []string{dumpPointPanic, dumpPointFatalPanic, dumpPointGoRoutineExit}
+	if dumpSignal != 0 {
+		dumpPoints = append(dumpPoints, dumpPointSignal)
+	}
+	for _, name := range dumpPoints {
+		addr, err := c.FunctionAddress(name)
+		if err != nil {
+			// e.g. the os/signal package is not linked.
+			log.Debugf("failed to find %s: %v", name, err)
+			continue
+		}
+		if err := c.breakpoints.Set(addr); err != nil {
+			return err
+		}
+		c.dumpPoints[addr] = name
+	}
+
+	c.flightRecorder = newFlightRecorder(size)
+	c.dumpSignal = dumpSignal
+	return nil
+}
+
+// DumpFlightRecorder writes the lines the flight recorder keeps and then discards them. It's safe to call while
+// the main loop is running.
+func (c *Controller) DumpFlightRecorder(w io.Writer, reason string) error {
+	if c.flightRecorder == nil {
+		return errors.New("flight recorder is not enabled")
+	}
+	return c.flightRecorder.dump(w, reason, true)
+}
+
+// dumpFlightRecorder dumps the flight recorder to the controller's writer if it's enabled. The dumped lines are
+// discarded if `discard` is true.
+func (c *Controller) dumpFlightRecorder(reason string, discard bool) {
+	if c.flightRecorder == nil {
+		return
+	}
+	if err := c.flightRecorder.dump(c.outputWriter, reason, discard); err != nil {
+		log.Printf("failed to dump the flight recorder: %v", err)
+	}
+}
+
+// DroppedEvents returns the number of the call and return events dropped due to the sampling or the event budget.
+// The events of the functions called by the dropped call are not counted, since they are not trapped.
+// It's safe to call while the main loop is running.
+func (c *Controller) DroppedEvents() int {
+	return c.sampler.droppedEvents()
+}
+
+// UpdateDefaultTraceOptions replaces the default options, which are used at the start trace points without the options.
+// Unlike SetTraceLevel and SetParseLevel, it's safe to call while the main loop is running. The go routines already traced
+// use the new options from the next function call.
+func (c *Controller) UpdateDefaultTraceOptions(options TraceOptions) error {
+	select {
+	case c.pendingDefaultOptions <- options:
+	default:
+		// maybe buffer full
+		return errors.New("failed to update default trace options")
+	}
+	return nil
 }
 
 // MainLoop repeatedly lets the tracee continue and then wait an event. It returns ErrInterrupted error if
 // the trace ends due to the interrupt.
-func (c *Controller) MainLoop() error {
-	defer c.process.Detach() // the connection status is unknown at this point
+func (c *Controller) MainLoop() (err error) {
+	defer func() {
+		for goRoutineID := range c.callFolders {
+			c.flushCallFolder(goRoutineID)
+		}
+		if dropped := c.DroppedEvents(); dropped > 0 {
+			fmt.Fprintf(c.outputWriter, "* %d events were dropped due to the sampling or the event budget\n", dropped)
+		}
+		if !c.stats.empty() {
+			if printErr := c.PrintStats(c.outputWriter); printErr != nil {
+				log.Printf("failed to print the stats: %v", printErr)
+			}
+		}
+
+		// the connection status is unknown at this point. The error matters only when interrupted.
+		if detachErr := c.process.Detach(); detachErr != nil && err == ErrInterrupted {
+			err = DetachError{Err: detachErr}
+		}
+	}()
 
 	event, err := c.continueAndWait()
 	if err == ErrInterrupted {
@@ -154,11 +548,18 @@ func (c *Controller) MainLoop() error {
 	for {
 		switch event.Type {
 		case debugapi.EventTypeExited:
+			if exitStatus, ok := event.Data.(int); ok && exitStatus != 0 {
+				c.dumpFlightRecorder(fmt.Sprintf("exit status %d", exitStatus), true)
+			}
 			return nil
 		case debugapi.EventTypeCoreDump:
+			c.dumpFlightRecorder("core dump", true)
 			return errors.New("the process exited due to core dump")
 		case debugapi.EventTypeTerminated:
+			c.dumpFlightRecorder(fmt.Sprintf("signal %d", event.Data.(int)), true)
 			return fmt.Errorf("the process exited due to signal %d", event.Data.(int))
+		case debugapi.EventTypeInterrupted:
+			return ErrInterrupted
 		case debugapi.EventTypeTrapped:
 			trappedThreadIDs := event.Data.([]int)
 			event, err = c.handleTrapEvent(trappedThreadIDs)
@@ -191,25 +592,46 @@ func (c *Controller) continueAndWait() (debugapi.Event, error) {
 func (c *Controller) setPendingTracePoints() error {
 	for {
 		select {
-		case startAddr := <-c.pendingStartTracePoint:
-			if c.tracingPoints.IsStartAddress(startAddr) {
+		case point := <-c.pendingStartTracePoint:
+			if point.options != nil {
+				c.startTraceOptions[point.addr] = *point.options
+			} else {
+				delete(c.startTraceOptions, point.addr)
+			}
+			c.endAtReturnStartAddrs[point.addr] = point.endAtReturn
+			if point.condition != nil {
+				c.startConditions[point.addr] = point.condition
+			} else {
+				delete(c.startConditions, point.addr)
+			}
+			if c.tracingPoints.IsStartAddress(point.addr) {
 				continue // set already
 			}
 
-			if err := c.breakpoints.Set(startAddr); err != nil {
+			if err := c.breakpoints.Set(point.addr); err != nil {
 				return err
 			}
-			c.tracingPoints.startAddressList = append(c.tracingPoints.startAddressList, startAddr)
+			c.tracingPoints.startAddressList = append(c.tracingPoints.startAddressList, point.addr)
 
-		case endAddr := <-c.pendingEndTracePoint:
-			if c.tracingPoints.IsEndAddress(endAddr) {
+		case point := <-c.pendingEndTracePoint:
+			c.regionEndAddrs[point.addr] = point.region
+			if c.tracingPoints.IsEndAddress(point.addr) {
 				continue // set already
 			}
 
-			if err := c.breakpoints.Set(endAddr); err != nil {
+			if err := c.breakpoints.Set(point.addr); err != nil {
+				return err
+			}
+			c.tracingPoints.endAddressList = append(c.tracingPoints.endAddressList, point.addr)
+
+		case wp := <-c.pendingWatchPoint:
+			if err := c.process.SetWatchpoint(wp.addr, wp.size); err != nil {
 				return err
 			}
-			c.tracingPoints.endAddressList = append(c.tracingPoints.endAddressList, endAddr)
+			c.watchPoints = append(c.watchPoints, wp)
+
+		case options := <-c.pendingDefaultOptions:
+			c.defaultOptions = options
 
 		default:
 			return nil // no data
@@ -229,12 +651,23 @@ func (c *Controller) handleTrapEvent(trappedThreadIDs []int) (debugapi.Event, er
 }
 
 func (c *Controller) handleTrapEventOfThread(threadID int) error {
+	if len(c.watchPoints) > 0 {
+		trappedAtBreakpoint, err := c.handleTrapAtWatchPoint(threadID)
+		if err != nil || !trappedAtBreakpoint {
+			return err
+		}
+	}
+
 	goRoutineInfo, err := c.process.CurrentGoRoutineInfo(threadID)
 	if err != nil || goRoutineInfo.ID == 0 {
 		return c.handleTrappedSystemRoutine(threadID)
 	}
 
 	breakpointAddr := goRoutineInfo.CurrentPC - 1
+	if err := c.handleTrapAtDumpPoint(goRoutineInfo, breakpointAddr); err != nil {
+		return err
+	}
+
 	if !c.breakpoints.Hit(breakpointAddr, goRoutineInfo.ID) {
 		return c.handleTrapAtUnrelatedBreakpoint(threadID, breakpointAddr)
 	}
@@ -265,32 +698,226 @@ func (c *Controller) handleTrapEventOfThread(threadID int) error {
 }
 
 func (c *Controller) updateTracingStatus(threadID int, goRoutineInfo tracee.GoRoutineInfo, breakpointAddr uint64) error {
-	if c.tracingPoints.IsStartAddress(breakpointAddr) {
-		if err := c.enterTracepoint(threadID, goRoutineInfo); err != nil {
+	if c.tracingPoints.IsStartAddress(breakpointAddr) && c.satisfyStartCondition(goRoutineInfo, breakpointAddr) {
+		if c.endAtReturnStartAddrs[breakpointAddr] {
+			if err := c.enterFunctionTracepoint(threadID, goRoutineInfo, breakpointAddr); err != nil {
+				return err
+			}
+		} else if err := c.enterTracepoint(threadID, goRoutineInfo, breakpointAddr); err != nil {
 			return err
 		}
 	}
 	if c.tracingPoints.IsEndAddress(breakpointAddr) {
+		if c.regionEndAddrs[breakpointAddr] {
+			return c.exitRegionTracepoint(goRoutineInfo)
+		}
 		return c.exitTracepoint(threadID, goRoutineInfo.ID, breakpointAddr)
 	}
+	if c.isReturnTracePoint(goRoutineInfo, breakpointAddr) {
+		return c.exitFunctionTracepoint(threadID, goRoutineInfo, breakpointAddr)
+	}
 	return nil
 }
 
-func (c *Controller) enterTracepoint(threadID int, goRoutineInfo tracee.GoRoutineInfo) error {
+// satisfyStartCondition returns true if the start trace point has no condition or its condition is true.
+// The condition which can't be evaluated, such as the one accessing the nil pointer, is considered false.
+func (c *Controller) satisfyStartCondition(goRoutineInfo tracee.GoRoutineInfo, startAddr uint64) bool {
+	condition, ok := c.startConditions[startAddr]
+	if !ok {
+		return true
+	}
+
+	stackFrame, err := c.currentStackFrame(goRoutineInfo)
+	if err != nil {
+		log.Debugf("failed to get the stack frame to evaluate the condition: %v", err)
+		return false
+	}
+
+	args := make(map[string]interface{})
+	for _, arg := range stackFrame.InputArguments {
+		if arg.Name != "" {
+			args[arg.Name] = arg.Value(condition.ParseLevel())
+		}
+	}
+	result, err := condition.Evaluate(args)
+	if err != nil {
+		log.Debugf("failed to evaluate the condition %s: %v", condition, err)
+		return false
+	}
+	return result
+}
+
+// enterFunctionTracepoint starts tracing at the beginning of the function and sets the end point at its return address.
+func (c *Controller) enterFunctionTracepoint(threadID int, goRoutineInfo tracee.GoRoutineInfo, startAddr uint64) error {
+	returnPoints := c.returnTracePoints[goRoutineInfo.ID]
+	if len(returnPoints) > 0 && returnPoints[len(returnPoints)-1].usedStackSize == goRoutineInfo.UsedStackSize {
+		return nil // the function is re-executed from the beginning after the stack is grown.
+	}
+
+	stackFrame, err := c.currentStackFrame(goRoutineInfo)
+	if err != nil {
+		return err
+	}
+	if err := c.breakpoints.SetConditional(stackFrame.ReturnAddress, goRoutineInfo.ID); err != nil {
+		return err
+	}
+	// the return address is not hit if the function is unwound by the panic. Detect it when the caller's deferred function is called.
+	if err := c.setBreakpointToDeferredFunc(goRoutineInfo); err != nil {
+		return err
+	}
+	returnPoint := returnTracePoint{addr: stackFrame.ReturnAddress, usedStackSize: goRoutineInfo.UsedStackSize, deferFuncAddr: goRoutineInfo.NextDeferFuncAddr}
+	c.returnTracePoints[goRoutineInfo.ID] = append(returnPoints, returnPoint)
+
+	return c.enterTracepoint(threadID, goRoutineInfo, startAddr)
+}
+
+func (c *Controller) isReturnTracePoint(goRoutineInfo tracee.GoRoutineInfo, breakpointAddr uint64) bool {
+	returnPoints := c.returnTracePoints[goRoutineInfo.ID]
+	if len(returnPoints) == 0 {
+		return false
+	}
+
+	// the stack size check is necessary because the function may be called recursively.
+	lastPoint := returnPoints[len(returnPoints)-1]
+	return lastPoint.addr == breakpointAddr && goRoutineInfo.UsedStackSize < lastPoint.usedStackSize
+}
+
+func (c *Controller) exitFunctionTracepoint(threadID int, goRoutineInfo tracee.GoRoutineInfo, breakpointAddr uint64) error {
+	returnPoints := c.returnTracePoints[goRoutineInfo.ID]
+	lastPoint := returnPoints[len(returnPoints)-1]
+	if len(returnPoints) > 1 {
+		c.returnTracePoints[goRoutineInfo.ID] = returnPoints[:len(returnPoints)-1]
+	} else {
+		delete(c.returnTracePoints, goRoutineInfo.ID)
+	}
+
+	if err := c.breakpoints.ClearConditional(lastPoint.addr, goRoutineInfo.ID); err != nil {
+		return err
+	}
+	if lastPoint.deferFuncAddr != 0x0 {
+		if err := c.breakpoints.ClearConditional(lastPoint.deferFuncAddr, goRoutineInfo.ID); err != nil {
+			return err
+		}
+	}
+	return c.exitTracepoint(threadID, goRoutineInfo.ID, breakpointAddr)
+}
+
+// unwindFunctionTracepoints ends the tracing started at the function trace points whose functions are unwound, because
+// their return trace points are never hit. It returns true if the go routine is still traced.
+func (c *Controller) unwindFunctionTracepoints(threadID int, goRoutineInfo tracee.GoRoutineInfo, usedStackSize uint64) (bool, error) {
+	for {
+		returnPoints := c.returnTracePoints[goRoutineInfo.ID]
+		if len(returnPoints) == 0 || returnPoints[len(returnPoints)-1].usedStackSize <= usedStackSize {
+			break
+		}
+		if err := c.exitFunctionTracepoint(threadID, goRoutineInfo, returnPoints[len(returnPoints)-1].addr); err != nil {
+			return false, err
+		}
+	}
+	return c.tracingGoRoutines.Tracing(goRoutineInfo.ID), nil
+}
+
+func (c *Controller) enterTracepoint(threadID int, goRoutineInfo tracee.GoRoutineInfo, startAddr uint64) error {
 	goRoutineID := goRoutineInfo.ID
 
 	if err := c.setCallInstBreakpoints(goRoutineID, goRoutineInfo.CurrentPC); err != nil {
 		return err
 	}
 
+	alreadyTracing := c.tracingGoRoutines.Tracing(goRoutineID)
 	c.tracingGoRoutines.Add(goRoutineID)
+	c.goRoutineStartAddrs[goRoutineID] = append(c.goRoutineStartAddrs[goRoutineID], startAddr)
+
+	if options := c.traceOptions(goRoutineID); options.PrintCallStack && !alreadyTracing {
+		return c.printCallStack(goRoutineInfo, startAddr, options)
+	}
+	return nil
+}
+
+// printCallStack prints the callers of the function at the start trace point, from the outermost one.
+// The function itself is not printed, since it's printed as the first function call.
+func (c *Controller) printCallStack(goRoutineInfo tracee.GoRoutineInfo, startAddr uint64, options TraceOptions) error {
+	if options.Format == OutputFormatStats {
+		return nil
+	}
+
+	frames, err := c.process.CallStack(goRoutineInfo.CurrentStackAddr, startAddr, maxCallStackFrames+1)
+	if err != nil {
+		log.Debugf("failed to get the call stack: %v", err)
+		return nil
+	}
+
+	for i := len(frames) - 1; i >= 1; i-- {
+		frame := frames[i]
+		event := Event{Type: EventTypeStack, GoRoutineID: goRoutineInfo.ID, Function: frame.Function.Name}
+		if options.CallStackParseLevel > 0 {
+			for _, arg := range frame.InputArguments {
+				event.InputArgs = append(event.InputArgs, arg.ParseValue(options.CallStackParseLevel))
+			}
+		}
+		// the callee's return address points to the location the function is executing.
+		if location, err := c.process.FindLocation(frames[i-1].ReturnAddress - 1); err == nil {
+			event.File, event.Line = location.File, location.Line
+		}
+
+		if c.eventHandler != nil {
+			c.eventHandler(event)
+		}
+		if options.Format == OutputFormatJSON {
+			if err := c.printEvent(options.OutputWriter, event); err != nil {
+				return err
+			}
+			continue
+		}
+		inputArgs := strings.Join(event.InputArgs, ", ")
+		if options.CallStackParseLevel <= 0 && len(frame.InputArguments) > 0 {
+			inputArgs = "..."
+		}
+		fmt.Fprintf(options.OutputWriter, "* (#%02d) %s(%s) at %s\n", goRoutineInfo.ID, event.Function, inputArgs, formatLocation(event.File, event.Line))
+	}
 	return nil
 }
 
 func (c *Controller) exitTracepoint(threadID int, goRoutineID int64, breakpointAddr uint64) error {
+	return c.exitTracepointAt(goRoutineID, len(c.goRoutineStartAddrs[goRoutineID])-1)
+}
+
+// exitRegionTracepoint ends the tracing started at the start trace point the first arg specifies.
+// It does nothing if the go routine is not traced by that start trace point.
+func (c *Controller) exitRegionTracepoint(goRoutineInfo tracee.GoRoutineInfo) error {
+	stackFrame, err := c.currentStackFrame(goRoutineInfo)
+	if err != nil {
+		return err
+	}
+	if len(stackFrame.InputArguments) == 0 {
+		return fmt.Errorf("no start trace point is specified at %s", stackFrame.Function.Name)
+	}
+	startAddr, ok := stackFrame.InputArguments[0].Value(1).(uint64)
+	if !ok {
+		return fmt.Errorf("invalid start trace point is specified at %s", stackFrame.Function.Name)
+	}
+
+	startAddrs := c.goRoutineStartAddrs[goRoutineInfo.ID]
+	for i := len(startAddrs) - 1; i >= 0; i-- {
+		if startAddrs[i] == startAddr {
+			return c.exitTracepointAt(goRoutineInfo.ID, i)
+		}
+	}
+	return nil
+}
+
+// exitTracepointAt ends the tracing started at the index-th start trace point in the go routine's stack.
+func (c *Controller) exitTracepointAt(goRoutineID int64, index int) error {
 	c.tracingGoRoutines.Remove(goRoutineID)
+	if startAddrs := c.goRoutineStartAddrs[goRoutineID]; len(startAddrs) > 1 {
+		c.goRoutineStartAddrs[goRoutineID] = append(startAddrs[:index], startAddrs[index+1:]...)
+	} else {
+		delete(c.goRoutineStartAddrs, goRoutineID)
+	}
 
 	if !c.tracingGoRoutines.Tracing(goRoutineID) {
+		delete(c.returnTracePoints, goRoutineID)
+		c.flushCallFolder(goRoutineID)
 		if err := c.breakpoints.ClearAllByGoRoutineID(goRoutineID); err != nil {
 			return err
 		}
@@ -333,6 +960,69 @@ func (c *Controller) alterCallInstBreakpoints(enable bool, goRoutineID int64, pc
 	return nil
 }
 
+// handleTrapAtWatchPoint prints the write access if the thread is trapped by the watch point.
+// It returns true if the thread is (also) trapped by the breakpoint and so the trap needs further handling.
+func (c *Controller) handleTrapAtWatchPoint(threadID int) (bool, error) {
+	watchedAddr, hit, err := c.process.HitWatchpoint(threadID)
+	if err != nil || !hit {
+		return true, err
+	}
+
+	threadInfo, err := c.process.CurrentThreadInfo(threadID)
+	if err != nil {
+		return false, err
+	}
+
+	var goRoutineID int64
+	if goRoutineInfo, err := c.process.CurrentGoRoutineInfo(threadID); err == nil {
+		goRoutineID = goRoutineInfo.ID
+	}
+
+	// the write instruction is already executed, so the current pc may point to the next function in rare cases.
+	funcName := "?"
+	if function, err := c.process.FindFunction(threadInfo.CurrentPC); err == nil {
+		funcName = function.Name
+	}
+	fmt.Fprintf(c.outputWriter, "* (#%02d) %s wrote to %#x\n", goRoutineID, funcName, watchedAddr)
+
+	// Unlike the breakpoint, the pc doesn't need to be rewound.
+	return c.process.ExistBreakpoint(threadInfo.CurrentPC - 1), nil
+}
+
+// handleTrapAtDumpPoint dumps the flight recorder if the go routine is at the beginning of the dump point.
+// If the go routine is exiting, its lines are discarded instead.
+func (c *Controller) handleTrapAtDumpPoint(goRoutineInfo tracee.GoRoutineInfo, addr uint64) error {
+	name, ok := c.dumpPoints[addr]
+	if !ok {
+		return nil
+	}
+
+	reason := name
+	switch name {
+	case dumpPointGoRoutineExit:
+		c.flightRecorder.discard(goRoutineInfo.ID)
+		return nil
+	case dumpPointSignal:
+		// the point is hit whenever the notified signal is delivered, so check the signal number.
+		goRoutineInfo.CurrentPC = addr
+		stackFrame, err := c.currentStackFrame(goRoutineInfo)
+		if err != nil {
+			return err
+		}
+		if len(stackFrame.InputArguments) == 0 {
+			return nil
+		}
+		signal, ok := stackFrame.InputArguments[0].Value(1).(int64)
+		if !ok || int(signal) != c.dumpSignal {
+			return nil
+		}
+		reason = fmt.Sprintf("signal %d", signal)
+	}
+
+	c.dumpFlightRecorder(reason, name != dumpPointPanic)
+	return nil
+}
+
 func (c *Controller) handleTrappedSystemRoutine(threadID int) error {
 	threadInfo, err := c.process.CurrentThreadInfo(threadID)
 	if err != nil {
@@ -358,6 +1048,11 @@ func (c *Controller) handleTrapBeforeFunctionCall(threadID int, goRoutineInfo tr
 		return err
 	}
 
+	// the breakpoint at the beginning of the function is not hit, since it's single-stepped.
+	if err := c.handleTrapAtDumpPoint(goRoutineInfo, goRoutineInfo.CurrentPC); err != nil {
+		return err
+	}
+
 	if err := c.updateTracingStatus(threadID, goRoutineInfo, goRoutineInfo.CurrentPC); err != nil {
 		return err
 	}
@@ -382,24 +1077,48 @@ func (c *Controller) handleTrapAtFunctionCall(threadID int, breakpointAddr uint6
 	// unwinded here in some cases:
 	// * just recovered from panic.
 	// * the last function used 'JMP' to call the next function and didn't change the SP. e.g. runtime.deferreturn
-	remainingFuncs, _, err := c.unwindFunctions(goRoutineInfo, goRoutineInfo.UsedStackSize)
+	remainingFuncs, unwindedFuncs, err := c.unwindFunctions(goRoutineInfo, goRoutineInfo.UsedStackSize)
 	if err != nil {
 		return err
 	}
+	c.recordStats(remainingFuncs, unwindedFuncs, false)
+	if err := c.printRecover(goRoutineInfo, len(remainingFuncs)); err != nil {
+		return err
+	}
 
+	options := c.traceOptions(goRoutineInfo.ID)
 	currStackDepth := len(remainingFuncs) + 1 // add the currently calling function
+	printable := currStackDepth <= options.TraceLevel && c.printableFunc(stackFrame.Function, options)
+	// the calls in the dropped call are dropped as well.
+	dropped := len(remainingFuncs) > 0 && remainingFuncs[len(remainingFuncs)-1].dropped
+	if printable {
+		if dropped {
+			c.sampler.drop()
+		} else {
+			dropped = !c.sampleCall(stackFrame.Function.Name, options)
+		}
+	}
 	callingFunc := callingFunction{
-		Function:               stackFrame.Function,
-		returnAddress:          stackFrame.ReturnAddress,
-		usedStackSize:          goRoutineInfo.UsedStackSize,
-		setCallInstBreakpoints: currStackDepth < c.traceLevel,
+		Function:      stackFrame.Function,
+		returnAddress: stackFrame.ReturnAddress,
+		usedStackSize: goRoutineInfo.UsedStackSize,
+		// the call instructions of the dropped call are not trapped to reduce the overhead.
+		setCallInstBreakpoints: currStackDepth < options.TraceLevel && !dropped,
+		dropped:                dropped,
+	}
+	if printable && !dropped && options.Format == OutputFormatStats {
+		callingFunc.recordStats = true
+		callingFunc.calledAt = time.Now()
+		if caller, err := c.process.FindFunction(stackFrame.ReturnAddress - 1); err == nil {
+			callingFunc.caller = caller.Name
+		}
 	}
 	if err = c.addFunction(callingFunc, goRoutineInfo.ID); err != nil {
 		return err
 	}
 
-	if currStackDepth <= c.traceLevel && c.printableFunc(stackFrame.Function) {
-		if err := c.printFunctionInput(goRoutineInfo.ID, stackFrame, currStackDepth); err != nil {
+	if printable && !dropped && options.Format != OutputFormatStats {
+		if err := c.printFunctionInput(goRoutineInfo.ID, stackFrame, currStackDepth, options); err != nil {
 			return err
 		}
 	}
@@ -465,11 +1184,34 @@ func (c *Controller) addFunction(newFunc callingFunction, goRoutineID int64) err
 }
 
 func (c *Controller) handleTrapAtDeferredFuncCall(threadID int, goRoutineInfo tracee.GoRoutineInfo) error {
-	if goRoutineInfo.Panicking && goRoutineInfo.PanicHandler != nil {
-		_, _, err := c.unwindFunctions(goRoutineInfo, goRoutineInfo.PanicHandler.UsedStackSizeAtDefer)
+	unwoundBy, err := c.unwoundBy(goRoutineInfo)
+	if err != nil {
+		return err
+	}
+
+	// the panic handler is the deferred function being called, even if the go routine is not panicking.
+	if unwoundBy != "" && goRoutineInfo.PanicHandler != nil {
+		remainingFuncs, unwindedFuncs, err := c.unwindFunctions(goRoutineInfo, goRoutineInfo.PanicHandler.UsedStackSizeAtDefer)
 		if err != nil {
 			return err
 		}
+		c.recordStats(remainingFuncs, unwindedFuncs, unwoundBy == UnwoundByPanic)
+
+		if unwoundBy == UnwoundByPanic {
+			if err := c.printPanic(goRoutineInfo, len(remainingFuncs)+len(unwindedFuncs)); err != nil {
+				return err
+			}
+		}
+		if err := c.printUnwoundFunctions(goRoutineInfo.ID, remainingFuncs, unwindedFuncs, unwoundBy); err != nil {
+			return err
+		}
+
+		tracing, err := c.unwindFunctionTracepoints(threadID, goRoutineInfo, goRoutineInfo.PanicHandler.UsedStackSizeAtDefer)
+		if err != nil {
+			return err
+		} else if !tracing {
+			return c.handleTrapAtUnrelatedBreakpoint(threadID, goRoutineInfo.CurrentPC-1)
+		}
 	}
 
 	if err := c.handleTrapAtFunctionCall(threadID, goRoutineInfo.CurrentPC-1, goRoutineInfo); err != nil {
@@ -485,21 +1227,29 @@ func (c *Controller) handleTrapAfterFunctionReturn(threadID int, goRoutineInfo t
 		return err
 	}
 	returnedFunc := unwindedFuncs[0].Function
+	c.recordStats(remainingFuncs, unwindedFuncs, false)
+	// the deferred function which called recover() returns here while the go routine is still panicking.
+	if err := c.printRecover(goRoutineInfo, len(remainingFuncs)); err != nil {
+		return err
+	}
 
+	options := c.traceOptions(goRoutineInfo.ID)
 	currStackDepth := len(remainingFuncs) + 1 // include returnedFunc for now
 	prevStackFrame, err := c.prevStackFrame(goRoutineInfo, returnedFunc.StartAddr)
 	if err != nil {
 		return err
 	}
 
-	if currStackDepth <= c.traceLevel && prevStackFrame.Function.Name == "runtime.deferproc" {
+	if currStackDepth <= options.TraceLevel && prevStackFrame.Function.Name == "runtime.deferproc" {
 		if err := c.setBreakpointToDeferredFunc(goRoutineInfo); err != nil {
 			return err
 		}
 	}
 
-	if currStackDepth <= c.traceLevel && c.printableFunc(returnedFunc) {
-		if err := c.printFunctionOutput(goRoutineInfo.ID, prevStackFrame, currStackDepth); err != nil {
+	if currStackDepth <= options.TraceLevel && c.printableFunc(returnedFunc, options) && options.Format != OutputFormatStats {
+		if unwindedFuncs[0].dropped {
+			c.sampler.drop()
+		} else if err := c.printFunctionOutput(goRoutineInfo.ID, prevStackFrame, currStackDepth, options); err != nil {
 			return err
 		}
 	}
@@ -507,6 +1257,82 @@ func (c *Controller) handleTrapAfterFunctionReturn(threadID int, goRoutineInfo t
 	return nil
 }
 
+// unwoundBy returns the reason the deferred function is called before the deferring function returns: UnwoundByPanic,
+// UnwoundByGoexit or empty if the deferring function is returning normally.
+func (c *Controller) unwoundBy(goRoutineInfo tracee.GoRoutineInfo) (string, error) {
+	// runtime.deferreturn jumps to the deferred function, while the panic and runtime.Goexit call it
+	// via runtime.reflectcall (runtime.call32 and so on).
+	stackFrame, err := c.currentStackFrame(goRoutineInfo)
+	if err != nil {
+		return "", err
+	}
+	caller, err := c.process.FindFunction(stackFrame.ReturnAddress - 1)
+	if err != nil {
+		return "", err
+	}
+	if !isReflectCall(caller.Name) {
+		return "", nil
+	}
+
+	// runtime.Goexit doesn't use the panic before go1.14.
+	if !goRoutineInfo.Panicking || (goRoutineInfo.Panic != nil && goRoutineInfo.Panic.Goexit) {
+		return UnwoundByGoexit, nil
+	}
+	return UnwoundByPanic, nil
+}
+
+// isReflectCall returns true if the function is one of runtime.call32, runtime.call64 and so on.
+func isReflectCall(name string) bool {
+	const prefix = "runtime.call"
+	if !strings.HasPrefix(name, prefix) || len(name) == len(prefix) {
+		return false
+	}
+	for _, r := range name[len(prefix):] {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// sampleCall returns true if the call is traced. It reports when the event budget is exhausted.
+func (c *Controller) sampleCall(name string, options TraceOptions) bool {
+	sampled, exhausted := c.sampler.sample(name, options, time.Now())
+	if exhausted {
+		fmt.Fprintf(c.outputWriter, "* the event budget (%d) is exhausted. The later calls are dropped\n", c.sampler.budget)
+	}
+	return sampled
+}
+
+// recordStats records the unwinded functions to the stats if they are traced in the stats format. They are recorded
+// from the deepest one so that their durations are excluded from the self durations of their callers.
+func (c *Controller) recordStats(remainingFuncs, unwindedFuncs []callingFunction, panicked bool) {
+	now := time.Now()
+	for i := len(unwindedFuncs) - 1; i >= 0; i-- {
+		unwindedFunc := unwindedFuncs[i]
+		if !unwindedFunc.recordStats {
+			continue
+		}
+
+		duration := now.Sub(unwindedFunc.calledAt)
+		var stack []string
+		var parent *callingFunction
+		for _, funcs := range [][]callingFunction{remainingFuncs, unwindedFuncs[:i]} {
+			for j := range funcs {
+				if funcs[j].recordStats {
+					stack = append(stack, funcs[j].Name)
+					parent = &funcs[j]
+				}
+			}
+		}
+		if parent != nil {
+			parent.childDuration += duration
+		}
+		stack = append(stack, unwindedFunc.Name)
+		c.stats.record(stack, unwindedFunc.caller, duration, duration-unwindedFunc.childDuration, panicked)
+	}
+}
+
 func (c *Controller) setBreakpointToDeferredFunc(goRoutineInfo tracee.GoRoutineInfo) error {
 	nextAddr := goRoutineInfo.NextDeferFuncAddr
 	if nextAddr == 0x0 /* no deferred func */ {
@@ -530,7 +1356,34 @@ func (c *Controller) prevStackFrame(goRoutineInfo tracee.GoRoutineInfo, rip uint
 	return c.process.StackFrameAt(goRoutineInfo.CurrentStackAddr-8, rip)
 }
 
-func (c *Controller) printableFunc(f *tracee.Function) bool {
+// traceOptions returns the options of the go routine.
+func (c *Controller) traceOptions(goRoutineID int64) TraceOptions {
+	options := c.defaultOptions
+	options.OutputWriter = nil
+	if startAddrs := c.goRoutineStartAddrs[goRoutineID]; len(startAddrs) > 0 {
+		if startOptions, ok := c.startTraceOptions[startAddrs[len(startAddrs)-1]]; ok {
+			options = startOptions
+		}
+	}
+
+	if options.OutputWriter == nil {
+		options.OutputWriter = c.outputWriter
+	}
+	if c.flightRecorder != nil {
+		options.OutputWriter = c.flightRecorder.writer(goRoutineID)
+	}
+	return options
+}
+
+func (c *Controller) printableFunc(f *tracee.Function, options TraceOptions) bool {
+	if !matchFuncFilters(f.Name, options.IncludeFuncs, options.ExcludeFuncs) {
+		return false
+	}
+
+	if len(options.Interfaces) > 0 && !c.implementsInterfaces(f, options.Interfaces) {
+		return false
+	}
+
 	const runtimePkgPrefix = "runtime."
 	if strings.HasPrefix(f.Name, runtimePkgPrefix) {
 		// it may be ok to print runtime unexported functions, but
@@ -541,10 +1394,45 @@ func (c *Controller) printableFunc(f *tracee.Function) bool {
 	return true
 }
 
-func (c *Controller) printFunctionInput(goRoutineID int64, stackFrame *tracee.StackFrame, depth int) error {
+func matchFuncFilters(name string, includeFuncs, excludeFuncs []*regexp.Regexp) bool {
+	for _, exclude := range excludeFuncs {
+		if exclude.MatchString(name) {
+			return false
+		}
+	}
+
+	if len(includeFuncs) == 0 {
+		return true
+	}
+	for _, include := range includeFuncs {
+		if include.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Controller) printFunctionInput(goRoutineID int64, stackFrame *tracee.StackFrame, depth int, options TraceOptions) error {
 	var inputArgs []string
 	for _, arg := range stackFrame.InputArguments {
-		inputArgs = append(inputArgs, arg.ParseValue(c.parseLevel))
+		inputArgs = append(inputArgs, arg.ParseValue(options.ParseLevel))
+	}
+
+	event := Event{Type: EventTypeCall, GoRoutineID: goRoutineID, Depth: depth, Function: stackFrame.Function.Name, InputArgs: inputArgs}
+	setReceiver(&event, stackFrame, options)
+	c.setLocations(&event, stackFrame.Function, stackFrame.ReturnAddress, options)
+	if c.eventHandler != nil {
+		c.eventHandler(event)
+	}
+	if options.Format == OutputFormatJSON {
+		return c.printEvent(options.OutputWriter, event)
+	}
+	name := displayName(stackFrame.Function, options)
+	if folder := c.callFolder(goRoutineID, options); folder != nil {
+		foldedEvent := event
+		foldedEvent.Function = name
+		folder.call(foldedEvent, time.Now())
+		return nil
 	}
 
 	var outputArgs string
@@ -552,26 +1440,218 @@ func (c *Controller) printFunctionInput(goRoutineID int64, stackFrame *tracee.St
 		outputArgs = "..."
 	}
 
-	fmt.Fprintf(c.outputWriter, "%s\\ (#%02d) %s(%s) (%s)\n", strings.Repeat("|", depth-1), goRoutineID, stackFrame.Function.Name, strings.Join(inputArgs, ", "), outputArgs)
+	fmt.Fprintf(options.OutputWriter, "%s\\ (#%02d) %s(%s) (%s)%s%s\n", strings.Repeat("|", depth-1), goRoutineID, name, strings.Join(event.InputArgs, ", "), outputArgs, receiverSuffix(event), locationSuffix(event, options))
 
 	return nil
 }
 
-func (c *Controller) printFunctionOutput(goRoutineID int64, stackFrame *tracee.StackFrame, depth int) error {
+func (c *Controller) printFunctionOutput(goRoutineID int64, stackFrame *tracee.StackFrame, depth int, options TraceOptions) error {
 	var inputArgs []string
 	for _, arg := range stackFrame.InputArguments {
-		inputArgs = append(inputArgs, arg.ParseValue(c.parseLevel))
+		inputArgs = append(inputArgs, arg.ParseValue(options.ParseLevel))
 	}
 
 	var outputArgs []string
 	for _, arg := range stackFrame.OutputArguments {
-		outputArgs = append(outputArgs, arg.ParseValue(c.parseLevel))
+		outputArgs = append(outputArgs, arg.ParseValue(options.ParseLevel))
+	}
+
+	localVars := selectLocalVariables(stackFrame.LocalVariables, options)
+
+	event := Event{Type: EventTypeReturn, GoRoutineID: goRoutineID, Depth: depth, Function: stackFrame.Function.Name, InputArgs: inputArgs, OutputArgs: outputArgs, LocalVariables: localVars}
+	setReceiver(&event, stackFrame, options)
+	c.setLocations(&event, stackFrame.Function, stackFrame.ReturnAddress, options)
+	if c.eventHandler != nil {
+		c.eventHandler(event)
+	}
+	if options.Format == OutputFormatJSON {
+		return c.printEvent(options.OutputWriter, event)
+	}
+	name := displayName(stackFrame.Function, options)
+	if folder := c.callFolder(goRoutineID, options); folder != nil {
+		foldedEvent := event
+		foldedEvent.Function = name
+		folder.ret(foldedEvent, localVariablesSuffix(localVars)+locationSuffix(event, options), time.Now())
+		return nil
+	}
+
+	fmt.Fprintf(options.OutputWriter, "%s/ (#%02d) %s(%s) (%s)%s%s%s\n", strings.Repeat("|", depth-1), goRoutineID, name, strings.Join(event.InputArgs, ", "), strings.Join(outputArgs, ", "), localVariablesSuffix(localVars), receiverSuffix(event), locationSuffix(event, options))
+
+	return nil
+}
+
+// printUnwoundFunctions prints the return events of the functions unwound without returning, from the deepest one.
+func (c *Controller) printUnwoundFunctions(goRoutineID int64, remainingFuncs, unwindedFuncs []callingFunction, unwoundBy string) error {
+	options := c.traceOptions(goRoutineID)
+	if options.Format == OutputFormatStats {
+		return nil
+	}
+
+	for i := len(unwindedFuncs) - 1; i >= 0; i-- {
+		unwindedFunc := unwindedFuncs[i]
+		depth := len(remainingFuncs) + i + 1
+		if depth > options.TraceLevel || !c.printableFunc(unwindedFunc.Function, options) {
+			continue
+		}
+		if unwindedFunc.dropped {
+			c.sampler.drop()
+			continue
+		}
+
+		event := Event{Type: EventTypeReturn, GoRoutineID: goRoutineID, Depth: depth, Function: unwindedFunc.Name, UnwoundBy: unwoundBy}
+		c.setLocations(&event, unwindedFunc.Function, unwindedFunc.returnAddress, options)
+		if c.eventHandler != nil {
+			c.eventHandler(event)
+		}
+		if options.Format == OutputFormatJSON {
+			if err := c.printEvent(options.OutputWriter, event); err != nil {
+				return err
+			}
+			continue
+		}
+		name := displayName(unwindedFunc.Function, options)
+		if folder := c.callFolder(goRoutineID, options); folder != nil {
+			foldedEvent := event
+			foldedEvent.Function = name
+			folder.ret(foldedEvent, locationSuffix(event, options), time.Now())
+			continue
+		}
+
+		fmt.Fprintf(options.OutputWriter, "%s/ (#%02d) %s(...) (unwound by %s)%s\n", strings.Repeat("|", depth-1), goRoutineID, name, unwoundBy, locationSuffix(event, options))
+	}
+	return nil
+}
+
+// printPanic prints the panic event if the panic the go routine is handling is not reported yet.
+func (c *Controller) printPanic(goRoutineInfo tracee.GoRoutineInfo, depth int) error {
+	if _, ok := c.panics[goRoutineInfo.ID]; ok || goRoutineInfo.Panic == nil {
+		return nil
+	}
+
+	options := c.traceOptions(goRoutineInfo.ID)
+	value := goRoutineInfo.Panic.ParseValue(options.ParseLevel)
+	c.panics[goRoutineInfo.ID] = value
+	return c.printPanicEvent(Event{Type: EventTypePanic, GoRoutineID: goRoutineInfo.ID, Depth: depth, PanicValue: value}, options)
+}
+
+// printRecover prints the recover event if the panic reported before is recovered.
+func (c *Controller) printRecover(goRoutineInfo tracee.GoRoutineInfo, depth int) error {
+	value, ok := c.panics[goRoutineInfo.ID]
+	if !ok || (goRoutineInfo.Panicking && (goRoutineInfo.Panic == nil || !goRoutineInfo.Panic.Recovered)) {
+		return nil
+	}
+
+	delete(c.panics, goRoutineInfo.ID)
+	options := c.traceOptions(goRoutineInfo.ID)
+	return c.printPanicEvent(Event{Type: EventTypeRecover, GoRoutineID: goRoutineInfo.ID, Depth: depth, PanicValue: value}, options)
+}
+
+func (c *Controller) printPanicEvent(event Event, options TraceOptions) error {
+	if c.eventHandler != nil {
+		c.eventHandler(event)
+	}
+	switch options.Format {
+	case OutputFormatJSON:
+		return c.printEvent(options.OutputWriter, event)
+	case OutputFormatStats:
+		return nil
 	}
-	fmt.Fprintf(c.outputWriter, "%s/ (#%02d) %s(%s) (%s)\n", strings.Repeat("|", depth-1), goRoutineID, stackFrame.Function.Name, strings.Join(inputArgs, ", "), strings.Join(outputArgs, ", "))
 
+	description := "panic"
+	if event.Type == EventTypeRecover {
+		description = "recovered from panic"
+	}
+	fmt.Fprintf(options.OutputWriter, "* (#%02d) %s: %s\n", event.GoRoutineID, description, event.PanicValue)
 	return nil
 }
 
+// callFolder returns the folder of the go routine if the calls are folded or collapsed. Otherwise returns nil.
+func (c *Controller) callFolder(goRoutineID int64, options TraceOptions) *callFolder {
+	if !options.FoldRepeatedCalls && options.CollapseRecursionDepth <= 0 {
+		return nil
+	}
+
+	folder, ok := c.callFolders[goRoutineID]
+	if !ok {
+		folder = newCallFolder(goRoutineID, options.OutputWriter, options.CollapseRecursionDepth)
+		c.callFolders[goRoutineID] = folder
+	}
+	return folder
+}
+
+// flushCallFolder writes the calls the folder of the go routine buffers and then removes the folder.
+func (c *Controller) flushCallFolder(goRoutineID int64) {
+	if folder, ok := c.callFolders[goRoutineID]; ok {
+		folder.flush()
+		delete(c.callFolders, goRoutineID)
+	}
+}
+
+// setLocations sets the source locations of the function and its call site to the event if they are used.
+// The call site is the call instruction right before the return address.
+func (c *Controller) setLocations(event *Event, function *tracee.Function, returnAddress uint64, options TraceOptions) {
+	if options.Format != OutputFormatJSON && !options.PrintLocation && c.eventHandler == nil {
+		return
+	}
+
+	if location, err := c.process.FindLocation(function.StartAddr); err != nil {
+		log.Debugf("failed to find the location of %s: %v", function.Name, err)
+	} else {
+		event.File, event.Line = location.File, location.Line
+	}
+
+	if location, err := c.process.FindLocation(returnAddress - 1); err != nil {
+		log.Debugf("failed to find the location of the call site of %s: %v", function.Name, err)
+	} else {
+		event.CallerFile, event.CallerLine = location.File, location.Line
+	}
+}
+
+// selectLocalVariables returns the values of the local variables selected by the options.
+func selectLocalVariables(localVars []tracee.Argument, options TraceOptions) []string {
+	var values []string
+	for _, localVar := range localVars {
+		for _, name := range options.LocalVariables {
+			if name == "*" || name == localVar.Name {
+				values = append(values, localVar.ParseValue(options.ParseLevel))
+				break
+			}
+		}
+	}
+	return values
+}
+
+func localVariablesSuffix(localVars []string) string {
+	if len(localVars) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" {%s}", strings.Join(localVars, ", "))
+}
+
+// locationSuffix returns the suffix of the text format line. It's empty if the location is not printed.
+func locationSuffix(event Event, options TraceOptions) string {
+	if !options.PrintLocation {
+		return ""
+	}
+	return fmt.Sprintf(" at %s, called from %s", formatLocation(event.File, event.Line), formatLocation(event.CallerFile, event.CallerLine))
+}
+
+func formatLocation(file string, line int) string {
+	if file == "" {
+		return "?"
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+func (c *Controller) printEvent(w io.Writer, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
 func (c *Controller) findCallInstAddresses(f *tracee.Function) ([]uint64, error) {
 	// this cache is not only efficient, but required because there are no call insts if breakpoints are set.
 	if cache, ok := c.callInstAddrCache[f.StartAddr]; ok {
@@ -596,7 +1676,34 @@ func (c *Controller) findCallInstAddresses(f *tracee.Function) ([]uint64, error)
 	return addresses, nil
 }
 
-// Interrupt interrupts the main loop.
+// Stats returns the stats of the functions traced in the stats format, in the descending order of the total duration.
+// It's safe to call while the main loop is running.
+func (c *Controller) Stats() []FunctionStats {
+	return c.stats.functionStats()
+}
+
+// PrintStats writes the stats of the functions traced in the stats format as the table. It's safe to call while
+// the main loop is running.
+func (c *Controller) PrintStats(w io.Writer) error {
+	return c.stats.writeTable(w)
+}
+
+// WriteProfile writes the call stacks traced in the stats format in the gzip-compressed pprof format.
+// `go tool pprof` shows the exact call graph, since all the calls are recorded. It's safe to call while
+// the main loop is running.
+func (c *Controller) WriteProfile(w io.Writer) error {
+	return c.stats.writeProfile(w)
+}
+
+// Interrupt interrupts the main loop. The tracee is stopped actively if possible. Otherwise, the main loop is
+// interrupted when the tracee is trapped next time.
 func (c *Controller) Interrupt() {
+	if c.process != nil {
+		err := c.process.Interrupt()
+		if err == nil {
+			return
+		}
+		log.Debugf("failed to interrupt the process: %v", err)
+	}
 	c.interruptCh <- true
 }
@@ -2,14 +2,17 @@ package tracer
 
 import (
 	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"regexp"
 	"runtime"
 	"strings"
 	"testing"
 
 	"github.com/ks888/tgo/testutils"
+	"golang.org/x/arch/x86/x86asm"
 )
 
 var helloworldAttrs = Attributes{
@@ -122,6 +125,397 @@ func TestMainLoop_MainMain(t *testing.T) {
 	}
 }
 
+func TestMainLoop_RecordAndReplay(t *testing.T) {
+	recordFile, err := ioutil.TempFile("", "tgo-record")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	recordFile.Close()
+	defer os.Remove(recordFile.Name())
+
+	trace := func(attrs Attributes) string {
+		controller := NewController()
+		buff := &bytes.Buffer{}
+		controller.outputWriter = buff
+		controller.SetTraceLevel(1)
+		if err := controller.LaunchTracee(testutils.ProgramHelloworld, nil, attrs); err != nil {
+			t.Fatalf("failed to launch process: %v", err)
+		}
+		if err := controller.AddStartTracePoint(testutils.HelloworldAddrMain); err != nil {
+			t.Fatalf("failed to set tracing point: %v", err)
+		}
+		if err := controller.MainLoop(); err != nil {
+			t.Errorf("failed to run main loop: %v", err)
+		}
+		return buff.String()
+	}
+
+	recordAttrs := helloworldAttrs
+	recordAttrs.RecordPath = recordFile.Name()
+	recorded := trace(recordAttrs)
+
+	replayAttrs := helloworldAttrs
+	replayAttrs.ReplayPath = recordFile.Name()
+	replayed := trace(replayAttrs)
+	if recorded == "" || replayed != recorded {
+		t.Errorf("unexpected output:\n%s\nrecorded:\n%s", replayed, recorded)
+	}
+}
+
+func TestMainLoop_StartTracePointWithOptions(t *testing.T) {
+	controller := NewController()
+	buff := &bytes.Buffer{}
+	controller.outputWriter = buff
+	controller.SetTraceLevel(1)
+	if err := controller.LaunchTracee(testutils.ProgramHelloworld, nil, helloworldAttrs); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	regionBuff := &bytes.Buffer{}
+	options := TraceOptions{TraceLevel: 1, ParseLevel: 1, ExcludeFuncs: []*regexp.Regexp{regexp.MustCompile("Parameter$")}, OutputWriter: regionBuff}
+	if err := controller.AddStartTracePointWithOptions(testutils.HelloworldAddrMain, options); err != nil {
+		t.Fatalf("failed to set tracing point: %v", err)
+	}
+
+	if err := controller.MainLoop(); err != nil {
+		t.Errorf("failed to run main loop: %v", err)
+	}
+
+	if buff.Len() != 0 {
+		t.Errorf("unexpected output: %s", buff.String())
+	}
+	output := regionBuff.String()
+	if strings.Count(output, "main.noParameter") != 0 || strings.Count(output, "main.oneParameter(") != 0 {
+		t.Errorf("unexpected output: %s", output)
+	}
+	if strings.Count(output, "main.twoParameters") != 2 {
+		t.Errorf("unexpected output: %s", output)
+	}
+}
+
+func TestMainLoop_UpdateDefaultTraceOptions(t *testing.T) {
+	controller := NewController()
+	buff := &bytes.Buffer{}
+	controller.outputWriter = buff
+	if err := controller.LaunchTracee(testutils.ProgramHelloworld, nil, helloworldAttrs); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	if err := controller.AddStartTracePoint(testutils.HelloworldAddrMain); err != nil {
+		t.Fatalf("failed to set tracing point: %v", err)
+	}
+	if err := controller.UpdateDefaultTraceOptions(TraceOptions{TraceLevel: 1, ParseLevel: 1, Format: OutputFormatJSON}); err != nil {
+		t.Fatalf("failed to update options: %v", err)
+	}
+
+	if err := controller.MainLoop(); err != nil {
+		t.Errorf("failed to run main loop: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buff.String()), "\n")
+	var event Event
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatalf("failed to decode %s: %v", lines[0], err)
+	}
+	if event.Type != EventTypeCall || event.Function != "main.noParameter" || event.Depth != 1 {
+		t.Errorf("unexpected event: %#v", event)
+	}
+}
+
+func TestMainLoop_EventHandler(t *testing.T) {
+	controller := NewController()
+	controller.outputWriter = ioutil.Discard
+	var events []Event
+	controller.SetEventHandler(func(event Event) { events = append(events, event) })
+	if err := controller.LaunchTracee(testutils.ProgramHelloworld, nil, helloworldAttrs); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	if err := controller.AddStartTracePoint(testutils.HelloworldAddrMain); err != nil {
+		t.Fatalf("failed to set tracing point: %v", err)
+	}
+	controller.SetTraceLevel(1)
+
+	if err := controller.MainLoop(); err != nil {
+		t.Errorf("failed to run main loop: %v", err)
+	}
+
+	if len(events) == 0 {
+		t.Fatalf("no events")
+	}
+	if events[0].Type != EventTypeCall || events[0].Function != "main.noParameter" {
+		t.Errorf("unexpected event: %#v", events[0])
+	}
+	if events[1].Type != EventTypeReturn || events[1].Function != "main.noParameter" {
+		t.Errorf("unexpected event: %#v", events[1])
+	}
+}
+
+func TestMainLoop_PrintLocation(t *testing.T) {
+	controller := NewController()
+	buff := &bytes.Buffer{}
+	controller.outputWriter = buff
+	var events []Event
+	controller.SetEventHandler(func(event Event) { events = append(events, event) })
+	if err := controller.LaunchTracee(testutils.ProgramHelloworld, nil, helloworldAttrs); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	if err := controller.AddStartTracePointWithOptions(testutils.HelloworldAddrMain, TraceOptions{TraceLevel: 1, PrintLocation: true}); err != nil {
+		t.Fatalf("failed to set tracing point: %v", err)
+	}
+
+	if err := controller.MainLoop(); err != nil {
+		t.Errorf("failed to run main loop: %v", err)
+	}
+
+	if len(events) == 0 {
+		t.Fatalf("no events")
+	}
+	event := events[0]
+	if !strings.HasSuffix(event.File, "helloworld.go") || event.Line != 9 || !strings.HasSuffix(event.CallerFile, "helloworld.go") || event.CallerLine != 39 {
+		t.Errorf("unexpected event: %#v", event)
+	}
+	if !strings.Contains(buff.String(), "helloworld.go:9, called from ") {
+		t.Errorf("unexpected output: %s", buff.String())
+	}
+}
+
+func TestMainLoop_FunctionTracePoint(t *testing.T) {
+	controller := NewController()
+	buff := &bytes.Buffer{}
+	controller.outputWriter = buff
+	controller.SetTraceLevel(1)
+	if err := controller.LaunchTracee(testutils.ProgramHelloworld, nil, helloworldAttrs); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	funcAddr, err := controller.FunctionAddress("main.oneParameterAndOneVariable")
+	if err != nil {
+		t.Fatalf("failed to find function: %v", err)
+	}
+	if err := controller.AddFunctionTracePoint(funcAddr, nil); err != nil {
+		t.Fatalf("failed to set tracing point: %v", err)
+	}
+
+	if err := controller.MainLoop(); err != nil {
+		t.Errorf("failed to run main loop: %v", err)
+	}
+
+	// twoParameters calls fmt.Println too, but it's not traced.
+	output := buff.String()
+	if strings.Count(output, "fmt.Println") != 4 || strings.Count(output, "main.") != 0 {
+		t.Errorf("unexpected output: %s", output)
+	}
+}
+
+func TestMainLoop_ConditionalStartTracePoint(t *testing.T) {
+	for i, testdata := range []struct {
+		condition     string
+		expectedCount int
+	}{
+		{condition: "i == 1", expectedCount: 4},
+		{condition: "i > 1", expectedCount: 0},
+	} {
+		controller := NewController()
+		buff := &bytes.Buffer{}
+		controller.outputWriter = buff
+		controller.SetTraceLevel(1)
+		if err := controller.LaunchTracee(testutils.ProgramHelloworld, nil, helloworldAttrs); err != nil {
+			t.Fatalf("failed to launch process: %v", err)
+		}
+		funcAddr, err := controller.FunctionAddress("main.oneParameterAndOneVariable")
+		if err != nil {
+			t.Fatalf("failed to find function: %v", err)
+		}
+		condition, err := ParseCondition(testdata.condition)
+		if err != nil {
+			t.Fatalf("failed to parse condition: %v", err)
+		}
+		if err := controller.AddConditionalStartTracePoint(funcAddr, condition, nil, true); err != nil {
+			t.Fatalf("failed to set tracing point: %v", err)
+		}
+
+		if err := controller.MainLoop(); err != nil {
+			t.Errorf("[%d] failed to run main loop: %v", i, err)
+		}
+
+		if output := buff.String(); strings.Count(output, "fmt.Println") != testdata.expectedCount {
+			t.Errorf("[%d] unexpected output: %s", i, output)
+		}
+	}
+}
+
+func TestMainLoop_StatsFormat(t *testing.T) {
+	controller := NewController()
+	buff := &bytes.Buffer{}
+	controller.outputWriter = buff
+	if err := controller.LaunchTracee(testutils.ProgramHelloworld, nil, helloworldAttrs); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	if err := controller.AddStartTracePointWithOptions(testutils.HelloworldAddrMain, TraceOptions{TraceLevel: 1, Format: OutputFormatStats}); err != nil {
+		t.Fatalf("failed to set tracing point: %v", err)
+	}
+
+	if err := controller.MainLoop(); err != nil {
+		t.Errorf("failed to run main loop: %v", err)
+	}
+
+	stats := controller.Stats()
+	if len(stats) == 0 {
+		t.Fatalf("no stats")
+	}
+	for _, s := range stats {
+		if s.Function == "main.oneParameterAndOneVariable" && (s.Calls != 1 || s.Callers != 1) {
+			t.Errorf("unexpected stats: %#v", s)
+		}
+	}
+	output := buff.String()
+	if strings.Count(output, "main.oneParameterAndOneVariable") != 1 || strings.Contains(output, "\\") {
+		t.Errorf("unexpected output: %s", output)
+	}
+}
+
+func TestMainLoop_Sampling(t *testing.T) {
+	controller := NewController()
+	buff := &bytes.Buffer{}
+	controller.outputWriter = buff
+	if err := controller.LaunchTracee(testutils.ProgramHelloworld, nil, helloworldAttrs); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	funcAddr, err := controller.FunctionAddress("main.oneParameterAndOneVariable")
+	if err != nil {
+		t.Fatalf("failed to find function: %v", err)
+	}
+	if err := controller.AddFunctionTracePoint(funcAddr, &TraceOptions{TraceLevel: 1, SampleRate: 2}); err != nil {
+		t.Fatalf("failed to set tracing point: %v", err)
+	}
+
+	if err := controller.MainLoop(); err != nil {
+		t.Errorf("failed to run main loop: %v", err)
+	}
+
+	// fmt.Println is called twice in oneParameterAndOneVariable and so the call and return of the 2nd call are dropped.
+	output := buff.String()
+	if strings.Count(output, "fmt.Println") != 2 || controller.DroppedEvents() != 2 || !strings.Contains(output, "2 events were dropped") {
+		t.Errorf("unexpected output: %s", output)
+	}
+}
+
+func TestMainLoop_CallStack(t *testing.T) {
+	controller := NewController()
+	buff := &bytes.Buffer{}
+	controller.outputWriter = buff
+	if err := controller.LaunchTracee(testutils.ProgramHelloworld, nil, helloworldAttrs); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	funcAddr, err := controller.FunctionAddress("main.oneParameterAndOneVariable")
+	if err != nil {
+		t.Fatalf("failed to find function: %v", err)
+	}
+	if err := controller.AddFunctionTracePoint(funcAddr, &TraceOptions{TraceLevel: 1, PrintCallStack: true}); err != nil {
+		t.Fatalf("failed to set tracing point: %v", err)
+	}
+
+	if err := controller.MainLoop(); err != nil {
+		t.Errorf("failed to run main loop: %v", err)
+	}
+
+	output := buff.String()
+	lines := strings.Split(output, "\n")
+	if len(lines) < 3 || !strings.HasPrefix(lines[0], "* (#01) runtime.main() at ") || !strings.HasPrefix(lines[1], "* (#01) main.main() at ") ||
+		!strings.HasPrefix(lines[2], "\\ (#01) main.oneParameterAndOneVariable") {
+		t.Errorf("unexpected output: %s", output)
+	}
+}
+
+func TestMainLoop_CallStackAtMiddleOfFunction(t *testing.T) {
+	controller := NewController()
+	buff := &bytes.Buffer{}
+	controller.outputWriter = buff
+	if err := controller.LaunchTracee(testutils.ProgramHelloworld, nil, helloworldAttrs); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	function, err := controller.process.FindFunction(testutils.HelloworldAddrOneParameterAndVariable)
+	if err != nil {
+		t.Fatalf("failed to find function: %v", err)
+	}
+	insts, err := controller.process.ReadInstructions(function)
+	if err != nil {
+		t.Fatalf("failed to read instructions: %v", err)
+	}
+	// the return address of the first call, like the start point the tracer.Start function specifies.
+	var retAddr uint64
+	pos := function.StartAddr
+	for _, inst := range insts {
+		pos += uint64(inst.Len)
+		if inst.Op == x86asm.CALL {
+			retAddr = pos
+			break
+		}
+	}
+	if err := controller.AddStartTracePointWithOptions(retAddr, TraceOptions{TraceLevel: 1, PrintCallStack: true}); err != nil {
+		t.Fatalf("failed to set tracing point: %v", err)
+	}
+
+	if err := controller.MainLoop(); err != nil {
+		t.Errorf("failed to run main loop: %v", err)
+	}
+
+	output := buff.String()
+	lines := strings.Split(output, "\n")
+	if len(lines) < 2 || !strings.HasPrefix(lines[0], "* (#01) runtime.main() at ") || !strings.HasPrefix(lines[1], "* (#01) main.main() at ") {
+		t.Errorf("unexpected output: %s", output)
+	}
+}
+
+func TestMainLoop_LocalVariables(t *testing.T) {
+	controller := NewController()
+	buff := &bytes.Buffer{}
+	controller.outputWriter = buff
+	if err := controller.LaunchTracee(testutils.ProgramHelloworld, nil, helloworldAttrs); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	funcAddr, err := controller.FunctionAddress("main.oneParameterAndOneVariable")
+	if err != nil {
+		t.Fatalf("failed to find function: %v", err)
+	}
+	if err := controller.AddFunctionTracePoint(funcAddr, &TraceOptions{TraceLevel: 1, ParseLevel: 1, LocalVariables: []string{"a"}}); err != nil {
+		t.Fatalf("failed to set tracing point: %v", err)
+	}
+
+	if err := controller.MainLoop(); err != nil {
+		t.Errorf("failed to run main loop: %v", err)
+	}
+
+	output := buff.String()
+	if !strings.Contains(output, "/ (#01) main.oneParameterAndOneVariable(i = 1) () {a = ") {
+		t.Errorf("unexpected output: %s", output)
+	}
+}
+
+func TestMainLoop_Interfaces(t *testing.T) {
+	controller := NewController()
+	buff := &bytes.Buffer{}
+	controller.outputWriter = buff
+	if err := controller.LaunchTracee(testutils.ProgramHelloworld, nil, helloworldAttrs); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	funcAddr, err := controller.FunctionAddress("main.noParameter")
+	if err != nil {
+		t.Fatalf("failed to find function: %v", err)
+	}
+	options := &TraceOptions{TraceLevel: 5, ParseLevel: 1, PrintReceiver: true, Interfaces: []string{"io.Writer.Write"}}
+	if err := controller.AddFunctionTracePoint(funcAddr, options); err != nil {
+		t.Fatalf("failed to set tracing point: %v", err)
+	}
+
+	if err := controller.MainLoop(); err != nil {
+		t.Errorf("failed to run main loop: %v", err)
+	}
+
+	output := buff.String()
+	if !strings.Contains(output, "\\ (#01) (*os.File) Write(b = ") || !strings.Contains(output, " receiver: f = &{") ||
+		strings.Contains(output, "fmt.Println") {
+		t.Errorf("unexpected output: %s", output)
+	}
+}
+
 func TestMainLoop_NoDWARFBinary(t *testing.T) {
 	controller := NewController()
 	buff := &bytes.Buffer{}
@@ -267,6 +661,115 @@ func TestMainLoop_Panic(t *testing.T) {
 	}
 }
 
+func TestMainLoop_PanicEvents(t *testing.T) {
+	controller := NewController()
+	buff := &bytes.Buffer{}
+	controller.outputWriter = buff
+	if err := controller.LaunchTracee(testutils.ProgramPanic, nil, panicAttrs); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	if err := controller.AddStartTracePoint(testutils.PanicAddrMain); err != nil {
+		t.Fatalf("failed to set tracing point: %v", err)
+	}
+	controller.SetTraceLevel(10)
+
+	if err := controller.MainLoop(); err != nil {
+		t.Errorf("failed to run main loop: %v", err)
+	}
+
+	output := buff.String()
+	if !strings.Contains(output, `* (#01) panic: string("2")`) || !strings.Contains(output, `* (#01) recovered from panic: string("2")`) {
+		t.Errorf("no panic or recover event:\n%s", output)
+	}
+	if strings.Count(output, "(unwound by panic)") != 4 /* main.throw and 3 main.g */ {
+		t.Errorf("wrong number of unwound functions: %d\n%s", strings.Count(output, "(unwound by panic)"), output)
+	}
+}
+
+func TestMainLoop_FunctionTracePointRecoveredPanic(t *testing.T) {
+	controller := NewController()
+	buff := &bytes.Buffer{}
+	controller.outputWriter = buff
+	controller.SetTraceLevel(1)
+	attrs := Attributes{
+		ProgramPath:         testutils.ProgramRecoveredPanic,
+		FirstModuleDataAddr: testutils.RecoveredPanicAddrFirstModuleData,
+		CompiledGoVersion:   runtime.Version(),
+	}
+	if err := controller.LaunchTracee(testutils.ProgramRecoveredPanic, nil, attrs); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	if err := controller.AddFunctionTracePoint(testutils.RecoveredPanicAddrPanicIfZero, nil); err != nil {
+		t.Fatalf("failed to set tracing point: %v", err)
+	}
+
+	if err := controller.MainLoop(); err != nil {
+		t.Errorf("failed to run main loop: %v", err)
+	}
+
+	// the second call is at the same stack size as the first one, which is unwound by the panic.
+	output := buff.String()
+	if !strings.Contains(output, "main.inc(i = 0)") || !strings.Contains(output, "main.inc(i = 1)") {
+		t.Errorf("unexpected output: %s", output)
+	}
+	if len(controller.returnTracePoints) != 0 || len(controller.goRoutineStartAddrs) != 0 {
+		t.Errorf("the trace points are left: %v, %v", controller.returnTracePoints, controller.goRoutineStartAddrs)
+	}
+}
+
+func TestMainLoop_FlightRecorder(t *testing.T) {
+	controller := NewController()
+	buff := &bytes.Buffer{}
+	controller.outputWriter = buff
+	if err := controller.LaunchTracee(testutils.ProgramPanic, nil, panicAttrs); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	if err := controller.AddStartTracePoint(testutils.PanicAddrMain); err != nil {
+		t.Fatalf("failed to set tracing point: %v", err)
+	}
+	controller.SetTraceLevel(6) // up to main.throw
+	if err := controller.SetFlightRecorder(2, 0); err != nil {
+		t.Fatalf("failed to set flight recorder: %v", err)
+	}
+
+	if err := controller.MainLoop(); err != nil {
+		t.Errorf("failed to run main loop: %v", err)
+	}
+
+	output := buff.String()
+	if !strings.HasPrefix(output, "* flight recorder dump (runtime.gopanic): the last 2 lines per go routine\n") {
+		t.Errorf("not dumped at panic:\n%s", output)
+	}
+	if !strings.Contains(output, "main.throw") || strings.Contains(output, "main.f") {
+		t.Errorf("unexpected lines are dumped:\n%s", output)
+	}
+}
+
+func TestMainLoop_FlightRecorderGoRoutineExit(t *testing.T) {
+	controller := NewController()
+	buff := &bytes.Buffer{}
+	controller.outputWriter = buff
+	controller.SetTraceLevel(1)
+	if err := controller.LaunchTracee(testutils.ProgramGoRoutines, nil, goRoutinesAttrs); err != nil {
+		t.Fatalf("failed to launch process: %v", err)
+	}
+	if err := controller.AddStartTracePoint(testutils.GoRoutinesAddrInc); err != nil {
+		t.Fatalf("failed to set tracing point: %v", err)
+	}
+	if err := controller.SetFlightRecorder(2, 0); err != nil {
+		t.Fatalf("failed to set flight recorder: %v", err)
+	}
+
+	if err := controller.MainLoop(); err != nil {
+		t.Errorf("failed to run main loop: %v", err)
+	}
+
+	// all the traced go routines exit before the main go routine.
+	if len(controller.flightRecorder.buffers) != 0 {
+		t.Errorf("the lines of the exited go routines are kept: %d", len(controller.flightRecorder.buffers))
+	}
+}
+
 var specialFuncsAttrs = Attributes{
 	ProgramPath:         testutils.ProgramSpecialFuncs,
 	FirstModuleDataAddr: testutils.SpecialFuncsAddrFirstModuleData,
@@ -316,3 +819,20 @@ func TestInterrupt(t *testing.T) {
 		t.Errorf("not interrupted: %v", err)
 	}
 }
+
+func TestIsReflectCall(t *testing.T) {
+	for _, testdata := range []struct {
+		name     string
+		expected bool
+	}{
+		{"runtime.call32", true},
+		{"runtime.call1073741824", true},
+		{"runtime.call", false},
+		{"runtime.callers", false},
+		{"main.call32", false},
+	} {
+		if actual := isReflectCall(testdata.name); actual != testdata.expected {
+			t.Errorf("unexpected result for %s: %v", testdata.name, actual)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package tracer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// flightRecorder keeps the last lines of the tracing log per go routine instead of writing them, and writes them
+// when dumped. It's written by the main loop and may be dumped by the other go routines, so the mutex protects the fields.
+type flightRecorder struct {
+	mtx sync.Mutex
+	// size is the max number of the lines kept per go routine.
+	size int
+	// seq is the sequence number of the last recorded line. It's used to dump the lines of the go routines in order.
+	seq     int
+	buffers map[int64]*lineRingBuffer
+}
+
+type recordedLine struct {
+	seq  int
+	line string
+}
+
+// lineRingBuffer holds the last lines. The oldest line is overwritten when full.
+type lineRingBuffer struct {
+	lines []recordedLine
+	// next is the index the next line is written to once the buffer is full.
+	next int
+}
+
+func (b *lineRingBuffer) add(line recordedLine, size int) {
+	if len(b.lines) < size {
+		b.lines = append(b.lines, line)
+		return
+	}
+	b.lines[b.next] = line
+	b.next = (b.next + 1) % size
+}
+
+func newFlightRecorder(size int) *flightRecorder {
+	return &flightRecorder{size: size, buffers: make(map[int64]*lineRingBuffer)}
+}
+
+// writer returns the writer which records the lines written to it as the lines of the go routine.
+func (r *flightRecorder) writer(goRoutineID int64) io.Writer {
+	return flightRecorderWriter{recorder: r, goRoutineID: goRoutineID}
+}
+
+type flightRecorderWriter struct {
+	recorder    *flightRecorder
+	goRoutineID int64
+}
+
+func (w flightRecorderWriter) Write(p []byte) (int, error) {
+	w.recorder.record(w.goRoutineID, string(p))
+	return len(p), nil
+}
+
+func (r *flightRecorder) record(goRoutineID int64, data string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	buffer, ok := r.buffers[goRoutineID]
+	if !ok {
+		buffer = &lineRingBuffer{}
+		r.buffers[goRoutineID] = buffer
+	}
+	for _, line := range strings.SplitAfter(data, "\n") {
+		if line == "" {
+			continue
+		}
+		r.seq++
+		buffer.add(recordedLine{seq: r.seq, line: line}, r.size)
+	}
+}
+
+// discard discards the recorded lines of the go routine.
+func (r *flightRecorder) discard(goRoutineID int64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	delete(r.buffers, goRoutineID)
+}
+
+// dump writes the recorded lines of all the go routines in the order they are recorded. If `discard` is true,
+// the lines are discarded so that the next dump writes only the new lines.
+func (r *flightRecorder) dump(w io.Writer, reason string, discard bool) error {
+	r.mtx.Lock()
+	var lines []recordedLine
+	for _, buffer := range r.buffers {
+		lines = append(lines, buffer.lines...)
+	}
+	if discard {
+		r.buffers = make(map[int64]*lineRingBuffer)
+	}
+	r.mtx.Unlock()
+	sort.Slice(lines, func(i, j int) bool { return lines[i].seq < lines[j].seq })
+
+	if _, err := fmt.Fprintf(w, "* flight recorder dump (%s): the last %d lines per go routine\n", reason, r.size); err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if _, err := io.WriteString(w, line.line); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w, "* end of flight recorder dump")
+	return err
+}
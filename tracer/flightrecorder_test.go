@@ -0,0 +1,65 @@
+package tracer
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestFlightRecorder_Dump(t *testing.T) {
+	recorder := newFlightRecorder(2)
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(recorder.writer(1), "line %d of #01\n", i)
+		fmt.Fprintf(recorder.writer(2), "line %d of #02\n", i)
+	}
+	fmt.Fprint(recorder.writer(1), "line 3 of #01\nline 4 of #01\n")
+
+	buff := &bytes.Buffer{}
+	if err := recorder.dump(buff, "test", true); err != nil {
+		t.Fatalf("failed to dump: %v", err)
+	}
+	expected := `* flight recorder dump (test): the last 2 lines per go routine
+line 1 of #02
+line 2 of #02
+line 3 of #01
+line 4 of #01
+* end of flight recorder dump
+`
+	if buff.String() != expected {
+		t.Errorf("unexpected dump:\n%s", buff.String())
+	}
+
+	buff.Reset()
+	if err := recorder.dump(buff, "test", true); err != nil {
+		t.Fatalf("failed to dump: %v", err)
+	}
+	if buff.String() != "* flight recorder dump (test): the last 2 lines per go routine\n* end of flight recorder dump\n" {
+		t.Errorf("the lines should be discarded after the dump:\n%s", buff.String())
+	}
+}
+
+func TestFlightRecorder_DumpWithoutDiscard(t *testing.T) {
+	recorder := newFlightRecorder(2)
+	fmt.Fprint(recorder.writer(1), "line 0 of #01\n")
+
+	for i := 0; i < 2; i++ {
+		buff := &bytes.Buffer{}
+		if err := recorder.dump(buff, "test", false); err != nil {
+			t.Fatalf("failed to dump: %v", err)
+		}
+		if !bytes.Contains(buff.Bytes(), []byte("line 0 of #01\n")) {
+			t.Errorf("[%d] the lines are discarded:\n%s", i, buff.String())
+		}
+	}
+}
+
+func TestFlightRecorder_Discard(t *testing.T) {
+	recorder := newFlightRecorder(2)
+	fmt.Fprint(recorder.writer(1), "line 0 of #01\n")
+	fmt.Fprint(recorder.writer(2), "line 0 of #02\n")
+	recorder.discard(1)
+
+	if len(recorder.buffers) != 1 || recorder.buffers[2] == nil {
+		t.Errorf("unexpected buffers: %v", recorder.buffers)
+	}
+}
@@ -0,0 +1,188 @@
+package tracer
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// callFolder buffers the calls of the go routine traced in the text format and writes them with the consecutive
+// identical calls folded and the deep recursive calls collapsed. The call is written after it returns, since
+// the following calls may be folded into it.
+type callFolder struct {
+	goRoutineID int64
+	writer      io.Writer
+	// collapseDepth is the recursion depth beyond which the recursive call is collapsed. 0 means no collapse.
+	collapseDepth int
+	// stack holds the calls not returned yet. The first one is the outermost call.
+	stack []*foldedCall
+	// pending is the last outermost call not written yet.
+	pending *foldedCall
+}
+
+// foldedCall is the call and the calls it made.
+type foldedCall struct {
+	depth                int
+	function, inputArgs  string
+	outputArgs, location string
+	returned             bool
+	children             []*foldedCall
+	// count is the number of the consecutive identical calls folded into this call.
+	count int
+	// The fields below are used if the call is collapsed.
+	collapsed bool
+	hidden    bool // true if the call is made in the collapsed call.
+	numCalls  int
+	calledAt  time.Time
+	duration  time.Duration
+}
+
+func newCallFolder(goRoutineID int64, writer io.Writer, collapseDepth int) *callFolder {
+	return &callFolder{goRoutineID: goRoutineID, writer: writer, collapseDepth: collapseDepth}
+}
+
+// call adds the call event.
+func (f *callFolder) call(event Event, now time.Time) {
+	// the calls unwound without the return event, e.g. by panic, are closed here.
+	for len(f.stack) > 0 && f.stack[len(f.stack)-1].depth >= event.Depth {
+		f.pop(now)
+	}
+
+	newCall := &foldedCall{depth: event.Depth, function: event.Function, inputArgs: strings.Join(event.InputArgs, ", "), count: 1, calledAt: now}
+	if len(f.stack) > 0 {
+		parent := f.stack[len(f.stack)-1]
+		newCall.hidden = parent.collapsed || parent.hidden
+	}
+	if !newCall.hidden && f.collapseDepth > 0 && f.recursionDepth(event.Function) >= f.collapseDepth {
+		newCall.collapsed = true
+	}
+	f.stack = append(f.stack, newCall)
+}
+
+// recursionDepth returns the number of the calls of the function in the stack.
+func (f *callFolder) recursionDepth(function string) int {
+	depth := 0
+	for _, call := range f.stack {
+		if call.function == function {
+			depth++
+		}
+	}
+	return depth
+}
+
+// ret adds the return event.
+func (f *callFolder) ret(event Event, location string, now time.Time) {
+	for len(f.stack) > 0 {
+		top := f.stack[len(f.stack)-1]
+		if top.depth < event.Depth {
+			break
+		}
+		if top.depth == event.Depth && top.function == event.Function {
+			top.outputArgs, top.location, top.returned = strings.Join(event.OutputArgs, ", "), location, true
+			if event.UnwoundBy != "" {
+				top.outputArgs = "unwound by " + event.UnwoundBy
+			}
+			f.pop(now)
+			break
+		}
+		f.pop(now)
+	}
+}
+
+func (f *callFolder) pop(now time.Time) {
+	call := f.stack[len(f.stack)-1]
+	f.stack = f.stack[:len(f.stack)-1]
+	call.duration = now.Sub(call.calledAt)
+	call.numCalls++
+
+	if len(f.stack) == 0 {
+		f.addOutermostCall(call)
+		return
+	}
+
+	parent := f.stack[len(f.stack)-1]
+	if call.hidden {
+		parent.numCalls += call.numCalls
+		return
+	}
+	parent.children = appendFoldedCall(parent.children, call)
+}
+
+func (f *callFolder) addOutermostCall(call *foldedCall) {
+	if f.pending != nil && identicalCalls(f.pending, call) {
+		f.pending.count++
+		return
+	}
+	f.writePending()
+	f.pending = call
+}
+
+// appendFoldedCall appends the call to the calls, or folds it into the last call if they are identical.
+func appendFoldedCall(calls []*foldedCall, call *foldedCall) []*foldedCall {
+	if len(calls) > 0 && identicalCalls(calls[len(calls)-1], call) {
+		calls[len(calls)-1].count++
+		return calls
+	}
+	return append(calls, call)
+}
+
+func identicalCalls(a, b *foldedCall) bool {
+	if a.collapsed || b.collapsed || a.depth != b.depth || a.function != b.function || a.inputArgs != b.inputArgs ||
+		a.outputArgs != b.outputArgs || a.location != b.location || a.returned != b.returned || len(a.children) != len(b.children) {
+		return false
+	}
+	for i := range a.children {
+		if a.children[i].count != b.children[i].count || !identicalCalls(a.children[i], b.children[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// flush writes all the buffered calls. The calls not returned yet are written as they are.
+func (f *callFolder) flush() {
+	now := time.Now()
+	for len(f.stack) > 0 {
+		f.pop(now)
+	}
+	f.writePending()
+}
+
+func (f *callFolder) writePending() {
+	if f.pending == nil {
+		return
+	}
+	var lines []string
+	f.render(f.pending, &lines)
+	fmt.Fprint(f.writer, strings.Join(lines, ""))
+	f.pending = nil
+}
+
+func (f *callFolder) render(call *foldedCall, lines *[]string) {
+	prefix := strings.Repeat("|", call.depth-1)
+	outputArgs := call.outputArgs
+	if !call.returned {
+		outputArgs = "?"
+	}
+	var countSuffix string
+	if call.count > 1 {
+		countSuffix = fmt.Sprintf(" ×%d", call.count)
+	}
+
+	switch {
+	case call.collapsed:
+		*lines = append(*lines, fmt.Sprintf("%s+ (#%02d) %s(%s) (%s)%s [%d calls, %v]%s\n", prefix, f.goRoutineID, call.function,
+			call.inputArgs, outputArgs, call.location, call.numCalls, call.duration, countSuffix))
+	case len(call.children) == 0:
+		*lines = append(*lines, fmt.Sprintf("%s- (#%02d) %s(%s) (%s)%s%s\n", prefix, f.goRoutineID, call.function,
+			call.inputArgs, outputArgs, call.location, countSuffix))
+	default:
+		*lines = append(*lines, fmt.Sprintf("%s\\ (#%02d) %s(%s) (...)\n", prefix, f.goRoutineID, call.function, call.inputArgs))
+		for _, child := range call.children {
+			f.render(child, lines)
+		}
+		*lines = append(*lines, fmt.Sprintf("%s/ (#%02d) %s(%s) (%s)%s%s\n", prefix, f.goRoutineID, call.function,
+			call.inputArgs, outputArgs, call.location, countSuffix))
+	}
+}
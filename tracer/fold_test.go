@@ -0,0 +1,127 @@
+package tracer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func callEvent(depth int, function string, inputArgs ...string) Event {
+	return Event{Type: EventTypeCall, Depth: depth, Function: function, InputArgs: inputArgs}
+}
+
+func returnEvent(depth int, function string, outputArgs ...string) Event {
+	return Event{Type: EventTypeReturn, Depth: depth, Function: function, OutputArgs: outputArgs}
+}
+
+func TestCallFolder_FoldRepeatedCalls(t *testing.T) {
+	buff := &bytes.Buffer{}
+	folder := newCallFolder(1, buff, 0)
+	now := time.Now()
+	folder.call(callEvent(1, "main.loop"), now)
+	for i := 0; i < 3; i++ {
+		folder.call(callEvent(2, "main.f", "n = 1"), now)
+		folder.ret(returnEvent(2, "main.f", "~r1 = 1"), "", now)
+	}
+	folder.call(callEvent(2, "main.f", "n = 2"), now)
+	folder.ret(returnEvent(2, "main.f", "~r1 = 2"), "", now)
+	folder.ret(returnEvent(1, "main.loop"), "", now)
+	if buff.Len() != 0 {
+		t.Errorf("written before the next call: %s", buff.String())
+	}
+	folder.call(callEvent(1, "main.loop"), now)
+	folder.call(callEvent(2, "main.f", "n = 1"), now)
+	folder.ret(returnEvent(2, "main.f", "~r1 = 1"), "", now)
+	folder.ret(returnEvent(1, "main.loop"), "", now)
+	folder.flush()
+
+	expected := `\ (#01) main.loop() (...)
+|- (#01) main.f(n = 1) (~r1 = 1) ×3
+|- (#01) main.f(n = 2) (~r1 = 2)
+/ (#01) main.loop() ()
+\ (#01) main.loop() (...)
+|- (#01) main.f(n = 1) (~r1 = 1)
+/ (#01) main.loop() ()
+`
+	if buff.String() != expected {
+		t.Errorf("unexpected output:\n%s", buff.String())
+	}
+}
+
+func TestCallFolder_FoldIdenticalSubtrees(t *testing.T) {
+	buff := &bytes.Buffer{}
+	folder := newCallFolder(1, buff, 0)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		folder.call(callEvent(1, "main.f"), now)
+		folder.call(callEvent(2, "main.g"), now)
+		folder.ret(returnEvent(2, "main.g"), "", now)
+		folder.ret(returnEvent(1, "main.f"), "", now)
+	}
+	folder.flush()
+
+	expected := `\ (#01) main.f() (...)
+|- (#01) main.g() ()
+/ (#01) main.f() () ×2
+`
+	if buff.String() != expected {
+		t.Errorf("unexpected output:\n%s", buff.String())
+	}
+}
+
+func TestCallFolder_CollapseRecursion(t *testing.T) {
+	buff := &bytes.Buffer{}
+	folder := newCallFolder(1, buff, 2)
+	now := time.Now()
+	for depth := 1; depth <= 4; depth++ {
+		folder.call(callEvent(depth, "main.fib"), now)
+	}
+	for depth := 4; depth >= 1; depth-- {
+		folder.ret(returnEvent(depth, "main.fib", "~r1 = 1"), "", now.Add(time.Millisecond))
+	}
+	folder.flush()
+
+	lines := strings.Split(strings.TrimSpace(buff.String()), "\n")
+	if len(lines) != 5 || lines[2] != "||+ (#01) main.fib() (~r1 = 1) [2 calls, 1ms]" {
+		t.Errorf("unexpected output:\n%s", buff.String())
+	}
+}
+
+func TestCallFolder_UnwoundCalls(t *testing.T) {
+	buff := &bytes.Buffer{}
+	folder := newCallFolder(1, buff, 0)
+	now := time.Now()
+	folder.call(callEvent(1, "main.f"), now)
+	folder.call(callEvent(2, "main.panic"), now)
+	folder.call(callEvent(1, "main.g"), now)
+	folder.flush()
+
+	expected := `\ (#01) main.f() (...)
+|- (#01) main.panic() (?)
+/ (#01) main.f() (?)
+- (#01) main.g() (?)
+`
+	if buff.String() != expected {
+		t.Errorf("unexpected output:\n%s", buff.String())
+	}
+}
+
+func TestCallFolder_UnwoundCall(t *testing.T) {
+	buff := &bytes.Buffer{}
+	folder := newCallFolder(1, buff, 0)
+	now := time.Now()
+	folder.call(callEvent(1, "main.f"), now)
+	folder.call(callEvent(2, "main.g", "i = 1"), now)
+	folder.ret(Event{Type: EventTypeReturn, Depth: 2, Function: "main.g", UnwoundBy: UnwoundByPanic}, "", now)
+	folder.ret(returnEvent(1, "main.f"), "", now)
+	folder.flush()
+
+	expected := `\ (#01) main.f() (...)
+|- (#01) main.g(i = 1) (unwound by panic)
+/ (#01) main.f() ()
+`
+	if buff.String() != expected {
+		t.Errorf("unexpected output:\n%s", buff.String())
+	}
+}
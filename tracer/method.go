@@ -0,0 +1,141 @@
+package tracer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ks888/tgo/log"
+	"github.com/ks888/tgo/tracee"
+)
+
+// splitMethod returns the receiver type and the method name if the function is the method, like ("*bytes.Buffer", "Write")
+// for "bytes.(*Buffer).Write". recvTypeName is the type name of the first parameter. It tells the method with the value
+// receiver, like "main.T.M", from the other functions, like the closure "main.f.func1". It's empty if unknown.
+// The package path may contain dots, like "gopkg.in/yaml.v2.(*decoder).unmarshal".
+func splitMethod(name, recvTypeName string) (receiverType, method string, ok bool) {
+	if pkg, typ, rest, ok := splitPointerMethod(name); ok {
+		receiverType, method = "*"+pkg+"."+typ, rest
+	} else if recvTypeName != "" && strings.HasPrefix(name, recvTypeName+".") {
+		receiverType, method = recvTypeName, name[len(recvTypeName)+1:]
+	} else {
+		return "", "", false
+	}
+
+	if method == "" || strings.ContainsAny(method, ".-") {
+		// the closure in the method or the method value wrapper like 'bytes.(*Buffer).Write-fm'
+		return "", "", false
+	}
+	return receiverType, method, true
+}
+
+// displayName returns the function name printed in the text format. If PrintReceiver is set and the function is the method,
+// the receiver type is separated like '(*bytes.Buffer) Write'.
+func displayName(function *tracee.Function, options TraceOptions) string {
+	if receiverType, method, ok := splitFunctionMethod(function, options); ok {
+		return fmt.Sprintf("(%s) %s", receiverType, method)
+	}
+	return function.Name
+}
+
+func splitFunctionMethod(function *tracee.Function, options TraceOptions) (receiverType, method string, ok bool) {
+	if !options.PrintReceiver || len(function.Parameters) == 0 || function.Parameters[0].IsOutput {
+		return "", "", false
+	}
+
+	var recvTypeName string
+	if typ := function.Parameters[0].Typ; typ != nil {
+		recvTypeName = typ.Common().Name
+	}
+	return splitMethod(function.Name, recvTypeName)
+}
+
+// setReceiver moves the receiver from the input args of the event to its receiver fields if PrintReceiver is set and
+// the function is the method. The receiver is parsed 1 level deeper than the args so that the pointer receiver is
+// not printed as the opaque address.
+func setReceiver(event *Event, stackFrame *tracee.StackFrame, options TraceOptions) {
+	receiverType, _, ok := splitFunctionMethod(stackFrame.Function, options)
+	if !ok || len(stackFrame.InputArguments) == 0 {
+		return
+	}
+
+	event.ReceiverType = receiverType
+	event.Receiver = stackFrame.InputArguments[0].ParseValue(options.ParseLevel + 1)
+	event.InputArgs = event.InputArgs[1:]
+}
+
+func receiverSuffix(event Event) string {
+	if event.Receiver == "" {
+		return ""
+	}
+	return " receiver: " + event.Receiver
+}
+
+// implementsInterfaces returns true if the function implements the method of one of the interfaces.
+// The implementations are looked up when the interface is used first.
+func (c *Controller) implementsInterfaces(f *tracee.Function, interfaces []string) bool {
+	for _, name := range interfaces {
+		impls, ok := c.interfaceImpls[name]
+		if !ok {
+			impls = make(map[uint64]bool)
+			addrs, err := c.process.FindInterfaceMethodImpls(name)
+			if err != nil {
+				log.Printf("failed to find the implementations of %s: %v", name, err)
+			}
+			for _, addr := range addrs {
+				impls[addr] = true
+				if valueMethodAddr, ok := c.valueMethodAddr(addr); ok {
+					impls[valueMethodAddr] = true
+				}
+			}
+			c.interfaceImpls[name] = impls
+		}
+
+		if impls[f.StartAddr] {
+			return true
+		}
+	}
+	return false
+}
+
+// valueMethodAddr returns the address of the method with the value receiver, like "main.T.M", if the function at the
+// address is its wrapper with the pointer receiver, like "main.(*T).M". The itab holds the wrapper instead of the method.
+func (c *Controller) valueMethodAddr(addr uint64) (uint64, bool) {
+	f, err := c.process.FindFunction(addr)
+	if err != nil {
+		return 0, false
+	}
+	name, ok := valueMethodName(f.Name)
+	if !ok {
+		return 0, false
+	}
+	// the type can't have both the pointer receiver method and value receiver method of the same name,
+	// so the pointer receiver one is the wrapper if the value receiver one exists.
+	valueMethodAddr, err := c.FunctionAddress(name)
+	return valueMethodAddr, err == nil
+}
+
+// valueMethodName returns the name of the method with the value receiver, like "main.T.M" for "main.(*T).M".
+func valueMethodName(name string) (string, bool) {
+	pkg, typ, rest, ok := splitPointerMethod(name)
+	if !ok {
+		return "", false
+	}
+	return pkg + "." + typ + "." + rest, true
+}
+
+// splitPointerMethod splits the name of the function with the pointer receiver, like "main.(*T).M", into the package path,
+// the type name and the rest. The rest may not be the method name, like "M.func1" for the closure.
+func splitPointerMethod(name string) (pkg, typ, rest string, ok bool) {
+	pkgPathEnd := strings.LastIndex(name, "/") + 1
+	start := strings.Index(name[pkgPathEnd:], ".(*")
+	if start < 0 {
+		return "", "", "", false
+	}
+	start += pkgPathEnd
+	end := strings.Index(name[start:], ").")
+	if end < 0 {
+		return "", "", "", false
+	}
+	end += start
+	return name[:start], name[start+len(".(*") : end], name[end+len(")."):], true
+}
@@ -0,0 +1,46 @@
+package tracer
+
+import "testing"
+
+func TestSplitMethod(t *testing.T) {
+	for i, testdata := range []struct {
+		name, recvTypeName           string
+		expectedType, expectedMethod string
+		expectedOK                   bool
+	}{
+		{name: "bytes.(*Buffer).Write", expectedType: "*bytes.Buffer", expectedMethod: "Write", expectedOK: true},
+		{name: "github.com/ks888/tgo/tracer.(*Controller).MainLoop", expectedType: "*github.com/ks888/tgo/tracer.Controller", expectedMethod: "MainLoop", expectedOK: true},
+		{name: "main.T.M", recvTypeName: "main.T", expectedType: "main.T", expectedMethod: "M", expectedOK: true},
+		{name: "gopkg.in/yaml.v2.(*decoder).unmarshal", expectedType: "*gopkg.in/yaml.v2.decoder", expectedMethod: "unmarshal", expectedOK: true},
+		{name: "gopkg.in/yaml.v2.decoder.unmarshal", recvTypeName: "gopkg.in/yaml.v2.decoder", expectedType: "gopkg.in/yaml.v2.decoder", expectedMethod: "unmarshal", expectedOK: true},
+		{name: "gopkg.in/yaml.v2.(*decoder).unmarshal.func1"},
+		{name: "gopkg.in/yaml.v2.newDecoder", recvTypeName: "int"},
+		{name: "main.f.func1", recvTypeName: "int"},
+		{name: "main.T.M", recvTypeName: ""},
+		{name: "main.(*T).M.func1"},
+		{name: "bytes.(*Buffer).Write-fm"},
+		{name: "main.main"},
+	} {
+		typ, method, ok := splitMethod(testdata.name, testdata.recvTypeName)
+		if typ != testdata.expectedType || method != testdata.expectedMethod || ok != testdata.expectedOK {
+			t.Errorf("[%d] unexpected result: %s, %s, %v", i, typ, method, ok)
+		}
+	}
+}
+
+func TestValueMethodName(t *testing.T) {
+	for i, testdata := range []struct {
+		name, expectedName string
+		expectedOK         bool
+	}{
+		{name: "main.(*T).M", expectedName: "main.T.M", expectedOK: true},
+		{name: "gopkg.in/yaml.v2.(*decoder).unmarshal", expectedName: "gopkg.in/yaml.v2.decoder.unmarshal", expectedOK: true},
+		{name: "main.T.M"},
+		{name: "main.main"},
+	} {
+		name, ok := valueMethodName(testdata.name)
+		if name != testdata.expectedName || ok != testdata.expectedOK {
+			t.Errorf("[%d] unexpected result: %s, %v", i, name, ok)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package tracer
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+	"time"
+)
+
+// The field numbers of the messages defined in the pprof's profile.proto.
+const (
+	profileSampleType        = 1
+	profileSample            = 2
+	profileLocation          = 4
+	profileFunction          = 5
+	profileStringTable       = 6
+	profileTimeNanos         = 9
+	profileDurationNanos     = 10
+	profileDefaultSampleType = 14
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	locationID   = 1
+	locationLine = 4
+
+	lineFunctionID = 1
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+)
+
+// writeProfile writes the call stacks in the gzip-compressed pprof format. Each sample is the call stack and its
+// values are the number of the calls and the self duration, so that `go tool pprof` shows the exact call graph.
+func (s *callStats) writeProfile(w io.Writer) error {
+	s.mtx.Lock()
+	var stacks []*stackStats
+	for _, stack := range s.stacks {
+		stacks = append(stacks, stack)
+	}
+	startTime := s.startTime
+	s.mtx.Unlock()
+	sort.Slice(stacks, func(i, j int) bool { return stacks[i].selfDuration > stacks[j].selfDuration })
+
+	b := &profileBuilder{strings: map[string]int{"": 0}, stringTable: []string{""}, functionIDs: make(map[string]uint64)}
+	b.valueType(profileSampleType, "calls", "count")
+	b.valueType(profileSampleType, "time", "nanoseconds")
+
+	for _, stack := range stacks {
+		var sample protoBuffer
+		var locationIDs []uint64
+		for i := len(stack.functions) - 1; i >= 0; i-- {
+			locationIDs = append(locationIDs, b.function(stack.functions[i]))
+		}
+		sample.packedUint64s(sampleLocationID, locationIDs)
+		sample.packedInt64s(sampleValue, []int64{int64(stack.calls), int64(stack.selfDuration)})
+		b.buff.message(profileSample, sample.data)
+	}
+
+	if !startTime.IsZero() {
+		b.buff.int64(profileTimeNanos, startTime.UnixNano())
+		b.buff.int64(profileDurationNanos, int64(time.Since(startTime)))
+	}
+	b.buff.int64(profileDefaultSampleType, int64(b.stringIndex("time")))
+	// the string table must be written last since the strings are added while the other fields are written.
+	for _, str := range b.stringTable {
+		b.buff.string(profileStringTable, str)
+	}
+
+	gw := gzip.NewWriter(w)
+	if _, err := gw.Write(b.buff.data); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+type profileBuilder struct {
+	buff        protoBuffer
+	strings     map[string]int
+	stringTable []string
+	// functionIDs maps the function name to the id of the function. The location has the same id.
+	functionIDs map[string]uint64
+}
+
+func (b *profileBuilder) stringIndex(str string) int {
+	if index, ok := b.strings[str]; ok {
+		return index
+	}
+	b.strings[str] = len(b.stringTable)
+	b.stringTable = append(b.stringTable, str)
+	return len(b.stringTable) - 1
+}
+
+func (b *profileBuilder) valueType(field int, typ, unit string) {
+	var valueType protoBuffer
+	valueType.int64(valueTypeType, int64(b.stringIndex(typ)))
+	valueType.int64(valueTypeUnit, int64(b.stringIndex(unit)))
+	b.buff.message(field, valueType.data)
+}
+
+// function adds the function and its location if not added yet, and returns the id of the location.
+func (b *profileBuilder) function(name string) uint64 {
+	if id, ok := b.functionIDs[name]; ok {
+		return id
+	}
+	id := uint64(len(b.functionIDs) + 1)
+	b.functionIDs[name] = id
+
+	var function protoBuffer
+	function.uint64(functionID, id)
+	function.int64(functionName, int64(b.stringIndex(name)))
+	function.int64(functionSystemName, int64(b.stringIndex(name)))
+	b.buff.message(profileFunction, function.data)
+
+	var line, location protoBuffer
+	line.uint64(lineFunctionID, id)
+	location.uint64(locationID, id)
+	location.message(locationLine, line.data)
+	b.buff.message(profileLocation, location.data)
+	return id
+}
+
+// protoBuffer encodes the protocol buffers message. The zero values are omitted like proto3.
+type protoBuffer struct {
+	data []byte
+}
+
+const (
+	wireVarint          = 0
+	wireLengthDelimited = 2
+)
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protoBuffer) key(field, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, wireVarint)
+	b.varint(x)
+}
+
+func (b *protoBuffer) int64(field int, x int64) {
+	b.uint64(field, uint64(x))
+}
+
+// string writes the string even if it's empty, since the string table must start with the empty string.
+func (b *protoBuffer) string(field int, str string) {
+	b.key(field, wireLengthDelimited)
+	b.varint(uint64(len(str)))
+	b.data = append(b.data, str...)
+}
+
+func (b *protoBuffer) message(field int, msg []byte) {
+	b.key(field, wireLengthDelimited)
+	b.varint(uint64(len(msg)))
+	b.data = append(b.data, msg...)
+}
+
+func (b *protoBuffer) packedUint64s(field int, xs []uint64) {
+	var packed protoBuffer
+	for _, x := range xs {
+		packed.varint(x)
+	}
+	b.message(field, packed.data)
+}
+
+func (b *protoBuffer) packedInt64s(field int, xs []int64) {
+	var packed protoBuffer
+	for _, x := range xs {
+		packed.varint(uint64(x))
+	}
+	b.message(field, packed.data)
+}
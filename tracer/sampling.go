@@ -0,0 +1,72 @@
+package tracer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// callSampler decides whether the call is traced, based on the sampling options of each go routine and
+// the controller's event budget. It's used only in the main loop except the number of the dropped events.
+type callSampler struct {
+	functions map[string]*functionSamplingState
+	// budget is the max number of the calls traced. 0 means unlimited.
+	budget int
+	traced int
+	// dropped is the number of the call and return events dropped. Accessed atomically.
+	dropped int64
+}
+
+type functionSamplingState struct {
+	calls int
+	// windowStart is the start time of the current 1-second window and callsInWindow is the number of the calls traced in it.
+	windowStart   time.Time
+	callsInWindow int
+}
+
+func newCallSampler() *callSampler {
+	return &callSampler{functions: make(map[string]*functionSamplingState)}
+}
+
+// sample returns true if the call of the function should be traced. exhausted is true only when the event budget
+// is exhausted by this call.
+func (s *callSampler) sample(name string, options TraceOptions, now time.Time) (sampled, exhausted bool) {
+	if s.budget > 0 && s.traced >= s.budget {
+		s.drop()
+		return false, false
+	}
+
+	state, ok := s.functions[name]
+	if !ok {
+		state = &functionSamplingState{}
+		s.functions[name] = state
+	}
+
+	state.calls++
+	if options.SampleRate > 1 && (state.calls-1)%options.SampleRate != 0 {
+		s.drop()
+		return false, false
+	}
+
+	if options.MaxCallsPerSecond > 0 {
+		if now.Sub(state.windowStart) >= time.Second {
+			state.windowStart = now
+			state.callsInWindow = 0
+		}
+		if state.callsInWindow >= options.MaxCallsPerSecond {
+			s.drop()
+			return false, false
+		}
+		state.callsInWindow++
+	}
+
+	s.traced++
+	return true, s.budget > 0 && s.traced == s.budget
+}
+
+func (s *callSampler) drop() {
+	atomic.AddInt64(&s.dropped, 1)
+}
+
+func (s *callSampler) droppedEvents() int {
+	return int(atomic.LoadInt64(&s.dropped))
+}
@@ -0,0 +1,61 @@
+package tracer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCallSampler_SampleRate(t *testing.T) {
+	sampler := newCallSampler()
+	options := TraceOptions{SampleRate: 3}
+	var sampled []bool
+	for i := 0; i < 4; i++ {
+		s, _ := sampler.sample("main.f", options, time.Now())
+		sampled = append(sampled, s)
+	}
+	if !sampled[0] || sampled[1] || sampled[2] || !sampled[3] {
+		t.Errorf("unexpected result: %v", sampled)
+	}
+	if s, _ := sampler.sample("main.g", options, time.Now()); !s {
+		t.Errorf("the sample rate should be applied per function")
+	}
+	if sampler.droppedEvents() != 2 {
+		t.Errorf("wrong number of the dropped events: %d", sampler.droppedEvents())
+	}
+}
+
+func TestCallSampler_MaxCallsPerSecond(t *testing.T) {
+	sampler := newCallSampler()
+	options := TraceOptions{MaxCallsPerSecond: 2}
+	now := time.Now()
+	for i, testdata := range []struct {
+		elapsed  time.Duration
+		expected bool
+	}{
+		{elapsed: 0, expected: true},
+		{elapsed: 100 * time.Millisecond, expected: true},
+		{elapsed: 200 * time.Millisecond, expected: false},
+		{elapsed: time.Second, expected: true},
+	} {
+		if sampled, _ := sampler.sample("main.f", options, now.Add(testdata.elapsed)); sampled != testdata.expected {
+			t.Errorf("[%d] unexpected result: %v", i, sampled)
+		}
+	}
+}
+
+func TestCallSampler_Budget(t *testing.T) {
+	sampler := newCallSampler()
+	sampler.budget = 2
+	if sampled, exhausted := sampler.sample("main.f", TraceOptions{}, time.Now()); !sampled || exhausted {
+		t.Errorf("unexpected result: %v, %v", sampled, exhausted)
+	}
+	if sampled, exhausted := sampler.sample("main.g", TraceOptions{}, time.Now()); !sampled || !exhausted {
+		t.Errorf("unexpected result: %v, %v", sampled, exhausted)
+	}
+	if sampled, exhausted := sampler.sample("main.f", TraceOptions{}, time.Now()); sampled || exhausted {
+		t.Errorf("unexpected result: %v, %v", sampled, exhausted)
+	}
+	if sampler.droppedEvents() != 1 {
+		t.Errorf("wrong number of the dropped events: %d", sampler.droppedEvents())
+	}
+}
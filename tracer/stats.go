@@ -0,0 +1,137 @@
+package tracer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// FunctionStats is the statistics of the calls of the function traced in the stats format.
+// The durations are measured by the tracer, so they include the overhead of the tracing.
+type FunctionStats struct {
+	Function                                string
+	Calls                                   int
+	TotalDuration, MinDuration, MaxDuration time.Duration
+	// Callers is the number of the distinct functions which called the function.
+	Callers int
+	// Panics is the number of the calls unwound by panic.
+	Panics int
+}
+
+// MeanDuration returns the mean duration of the calls.
+func (s FunctionStats) MeanDuration() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.TotalDuration / time.Duration(s.Calls)
+}
+
+// callStats aggregates the calls per function and per call stack. It's accessed by both the main loop and
+// the clients requesting the stats, so the mutex protects the fields.
+type callStats struct {
+	mtx sync.Mutex
+	// startTime is the time the first recorded call started.
+	startTime time.Time
+	functions map[string]*functionStatsEntry
+	// stacks holds the calls per call stack. The key is the names of the functions in the stack joined by '\n'.
+	stacks map[string]*stackStats
+}
+
+type functionStatsEntry struct {
+	FunctionStats
+	callers map[string]bool
+}
+
+type stackStats struct {
+	// functions is the stack of the function names. The first one is the root.
+	functions    []string
+	calls        int
+	selfDuration time.Duration
+}
+
+func newCallStats() *callStats {
+	return &callStats{functions: make(map[string]*functionStatsEntry), stacks: make(map[string]*stackStats)}
+}
+
+// record records the call. The stack is the function names from the root to the called function.
+// The self duration is the duration excluding the durations of the functions it called.
+func (s *callStats) record(stack []string, caller string, duration, selfDuration time.Duration, panicked bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if calledAt := time.Now().Add(-duration); s.startTime.IsZero() || calledAt.Before(s.startTime) {
+		s.startTime = calledAt
+	}
+
+	name := stack[len(stack)-1]
+	entry, ok := s.functions[name]
+	if !ok {
+		entry = &functionStatsEntry{FunctionStats: FunctionStats{Function: name, MinDuration: duration}, callers: make(map[string]bool)}
+		s.functions[name] = entry
+	}
+	entry.Calls++
+	entry.TotalDuration += duration
+	if duration < entry.MinDuration {
+		entry.MinDuration = duration
+	}
+	if duration > entry.MaxDuration {
+		entry.MaxDuration = duration
+	}
+	if !entry.callers[caller] {
+		entry.callers[caller] = true
+		entry.Callers++
+	}
+	if panicked {
+		entry.Panics++
+	}
+
+	key := strings.Join(stack, "\n")
+	stackEntry, ok := s.stacks[key]
+	if !ok {
+		stackEntry = &stackStats{functions: append([]string(nil), stack...)}
+		s.stacks[key] = stackEntry
+	}
+	stackEntry.calls++
+	stackEntry.selfDuration += selfDuration
+}
+
+// empty returns true if no calls are recorded.
+func (s *callStats) empty() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return len(s.functions) == 0
+}
+
+// functionStats returns the stats of the functions in the descending order of the total duration.
+func (s *callStats) functionStats() []FunctionStats {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var stats []FunctionStats
+	for _, entry := range s.functions {
+		stats = append(stats, entry.FunctionStats)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].TotalDuration != stats[j].TotalDuration {
+			return stats[i].TotalDuration > stats[j].TotalDuration
+		}
+		return stats[i].Function < stats[j].Function
+	})
+	return stats
+}
+
+// writeTable writes the stats of the functions as the table.
+func (s *callStats) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "calls\ttotal\tmin\tmean\tmax\tcallers\tpanics\t  function")
+	for _, stats := range s.functionStats() {
+		fmt.Fprintf(tw, "%d\t%v\t%v\t%v\t%v\t%d\t%d\t  %s\n", stats.Calls, stats.TotalDuration, stats.MinDuration,
+			stats.MeanDuration(), stats.MaxDuration, stats.Callers, stats.Panics, stats.Function)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,269 @@
+package tracer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCallStats_Record(t *testing.T) {
+	stats := newCallStats()
+	stats.record([]string{"main.f"}, "main.main", 3*time.Millisecond, time.Millisecond, false)
+	stats.record([]string{"main.f", "main.g"}, "main.f", 2*time.Millisecond, 2*time.Millisecond, false)
+	stats.record([]string{"main.g"}, "main.main", 4*time.Millisecond, 4*time.Millisecond, true)
+
+	functions := stats.functionStats()
+	if len(functions) != 2 {
+		t.Fatalf("wrong number of functions: %d", len(functions))
+	}
+	g := functions[0]
+	if g.Function != "main.g" || g.Calls != 2 || g.TotalDuration != 6*time.Millisecond || g.MinDuration != 2*time.Millisecond ||
+		g.MaxDuration != 4*time.Millisecond || g.MeanDuration() != 3*time.Millisecond || g.Callers != 2 || g.Panics != 1 {
+		t.Errorf("unexpected stats: %#v", g)
+	}
+	if f := functions[1]; f.Function != "main.f" || f.Calls != 1 || f.Callers != 1 || f.Panics != 0 {
+		t.Errorf("unexpected stats: %#v", f)
+	}
+
+	if len(stats.stacks) != 3 {
+		t.Errorf("wrong number of stacks: %d", len(stats.stacks))
+	}
+}
+
+func TestCallStats_WriteTable(t *testing.T) {
+	stats := newCallStats()
+	stats.record([]string{"main.f"}, "main.main", time.Millisecond, time.Millisecond, false)
+
+	buff := &bytes.Buffer{}
+	if err := stats.writeTable(buff); err != nil {
+		t.Fatalf("failed to write table: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buff.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "function") || !strings.HasSuffix(lines[1], "  main.f") || !strings.Contains(lines[1], "1ms") {
+		t.Errorf("unexpected table: %s", buff.String())
+	}
+}
+
+func TestCallStats_WriteProfile(t *testing.T) {
+	stats := newCallStats()
+	stats.record([]string{"main.f", "main.g"}, "main.f", time.Millisecond, time.Millisecond, false)
+	stats.record([]string{"main.f"}, "main.main", 3*time.Millisecond, 2*time.Millisecond, false)
+
+	buff := &bytes.Buffer{}
+	if err := stats.writeProfile(buff); err != nil {
+		t.Fatalf("failed to write profile: %v", err)
+	}
+	reader, err := gzip.NewReader(buff)
+	if err != nil {
+		t.Fatalf("not gzipped: %v", err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	profile, err := decodeTestProfile(data)
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+
+	if sampleTypes := strings.Join(profile.sampleTypes, ","); sampleTypes != "calls/count,time/nanoseconds" {
+		t.Errorf("unexpected sample types: %s", sampleTypes)
+	}
+	// the samples are sorted by the self duration and the leaf function comes first.
+	expected := []testSample{
+		{stack: "main.f", values: "1,2000000"},
+		{stack: "main.g,main.f", values: "1,1000000"},
+	}
+	if len(profile.samples) != len(expected) {
+		t.Fatalf("unexpected samples: %v", profile.samples)
+	}
+	for i, sample := range profile.samples {
+		if sample != expected[i] {
+			t.Errorf("[%d] unexpected sample: %v", i, sample)
+		}
+	}
+}
+
+type testProfile struct {
+	sampleTypes []string
+	samples     []testSample
+}
+
+type testSample struct {
+	// stack is the comma-separated function names and values is the comma-separated values.
+	stack, values string
+}
+
+// decodeTestProfile decodes the sample, location and function messages of the profile.
+func decodeTestProfile(data []byte) (testProfile, error) {
+	var profile testProfile
+	var stringTable []string
+	var rawSampleTypes, rawSamples [][]byte
+	locationFuncs := make(map[uint64]uint64)
+	funcNames := make(map[uint64]uint64)
+
+	err := decodeTestMessage(data, func(field int, x uint64, msg []byte) error {
+		switch field {
+		case profileSampleType:
+			rawSampleTypes = append(rawSampleTypes, msg)
+		case profileSample:
+			rawSamples = append(rawSamples, msg)
+		case profileLocation:
+			var id, funcID uint64
+			err := decodeTestMessage(msg, func(field int, x uint64, msg []byte) error {
+				switch field {
+				case locationID:
+					id = x
+				case locationLine:
+					return decodeTestMessage(msg, func(field int, x uint64, msg []byte) error {
+						if field == lineFunctionID {
+							funcID = x
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			locationFuncs[id] = funcID
+			return err
+		case profileFunction:
+			var id, name uint64
+			err := decodeTestMessage(msg, func(field int, x uint64, msg []byte) error {
+				switch field {
+				case functionID:
+					id = x
+				case functionName:
+					name = x
+				}
+				return nil
+			})
+			funcNames[id] = name
+			return err
+		case profileStringTable:
+			stringTable = append(stringTable, string(msg))
+		}
+		return nil
+	})
+	if err != nil {
+		return profile, err
+	}
+
+	lookup := func(index uint64) string {
+		if index >= uint64(len(stringTable)) {
+			return fmt.Sprintf("invalid string index %d", index)
+		}
+		return stringTable[index]
+	}
+	for _, msg := range rawSampleTypes {
+		var typ, unit uint64
+		err := decodeTestMessage(msg, func(field int, x uint64, msg []byte) error {
+			switch field {
+			case valueTypeType:
+				typ = x
+			case valueTypeUnit:
+				unit = x
+			}
+			return nil
+		})
+		if err != nil {
+			return profile, err
+		}
+		profile.sampleTypes = append(profile.sampleTypes, lookup(typ)+"/"+lookup(unit))
+	}
+	for _, msg := range rawSamples {
+		var funcs, values []string
+		err := decodeTestMessage(msg, func(field int, x uint64, msg []byte) error {
+			packed := protoReader{data: msg}
+			for len(packed.data) > 0 {
+				x, err := packed.varint()
+				if err != nil {
+					return err
+				}
+				switch field {
+				case sampleLocationID:
+					funcs = append(funcs, lookup(funcNames[locationFuncs[x]]))
+				case sampleValue:
+					values = append(values, fmt.Sprintf("%d", x))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return profile, err
+		}
+		profile.samples = append(profile.samples, testSample{stack: strings.Join(funcs, ","), values: strings.Join(values, ",")})
+	}
+	return profile, nil
+}
+
+// decodeTestMessage calls the handler for each field of the message. x is the value of the varint field
+// and msg is the value of the length-delimited field.
+func decodeTestMessage(data []byte, handler func(field int, x uint64, msg []byte) error) error {
+	reader := protoReader{data: data}
+	for len(reader.data) > 0 {
+		key, err := reader.varint()
+		if err != nil {
+			return err
+		}
+		field := int(key >> 3)
+		switch key & 0x7 {
+		case wireVarint:
+			x, err := reader.varint()
+			if err != nil {
+				return err
+			}
+			if err := handler(field, x, nil); err != nil {
+				return err
+			}
+		case wireLengthDelimited:
+			length, err := reader.varint()
+			if err != nil {
+				return err
+			}
+			if length > uint64(len(reader.data)) {
+				return fmt.Errorf("too long field: %d", length)
+			}
+			msg := reader.data[:length]
+			reader.data = reader.data[length:]
+			if err := handler(field, 0, msg); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected wire type: %d", key&0x7)
+		}
+	}
+	return nil
+}
+
+type protoReader struct {
+	data []byte
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	var x uint64
+	for i := 0; i < len(r.data); i++ {
+		x |= uint64(r.data[i]&0x7f) << (7 * uint(i))
+		if r.data[i] < 0x80 {
+			r.data = r.data[i+1:]
+			return x, nil
+		}
+	}
+	return 0, errors.New("truncated varint")
+}
+
+func TestProtoBuffer(t *testing.T) {
+	var buff protoBuffer
+	buff.uint64(1, 300)
+	buff.uint64(2, 0)
+	buff.string(3, "")
+	buff.packedInt64s(4, []int64{1, 2})
+	expected := []byte{0x08, 0xac, 0x02, 0x1a, 0x00, 0x22, 0x02, 0x01, 0x02}
+	if !bytes.Equal(buff.data, expected) {
+		t.Errorf("unexpected data: %v", buff.data)
+	}
+}